@@ -43,13 +43,18 @@ import (
 	"github.com/flannel-io/flannel/pkg/trafficmngr/nftables"
 	"github.com/flannel-io/flannel/pkg/version"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "k8s.io/klog/v2"
 
 	// Backends need to be imported for their init() to get executed and them to register
 	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/flannel-io/flannel/pkg/backend"
 	_ "github.com/flannel-io/flannel/pkg/backend/alloc"
+	_ "github.com/flannel-io/flannel/pkg/backend/auto"
+	_ "github.com/flannel-io/flannel/pkg/backend/bgp"
 	_ "github.com/flannel-io/flannel/pkg/backend/extension"
+	_ "github.com/flannel-io/flannel/pkg/backend/geneve"
+	_ "github.com/flannel-io/flannel/pkg/backend/gre"
 	_ "github.com/flannel-io/flannel/pkg/backend/hostgw"
 	_ "github.com/flannel-io/flannel/pkg/backend/ipip"
 	_ "github.com/flannel-io/flannel/pkg/backend/ipsec"
@@ -57,6 +62,7 @@ import (
 	_ "github.com/flannel-io/flannel/pkg/backend/udp"
 	_ "github.com/flannel-io/flannel/pkg/backend/vxlan"
 	_ "github.com/flannel-io/flannel/pkg/backend/wireguard"
+	"github.com/flannel-io/flannel/pkg/cleanup"
 )
 
 type flagSlice []string
@@ -98,6 +104,8 @@ type CmdLineOpts struct {
 	iptablesForwardRules      bool
 	blackholeRoute            bool
 	netConfPath               string
+	netConfigReloadPeriod     int
+	nodeIdentity              string
 	setNodeNetworkUnavailable bool
 }
 
@@ -118,6 +126,7 @@ func init() {
 	flannelFlags.StringVar(&opts.etcdCAFile, "etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
 	flannelFlags.StringVar(&opts.etcdUsername, "etcd-username", "", "username for BasicAuth to etcd")
 	flannelFlags.StringVar(&opts.etcdPassword, "etcd-password", "", "password for BasicAuth to etcd")
+	flannelFlags.StringVar(&opts.nodeIdentity, "node-identity", "", "identity of the node used to find its subnet lease in etcd. Defaults to the hostname")
 	flannelFlags.Var(&opts.iface, "iface", "interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each option in order. Returns the first match found.")
 	flannelFlags.Var(&opts.ifaceRegex, "iface-regex", "regex expression to match the first interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each regex in order. Returns the first match found. Regexes are checked after specific interfaces specified by the iface option have already been checked.")
 	flannelFlags.StringVar(&opts.ifaceCanReach, "iface-can-reach", "", "detect interface to use (IP or name) for inter-host communication based on which will be used for provided IP. This is exactly the interface to use of command 'ip route get <ip-address>'")
@@ -133,11 +142,12 @@ func init() {
 	flannelFlags.StringVar(&opts.kubeConfigFile, "kubeconfig-file", "", "kubeconfig file location. Does not need to be specified if flannel is running in a pod.")
 	flannelFlags.BoolVar(&opts.version, "version", false, "print version and exit")
 	flannelFlags.StringVar(&opts.healthzIP, "healthz-ip", "0.0.0.0", "the IP address for healthz server to listen")
-	flannelFlags.IntVar(&opts.healthzPort, "healthz-port", 0, "the port for healthz server to listen(0 to disable)")
+	flannelFlags.IntVar(&opts.healthzPort, "healthz-port", 0, "the port for healthz server to listen(0 to disable). The server also exposes prometheus metrics on /metrics")
 	flannelFlags.IntVar(&opts.iptablesResyncSeconds, "iptables-resync", 5, "resync period for iptables rules, in seconds")
 	flannelFlags.BoolVar(&opts.iptablesForwardRules, "iptables-forward-rules", true, "add default accept rules to FORWARD chain in iptables")
 	flannelFlags.BoolVar(&opts.blackholeRoute, "ip-blackhole-route", false, "add blackroute route ont the node for the local podCIDR")
 	flannelFlags.StringVar(&opts.netConfPath, "net-config-path", "/etc/kube-flannel/net-conf.json", "path to the network configuration file")
+	flannelFlags.IntVar(&opts.netConfigReloadPeriod, "net-config-reload-period", 0, "period to check the network configuration for changes and apply them, in seconds (0 to disable)")
 	flannelFlags.BoolVar(&opts.setNodeNetworkUnavailable, "set-node-network-unavailable", true, "set NodeNetworkUnavailable after ready")
 
 	log.InitFlags(nil)
@@ -183,6 +193,7 @@ func copyFlag(name string) {
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [OPTION]... cleanup [--dry-run]\n", os.Args[0])
 	flannelFlags.PrintDefaults()
 	os.Exit(0)
 }
@@ -211,7 +222,7 @@ func newSubnetManager(ctx context.Context) (subnet.Manager, error) {
 	prevSubnet := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_SUBNET")
 	prevIPv6Subnet := ReadIP6CIDRFromSubnetFile(opts.subnetFile, "FLANNEL_IPV6_SUBNET")
 
-	return etcd.NewLocalManager(ctx, cfg, prevSubnet, prevIPv6Subnet, opts.subnetLeaseRenewMargin)
+	return etcd.NewLocalManager(ctx, cfg, prevSubnet, prevIPv6Subnet, opts.subnetLeaseRenewMargin, opts.nodeIdentity)
 }
 
 func main() {
@@ -225,6 +236,10 @@ func main() {
 		log.Error("Failed to set flag FLANNELD from env", err)
 	}
 
+	if flannelFlags.Arg(0) == "cleanup" {
+		os.Exit(runCleanup(flannelFlags.Args()[1:]))
+	}
+
 	// Log the config set via CLI flags
 	log.Infof("CLI flags config: %+v", opts)
 
@@ -371,7 +386,13 @@ func main() {
 
 	// Create a backend manager then use it to create the backend and register the network with it.
 	bm := backend.NewManager(ctx, sm, extIface)
-	be, err := bm.GetBackend(config.BackendType)
+	var be backend.Backend
+	if config.MigrationBackendType != "" {
+		log.Infof("Migrating from the %s backend to the %s backend", config.BackendType, config.MigrationBackendType)
+		be, err = bm.GetMigrationBackend(config.BackendType, config.MigrationBackendType)
+	} else {
+		be, err = bm.GetBackend(config.BackendType)
+	}
 	if err != nil {
 		log.Errorf("Error fetching backend: %s", err)
 		cancel()
@@ -410,17 +431,17 @@ func main() {
 
 	// Set up ipMasq if needed
 	if opts.ipMasq {
-		prevNetwork := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_NETWORK")
+		prevNetworks := ReadCIDRsFromSubnetFile(opts.subnetFile, "FLANNEL_NETWORK")
 		prevSubnet := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_SUBNET")
 
-		prevIPv6Network := ReadIP6CIDRFromSubnetFile(opts.subnetFile, "FLANNEL_IPV6_NETWORK")
+		prevIPv6Networks := ReadIP6CIDRsFromSubnetFile(opts.subnetFile, "FLANNEL_IPV6_NETWORK")
 		prevIPv6Subnet := ReadIP6CIDRFromSubnetFile(opts.subnetFile, "FLANNEL_IPV6_SUBNET")
 
 		err = trafficMngr.SetupAndEnsureMasqRules(ctx,
-			config.Network, prevSubnet,
-			prevNetwork,
-			config.IPv6Network, prevIPv6Subnet,
-			prevIPv6Network,
+			config.Networks(), prevSubnet,
+			prevNetworks,
+			config.IPv6Networks(), prevIPv6Subnet,
+			prevIPv6Networks,
 			bn.Lease(),
 			opts.iptablesResyncSeconds,
 			opts.ipMasqRandomFullyDisable)
@@ -437,8 +458,8 @@ func main() {
 	// In Docker 1.13 and later, Docker sets the default policy of the FORWARD chain to DROP.
 	if opts.iptablesForwardRules {
 		trafficMngr.SetupAndEnsureForwardRules(ctx,
-			config.Network,
-			config.IPv6Network,
+			config.Networks(),
+			config.IPv6Networks(),
 			opts.iptablesResyncSeconds)
 	}
 
@@ -492,6 +513,20 @@ func main() {
 		wg.Done()
 	}()
 
+	// Watch the network configuration and apply the changes that don't require a restart
+	if opts.netConfigReloadPeriod > 0 {
+		if reloader, ok := sm.(subnet.ConfigReloader); ok {
+			reloader.SetNetworkConfig(config)
+			wg.Add(1)
+			go func() {
+				watchNetworkConfig(ctx, sm, reloader, bn, config, time.Duration(opts.netConfigReloadPeriod)*time.Second)
+				wg.Done()
+			}()
+		} else {
+			log.Warningf("The %s subnet manager doesn't support reloading the network config", sm.Name())
+		}
+	}
+
 	_, err = daemon.SdNotify(false, "READY=1")
 	if err != nil {
 		log.Errorf("Failed to notify systemd the message READY=1 %v", err)
@@ -513,6 +548,28 @@ func main() {
 	os.Exit(0)
 }
 
+// runCleanup implements the cleanup command: it removes from the host everything
+// installed by flanneld, whatever the backend and the traffic manager.
+func runCleanup(args []string) int {
+	cleanupFlags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	dryRun := cleanupFlags.Bool("dry-run", false, "only print what would be removed")
+	if err := cleanupFlags.Parse(args); err != nil {
+		log.Error("Can't parse cleanup flags", err)
+		return 1
+	}
+
+	cleanupOpts := cleanup.Options{
+		SubnetFile:   opts.subnetFile,
+		Networks:     ReadCIDRsFromSubnetFile(opts.subnetFile, "FLANNEL_NETWORK"),
+		IPv6Networks: ReadIP6CIDRsFromSubnetFile(opts.subnetFile, "FLANNEL_IPV6_NETWORK"),
+	}
+	if err := cleanup.Run(context.Background(), cleanupOpts, *dryRun); err != nil {
+		log.Errorf("Cleanup failed: %v", err)
+		return 1
+	}
+	return 0
+}
+
 func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.CancelFunc) {
 	// Wait for the context do be Done or for the signal to come in to shutdown.
 	select {
@@ -549,6 +606,62 @@ func getConfig(ctx context.Context, sm subnet.Manager) (*subnet.Config, error) {
 	}
 }
 
+// watchNetworkConfig periodically reloads the network config and applies the
+// changes to the running backend. Changes which can't be applied in place are
+// reported and ignored until the config changes again.
+func watchNetworkConfig(ctx context.Context, sm subnet.Manager, reloader subnet.ConfigReloader, bn backend.Network, running *subnet.Config, period time.Duration) {
+	log.Infof("Watching the network config for changes every %s", period)
+	var rejected *subnet.Config
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+		}
+
+		updated, err := reloader.LoadNetworkConfig(ctx)
+		if err != nil {
+			log.Errorf("Couldn't reload network config: %v", err)
+			continue
+		}
+		if subnet.ConfigEqual(running, updated) || (rejected != nil && subnet.ConfigEqual(rejected, updated)) {
+			continue
+		}
+
+		log.Info("Network config changed, applying the new config")
+		if err := applyNetworkConfig(ctx, bn, running, updated); err != nil {
+			log.Errorf("Ignoring the new network config: %v", err)
+			rejected = updated
+			continue
+		}
+		rejected = nil
+		running = updated
+		reloader.SetNetworkConfig(updated)
+
+		if err := sm.HandleSubnetFile(opts.subnetFile, updated, opts.ipMasq, bn.Lease().Subnet, bn.Lease().IPv6Subnet, bn.MTU()); err != nil {
+			log.Warningf("Failed to write subnet file: %s", err)
+		} else {
+			log.Infof("Wrote subnet file to %s", opts.subnetFile)
+		}
+		log.Info("New network config applied")
+	}
+}
+
+// applyNetworkConfig applies the updated network config to the running network.
+func applyNetworkConfig(ctx context.Context, bn backend.Network, running, updated *subnet.Config) error {
+	if err := subnet.CheckConfigUpdate(running, updated); err != nil {
+		return err
+	}
+	if !subnet.BackendConfigChanged(running, updated) {
+		return nil
+	}
+	rn, ok := bn.(backend.ReconfigurableNetwork)
+	if !ok {
+		return fmt.Errorf("the %s backend doesn't support changing its configuration, flanneld must be restarted", updated.BackendType)
+	}
+	return rn.UpdateConfig(ctx, updated)
+}
+
 func mustRunHealthz(stopChan <-chan struct{}, wg *sync.WaitGroup) {
 	address := net.JoinHostPort(opts.healthzIP, strconv.Itoa(opts.healthzPort))
 	log.Infof("Start healthz server on %s", address)
@@ -578,6 +691,9 @@ func mustRunHealthz(stopChan <-chan struct{}, wg *sync.WaitGroup) {
 		}
 	})
 
+	// Prometheus metrics, see pkg/metrics for the flannel specific collectors
+	http.Handle("/metrics", promhttp.Handler())
+
 	server := &http.Server{Addr: address}
 
 	wg.Add(2)
@@ -15,12 +15,15 @@
 package main
 
 import (
+	"context"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/subnet"
 )
 
 func TestReadCIDRsFromSubnetFileSkipsInvalidCIDRs(t *testing.T) {
@@ -144,3 +147,48 @@ func assertIP6NetsEqual(t *testing.T, got, want []ip.IP6Net) {
 		}
 	}
 }
+
+type fakeNetwork struct {
+	backend.SimpleNetwork
+	updates []*subnet.Config
+}
+
+func (n *fakeNetwork) UpdateConfig(ctx context.Context, config *subnet.Config) error {
+	n.updates = append(n.updates, config)
+	return nil
+}
+
+func mustParseConfig(t *testing.T, s string) *subnet.Config {
+	t.Helper()
+	config, err := subnet.ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig(%q) failed: %v", s, err)
+	}
+	return config
+}
+
+func TestApplyNetworkConfig(t *testing.T) {
+	ctx := context.Background()
+	running := mustParseConfig(t, `{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan"}}`)
+	directRouting := mustParseConfig(t, `{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan", "DirectRouting": true}}`)
+	network := mustParseConfig(t, `{"Network": "10.245.0.0/16", "Backend": {"Type": "vxlan", "DirectRouting": true}}`)
+
+	bn := &fakeNetwork{}
+	if err := applyNetworkConfig(ctx, bn, running, directRouting); err != nil {
+		t.Fatalf("applyNetworkConfig failed: %v", err)
+	}
+	if len(bn.updates) != 1 || bn.updates[0] != directRouting {
+		t.Errorf("expected the backend to be updated once, got %d updates", len(bn.updates))
+	}
+
+	if err := applyNetworkConfig(ctx, bn, running, network); err == nil {
+		t.Error("expected a Network change to be refused")
+	}
+	if len(bn.updates) != 1 {
+		t.Errorf("the backend shouldn't be updated when the change is refused")
+	}
+
+	if err := applyNetworkConfig(ctx, &bn.SimpleNetwork, running, directRouting); err == nil {
+		t.Error("expected an error for a backend which can't be reconfigured")
+	}
+}
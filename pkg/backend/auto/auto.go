@@ -0,0 +1,336 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auto
+
+// The auto backend probes the host when it starts and runs the datapaths the
+// host supports side by side, sharing the lease of the node:
+//   - host-gw, the direct routes to the peers on the same L2 network,
+//   - vxlan, the encapsulation to the other peers,
+//   - wireguard, the encapsulation when vxlan isn't available on both ends,
+//     and the only datapath when the encryption is requested.
+//
+// The lease records the datapaths of the node and whether it requires the
+// encryption, and each peer is handled by the first datapath both ends
+// support, so both ends of a connection choose the same datapath.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/backend/hostgw"
+	"github.com/flannel-io/flannel/pkg/backend/vxlan"
+	"github.com/flannel-io/flannel/pkg/backend/wireguard"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	backendType = "auto"
+
+	hostGWMode    = "host-gw"
+	vxlanMode     = "vxlan"
+	wireguardMode = "wireguard"
+
+	probeLinkName = "flannel-probe"
+)
+
+func init() {
+	backend.Register(backendType, New)
+}
+
+type AutoBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	return &AutoBackend{
+		sm:       sm,
+		extIface: extIface,
+	}, nil
+}
+
+type autoConfig struct {
+	Encrypt bool
+	// VXLAN and WireGuard are the options of the vxlan and wireguard
+	// datapaths, as for the backends of the same type
+	VXLAN     json.RawMessage
+	WireGuard json.RawMessage
+}
+
+// leaseData is the backend data, and the IPv6 backend data, of the leases.
+type leaseData struct {
+	Encrypt bool `json:",omitempty"`
+	// Modes are the datapaths of the node by order of preference
+	Modes []string
+	// Data are the backend data of the datapaths
+	Data map[string]json.RawMessage `json:",omitempty"`
+}
+
+func (be *AutoBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg := autoConfig{}
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding auto backend config: %v", err)
+		}
+	}
+
+	modes, err := be.probe(cfg.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Using the %v datapaths (encryption: %v)", modes, cfg.Encrypt)
+
+	c := newCodec(cfg.Encrypt, modes)
+	shared := backend.NewSharedLease(be.sm, c, len(modes))
+	var networks []backend.Network
+	for i, mode := range modes {
+		modeConfig := *config
+		modeConfig.BackendType = mode
+		modeConfig.Backend, err = modeBackendConfig(mode, &cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		mbe, err := newModeBackend(mode, shared.Manager(i), be.extIface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the %s datapath: %v", mode, err)
+		}
+		n, err := mbe.RegisterNetwork(ctx, wg, &modeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register the network of the %s datapath: %v", mode, err)
+		}
+		networks = append(networks, n)
+	}
+
+	return &backend.SharedNetwork{Shared: shared, Networks: networks}, nil
+}
+
+// probe returns the datapaths supported by the host, by order of preference.
+func (be *AutoBackend) probe(encrypt bool) ([]string, error) {
+	wireguardSupported := probeLink(&netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: probeLinkName}, LinkType: "wireguard"})
+	if encrypt {
+		if !wireguardSupported {
+			log.Warning("The wireguard module is not available, the traffic is encrypted by the userspace implementation")
+		}
+		return []string{wireguardMode}, nil
+	}
+
+	var modes []string
+	// host-gw doesn't support NAT
+	if be.extIface.ExtAddr.Equal(be.extIface.IfaceAddr) {
+		modes = append(modes, hostGWMode)
+	} else {
+		log.Infof("The public IP %s differs from the interface IP, no direct routes to the peers", be.extIface.ExtAddr)
+	}
+	if probeLink(&netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: probeLinkName}, VxlanId: 1}) {
+		modes = append(modes, vxlanMode)
+	} else {
+		log.Warning("The vxlan module is not available")
+	}
+	if wireguardSupported {
+		modes = append(modes, wireguardMode)
+	}
+
+	if len(modes) == 0 {
+		return nil, errors.New("no datapath is supported by the host")
+	}
+	return modes, nil
+}
+
+// probeLink tells if the kernel supports the links of the type of link, by
+// creating and removing it.
+func probeLink(link netlink.Link) bool {
+	if existing, err := netlink.LinkByName(link.Attrs().Name); err == nil {
+		if err := netlink.LinkDel(existing); err != nil {
+			log.Warningf("failed to remove the %s link: %v", link.Attrs().Name, err)
+		}
+	}
+
+	err := netlink.LinkAdd(link)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EAFNOSUPPORT) {
+		return false
+	}
+	if err != nil {
+		// Not a matter of support, the datapath reports the error if any
+		log.V(2).Infof("Failed to probe the %s links: %v", link.Type(), err)
+		return true
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		log.Warningf("failed to remove the %s link: %v", link.Attrs().Name, err)
+	}
+	return true
+}
+
+// modeBackendConfig returns the backend config of the datapath.
+func modeBackendConfig(mode string, cfg *autoConfig) (json.RawMessage, error) {
+	var section json.RawMessage
+	switch mode {
+	case vxlanMode:
+		section = cfg.VXLAN
+	case wireguardMode:
+		section = cfg.WireGuard
+	}
+	config, err := backend.BackendConfig(mode, section)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the %s options of the auto backend config: %v", mode, err)
+	}
+	return config, nil
+}
+
+func newModeBackend(mode string, sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	switch mode {
+	case hostGWMode:
+		return hostgw.New(sm, extIface)
+	case vxlanMode:
+		return vxlan.New(sm, extIface)
+	case wireguardMode:
+		return wireguard.New(sm, extIface)
+	}
+	return nil, fmt.Errorf("unknown datapath %s", mode)
+}
+
+// codec is the backend.LeaseCodec of the datapaths.
+type codec struct {
+	encrypt bool
+	modes   []string
+	// directRouting tells if a peer is on the same L2 network
+	directRouting func(net.IP) (bool, error)
+
+	unreachable backend.UnreachablePeers
+}
+
+func newCodec(encrypt bool, modes []string) *codec {
+	return &codec{
+		encrypt:       encrypt,
+		modes:         modes,
+		directRouting: ip.DirectRouting,
+	}
+}
+
+func (c *codec) Merge(attrs []*lease.LeaseAttrs) (*lease.LeaseAttrs, error) {
+	merged := &lease.LeaseAttrs{BackendType: backendType}
+	data := leaseData{Encrypt: c.encrypt, Data: map[string]json.RawMessage{}}
+	v6Data := leaseData{Encrypt: c.encrypt, Data: map[string]json.RawMessage{}}
+	for i, a := range attrs {
+		if a == nil {
+			continue
+		}
+		merged.PublicIP = a.PublicIP
+		if a.PublicIPv6 != nil {
+			merged.PublicIPv6 = a.PublicIPv6
+		}
+		merged.NodeID = a.NodeID
+
+		mode := c.modes[i]
+		data.Modes = append(data.Modes, mode)
+		v6Data.Modes = append(v6Data.Modes, mode)
+		if len(a.BackendData) > 0 {
+			data.Data[mode] = a.BackendData
+		}
+		if len(a.BackendV6Data) > 0 {
+			v6Data.Data[mode] = a.BackendV6Data
+		}
+	}
+
+	var err error
+	if merged.BackendData, err = json.Marshal(&data); err != nil {
+		return nil, err
+	}
+	if merged.PublicIPv6 != nil {
+		if merged.BackendV6Data, err = json.Marshal(&v6Data); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// decode returns the backend data of the lease, its datapaths and whether it
+// requires the encryption coming from the IPv6 data for the IPv6 only leases.
+func decode(l *lease.Lease) (data, v6Data leaseData, err error) {
+	if backend.IsBackendData(l.Attrs.BackendData) {
+		if err = json.Unmarshal(l.Attrs.BackendData, &data); err != nil {
+			return data, v6Data, fmt.Errorf("error decoding the backend data: %v", err)
+		}
+	}
+	if backend.IsBackendData(l.Attrs.BackendV6Data) {
+		if err = json.Unmarshal(l.Attrs.BackendV6Data, &v6Data); err != nil {
+			return data, v6Data, fmt.Errorf("error decoding the IPv6 backend data: %v", err)
+		}
+		if len(data.Modes) == 0 {
+			data.Encrypt, data.Modes = v6Data.Encrypt, v6Data.Modes
+		}
+	}
+	return data, v6Data, nil
+}
+
+func (c *codec) View(l lease.Lease, i int) (lease.Lease, bool) {
+	if l.Attrs.BackendType != backendType {
+		return l, false
+	}
+	data, v6Data, err := decode(&l)
+	mode := c.modes[i]
+	if err != nil || !slices.Contains(data.Modes, mode) {
+		return l, false
+	}
+
+	l.Attrs.BackendType = mode
+	l.Attrs.BackendData = data.Data[mode]
+	l.Attrs.BackendV6Data = v6Data.Data[mode]
+	return l, true
+}
+
+// Select returns the datapath of the peer: wireguard if either end requires
+// the encryption, host-gw for the peers on the same L2 network, and else vxlan
+// or wireguard, if both ends support them.
+func (c *codec) Select(l lease.Lease) int {
+	if l.Attrs.BackendType != backendType {
+		return -1
+	}
+	data, _, err := decode(&l)
+	if err != nil {
+		c.unreachable.Report(&l, err.Error())
+		return -1
+	}
+
+	candidates := []string{vxlanMode, wireguardMode}
+	if c.encrypt || data.Encrypt {
+		candidates = []string{wireguardMode}
+	} else if backend.Adjacent(&l, c.directRouting) {
+		candidates = append([]string{hostGWMode}, candidates...)
+	}
+
+	for _, mode := range candidates {
+		if i := slices.Index(c.modes, mode); i >= 0 && slices.Contains(data.Modes, mode) {
+			c.unreachable.Reachable(&l)
+			return i
+		}
+	}
+	c.unreachable.Report(&l, fmt.Sprintf("no common datapath among %v, the peer supports %v (encryption: %v)", candidates, data.Modes, data.Encrypt))
+	return -1
+}
@@ -0,0 +1,162 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auto
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// testCodec returns a codec for which the peers of 192.168.0.0/24 are on the
+// same L2 network.
+func testCodec(encrypt bool, modes ...string) *codec {
+	c := newCodec(encrypt, modes)
+	_, l2, _ := net.ParseCIDR("192.168.0.0/24")
+	c.directRouting = func(peer net.IP) (bool, error) {
+		return l2.Contains(peer), nil
+	}
+	return c
+}
+
+// peerLease returns the lease of a peer with the datapaths and their backend
+// data, as merged by its codec.
+func peerLease(t *testing.T, subnet, publicIP string, encrypt bool, modes ...string) lease.Lease {
+	c := testCodec(encrypt, modes...)
+	var attrs []*lease.LeaseAttrs
+	for _, mode := range modes {
+		attrs = append(attrs, &lease.LeaseAttrs{
+			PublicIP:    ip.MustParseIP4(publicIP),
+			BackendType: mode,
+			BackendData: json.RawMessage(`"` + mode + `"`),
+		})
+	}
+	merged, err := c.Merge(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lease.Lease{
+		EnableIPv4: true,
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4(subnet), PrefixLen: 24},
+		Attrs:      *merged,
+	}
+}
+
+func TestMergeView(t *testing.T) {
+	c := testCodec(false, hostGWMode, vxlanMode, wireguardMode)
+	// The wireguard datapath didn't acquire the lease yet
+	merged, err := c.Merge([]*lease.LeaseAttrs{
+		{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: hostGWMode},
+		{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: vxlanMode, BackendData: json.RawMessage(`{"VNI":1}`)},
+		nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.BackendType != backendType || string(merged.BackendData) != `{"Modes":["host-gw","vxlan"],"Data":{"vxlan":{"VNI":1}}}` ||
+		merged.BackendV6Data != nil || merged.PublicIP != ip.MustParseIP4("192.168.0.1") {
+		t.Fatalf("unexpected lease attributes %+v", merged)
+	}
+
+	l := lease.Lease{Attrs: *merged}
+	if vl, ok := c.View(l, 1); !ok || vl.Attrs.BackendType != vxlanMode || string(vl.Attrs.BackendData) != `{"VNI":1}` {
+		t.Errorf("unexpected vxlan lease %+v", vl.Attrs)
+	}
+	if vl, ok := c.View(l, 0); !ok || vl.Attrs.BackendType != hostGWMode || vl.Attrs.BackendData != nil {
+		t.Errorf("unexpected host-gw lease %+v", vl.Attrs)
+	}
+	if _, ok := c.View(l, 2); ok {
+		t.Errorf("the lease doesn't advertise the wireguard datapath")
+	}
+
+	// The datapaths of the IPv6 only leases are in the IPv6 data
+	v6 := ip.MustParseIP6("fd00::1")
+	merged, err = c.Merge([]*lease.LeaseAttrs{nil, nil, {PublicIPv6: v6, BackendType: wireguardMode, BackendV6Data: json.RawMessage(`"key"`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = lease.Lease{EnableIPv6: true, Attrs: *merged}
+	l.Attrs.BackendData = nil
+	if vl, ok := c.View(l, 2); !ok || string(vl.Attrs.BackendV6Data) != `"key"` {
+		t.Errorf("unexpected IPv6 wireguard lease %+v", vl.Attrs)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	c := testCodec(false, hostGWMode, vxlanMode, wireguardMode)
+	for _, tc := range []struct {
+		name     string
+		peer     lease.Lease
+		expected int
+	}{
+		{"same L2 network", peerLease(t, "10.5.2.0", "192.168.0.2", false, hostGWMode, vxlanMode), 0},
+		{"other network", peerLease(t, "10.5.3.0", "192.168.1.3", false, hostGWMode, vxlanMode, wireguardMode), 1},
+		{"no common encapsulation", peerLease(t, "10.5.4.0", "192.168.1.4", false, hostGWMode, wireguardMode), 2},
+		{"encryption required by the peer", peerLease(t, "10.5.5.0", "192.168.0.5", true, wireguardMode), 2},
+		{"unreachable", peerLease(t, "10.5.6.0", "192.168.1.6", false, hostGWMode), -1},
+		{"another backend", lease.Lease{Attrs: lease.LeaseAttrs{BackendType: vxlanMode}}, -1},
+	} {
+		if i := c.Select(tc.peer); i != tc.expected {
+			t.Errorf("%s: expected the datapath %d, got %d", tc.name, tc.expected, i)
+		}
+	}
+
+	// The peers without wireguard are unreachable when the encryption is
+	// required
+	c = testCodec(true, wireguardMode)
+	if i := c.Select(peerLease(t, "10.5.2.0", "192.168.0.2", false, hostGWMode, vxlanMode)); i != -1 {
+		t.Errorf("the traffic to the peer without wireguard isn't encrypted")
+	}
+	if i := c.Select(peerLease(t, "10.5.3.0", "192.168.0.3", false, hostGWMode, vxlanMode, wireguardMode)); i != 0 {
+		t.Errorf("the traffic to the peer with wireguard isn't encrypted")
+	}
+}
+
+func TestModeBackendConfig(t *testing.T) {
+	cfg := autoConfig{VXLAN: json.RawMessage(`{"VNI": 4, "Type": "udp"}`)}
+	for mode, expected := range map[string]string{
+		vxlanMode:     `{"Type":"vxlan","VNI":4}`,
+		wireguardMode: `{"Type":"wireguard"}`,
+		hostGWMode:    `{"Type":"host-gw"}`,
+	} {
+		config, err := modeBackendConfig(mode, &cfg)
+		if err != nil || string(config) != expected {
+			t.Errorf("expected the %s config %s, got %s: %v", mode, expected, config, err)
+		}
+	}
+}
+
+func TestProbeLink(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	for _, link := range []netlink.Link{
+		&netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: probeLinkName}, VxlanId: 1},
+		&netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: probeLinkName}, LinkType: "wireguard"},
+	} {
+		t.Logf("%s supported: %v", link.Type(), probeLink(link))
+		if _, err := netlink.LinkByName(probeLinkName); err == nil {
+			t.Errorf("the %s probe link wasn't removed", link.Type())
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package bgp
+
+// The bgp backend doesn't encapsulate the packets: it runs an embedded BGP
+// speaker announcing the subnet of the node to the configured peers (usually
+// the ToR routers or route reflectors), so that the underlay routes the pod
+// traffic between racks.
+//
+// The routes to the other nodes are programmed either from the leases, like
+// host-gw but only for the nodes on the same subnet (the other ones are
+// reached through the underlay), or from the routes announced by the peers
+// when "learnRoutes" is enabled.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	backendType     = "bgp"
+	defaultPort     = 179
+	defaultHoldTime = 90
+)
+
+func init() {
+	backend.Register(backendType, New)
+}
+
+type BGPBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	if extIface.ExtAddr != nil && !extIface.ExtAddr.Equal(extIface.IfaceAddr) {
+		return nil, fmt.Errorf("your PublicIP differs from interface IP, meaning that probably you're on a NAT, which is not supported by bgp backend")
+	}
+
+	be := &BGPBackend{
+		sm:       sm,
+		extIface: extIface,
+	}
+	return be, nil
+}
+
+type PeerConfig struct {
+	Address string `json:"address"`
+	ASN     uint32 `json:"asn"`
+	Port    int    `json:"port"`
+}
+
+type BGPConfig struct {
+	ASN         uint32       `json:"asn"`
+	RouterID    string       `json:"routerID"`
+	HoldTime    int          `json:"holdTime"`
+	LearnRoutes bool         `json:"learnRoutes"`
+	Peers       []PeerConfig `json:"peers"`
+}
+
+func parseBGPConfig(config json.RawMessage) (BGPConfig, error) {
+	cfg := BGPConfig{
+		HoldTime: defaultHoldTime,
+	}
+
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return BGPConfig{}, err
+		}
+	}
+
+	if cfg.ASN == 0 {
+		return BGPConfig{}, fmt.Errorf("ASN is required")
+	}
+	if cfg.RouterID != "" {
+		if id := net.ParseIP(cfg.RouterID); id == nil || id.To4() == nil {
+			return BGPConfig{}, fmt.Errorf("RouterID %q is not an IPv4 address", cfg.RouterID)
+		}
+	}
+	// The hold time is either 0 (no keepalive) or at least 3 seconds
+	if cfg.HoldTime < 0 || (cfg.HoldTime > 0 && cfg.HoldTime < 3) || cfg.HoldTime > 0xffff {
+		return BGPConfig{}, fmt.Errorf("invalid HoldTime %d", cfg.HoldTime)
+	}
+	if len(cfg.Peers) == 0 {
+		return BGPConfig{}, fmt.Errorf("at least one peer is required")
+	}
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		if net.ParseIP(peer.Address) == nil {
+			return BGPConfig{}, fmt.Errorf("peer address %q is not an IP address", peer.Address)
+		}
+		if peer.ASN == 0 {
+			return BGPConfig{}, fmt.Errorf("ASN of peer %s is required", peer.Address)
+		}
+		if peer.Port == 0 {
+			peer.Port = defaultPort
+		}
+	}
+	return cfg, nil
+}
+
+// routerID returns the configured router ID, or the public IPv4 address of
+// the node, or an ID derived from its public IPv6 address.
+func routerID(cfg BGPConfig, extIface *backend.ExternalInterface) net.IP {
+	if cfg.RouterID != "" {
+		return net.ParseIP(cfg.RouterID).To4()
+	}
+	if extIface.ExtAddr != nil && extIface.ExtAddr.To4() != nil {
+		return extIface.ExtAddr.To4()
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(extIface.ExtV6Addr)
+	sum := h.Sum(nil)
+	return net.IPv4(sum[0], sum[1], sum[2], sum[3]).To4()
+}
+
+func (be *BGPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg, err := parseBGPConfig(config.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding BGP backend config: %w", err)
+	}
+
+	n := &network{
+		RouteNetwork: backend.RouteNetwork{
+			SimpleNetwork: backend.SimpleNetwork{
+				ExtIface: be.extIface,
+			},
+			SM:          be.sm,
+			BackendType: backendType,
+			Mtu:         be.extIface.Iface.MTU,
+			LinkIndex:   be.extIface.Iface.Index,
+		},
+		config:      config,
+		learnRoutes: cfg.LearnRoutes,
+		learned:     make(map[string]learnedRoute),
+		announced:   make(map[string]map[string]route),
+	}
+
+	attrs := lease.LeaseAttrs{
+		BackendType: backendType,
+	}
+
+	if config.EnableIPv4 {
+		attrs.PublicIP = ip.FromIP(be.extIface.ExtAddr)
+		n.GetRoute = func(lease *lease.Lease) *netlink.Route {
+			return directRoute(lease.Subnet.ToIPNet(), lease.Attrs.PublicIP.ToIP(), n.LinkIndex)
+		}
+	}
+
+	if config.EnableIPv6 {
+		attrs.PublicIPv6 = ip.FromIP6(be.extIface.ExtV6Addr)
+		n.GetV6Route = func(lease *lease.Lease) *netlink.Route {
+			return directRoute(lease.IPv6Subnet.ToIPNet(), lease.Attrs.PublicIPv6.ToIP(), n.LinkIndex)
+		}
+	}
+
+	l, err := be.sm.AcquireLease(ctx, &attrs)
+	switch err {
+	case nil:
+		n.SubnetLease = l
+
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	n.speaker = &speaker{
+		asn:      cfg.ASN,
+		routerID: routerID(cfg, be.extIface),
+		holdTime: time.Duration(cfg.HoldTime) * time.Second,
+		peers:    cfg.Peers,
+	}
+	if config.EnableIPv4 {
+		n.speaker.prefix = l.Subnet.ToIPNet()
+		n.speaker.nextHop = be.extIface.ExtAddr
+	}
+	if config.EnableIPv6 {
+		n.speaker.v6Prefix = l.IPv6Subnet.ToIPNet()
+		n.speaker.v6NextHop = be.extIface.ExtV6Addr
+	}
+	if cfg.LearnRoutes {
+		n.speaker.onUpdate = n.handleRoute
+	}
+
+	log.Infof("BGP config: ASN=%d RouterID=%s HoldTime=%d LearnRoutes=%v Peers=%v", cfg.ASN, n.speaker.routerID, cfg.HoldTime, cfg.LearnRoutes, cfg.Peers)
+	return n, nil
+}
+
+// directRoute returns the route to a subnet through the node with the given
+// public IP, or nil if the node isn't on the same subnet: the underlay knows
+// the route to its subnet from BGP.
+func directRoute(dst *net.IPNet, publicIP net.IP, linkIndex int) *netlink.Route {
+	dr, err := ip.DirectRouting(publicIP)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if !dr {
+		log.V(2).Infof("%v is routed by the underlay to %v", dst, publicIP)
+		return nil
+	}
+	return &netlink.Route{
+		Dst:       dst,
+		Gw:        publicIP,
+		LinkIndex: linkIndex,
+	}
+}
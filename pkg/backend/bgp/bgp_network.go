@@ -0,0 +1,152 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package bgp
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/metrics"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+// learnedRoute is a route programmed from the announcement of a peer.
+type learnedRoute struct {
+	peer  string
+	route netlink.Route
+}
+
+type network struct {
+	backend.RouteNetwork
+	speaker     *speaker
+	config      *subnet.Config
+	learnRoutes bool
+
+	// mu protects learned, the routes programmed from the announcements of
+	// the peers keyed by prefix, and announced, the routes announced by each
+	// peer keyed by prefix then peer. The sessions with the peers run
+	// concurrently.
+	mu        sync.Mutex
+	learned   map[string]learnedRoute
+	announced map[string]map[string]route
+}
+
+func (n *network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.Info("Starting the BGP speaker")
+	wg.Add(1)
+	go func() {
+		n.speaker.Run(ctx)
+		log.V(1).Info("BGP speaker exited")
+		wg.Done()
+	}()
+
+	if n.learnRoutes {
+		<-ctx.Done()
+	} else {
+		n.RouteNetwork.Run(ctx)
+	}
+	wg.Wait()
+}
+
+// handleRoute programs the routes announced by the peers. Only the routes to
+// the subnets of the flannel networks are considered.
+func (n *network) handleRoute(peer string, r route, withdrawn bool) {
+	if !n.isFlannelSubnet(r) {
+		log.V(2).Infof("Ignoring route to %v from %s outside of the flannel networks", r.prefix, peer)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := r.prefix.String()
+	if withdrawn {
+		delete(n.announced[key], peer)
+		if len(n.announced[key]) == 0 {
+			delete(n.announced, key)
+		}
+		existing, ok := n.learned[key]
+		if !ok || existing.peer != peer {
+			// The route was not programmed, or it was programmed from another peer
+			return
+		}
+
+		// Another peer may still announce the route
+		peers := make([]string, 0, len(n.announced[key]))
+		for p := range n.announced[key] {
+			peers = append(peers, p)
+		}
+		if len(peers) > 0 {
+			sort.Strings(peers)
+			if n.programRoute(key, peers[0], n.announced[key][peers[0]]) {
+				return
+			}
+		}
+
+		log.Infof("Subnet removed: %v via %v", r.prefix, r.nextHop)
+		delete(n.learned, key)
+		if err := netlink.RouteDel(&existing.route); err != nil {
+			log.Errorf("Error deleting route to %v: %v", r.prefix, err)
+			metrics.SubnetEventFailed(backendType)
+		}
+		return
+	}
+
+	if n.announced[key] == nil {
+		n.announced[key] = make(map[string]route)
+	}
+	n.announced[key][peer] = r
+	if existing, ok := n.learned[key]; ok && existing.peer != peer {
+		// The route stays through the peer which announced it first
+		log.V(1).Infof("Subnet %v is also announced by %s via %v", r.prefix, peer, r.nextHop)
+		return
+	}
+	n.programRoute(key, peer, r)
+}
+
+// programRoute programs the route announced by the peer, replacing the route
+// to the same prefix. It returns false if the route couldn't be programmed.
+func (n *network) programRoute(key, peer string, r route) bool {
+	log.Infof("Subnet added: %v via %v", r.prefix, r.nextHop)
+	nlRoute := netlink.Route{
+		Dst: r.prefix,
+		Gw:  r.nextHop,
+	}
+	if err := netlink.RouteReplace(&nlRoute); err != nil {
+		log.Errorf("Error adding route to %v via %v: %v", r.prefix, r.nextHop, err)
+		metrics.SubnetEventFailed(backendType)
+		return false
+	}
+	n.learned[key] = learnedRoute{peer: peer, route: nlRoute}
+	return true
+}
+
+func (n *network) isFlannelSubnet(r route) bool {
+	if r.prefix.IP.To4() != nil {
+		sn := ip.FromIPNet(r.prefix)
+		return n.config.EnableIPv4 && n.config.ContainsSubnet(sn) && !sn.Equal(n.SubnetLease.Subnet)
+	}
+	sn := ip.FromIP6Net(r.prefix)
+	return n.config.EnableIPv6 && n.config.ContainsIPv6Subnet(sn) && !sn.Equal(n.SubnetLease.IPv6Subnet)
+}
@@ -0,0 +1,482 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package bgp
+
+// This file implements the subset of the BGP-4 messages (RFC 4271) used by the
+// speaker: OPEN with the multiprotocol (RFC 4760) and 4-octet AS number
+// (RFC 6793) capabilities, UPDATE for IPv4 and IPv6 unicast, KEEPALIVE and
+// NOTIFICATION.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	headerLen     = 19
+	maxMessageLen = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	bgpVersion = 4
+	// asTrans is the 2-octet AS number used in place of 4-octet AS numbers
+	asTrans = 23456
+
+	optParamCapabilities = 2
+	capMultiprotocol     = 1
+	capFourOctetAS       = 65
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	attrFlagOptional = 0x80
+	attrFlagTransit  = 0x40
+	attrFlagExtended = 0x10
+
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrLocalPref   = 5
+	attrMPReachNLRI = 14
+	attrMPUnreach   = 15
+
+	originIGP        = 0
+	asPathSequence   = 2
+	defaultLocalPref = 100
+
+	// Notification error codes and the subcodes of the OPEN errors
+	errMessageHeader  = 1
+	errOpenMessage    = 2
+	errUpdateMessage  = 3
+	errHoldTimer      = 4
+	errFSM            = 5
+	errCease          = 6
+	errOpenBadVersion = 1
+	errOpenBadPeerAS  = 2
+	errOpenBadHold    = 6
+)
+
+// openMessage is a BGP OPEN message, the AS number is the 4-octet one when
+// the peer advertised the capability.
+type openMessage struct {
+	asn       uint32
+	holdTime  uint16
+	routerID  net.IP
+	fourOctet bool
+	families  []family
+}
+
+type family struct {
+	afi  uint16
+	safi uint8
+}
+
+var (
+	ipv4Unicast = family{afi: afiIPv4, safi: safiUnicast}
+	ipv6Unicast = family{afi: afiIPv6, safi: safiUnicast}
+)
+
+// updateMessage is a BGP UPDATE message for IPv4 and IPv6 unicast.
+type updateMessage struct {
+	withdrawn   []*net.IPNet
+	nlri        []*net.IPNet
+	nextHop     net.IP
+	asPath      []uint32
+	localPref   uint32
+	v6Withdrawn []*net.IPNet
+	v6NLRI      []*net.IPNet
+	v6NextHop   net.IP
+}
+
+type notificationMessage struct {
+	code    uint8
+	subcode uint8
+	data    []byte
+}
+
+func (n *notificationMessage) Error() string {
+	return fmt.Sprintf("BGP notification code %d subcode %d", n.code, n.subcode)
+}
+
+func marshalMessage(msgType uint8, body []byte) []byte {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLen+len(body)))
+	msg[18] = msgType
+	return append(msg, body...)
+}
+
+// readMessage reads the next message and returns its type and body.
+func readMessage(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	for i := 0; i < 16; i++ {
+		if header[i] != 0xff {
+			return 0, nil, &notificationMessage{code: errMessageHeader, subcode: 1}
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLen || length > maxMessageLen {
+		return 0, nil, &notificationMessage{code: errMessageHeader, subcode: 2}
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+func marshalKeepalive() []byte {
+	return marshalMessage(msgKeepalive, nil)
+}
+
+func (n *notificationMessage) marshal() []byte {
+	return marshalMessage(msgNotification, append([]byte{n.code, n.subcode}, n.data...))
+}
+
+func parseNotification(body []byte) (*notificationMessage, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("notification message too short")
+	}
+	return &notificationMessage{code: body[0], subcode: body[1], data: body[2:]}, nil
+}
+
+func (o *openMessage) marshal() []byte {
+	var caps []byte
+	for _, f := range o.families {
+		caps = append(caps, capMultiprotocol, 4, byte(f.afi>>8), byte(f.afi), 0, f.safi)
+	}
+	caps = append(caps, capFourOctetAS, 4)
+	caps = binary.BigEndian.AppendUint32(caps, o.asn)
+
+	asn := uint16(asTrans)
+	if o.asn <= 0xffff {
+		asn = uint16(o.asn)
+	}
+
+	body := []byte{bgpVersion}
+	body = binary.BigEndian.AppendUint16(body, asn)
+	body = binary.BigEndian.AppendUint16(body, o.holdTime)
+	body = append(body, o.routerID.To4()...)
+	body = append(body, byte(2+len(caps)), optParamCapabilities, byte(len(caps)))
+	body = append(body, caps...)
+	return marshalMessage(msgOpen, body)
+}
+
+func parseOpen(body []byte) (*openMessage, error) {
+	if len(body) < 10 {
+		return nil, &notificationMessage{code: errMessageHeader, subcode: 2}
+	}
+	if body[0] != bgpVersion {
+		return nil, &notificationMessage{code: errOpenMessage, subcode: errOpenBadVersion, data: []byte{0, bgpVersion}}
+	}
+	o := &openMessage{
+		asn:      uint32(binary.BigEndian.Uint16(body[1:])),
+		holdTime: binary.BigEndian.Uint16(body[3:]),
+		routerID: net.IP(append([]byte{}, body[5:9]...)),
+	}
+	if o.holdTime == 1 || o.holdTime == 2 {
+		return nil, &notificationMessage{code: errOpenMessage, subcode: errOpenBadHold}
+	}
+
+	params := body[10:]
+	if int(body[9]) != len(params) {
+		return nil, &notificationMessage{code: errMessageHeader, subcode: 2}
+	}
+	hasCapabilities := false
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, &notificationMessage{code: errOpenMessage}
+		}
+		value := params[2 : 2+paramLen]
+		params = params[2+paramLen:]
+		if paramType != optParamCapabilities {
+			continue
+		}
+		hasCapabilities = true
+		for len(value) >= 2 {
+			code, capLen := value[0], int(value[1])
+			if len(value) < 2+capLen {
+				return nil, &notificationMessage{code: errOpenMessage}
+			}
+			data := value[2 : 2+capLen]
+			value = value[2+capLen:]
+			switch {
+			case code == capMultiprotocol && capLen == 4:
+				o.families = append(o.families, family{afi: binary.BigEndian.Uint16(data), safi: data[3]})
+			case code == capFourOctetAS && capLen == 4:
+				o.fourOctet = true
+				o.asn = binary.BigEndian.Uint32(data)
+			}
+		}
+	}
+	if !hasCapabilities || len(o.families) == 0 {
+		// Without the multiprotocol capability, only IPv4 unicast is supported
+		o.families = append(o.families, ipv4Unicast)
+	}
+	return o, nil
+}
+
+func (o *openMessage) supports(f family) bool {
+	for _, of := range o.families {
+		if of == f {
+			return true
+		}
+	}
+	return false
+}
+
+// marshal encodes the update. fourOctet tells whether the AS numbers of the
+// AS_PATH are encoded on 4 octets.
+func (u *updateMessage) marshal(fourOctet bool) []byte {
+	var withdrawn []byte
+	for _, p := range u.withdrawn {
+		withdrawn = appendPrefix(withdrawn, p)
+	}
+
+	var attrs []byte
+	if len(u.nlri) > 0 || len(u.v6NLRI) > 0 {
+		attrs = appendAttr(attrs, attrFlagTransit, attrOrigin, []byte{originIGP})
+
+		var asPath []byte
+		if len(u.asPath) > 0 {
+			asPath = append(asPath, asPathSequence, byte(len(u.asPath)))
+			for _, asn := range u.asPath {
+				if fourOctet {
+					asPath = binary.BigEndian.AppendUint32(asPath, asn)
+				} else if asn > 0xffff {
+					asPath = binary.BigEndian.AppendUint16(asPath, asTrans)
+				} else {
+					asPath = binary.BigEndian.AppendUint16(asPath, uint16(asn))
+				}
+			}
+		}
+		attrs = appendAttr(attrs, attrFlagTransit, attrASPath, asPath)
+
+		if len(u.nlri) > 0 {
+			attrs = appendAttr(attrs, attrFlagTransit, attrNextHop, u.nextHop.To4())
+		}
+		if u.localPref != 0 {
+			attrs = appendAttr(attrs, attrFlagTransit, attrLocalPref, binary.BigEndian.AppendUint32(nil, u.localPref))
+		}
+	}
+	if len(u.v6NLRI) > 0 {
+		reach := []byte{0, afiIPv6, safiUnicast, net.IPv6len}
+		reach = append(reach, u.v6NextHop.To16()...)
+		reach = append(reach, 0)
+		for _, p := range u.v6NLRI {
+			reach = appendPrefix(reach, p)
+		}
+		attrs = appendAttr(attrs, attrFlagOptional, attrMPReachNLRI, reach)
+	}
+	if len(u.v6Withdrawn) > 0 {
+		unreach := []byte{0, afiIPv6, safiUnicast}
+		for _, p := range u.v6Withdrawn {
+			unreach = appendPrefix(unreach, p)
+		}
+		attrs = appendAttr(attrs, attrFlagOptional, attrMPUnreach, unreach)
+	}
+
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	for _, p := range u.nlri {
+		body = appendPrefix(body, p)
+	}
+	return marshalMessage(msgUpdate, body)
+}
+
+func appendAttr(b []byte, flags, attrType uint8, value []byte) []byte {
+	if len(value) > 0xff {
+		b = append(b, flags|attrFlagExtended, attrType)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	} else {
+		b = append(b, flags, attrType, byte(len(value)))
+	}
+	return append(b, value...)
+}
+
+func appendPrefix(b []byte, p *net.IPNet) []byte {
+	ones, _ := p.Mask.Size()
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	return append(append(b, byte(ones)), ip[:(ones+7)/8]...)
+}
+
+func parsePrefixes(b []byte, size int) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > size*8 || len(b) < 1+n {
+			return nil, &notificationMessage{code: errUpdateMessage, subcode: 10}
+		}
+		ip := make(net.IP, size)
+		copy(ip, b[1:1+n])
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, size*8)})
+		b = b[1+n:]
+	}
+	return prefixes, nil
+}
+
+// parseUpdate decodes an update. fourOctet tells whether the AS numbers of
+// the AS_PATH are encoded on 4 octets.
+func parseUpdate(body []byte, fourOctet bool) (*updateMessage, error) {
+	malformed := &notificationMessage{code: errUpdateMessage, subcode: 1}
+	if len(body) < 4 {
+		return nil, malformed
+	}
+	u := &updateMessage{}
+
+	withdrawnLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+withdrawnLen+2 {
+		return nil, malformed
+	}
+	var err error
+	if u.withdrawn, err = parsePrefixes(body[2:2+withdrawnLen], net.IPv4len); err != nil {
+		return nil, err
+	}
+	body = body[2+withdrawnLen:]
+
+	attrsLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+attrsLen {
+		return nil, malformed
+	}
+	attrs := body[2 : 2+attrsLen]
+	if u.nlri, err = parsePrefixes(body[2+attrsLen:], net.IPv4len); err != nil {
+		return nil, err
+	}
+
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, malformed
+		}
+		flags, attrType := attrs[0], attrs[1]
+		var value []byte
+		if flags&attrFlagExtended != 0 {
+			if len(attrs) < 4 {
+				return nil, malformed
+			}
+			l := int(binary.BigEndian.Uint16(attrs[2:]))
+			if len(attrs) < 4+l {
+				return nil, malformed
+			}
+			value, attrs = attrs[4:4+l], attrs[4+l:]
+		} else {
+			l := int(attrs[2])
+			if len(attrs) < 3+l {
+				return nil, malformed
+			}
+			value, attrs = attrs[3:3+l], attrs[3+l:]
+		}
+
+		switch attrType {
+		case attrNextHop:
+			if len(value) != net.IPv4len {
+				return nil, &notificationMessage{code: errUpdateMessage, subcode: 8}
+			}
+			u.nextHop = net.IP(append([]byte{}, value...))
+		case attrLocalPref:
+			if len(value) == 4 {
+				u.localPref = binary.BigEndian.Uint32(value)
+			}
+		case attrASPath:
+			if u.asPath, err = parseASPath(value, fourOctet); err != nil {
+				return nil, err
+			}
+		case attrMPReachNLRI:
+			if err := u.parseMPReach(value); err != nil {
+				return nil, err
+			}
+		case attrMPUnreach:
+			if len(value) < 3 {
+				return nil, malformed
+			}
+			if binary.BigEndian.Uint16(value) != afiIPv6 || value[2] != safiUnicast {
+				continue
+			}
+			if u.v6Withdrawn, err = parsePrefixes(value[3:], net.IPv6len); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(u.nlri) > 0 && u.nextHop == nil {
+		return nil, &notificationMessage{code: errUpdateMessage, subcode: 3, data: []byte{attrNextHop}}
+	}
+	return u, nil
+}
+
+func (u *updateMessage) parseMPReach(value []byte) error {
+	malformed := &notificationMessage{code: errUpdateMessage, subcode: 9}
+	if len(value) < 5 {
+		return malformed
+	}
+	if binary.BigEndian.Uint16(value) != afiIPv6 || value[2] != safiUnicast {
+		// Other families are not negotiated, ignore them
+		return nil
+	}
+	nextHopLen := int(value[3])
+	if len(value) < 4+nextHopLen+1 || nextHopLen < net.IPv6len {
+		return malformed
+	}
+	// With 32 octets, the second next hop is the link local one
+	u.v6NextHop = net.IP(append([]byte{}, value[4:4+net.IPv6len]...))
+	var err error
+	u.v6NLRI, err = parsePrefixes(value[4+nextHopLen+1:], net.IPv6len)
+	return err
+}
+
+func parseASPath(value []byte, fourOctet bool) ([]uint32, error) {
+	asLen := 2
+	if fourOctet {
+		asLen = 4
+	}
+	var path []uint32
+	for len(value) > 0 {
+		if len(value) < 2 {
+			return nil, &notificationMessage{code: errUpdateMessage, subcode: 11}
+		}
+		count := int(value[1])
+		if len(value) < 2+count*asLen {
+			return nil, &notificationMessage{code: errUpdateMessage, subcode: 11}
+		}
+		segment := value[2 : 2+count*asLen]
+		value = value[2+count*asLen:]
+		for i := 0; i < count; i++ {
+			if fourOctet {
+				path = append(path, binary.BigEndian.Uint32(segment[i*4:]))
+			} else {
+				path = append(path, uint32(binary.BigEndian.Uint16(segment[i*2:])))
+			}
+		}
+	}
+	return path, nil
+}
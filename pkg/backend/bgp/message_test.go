@@ -0,0 +1,146 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package bgp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOpenMessage(t *testing.T) {
+	for _, asn := range []uint32{64512, 4200000000} {
+		open := &openMessage{
+			asn:      asn,
+			holdTime: 90,
+			routerID: net.ParseIP("10.0.0.1"),
+			families: []family{ipv4Unicast, ipv6Unicast},
+		}
+		msgType, body, err := readMessage(bytes.NewReader(open.marshal()))
+		if err != nil {
+			t.Fatalf("readMessage() failed: %v", err)
+		}
+		if msgType != msgOpen {
+			t.Fatalf("unexpected message type %d", msgType)
+		}
+		parsed, err := parseOpen(body)
+		if err != nil {
+			t.Fatalf("parseOpen() failed: %v", err)
+		}
+		if parsed.asn != asn || parsed.holdTime != 90 || !parsed.routerID.Equal(net.ParseIP("10.0.0.1")) || !parsed.fourOctet {
+			t.Errorf("unexpected OPEN: %+v", parsed)
+		}
+		if !parsed.supports(ipv4Unicast) || !parsed.supports(ipv6Unicast) {
+			t.Errorf("unexpected families: %v", parsed.families)
+		}
+	}
+
+	// Without capabilities, the 2-octet AS and IPv4 unicast are used
+	body := []byte{bgpVersion, 0xfc, 0x00, 0, 180, 10, 0, 0, 2, 0}
+	parsed, err := parseOpen(body)
+	if err != nil {
+		t.Fatalf("parseOpen() failed: %v", err)
+	}
+	if parsed.asn != 64512 || parsed.fourOctet || !parsed.supports(ipv4Unicast) || parsed.supports(ipv6Unicast) {
+		t.Errorf("unexpected OPEN: %+v", parsed)
+	}
+
+	// Bad version
+	body[0] = 3
+	var n *notificationMessage
+	if _, err := parseOpen(body); !errors.As(err, &n) || n.code != errOpenMessage || n.subcode != errOpenBadVersion {
+		t.Errorf("unexpected error for a bad version: %v", err)
+	}
+}
+
+func TestUpdateMessage(t *testing.T) {
+	for _, fourOctet := range []bool{true, false} {
+		update := &updateMessage{
+			withdrawn:   []*net.IPNet{mustParseCIDR(t, "10.244.3.0/24")},
+			nlri:        []*net.IPNet{mustParseCIDR(t, "10.244.1.0/24"), mustParseCIDR(t, "10.245.0.0/16")},
+			nextHop:     net.ParseIP("192.168.0.1").To4(),
+			asPath:      []uint32{64512, 64513},
+			localPref:   100,
+			v6Withdrawn: []*net.IPNet{mustParseCIDR(t, "fd00:3::/64")},
+			v6NLRI:      []*net.IPNet{mustParseCIDR(t, "fd00:1::/64")},
+			v6NextHop:   net.ParseIP("fc00::1"),
+		}
+		msgType, body, err := readMessage(bytes.NewReader(update.marshal(fourOctet)))
+		if err != nil {
+			t.Fatalf("readMessage() failed: %v", err)
+		}
+		if msgType != msgUpdate {
+			t.Fatalf("unexpected message type %d", msgType)
+		}
+		parsed, err := parseUpdate(body, fourOctet)
+		if err != nil {
+			t.Fatalf("parseUpdate() failed: %v", err)
+		}
+		if !reflect.DeepEqual(parsed, update) {
+			t.Errorf("unexpected UPDATE:\n%+v\nexpected:\n%+v", parsed, update)
+		}
+	}
+
+	// 4-octet AS numbers are replaced with AS_TRANS for the peers without the capability
+	update := &updateMessage{
+		nlri:    []*net.IPNet{mustParseCIDR(t, "10.244.1.0/24")},
+		nextHop: net.ParseIP("192.168.0.1").To4(),
+		asPath:  []uint32{4200000000},
+	}
+	_, body, err := readMessage(bytes.NewReader(update.marshal(false)))
+	if err != nil {
+		t.Fatalf("readMessage() failed: %v", err)
+	}
+	parsed, err := parseUpdate(body, false)
+	if err != nil {
+		t.Fatalf("parseUpdate() failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed.asPath, []uint32{asTrans}) {
+		t.Errorf("unexpected AS path %v", parsed.asPath)
+	}
+
+	// NLRI without next hop
+	body = []byte{0, 0, 0, 0, 24, 10, 244, 1}
+	if _, err := parseUpdate(body, true); err == nil {
+		t.Errorf("parseUpdate() should fail without NEXT_HOP")
+	}
+
+	// Truncated prefix
+	body = []byte{0, 2, 24, 10, 0, 0}
+	if _, err := parseUpdate(body, true); err == nil {
+		t.Errorf("parseUpdate() should fail with a truncated prefix")
+	}
+}
+
+func TestReadMessageBadHeader(t *testing.T) {
+	msg := marshalKeepalive()
+	msg[0] = 0
+	var n *notificationMessage
+	if _, _, err := readMessage(bytes.NewReader(msg)); !errors.As(err, &n) || n.code != errMessageHeader {
+		t.Errorf("unexpected error for a bad marker: %v", err)
+	}
+}
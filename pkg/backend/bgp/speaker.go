@@ -0,0 +1,333 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "k8s.io/klog/v2"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	// openHoldTime is the hold time used until the OPEN messages are exchanged
+	openHoldTime = 4 * time.Minute
+	minBackoff   = time.Second
+	maxBackoff   = 30 * time.Second
+)
+
+// route is a route announced or withdrawn by a peer.
+type route struct {
+	prefix  *net.IPNet
+	nextHop net.IP
+}
+
+// speaker is a minimal BGP speaker. It opens a session with each of its peers,
+// announces the prefixes of the local node and reports the routes announced
+// by the peers. It never propagates the routes it learns.
+type speaker struct {
+	asn      uint32
+	routerID net.IP
+	holdTime time.Duration
+	peers    []PeerConfig
+
+	// prefix and v6Prefix are announced with nextHop and v6NextHop.
+	prefix    *net.IPNet
+	nextHop   net.IP
+	v6Prefix  *net.IPNet
+	v6NextHop net.IP
+
+	// onUpdate, when set, is called for every route announced (or withdrawn)
+	// by a peer. The routes of a peer are withdrawn when its session goes down.
+	onUpdate func(peer string, r route, withdrawn bool)
+}
+
+// Run maintains the sessions with the peers until the context is canceled.
+func (s *speaker) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, peer := range s.peers {
+		wg.Add(1)
+		go func() {
+			s.runSession(ctx, peer)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *speaker) runSession(ctx context.Context, peer PeerConfig) {
+	backoff := minBackoff
+	for {
+		learned := make(map[string]route)
+		established, err := s.session(ctx, peer, learned)
+		for _, r := range learned {
+			s.update(peer.Address, r, true)
+		}
+		if ctx.Err() != nil {
+			log.Infof("Closed BGP session with %s", peer.Address)
+			return
+		}
+		if established {
+			backoff = minBackoff
+		}
+		log.Warningf("BGP session with %s (AS %d) failed: %v, retrying in %v", peer.Address, peer.ASN, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (s *speaker) update(peer string, r route, withdrawn bool) {
+	if s.onUpdate != nil {
+		s.onUpdate(peer, r, withdrawn)
+	}
+}
+
+// session runs one BGP session with the peer. The routes announced by the
+// peer are recorded in learned, keyed by prefix. It returns when the session
+// fails or the context is canceled, established tells whether the session
+// reached the established state.
+func (s *speaker) session(ctx context.Context, peer PeerConfig, learned map[string]route) (established bool, err error) {
+	dialer := net.Dialer{Timeout: connectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(peer.Address, strconv.Itoa(peer.Port)))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// The keepalives are sent concurrently with the notifications
+	var writeMu sync.Mutex
+	write := func(msg []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := conn.Write(msg)
+		return err
+	}
+	notify := func(err error) error {
+		var n *notificationMessage
+		if errors.As(err, &n) {
+			_ = write(n.marshal())
+		}
+		return err
+	}
+
+	var families []family
+	if s.prefix != nil {
+		families = append(families, ipv4Unicast)
+	}
+	if s.v6Prefix != nil {
+		families = append(families, ipv6Unicast)
+	}
+	open := &openMessage{
+		asn:      s.asn,
+		holdTime: uint16(s.holdTime / time.Second),
+		routerID: s.routerID,
+		families: families,
+	}
+	if err := write(open.marshal()); err != nil {
+		return false, err
+	}
+
+	// OpenSent: wait for the OPEN of the peer
+	_ = conn.SetReadDeadline(time.Now().Add(openHoldTime))
+	peerOpen, err := readOpen(conn)
+	if err != nil {
+		return false, notify(err)
+	}
+	if peerOpen.asn != peer.ASN {
+		return false, notify(&notificationMessage{code: errOpenMessage, subcode: errOpenBadPeerAS})
+	}
+	holdTime := min(s.holdTime, time.Duration(peerOpen.holdTime)*time.Second)
+	if err := write(marshalKeepalive()); err != nil {
+		return false, err
+	}
+
+	// OpenConfirm: wait for the KEEPALIVE of the peer
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		return false, notify(err)
+	}
+	switch msgType {
+	case msgKeepalive:
+	case msgNotification:
+		return false, notificationError(body)
+	default:
+		return false, notify(&notificationMessage{code: errFSM})
+	}
+	log.Infof("BGP session with %s (AS %d) established, hold time %v", peer.Address, peer.ASN, holdTime)
+
+	// Established: announce the prefixes and keep the session alive
+	ibgp := peer.ASN == s.asn
+	for _, u := range s.announcements(peerOpen, ibgp) {
+		if err := write(u.marshal(peerOpen.fourOctet)); err != nil {
+			return true, err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if holdTime > 0 {
+		go func() {
+			ticker := time.NewTicker(holdTime / 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if err := write(marshalKeepalive()); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for {
+		if holdTime > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(holdTime))
+		} else {
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+		msgType, body, err := readMessage(conn)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return true, notify(&notificationMessage{code: errHoldTimer})
+			}
+			return true, notify(err)
+		}
+
+		switch msgType {
+		case msgKeepalive:
+		case msgUpdate:
+			u, err := parseUpdate(body, peerOpen.fourOctet)
+			if err != nil {
+				return true, notify(err)
+			}
+			s.handleUpdate(peer, u, ibgp, learned)
+		case msgNotification:
+			return true, notificationError(body)
+		default:
+			return true, notify(&notificationMessage{code: errFSM})
+		}
+	}
+}
+
+func readOpen(conn net.Conn) (*openMessage, error) {
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case msgOpen:
+		return parseOpen(body)
+	case msgNotification:
+		return nil, notificationError(body)
+	default:
+		return nil, &notificationMessage{code: errFSM}
+	}
+}
+
+// notificationError returns the error sent by the peer in a notification.
+func notificationError(body []byte) error {
+	n, err := parseNotification(body)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("received %v", n)
+}
+
+// announcements returns the updates announcing the local prefixes of the
+// families supported by the peer.
+func (s *speaker) announcements(peerOpen *openMessage, ibgp bool) []*updateMessage {
+	var asPath []uint32
+	var localPref uint32
+	if ibgp {
+		localPref = defaultLocalPref
+	} else {
+		asPath = []uint32{s.asn}
+	}
+
+	var updates []*updateMessage
+	if s.prefix != nil && peerOpen.supports(ipv4Unicast) {
+		updates = append(updates, &updateMessage{
+			nlri:      []*net.IPNet{s.prefix},
+			nextHop:   s.nextHop,
+			asPath:    asPath,
+			localPref: localPref,
+		})
+	}
+	if s.v6Prefix != nil && peerOpen.supports(ipv6Unicast) {
+		updates = append(updates, &updateMessage{
+			v6NLRI:    []*net.IPNet{s.v6Prefix},
+			v6NextHop: s.v6NextHop,
+			asPath:    asPath,
+			localPref: localPref,
+		})
+	}
+	return updates
+}
+
+func (s *speaker) handleUpdate(peer PeerConfig, u *updateMessage, ibgp bool, learned map[string]route) {
+	s.withdraw(peer, append(u.withdrawn, u.v6Withdrawn...), learned)
+
+	if !ibgp {
+		for _, asn := range u.asPath {
+			if asn == s.asn {
+				log.V(2).Infof("Ignoring routes from %s looping through AS %d", peer.Address, s.asn)
+				// The update replaces the routes previously learned for
+				// its prefixes, they're withdrawn
+				s.withdraw(peer, append(u.nlri, u.v6NLRI...), learned)
+				return
+			}
+		}
+	}
+
+	for _, prefix := range u.nlri {
+		r := route{prefix: prefix, nextHop: u.nextHop}
+		learned[prefix.String()] = r
+		s.update(peer.Address, r, false)
+	}
+	for _, prefix := range u.v6NLRI {
+		r := route{prefix: prefix, nextHop: u.v6NextHop}
+		learned[prefix.String()] = r
+		s.update(peer.Address, r, false)
+	}
+}
+
+// withdraw removes the routes learned from the peer for the prefixes.
+func (s *speaker) withdraw(peer PeerConfig, prefixes []*net.IPNet, learned map[string]route) {
+	for _, prefix := range prefixes {
+		if r, ok := learned[prefix.String()]; ok {
+			delete(learned, prefix.String())
+			s.update(peer.Address, r, true)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package bgp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+)
+
+type routeUpdate struct {
+	peer      string
+	route     route
+	withdrawn bool
+}
+
+// fakePeer accepts a BGP session from the speaker and plays the role of a
+// router in AS asn.
+type fakePeer struct {
+	t        *testing.T
+	listener net.Listener
+	asn      uint32
+}
+
+func newFakePeer(t *testing.T, asn uint32) *fakePeer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return &fakePeer{t: t, listener: l, asn: asn}
+}
+
+func (p *fakePeer) config() PeerConfig {
+	return PeerConfig{
+		Address: "127.0.0.1",
+		ASN:     p.asn,
+		Port:    p.listener.Addr().(*net.TCPAddr).Port,
+	}
+}
+
+// accept waits for the speaker and goes through the OPEN exchange. It returns
+// the connection and the OPEN of the speaker.
+func (p *fakePeer) accept() (net.Conn, *openMessage) {
+	conn, err := p.listener.Accept()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	open, err := readOpen(conn)
+	if err != nil {
+		p.t.Fatalf("failed to read OPEN: %v", err)
+	}
+	reply := &openMessage{
+		asn:      p.asn,
+		holdTime: 30,
+		routerID: net.ParseIP("10.0.0.254"),
+		families: []family{ipv4Unicast, ipv6Unicast},
+	}
+	if _, err := conn.Write(reply.marshal()); err != nil {
+		p.t.Fatal(err)
+	}
+	if _, err := conn.Write(marshalKeepalive()); err != nil {
+		p.t.Fatal(err)
+	}
+	if msgType, _ := p.read(conn); msgType != msgKeepalive {
+		p.t.Fatalf("expected a KEEPALIVE, got message %d", msgType)
+	}
+	return conn, open
+}
+
+func (p *fakePeer) read(conn net.Conn) (uint8, []byte) {
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		p.t.Fatalf("failed to read message: %v", err)
+	}
+	return msgType, body
+}
+
+func (p *fakePeer) readUpdate(conn net.Conn) *updateMessage {
+	for {
+		msgType, body := p.read(conn)
+		if msgType == msgKeepalive {
+			continue
+		}
+		if msgType != msgUpdate {
+			p.t.Fatalf("expected an UPDATE, got message %d", msgType)
+		}
+		u, err := parseUpdate(body, true)
+		if err != nil {
+			p.t.Fatalf("failed to parse UPDATE: %v", err)
+		}
+		return u
+	}
+}
+
+func newTestSpeaker(t *testing.T, asn uint32, peers ...PeerConfig) (*speaker, chan routeUpdate) {
+	updates := make(chan routeUpdate, 10)
+	s := &speaker{
+		asn:       asn,
+		routerID:  net.ParseIP("10.0.0.1").To4(),
+		holdTime:  90 * time.Second,
+		peers:     peers,
+		prefix:    mustParseCIDR(t, "10.244.1.0/24"),
+		nextHop:   net.ParseIP("192.168.0.1"),
+		v6Prefix:  mustParseCIDR(t, "fd00:1::/64"),
+		v6NextHop: net.ParseIP("fc00::1"),
+		onUpdate: func(peer string, r route, withdrawn bool) {
+			updates <- routeUpdate{peer: peer, route: r, withdrawn: withdrawn}
+		},
+	}
+	return s, updates
+}
+
+func expectUpdate(t *testing.T, updates chan routeUpdate, prefix string, withdrawn bool) routeUpdate {
+	select {
+	case u := <-updates:
+		if u.route.prefix.String() != prefix || u.withdrawn != withdrawn {
+			t.Fatalf("unexpected route update %+v, expected %s (withdrawn=%v)", u, prefix, withdrawn)
+		}
+		return u
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the route update of %s", prefix)
+	}
+	return routeUpdate{}
+}
+
+func TestSpeakerEBGP(t *testing.T) {
+	peer := newFakePeer(t, 64513)
+	s, updates := newTestSpeaker(t, 64512, peer.config())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, open := peer.accept()
+	if open.asn != 64512 || !open.routerID.Equal(net.ParseIP("10.0.0.1")) || !open.supports(ipv6Unicast) {
+		t.Errorf("unexpected OPEN from the speaker: %+v", open)
+	}
+
+	// The speaker announces the subnets of the node
+	u := peer.readUpdate(conn)
+	if len(u.nlri) != 1 || u.nlri[0].String() != "10.244.1.0/24" || !u.nextHop.Equal(net.ParseIP("192.168.0.1")) {
+		t.Errorf("unexpected IPv4 announcement: %+v", u)
+	}
+	if len(u.asPath) != 1 || u.asPath[0] != 64512 || u.localPref != 0 {
+		t.Errorf("unexpected eBGP attributes: %+v", u)
+	}
+	u = peer.readUpdate(conn)
+	if len(u.v6NLRI) != 1 || u.v6NLRI[0].String() != "fd00:1::/64" || !u.v6NextHop.Equal(net.ParseIP("fc00::1")) {
+		t.Errorf("unexpected IPv6 announcement: %+v", u)
+	}
+
+	// The routes of the peer are reported
+	announce := &updateMessage{
+		nlri:    []*net.IPNet{mustParseCIDR(t, "10.244.2.0/24")},
+		nextHop: net.ParseIP("192.168.0.2").To4(),
+		asPath:  []uint32{64513},
+	}
+	if _, err := conn.Write(announce.marshal(true)); err != nil {
+		t.Fatal(err)
+	}
+	r := expectUpdate(t, updates, "10.244.2.0/24", false)
+	if r.peer != "127.0.0.1" || !r.route.nextHop.Equal(net.ParseIP("192.168.0.2")) {
+		t.Errorf("unexpected route update %+v", r)
+	}
+
+	// Routes looping through the AS of the speaker are ignored, and replace
+	// the routes learned before for their prefixes
+	loop := &updateMessage{
+		nlri:    []*net.IPNet{mustParseCIDR(t, "10.244.3.0/24"), mustParseCIDR(t, "10.244.2.0/24")},
+		nextHop: net.ParseIP("192.168.0.3").To4(),
+		asPath:  []uint32{64513, 64512},
+	}
+	if _, err := conn.Write(loop.marshal(true)); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, updates, "10.244.2.0/24", true)
+
+	if _, err := conn.Write(announce.marshal(true)); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, updates, "10.244.2.0/24", false)
+	withdraw := &updateMessage{withdrawn: []*net.IPNet{mustParseCIDR(t, "10.244.2.0/24")}}
+	if _, err := conn.Write(withdraw.marshal(true)); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, updates, "10.244.2.0/24", true)
+
+	// The routes of the peer are withdrawn when the session goes down
+	if _, err := conn.Write(announce.marshal(true)); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, updates, "10.244.2.0/24", false)
+	conn.Close()
+	expectUpdate(t, updates, "10.244.2.0/24", true)
+
+	// And the speaker reconnects
+	conn, _ = peer.accept()
+	peer.readUpdate(conn)
+}
+
+func TestSpeakerIBGP(t *testing.T) {
+	peer := newFakePeer(t, 64512)
+	s, _ := newTestSpeaker(t, 64512, peer.config())
+	s.v6Prefix = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, open := peer.accept()
+	if open.supports(ipv6Unicast) {
+		t.Errorf("the speaker should not negotiate IPv6 without IPv6 prefix: %+v", open)
+	}
+	u := peer.readUpdate(conn)
+	if len(u.asPath) != 0 || u.localPref != defaultLocalPref {
+		t.Errorf("unexpected iBGP attributes: %+v", u)
+	}
+}
+
+func TestSpeakerBadPeerAS(t *testing.T) {
+	peer := newFakePeer(t, 64513)
+	config := peer.config()
+	config.ASN = 64514
+	s, _ := newTestSpeaker(t, 64512, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.session(ctx, config, map[string]route{})
+		result <- err
+	}()
+
+	conn, err := peer.listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := readOpen(conn); err != nil {
+		t.Fatal(err)
+	}
+	reply := &openMessage{asn: 64513, holdTime: 30, routerID: net.ParseIP("10.0.0.254")}
+	if _, err := conn.Write(reply.marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	msgType, body := peer.read(conn)
+	if msgType != msgNotification {
+		t.Fatalf("expected a NOTIFICATION, got message %d", msgType)
+	}
+	if n, err := parseNotification(body); err != nil || n.code != errOpenMessage || n.subcode != errOpenBadPeerAS {
+		t.Errorf("unexpected notification %v (%v)", n, err)
+	}
+	if err := <-result; err == nil {
+		t.Errorf("the session should have failed")
+	}
+}
+
+func TestHandleRoute(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: mustParseCIDR(t, "192.168.0.1/24")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &subnet.Config{
+		EnableIPv4: true,
+		Network:    ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.0.0")), PrefixLen: 16},
+		SubnetLen:  24,
+	}
+	n := &network{config: config, learned: make(map[string]learnedRoute), announced: make(map[string]map[string]route)}
+	n.SubnetLease = &lease.Lease{
+		Subnet:     ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.1.0")), PrefixLen: 24},
+		EnableIPv4: true,
+	}
+
+	listRoutes := func() []netlink.Route {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: mustParseCIDR(t, "10.244.2.0/24")}, netlink.RT_FILTER_DST)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return routes
+	}
+
+	r := route{prefix: mustParseCIDR(t, "10.244.2.0/24"), nextHop: net.ParseIP("192.168.0.2")}
+	n.handleRoute("peer1", r, false)
+	routes := listRoutes()
+	if len(routes) != 1 || !routes[0].Gw.Equal(net.ParseIP("192.168.0.2")) {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	// A withdraw from another peer doesn't remove the route
+	n.handleRoute("peer2", r, true)
+	if routes := listRoutes(); len(routes) != 1 {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+	n.handleRoute("peer1", r, true)
+	if routes := listRoutes(); len(routes) != 0 {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	// The route stays through the other peer announcing it when a peer
+	// withdraws it
+	n.handleRoute("peer1", r, false)
+	n.handleRoute("peer2", route{prefix: r.prefix, nextHop: net.ParseIP("192.168.0.3")}, false)
+	if routes := listRoutes(); len(routes) != 1 || !routes[0].Gw.Equal(net.ParseIP("192.168.0.2")) {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+	n.handleRoute("peer1", r, true)
+	if routes := listRoutes(); len(routes) != 1 || !routes[0].Gw.Equal(net.ParseIP("192.168.0.3")) {
+		t.Fatalf("the route wasn't moved to the remaining peer: %v", routes)
+	}
+	n.handleRoute("peer2", r, true)
+	if routes := listRoutes(); len(routes) != 0 || len(n.announced) != 0 {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	// Routes outside of the flannel network, or to the local subnet, are ignored
+	n.handleRoute("peer1", route{prefix: mustParseCIDR(t, "10.0.0.0/24"), nextHop: net.ParseIP("192.168.0.2")}, false)
+	n.handleRoute("peer1", route{prefix: mustParseCIDR(t, "10.244.1.0/24"), nextHop: net.ParseIP("192.168.0.2")}, false)
+	if len(n.learned) != 0 {
+		t.Errorf("unexpected learned routes %v", n.learned)
+	}
+}
+
+func TestParseBGPConfig(t *testing.T) {
+	cfg, err := parseBGPConfig([]byte(`{"ASN":64512,"Peers":[{"Address":"192.168.0.254","ASN":64513}]}`))
+	if err != nil {
+		t.Fatalf("parseBGPConfig() failed: %v", err)
+	}
+	if cfg.HoldTime != defaultHoldTime || cfg.Peers[0].Port != defaultPort || cfg.LearnRoutes {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	for _, invalid := range []string{
+		`{"Peers":[{"Address":"192.168.0.254","ASN":64513}]}`,
+		`{"ASN":64512}`,
+		`{"ASN":64512,"Peers":[{"Address":"router","ASN":64513}]}`,
+		`{"ASN":64512,"Peers":[{"Address":"192.168.0.254"}]}`,
+		`{"ASN":64512,"RouterID":"fc00::1","Peers":[{"Address":"192.168.0.254","ASN":64513}]}`,
+		`{"ASN":64512,"HoldTime":2,"Peers":[{"Address":"192.168.0.254","ASN":64513}]}`,
+	} {
+		if _, err := parseBGPConfig([]byte(invalid)); err == nil {
+			t.Errorf("parseBGPConfig(%s) should have failed", invalid)
+		}
+	}
+}
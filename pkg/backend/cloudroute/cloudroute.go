@@ -0,0 +1,357 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloudroute implements the backends routing the subnets through the
+// route table of a cloud network. The route table has a route from the subnet
+// of each host to its instance, maintained from the lease events by every
+// host, so the routes of the hosts which left are removed by the others. Each
+// host also reconciles periodically the routes to its own instance with its
+// lease, restoring its missing routes and removing its routes to the other
+// subnets of the flannel networks. A cloud is supported by a CloudRouteProvider managing the routes with
+// the API of the cloud.
+package cloudroute
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"k8s.io/apimachinery/pkg/util/wait"
+	log "k8s.io/klog/v2"
+)
+
+// DefaultReconcileInterval is the default period of the reconciliation of the
+// route table.
+const DefaultReconcileInterval = 5 * time.Minute
+
+// reconcileJitter is the maximum factor of the interval added to each period,
+// so the hosts started together don't call the cloud API at the same time.
+const reconcileJitter = 0.2
+
+// Route is a route of the cloud route table.
+type Route struct {
+	// ID identifies the route in the cloud. It's set by ListRoutes and
+	// may be empty otherwise.
+	ID string
+	// Destination is the CIDR of the IPv4 or IPv6 subnet of a host.
+	Destination string
+	// Target is the identity of the instance of the host, as returned by
+	// Instance.
+	Target string
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("%s via %s", r.Destination, r.Target)
+}
+
+type CloudRouteProvider interface {
+	// Instance discovers the identity of the instance of this host, the
+	// target of the routes to its subnets.
+	Instance(ctx context.Context) (string, error)
+	// ListRoutes returns the routes of the route table managed by flannel.
+	ListRoutes(ctx context.Context) ([]Route, error)
+	// EnsureRoute creates the route if it doesn't exist, replacing the
+	// routes to the same destination through other targets.
+	EnsureRoute(ctx context.Context, route Route) error
+	// DeleteRoute removes the route to the destination through the target,
+	// if it exists. The routes to the destination through other targets are
+	// kept, the subnet may have been allocated to another host.
+	DeleteRoute(ctx context.Context, route Route) error
+}
+
+// leaseAttrs are the backend data of the leases.
+type leaseAttrs struct {
+	Instance string
+}
+
+type Network struct {
+	backend.SimpleNetwork
+	SM                subnet.Manager
+	Provider          CloudRouteProvider
+	BackendType       string
+	Config            *subnet.Config
+	ReconcileInterval time.Duration
+
+	// mu serializes the calls to the provider
+	mu sync.Mutex
+}
+
+// RegisterNetwork acquires the lease of the host, publishing its instance,
+// and ensures the routes to its subnets.
+func RegisterNetwork(ctx context.Context, sm subnet.Manager, extIface *backend.ExternalInterface, config *subnet.Config, backendType string, provider CloudRouteProvider) (*Network, error) {
+	instance, err := provider.Instance(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover the instance: %v", err)
+	}
+	log.Infof("Running on instance %s", instance)
+
+	data, err := json.Marshal(&leaseAttrs{Instance: instance})
+	if err != nil {
+		return nil, err
+	}
+	attrs := lease.LeaseAttrs{
+		PublicIP:    ip.FromIP(extIface.ExtAddr),
+		BackendType: backendType,
+		BackendData: data,
+	}
+	if config.EnableIPv6 {
+		if extIface.ExtV6Addr == nil {
+			return nil, fmt.Errorf("no IPv6 address on %s for the IPv6 routes", extIface.Iface.Name)
+		}
+		attrs.PublicIPv6 = ip.FromIP6(extIface.ExtV6Addr)
+	}
+
+	l, err := sm.AcquireLease(ctx, &attrs)
+	switch err {
+	case nil:
+
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	n := &Network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    extIface,
+		},
+		SM:                sm,
+		Provider:          provider,
+		BackendType:       backendType,
+		Config:            config,
+		ReconcileInterval: DefaultReconcileInterval,
+	}
+
+	// The pods of the host aren't reachable without the routes to its subnets
+	routes, err := LeaseRoutes(l)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		log.Infof("Ensuring the route %v", route)
+		if err := provider.EnsureRoute(ctx, route); err != nil {
+			return nil, fmt.Errorf("failed to create the route %v: %v", route, err)
+		}
+	}
+
+	return n, nil
+}
+
+// LeaseRoutes returns the routes to the subnets of a lease. The leases of the
+// hosts which don't publish their instance are routed to their public IP.
+func LeaseRoutes(l *lease.Lease) ([]Route, error) {
+	attrs := leaseAttrs{}
+	if len(l.Attrs.BackendData) > 0 {
+		if err := json.Unmarshal(l.Attrs.BackendData, &attrs); err != nil {
+			return nil, fmt.Errorf("error decoding the backend data of %s: %v", l.Subnet, err)
+		}
+	}
+	if len(attrs.Instance) == 0 {
+		attrs.Instance = l.Attrs.PublicIP.String()
+	}
+
+	var routes []Route
+	// The leases of etcd without the address families are IPv4 leases
+	if l.EnableIPv4 || !l.EnableIPv6 {
+		routes = append(routes, Route{Destination: l.Subnet.String(), Target: attrs.Instance})
+	}
+	if l.EnableIPv6 && l.IPv6Subnet.IP != nil {
+		routes = append(routes, Route{Destination: l.IPv6Subnet.String(), Target: attrs.Instance})
+	}
+	return routes, nil
+}
+
+func (n *Network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.Info("Watching for new subnet leases")
+	evts := make(chan []lease.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.SM, n.SubnetLease, evts)
+		wg.Done()
+	}()
+
+	defer wg.Wait()
+
+	timer := time.NewTimer(n.reconcileInterval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case evtBatch, ok := <-evts:
+			if !ok {
+				log.Infof("evts chan closed")
+				return
+			}
+			n.handleSubnetEvents(ctx, evtBatch)
+
+		case <-timer.C:
+			n.mu.Lock()
+			n.reconcile(ctx)
+			n.mu.Unlock()
+			timer.Reset(n.reconcileInterval())
+		}
+	}
+}
+
+func (n *Network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
+	defer metrics.ObserveSubnetEvents(n.BackendType, time.Now())
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, evt := range batch {
+		if evt.Lease.Attrs.BackendType != n.BackendType {
+			log.Warningf("Ignoring non-%v subnet: type=%v", n.BackendType, evt.Lease.Attrs.BackendType)
+			continue
+		}
+
+		routes, err := LeaseRoutes(&evt.Lease)
+		if err != nil {
+			log.Error(err)
+			metrics.SubnetEventFailed(n.BackendType)
+			continue
+		}
+
+		if evt.Type != lease.EventAdded && evt.Type != lease.EventRemoved {
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+			continue
+		}
+
+		for _, route := range routes {
+			if evt.Type == lease.EventAdded {
+				log.Infof("Subnet added: %v", route)
+				err = n.Provider.EnsureRoute(ctx, route)
+			} else {
+				log.Infof("Subnet removed: %v", route)
+				err = n.Provider.DeleteRoute(ctx, route)
+			}
+
+			if err != nil {
+				log.Errorf("Failed to update the route %v: %v", route, err)
+				metrics.SubnetEventFailed(n.BackendType)
+			}
+		}
+	}
+}
+
+// reconcileInterval returns the period until the next reconciliation, with
+// jitter.
+func (n *Network) reconcileInterval() time.Duration {
+	interval := n.ReconcileInterval
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+	return wait.Jitter(interval, reconcileJitter)
+}
+
+// routeKey returns the route without ID and with its destination in the
+// canonical form.
+func routeKey(r Route) Route {
+	if _, dst, err := net.ParseCIDR(r.Destination); err == nil {
+		r.Destination = dst.String()
+	}
+	r.ID = ""
+	return r
+}
+
+// inNetworks returns true if the destination is a subnet of the flannel
+// networks.
+func (n *Network) inNetworks(destination string) bool {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil || n.Config == nil {
+		return false
+	}
+	if dst.IP.To4() != nil {
+		return n.Config.ContainsSubnet(ip.FromIPNet(dst))
+	}
+	return n.Config.ContainsIPv6Subnet(ip.FromIP6Net(dst))
+}
+
+// reconcile restores the routes of the lease of the host missing from the
+// route table and removes the other routes to its instance in the flannel
+// networks, left by a previous lease. The routes of the other hosts are
+// maintained by their own reconciliation and the lease events, so the hosts
+// don't remove the routes of the leases they don't know yet. It must be called
+// with n.mu held.
+func (n *Network) reconcile(ctx context.Context) {
+	own, err := LeaseRoutes(n.SubnetLease)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(own) == 0 {
+		return
+	}
+	target := own[0].Target
+
+	routes, err := n.Provider.ListRoutes(ctx)
+	if err != nil {
+		log.Errorf("Failed to list the routes: %v", err)
+		return
+	}
+
+	expected := map[Route]bool{}
+	for _, r := range own {
+		expected[routeKey(r)] = true
+	}
+	existing := map[Route]bool{}
+	restored, removed := 0, 0
+
+	for _, r := range routes {
+		key := routeKey(r)
+		existing[key] = true
+		if expected[key] || key.Target != target || !n.inNetworks(r.Destination) {
+			continue
+		}
+
+		log.Infof("Removing the stale route %v", r)
+		if err := n.Provider.DeleteRoute(ctx, r); err != nil {
+			log.Errorf("Failed to remove the stale route %v: %v", r, err)
+			continue
+		}
+		removed++
+	}
+
+	for r := range expected {
+		if existing[r] {
+			continue
+		}
+		log.Infof("Restoring the route %v", r)
+		if err := n.Provider.EnsureRoute(ctx, r); err != nil {
+			log.Errorf("Failed to restore the route %v: %v", r, err)
+			continue
+		}
+		restored++
+	}
+
+	metrics.ReconcileRepaired(n.BackendType, "route", "restored", restored)
+	metrics.ReconcileRepaired(n.BackendType, "route", "removed", removed)
+	if restored > 0 || removed > 0 {
+		log.Infof("Reconciled the routes of the host: restored %d routes, removed %d routes", restored, removed)
+	} else {
+		log.V(4).Info("The routes of the host match its lease")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudroute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+func testLease(subnet, publicIP, instance string) lease.Lease {
+	l := lease.Lease{
+		EnableIPv4: true,
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4(subnet), PrefixLen: 24},
+		Attrs:      lease.LeaseAttrs{PublicIP: ip.MustParseIP4(publicIP), BackendType: "fake"},
+	}
+	if len(instance) > 0 {
+		l.Attrs.BackendData, _ = json.Marshal(&leaseAttrs{Instance: instance})
+	}
+	return l
+}
+
+func TestHandleSubnetEvents(t *testing.T) {
+	provider := newFakeProvider("i-1")
+	n := &Network{Provider: provider, BackendType: "fake"}
+	ctx := context.Background()
+
+	other := testLease("10.5.4.0", "192.168.0.4", "")
+	other.Attrs.BackendType = "vxlan"
+	n.handleSubnetEvents(ctx, []lease.Event{
+		{Type: lease.EventAdded, Lease: testLease("10.5.2.0", "192.168.0.2", "i-2")},
+		// A host without instance in its lease is routed to its public IP
+		{Type: lease.EventAdded, Lease: testLease("10.5.3.0", "192.168.0.3", "")},
+		{Type: lease.EventAdded, Lease: other},
+	})
+	expected := []Route{
+		{ID: "1", Destination: "10.5.2.0/24", Target: "i-2"},
+		{ID: "2", Destination: "10.5.3.0/24", Target: "192.168.0.3"},
+	}
+	if routes := provider.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("expected routes %v, got %v", expected, routes)
+	}
+
+	// The subnet moved to another instance before its removal was seen
+	n.handleSubnetEvents(ctx, []lease.Event{
+		{Type: lease.EventAdded, Lease: testLease("10.5.2.0", "192.168.0.5", "i-5")},
+		{Type: lease.EventRemoved, Lease: testLease("10.5.2.0", "192.168.0.2", "i-2")},
+		{Type: lease.EventRemoved, Lease: testLease("10.5.3.0", "192.168.0.3", "")},
+	})
+	expected = []Route{{ID: "3", Destination: "10.5.2.0/24", Target: "i-5"}}
+	if routes := provider.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("expected routes %v, got %v", expected, routes)
+	}
+
+	// The failures of the provider don't stop the other events
+	provider.SetError(errors.New("unavailable"))
+	n.handleSubnetEvents(ctx, []lease.Event{{Type: lease.EventRemoved, Lease: testLease("10.5.2.0", "192.168.0.5", "i-5")}})
+	provider.SetError(nil)
+	if routes := provider.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected routes %v, got %v", expected, routes)
+	}
+}
+
+func TestLeaseRoutes(t *testing.T) {
+	l := testLease("10.5.2.0", "192.168.0.2", "i-2")
+	l.EnableIPv6 = true
+	l.IPv6Subnet = ip.IP6Net{IP: ip.MustParseIP6("fc00:0:0:2::"), PrefixLen: 64}
+	routes, err := LeaseRoutes(&l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Route{{Destination: "10.5.2.0/24", Target: "i-2"}, {Destination: "fc00:0:0:2::/64", Target: "i-2"}}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected routes %v, got %v", expected, routes)
+	}
+
+	l.EnableIPv4 = false
+	if routes, err := LeaseRoutes(&l); err != nil || len(routes) != 1 || routes[0].Destination != "fc00:0:0:2::/64" {
+		t.Errorf("unexpected routes of the IPv6 only lease %v: %v", routes, err)
+	}
+
+	l.Attrs.BackendData = json.RawMessage(`"invalid"`)
+	if _, err := LeaseRoutes(&l); err == nil {
+		t.Errorf("the invalid backend data should be reported")
+	}
+}
+
+func testNetwork(provider CloudRouteProvider, own lease.Lease) *Network {
+	n := &Network{
+		Provider:    provider,
+		BackendType: "fake",
+		Config: &subnet.Config{
+			EnableIPv4: true,
+			Network:    ip.IP4Net{IP: ip.MustParseIP4("10.5.0.0"), PrefixLen: 16},
+		},
+	}
+	n.SubnetLease = &own
+	return n
+}
+
+func TestReconcile(t *testing.T) {
+	provider := newFakeProvider("i-1")
+	n := testNetwork(provider, testLease("10.5.1.0", "192.168.0.1", "i-1"))
+	ctx := context.Background()
+
+	// The route of the previous subnet of the host, the route of a host
+	// which isn't known yet, and a route of the host outside of the network
+	provider.AddRoute(Route{Destination: "10.5.9.0/24", Target: "i-1"})
+	provider.AddRoute(Route{Destination: "10.5.3.0/24", Target: "i-3"})
+	provider.AddRoute(Route{Destination: "10.6.0.0/24", Target: "i-1"})
+
+	n.mu.Lock()
+	n.reconcile(ctx)
+	n.mu.Unlock()
+	expected := []Route{
+		{ID: "4", Destination: "10.5.1.0/24", Target: "i-1"},
+		{ID: "2", Destination: "10.5.3.0/24", Target: "i-3"},
+		{ID: "3", Destination: "10.6.0.0/24", Target: "i-1"},
+	}
+	if routes := provider.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("expected routes %v, got %v", expected, routes)
+	}
+
+	// The provider errors are retried by the next reconciliation
+	provider.DeleteRoute(ctx, expected[0])
+	provider.SetError(errors.New("unavailable"))
+	n.mu.Lock()
+	n.reconcile(ctx)
+	n.mu.Unlock()
+	provider.SetError(nil)
+	n.mu.Lock()
+	n.reconcile(ctx)
+	n.mu.Unlock()
+	expected = []Route{
+		{ID: "5", Destination: "10.5.1.0/24", Target: "i-1"},
+		expected[1],
+		expected[2],
+	}
+	if routes := provider.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected routes %v, got %v", expected, routes)
+	}
+}
+
+func TestReconcileHosts(t *testing.T) {
+	provider := newFakeProvider("")
+	ctx := context.Background()
+
+	// The hosts share the route table, the second host starts while the
+	// first one doesn't know its lease
+	n1 := testNetwork(provider, testLease("10.5.1.0", "192.168.0.1", "i-1"))
+	n2 := testNetwork(provider, testLease("10.5.2.0", "192.168.0.2", "i-2"))
+	for _, n := range []*Network{n1, n2} {
+		routes, _ := LeaseRoutes(n.SubnetLease)
+		provider.EnsureRoute(ctx, routes[0])
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, n := range []*Network{n1, n2} {
+			n.mu.Lock()
+			n.reconcile(ctx)
+			n.mu.Unlock()
+		}
+	}
+	expected := []Route{
+		{ID: "1", Destination: "10.5.1.0/24", Target: "i-1"},
+		{ID: "2", Destination: "10.5.2.0/24", Target: "i-2"},
+	}
+	if routes := provider.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected routes %v, got %v", expected, routes)
+	}
+}
+
+func TestReconcileInterval(t *testing.T) {
+	n := &Network{ReconcileInterval: time.Minute}
+	for i := 0; i < 10; i++ {
+		interval := n.reconcileInterval()
+		if interval < time.Minute || interval > time.Minute+time.Minute/5 {
+			t.Fatalf("expected an interval between 1m and 1m12s, got %v", interval)
+		}
+	}
+
+	n.ReconcileInterval = 0
+	if interval := n.reconcileInterval(); interval < DefaultReconcileInterval {
+		t.Errorf("expected at least the default interval, got %v", interval)
+	}
+}
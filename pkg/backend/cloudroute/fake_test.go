@@ -0,0 +1,128 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudroute
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// fakeProvider is a CloudRouteProvider keeping the route table in memory, for
+// the tests.
+type fakeProvider struct {
+	InstanceID string
+
+	mu     sync.Mutex
+	routes []Route
+	nextID int
+	err    error
+}
+
+func newFakeProvider(instanceID string) *fakeProvider {
+	return &fakeProvider{InstanceID: instanceID}
+}
+
+// SetError makes the calls to the provider fail with err, until it's reset
+// with nil.
+func (p *fakeProvider) SetError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// AddRoute adds a route to the table as if it was created outside of
+// flannel.
+func (p *fakeProvider) AddRoute(route Route) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.add(route)
+}
+
+func (p *fakeProvider) add(route Route) {
+	p.nextID++
+	route.ID = strconv.Itoa(p.nextID)
+	p.routes = append(p.routes, route)
+}
+
+// Routes returns the routes of the table sorted by destination.
+func (p *fakeProvider) Routes() []Route {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	routes := append([]Route{}, p.routes...)
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Destination < routes[j].Destination })
+	return routes
+}
+
+func (p *fakeProvider) Instance(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.InstanceID, p.err
+}
+
+func (p *fakeProvider) ListRoutes(ctx context.Context) ([]Route, error) {
+	p.mu.Lock()
+	err := p.err
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return p.Routes(), nil
+}
+
+func (p *fakeProvider) EnsureRoute(ctx context.Context, route Route) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+
+	kept := p.routes[:0]
+	exists := false
+	for _, r := range p.routes {
+		if r.Destination == route.Destination {
+			if r.Target != route.Target || exists {
+				continue
+			}
+			exists = true
+		}
+		kept = append(kept, r)
+	}
+	p.routes = kept
+
+	if !exists {
+		p.add(route)
+	}
+	return nil
+}
+
+func (p *fakeProvider) DeleteRoute(ctx context.Context, route Route) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+
+	kept := p.routes[:0]
+	for _, r := range p.routes {
+		if r.Destination != route.Destination || r.Target != route.Target {
+			kept = append(kept, r)
+		}
+	}
+	p.routes = kept
+	return nil
+}
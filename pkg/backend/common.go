@@ -47,4 +47,14 @@ type Network interface {
 	Run(ctx context.Context)
 }
 
+// ReconfigurableNetwork is implemented by the networks that can apply a new
+// backend configuration without restarting flanneld.
+type ReconfigurableNetwork interface {
+	Network
+	// UpdateConfig applies the new configuration or returns an error if a
+	// setting cannot be changed at runtime. The non-backend fields of the
+	// config are guaranteed to be unchanged.
+	UpdateConfig(ctx context.Context, config *subnet.Config) error
+}
+
 type BackendCtor func(sm subnet.Manager, ei *ExternalInterface) (Backend, error)
@@ -23,6 +23,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/flannel-io/flannel/pkg/ip"
@@ -62,13 +63,17 @@ func (be *ExtensionBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGr
 	}
 
 	// Parse out configuration
+	cfg := struct {
+		Protocol            string
+		PreStartupCommand   string
+		PostStartupCommand  string
+		SubnetAddCommand    string
+		SubnetRemoveCommand string
+		PluginCommand       string
+		PluginSocket        string
+		PluginTimeout       int
+	}{}
 	if len(config.Backend) > 0 {
-		cfg := struct {
-			PreStartupCommand   string
-			PostStartupCommand  string
-			SubnetAddCommand    string
-			SubnetRemoveCommand string
-		}{}
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
 			return nil, fmt.Errorf("error decoding backend config: %v", err)
 		}
@@ -78,6 +83,24 @@ func (be *ExtensionBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGr
 		n.subnetRemoveCommand = cfg.SubnetRemoveCommand
 	}
 
+	switch cfg.Protocol {
+	case "", protocolV1:
+	case protocolV2:
+		if len(n.preStartupCommand) > 0 || len(n.postStartupCommand) > 0 || len(n.subnetAddCommand) > 0 || len(n.subnetRemoveCommand) > 0 {
+			return nil, fmt.Errorf("the commands of the v1 protocol can't be used with the v2 protocol")
+		}
+		if len(strings.Fields(cfg.PluginCommand)) == 0 && len(cfg.PluginSocket) == 0 {
+			return nil, fmt.Errorf("the v2 protocol requires PluginCommand or PluginSocket")
+		}
+		timeout := defaultPluginTimeout
+		if cfg.PluginTimeout > 0 {
+			timeout = time.Duration(cfg.PluginTimeout) * time.Second
+		}
+		return be.registerPluginNetwork(ctx, config, newPluginClient(cfg.PluginCommand, cfg.PluginSocket, timeout))
+	default:
+		return nil, fmt.Errorf("unknown extension protocol %q", cfg.Protocol)
+	}
+
 	data := []byte{}
 	if len(n.preStartupCommand) > 0 {
 		preArgs := strings.Fields(n.preStartupCommand)
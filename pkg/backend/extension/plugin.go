@@ -0,0 +1,331 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extension
+
+// The v2 protocol talks to a single long-running plugin instead of running a
+// command per event. flannel sends one JSON request per line and waits for the
+// response with the same id before sending the next one:
+//
+//   - init, with the network configuration, when the plugin starts. The
+//     response may set the backend data of the lease and the MTU.
+//   - configure, with the lease of the host once it's acquired.
+//   - sync, with all the leases of the remote hosts, after configure and when a
+//     failed request is retried. The plugin removes the state of the other hosts.
+//   - events, with the leases added and removed.
+//
+// The messages go through the stdin and stdout of the plugin, or through a
+// unix socket on which the plugin listens.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	protocolV1 = "v1"
+	protocolV2 = "v2"
+
+	requestInit      = "init"
+	requestConfigure = "configure"
+	requestSync      = "sync"
+	requestEvents    = "events"
+
+	defaultPluginTimeout = 10 * time.Second
+	// maxMessageSize is the maximum size of a response of the plugin
+	maxMessageSize = 1024 * 1024
+	dialInterval   = 100 * time.Millisecond
+)
+
+type request struct {
+	ID     uint64        `json:"id"`
+	Type   string        `json:"type"`
+	Config *pluginConfig `json:"config,omitempty"`
+	Lease  *lease.Lease  `json:"lease,omitempty"`
+	Leases []lease.Lease `json:"leases,omitempty"`
+	Events []pluginEvent `json:"events,omitempty"`
+}
+
+// pluginConfig is the network configuration sent in the init request.
+type pluginConfig struct {
+	EnableIPv4  bool      `json:"enableIPv4"`
+	EnableIPv6  bool      `json:"enableIPv6"`
+	Network     ip.IP4Net `json:"network"`
+	IPv6Network ip.IP6Net `json:"ipv6Network"`
+	PublicIP    *ip.IP4   `json:"publicIP,omitempty"`
+	PublicIPv6  *ip.IP6   `json:"publicIPv6,omitempty"`
+	MTU         int       `json:"mtu"`
+}
+
+type pluginEvent struct {
+	Type  string      `json:"type"`
+	Lease lease.Lease `json:"lease"`
+}
+
+type response struct {
+	ID    uint64 `json:"id"`
+	Error string `json:"error,omitempty"`
+	// BackendData, BackendV6Data and MTU are only read from the response to
+	// init
+	BackendData   json.RawMessage `json:"backendData,omitempty"`
+	BackendV6Data json.RawMessage `json:"backendV6Data,omitempty"`
+	MTU           int             `json:"mtu,omitempty"`
+}
+
+// pluginError is an error reported by the plugin in its response, the plugin
+// is still running.
+type pluginError struct {
+	requestType string
+	message     string
+}
+
+func (e *pluginError) Error() string {
+	return fmt.Sprintf("extension plugin failed the %s request: %s", e.requestType, e.message)
+}
+
+// pluginClient runs the plugin and sends it the requests. It isn't safe for
+// concurrent use.
+type pluginClient struct {
+	command string
+	socket  string
+	timeout time.Duration
+
+	cmd       *exec.Cmd
+	w         io.WriteCloser
+	responses chan *response
+	// done is closed when the plugin closes its output, and closing when
+	// flannel stops the plugin
+	done    chan struct{}
+	closing chan struct{}
+	nextID  uint64
+}
+
+func newPluginClient(command, socket string, timeout time.Duration) *pluginClient {
+	return &pluginClient{
+		command: command,
+		socket:  socket,
+		timeout: timeout,
+	}
+}
+
+// start runs the plugin command, if any, and connects to the plugin.
+func (c *pluginClient) start(ctx context.Context) error {
+	var r io.Reader
+
+	if args := strings.Fields(c.command); len(args) > 0 {
+		args = expandVars(buildEnvMap(nil), args)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = os.Environ()
+		cmd.Stderr = pluginLogWriter{}
+		// Don't wait for the processes started by the plugin which keep its
+		// output open
+		cmd.WaitDelay = c.timeout
+		if len(c.socket) > 0 {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("FLANNEL_PLUGIN_SOCKET=%s", c.socket))
+			cmd.Stdout = pluginLogWriter{}
+		} else {
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				return err
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				return err
+			}
+			c.w, r = stdin, stdout
+		}
+
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("failed to start the extension plugin %q: %v", c.command, err)
+		}
+		log.Infof("Started the extension plugin %q, pid %d", c.command, cmd.Process.Pid)
+		c.cmd = cmd
+	}
+
+	if len(c.socket) > 0 {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			c.stop()
+			return err
+		}
+		c.w, r = conn, conn
+	}
+
+	c.responses = make(chan *response)
+	c.done = make(chan struct{})
+	c.closing = make(chan struct{})
+	go c.read(r, c.responses, c.done, c.closing)
+	return nil
+}
+
+// dial connects to the socket of the plugin, which may not listen yet if the
+// plugin was just started.
+func (c *pluginClient) dial(ctx context.Context) (net.Conn, error) {
+	deadline := time.Now().Add(c.timeout)
+	for {
+		conn, err := net.DialTimeout("unix", c.socket, c.timeout)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to connect to the extension plugin on %s: %v", c.socket, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(dialInterval):
+		}
+	}
+}
+
+func (c *pluginClient) read(r io.Reader, responses chan<- *response, done, closing chan struct{}) {
+	defer close(done)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		resp := &response{}
+		if err := json.Unmarshal(scanner.Bytes(), resp); err != nil {
+			log.Warningf("Ignoring invalid message from the extension plugin: %v", err)
+			continue
+		}
+
+		select {
+		case responses <- resp:
+		case <-closing:
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Warningf("Failed to read from the extension plugin: %v", err)
+	}
+}
+
+// exited returns a channel closed when the plugin stops responding, nil if the
+// plugin isn't started.
+func (c *pluginClient) exited() <-chan struct{} {
+	return c.done
+}
+
+// call sends a request to the plugin and waits for its response. The errors
+// other than pluginError mean that the plugin must be restarted.
+func (c *pluginClient) call(ctx context.Context, req *request) (*response, error) {
+	if c.w == nil {
+		return nil, fmt.Errorf("extension plugin isn't running")
+	}
+
+	c.nextID++
+	req.ID = c.nextID
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+
+	// The write blocks if the plugin doesn't read its input
+	w := c.w
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		writeErr <- err
+	}()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-writeErr:
+			if err != nil {
+				return nil, fmt.Errorf("failed to send the %s request to the extension plugin: %v", req.Type, err)
+			}
+			writeErr = nil
+		case resp := <-c.responses:
+			if resp.ID != req.ID {
+				log.Warningf("Ignoring the response of the extension plugin to request %d, expecting %d", resp.ID, req.ID)
+				continue
+			}
+			if len(resp.Error) > 0 {
+				return resp, &pluginError{requestType: req.Type, message: resp.Error}
+			}
+			return resp, nil
+		case <-c.done:
+			return nil, fmt.Errorf("extension plugin exited during the %s request", req.Type)
+		case <-timer.C:
+			return nil, fmt.Errorf("timed out waiting for the extension plugin to acknowledge the %s request", req.Type)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// stop closes the connection to the plugin and waits for the plugin to exit,
+// killing it after the timeout.
+func (c *pluginClient) stop() {
+	if c.closing != nil {
+		close(c.closing)
+	}
+	if c.w != nil {
+		if err := c.w.Close(); err != nil {
+			log.Warningf("Failed to close the connection to the extension plugin: %v", err)
+		}
+	}
+
+	if c.cmd != nil {
+		exited := make(chan error, 1)
+		go func() {
+			exited <- c.cmd.Wait()
+		}()
+
+		select {
+		case err := <-exited:
+			log.Infof("Extension plugin exited: %v", err)
+		case <-time.After(c.timeout):
+			log.Warningf("Extension plugin didn't exit after closing its input, killing it")
+			if err := c.cmd.Process.Kill(); err != nil {
+				log.Errorf("Failed to kill the extension plugin: %v", err)
+			}
+			<-exited
+		}
+	}
+
+	c.cmd = nil
+	c.w = nil
+	c.responses = nil
+	c.done = nil
+	c.closing = nil
+}
+
+// pluginLogWriter logs the output of the plugin which isn't part of the
+// protocol.
+type pluginLogWriter struct{}
+
+func (pluginLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Infof("extension plugin: %s", line)
+	}
+	return len(p), nil
+}
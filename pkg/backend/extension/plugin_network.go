@@ -0,0 +1,270 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extension
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+)
+
+// pluginNetwork is the network of the v2 protocol.
+type pluginNetwork struct {
+	extIface *backend.ExternalInterface
+	sm       subnet.Manager
+	config   *subnet.Config
+	plugin   *pluginClient
+	lease    *lease.Lease
+	mtu      int
+	// leases are the leases of the remote hosts, keyed by subnet, sent to
+	// the plugin again when it restarts
+	leases map[string]lease.Lease
+}
+
+func (be *ExtensionBackend) registerPluginNetwork(ctx context.Context, config *subnet.Config, plugin *pluginClient) (backend.Network, error) {
+	n := &pluginNetwork{
+		extIface: be.extIface,
+		sm:       be.sm,
+		config:   config,
+		plugin:   plugin,
+		mtu:      be.extIface.Iface.MTU,
+		leases:   make(map[string]lease.Lease),
+	}
+
+	attrs := lease.LeaseAttrs{
+		BackendType: "extension",
+	}
+	if be.extIface.IfaceAddr != nil {
+		attrs.PublicIP = ip.FromIP(be.extIface.IfaceAddr)
+	}
+	if be.extIface.IfaceV6Addr != nil {
+		attrs.PublicIPv6 = ip.FromIP6(be.extIface.IfaceV6Addr)
+	}
+
+	if err := plugin.start(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := n.init(ctx, &attrs)
+	if err != nil {
+		plugin.stop()
+		return nil, err
+	}
+	attrs.BackendData = resp.BackendData
+	attrs.BackendV6Data = resp.BackendV6Data
+
+	l, err := be.sm.AcquireLease(ctx, &attrs)
+	switch err {
+	case nil:
+		n.lease = l
+
+	case context.Canceled, context.DeadlineExceeded:
+		plugin.stop()
+		return nil, err
+
+	default:
+		plugin.stop()
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	if err := n.configure(ctx); err != nil {
+		plugin.stop()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *pluginNetwork) Lease() *lease.Lease {
+	return n.lease
+}
+
+func (n *pluginNetwork) MTU() int {
+	return n.mtu
+}
+
+// init sends the init request and sets the MTU of the network.
+func (n *pluginNetwork) init(ctx context.Context, attrs *lease.LeaseAttrs) (*response, error) {
+	cfg := &pluginConfig{
+		EnableIPv4:  n.config.EnableIPv4,
+		EnableIPv6:  n.config.EnableIPv6,
+		Network:     n.config.Network,
+		IPv6Network: n.config.IPv6Network,
+		PublicIPv6:  attrs.PublicIPv6,
+		MTU:         n.extIface.Iface.MTU,
+	}
+	if n.extIface.IfaceAddr != nil {
+		cfg.PublicIP = &attrs.PublicIP
+	}
+
+	resp, err := n.plugin.call(ctx, &request{Type: requestInit, Config: cfg})
+	if err != nil {
+		return nil, err
+	}
+	if resp.MTU > 0 {
+		n.mtu = resp.MTU
+	}
+	return resp, nil
+}
+
+func (n *pluginNetwork) configure(ctx context.Context) error {
+	_, err := n.plugin.call(ctx, &request{Type: requestConfigure, Lease: n.lease})
+	return err
+}
+
+// sync sends all the remote leases to the plugin, after restarting it if
+// restart is set.
+func (n *pluginNetwork) sync(ctx context.Context, restart bool) error {
+	if restart {
+		n.plugin.stop()
+		if err := n.plugin.start(ctx); err != nil {
+			return err
+		}
+
+		resp, err := n.init(ctx, &n.lease.Attrs)
+		if err != nil {
+			return err
+		}
+		// The lease isn't acquired again, the other hosts keep the
+		// backend data of the first start
+		if !bytes.Equal(resp.BackendData, n.lease.Attrs.BackendData) || !bytes.Equal(resp.BackendV6Data, n.lease.Attrs.BackendV6Data) {
+			log.Warningf("Extension plugin returned new backend data after its restart, ignoring it")
+		}
+		if err := n.configure(ctx); err != nil {
+			return err
+		}
+	}
+
+	leases := make([]lease.Lease, 0, len(n.leases))
+	for _, l := range n.leases {
+		leases = append(leases, l)
+	}
+	_, err := n.plugin.call(ctx, &request{Type: requestSync, Leases: leases})
+	return err
+}
+
+func (n *pluginNetwork) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.Info("Watching for new subnet leases")
+	evts := make(chan []lease.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.sm, n.lease, evts)
+		wg.Done()
+	}()
+
+	defer func() {
+		n.plugin.stop()
+		wg.Wait()
+	}()
+
+	// retry is set until the plugin has the current leases, initially and
+	// once a request failed. The plugin is restarted if it didn't respond.
+	retry := time.After(0)
+	restart := false
+	retryInterval := minRetryInterval
+	for {
+		var exited <-chan struct{}
+		if retry == nil {
+			exited = n.plugin.exited()
+		}
+
+		var err error
+		select {
+		case evtBatch, ok := <-evts:
+			if !ok {
+				log.Infof("evts chan closed")
+				return
+			}
+			events := n.track(evtBatch)
+			if retry != nil || len(events) == 0 {
+				// The leases are sent by the next sync
+				continue
+			}
+			_, err = n.plugin.call(ctx, &request{Type: requestEvents, Events: events})
+
+		case <-exited:
+			err = errors.New("extension plugin exited")
+
+		case <-retry:
+			err = n.sync(ctx, restart)
+		}
+
+		switch {
+		case err == nil:
+			retry = nil
+			restart = false
+			retryInterval = minRetryInterval
+		case ctx.Err() != nil:
+			// Shutting down, wait for the watch to end
+		default:
+			var pe *pluginError
+			restart = restart || !errors.As(err, &pe)
+			log.Errorf("%v, retrying in %v", err, retryInterval)
+			retry = time.After(retryInterval)
+			retryInterval = min(2*retryInterval, maxRetryInterval)
+		}
+	}
+}
+
+// track updates the remote leases and returns the events of the extension
+// leases.
+func (n *pluginNetwork) track(batch []lease.Event) []pluginEvent {
+	events := make([]pluginEvent, 0, len(batch))
+	for _, evt := range batch {
+		if evt.Lease.Attrs.BackendType != "extension" {
+			log.Warningf("Ignoring non-extension subnet: type=%v", evt.Lease.Attrs.BackendType)
+			continue
+		}
+
+		key := pluginLeaseKey(&evt.Lease)
+		switch evt.Type {
+		case lease.EventAdded:
+			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
+			n.leases[key] = evt.Lease
+		case lease.EventRemoved:
+			log.Info("Subnet removed: ", evt.Lease.Subnet)
+			delete(n.leases, key)
+		default:
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+			continue
+		}
+		events = append(events, pluginEvent{Type: evt.Type.String(), Lease: evt.Lease})
+	}
+	return events
+}
+
+// pluginLeaseKey returns the IPv4 subnet of a lease, or its IPv6 subnet in the
+// IPv6 only case, as the lease watcher.
+func pluginLeaseKey(l *lease.Lease) string {
+	if !l.EnableIPv4 && l.EnableIPv6 {
+		return l.IPv6Subnet.String()
+	}
+	return l.Subnet.String()
+}
@@ -0,0 +1,206 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extension
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+func TestPluginCommand(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat isn't available")
+	}
+
+	// cat acknowledges the requests by sending them back
+	c := newPluginClient("cat", "", 5*time.Second)
+	if err := c.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 2; i++ {
+		resp, err := c.call(context.Background(), &request{Type: requestSync})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != i {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	}
+
+	exited := c.exited()
+	c.stop()
+	select {
+	case <-exited:
+	default:
+		t.Errorf("the plugin is still running")
+	}
+	if _, err := c.call(context.Background(), &request{Type: requestSync}); err == nil {
+		t.Errorf("the stopped plugin shouldn't respond")
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep isn't available")
+	}
+
+	c := newPluginClient("sleep 30", "", 200*time.Millisecond)
+	if err := c.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.call(context.Background(), &request{Type: requestSync})
+	var pe *pluginError
+	if err == nil || errors.As(err, &pe) {
+		t.Errorf("the request should time out: %v", err)
+	}
+
+	// The plugin is killed as it ignores its input
+	start := time.Now()
+	c.stop()
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the plugin wasn't killed")
+	}
+}
+
+// fakePlugin listens on a unix socket, records the requests and fails the
+// events requests.
+func fakePlugin(t *testing.T, socket string) <-chan *request {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	requests := make(chan *request, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				req := &request{}
+				if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+					t.Error(err)
+					return
+				}
+				requests <- req
+
+				resp := response{ID: req.ID}
+				switch req.Type {
+				case requestInit:
+					resp.MTU = 1400
+					resp.BackendData = json.RawMessage(`"data"`)
+				case requestEvents:
+					resp.Error = "failed"
+				}
+				data, _ := json.Marshal(resp)
+				if _, err := conn.Write(append(data, '\n')); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return requests
+}
+
+func TestPluginNetwork(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "plugin.sock")
+	requests := fakePlugin(t, socket)
+
+	n := &pluginNetwork{
+		extIface: &backend.ExternalInterface{Iface: &net.Interface{MTU: 1500}},
+		config:   &subnet.Config{EnableIPv4: true, Network: ip.IP4Net{IP: ip.MustParseIP4("10.5.0.0"), PrefixLen: 16}},
+		plugin:   newPluginClient("", socket, 5*time.Second),
+		lease: &lease.Lease{
+			EnableIPv4: true,
+			Subnet:     ip.IP4Net{IP: ip.MustParseIP4("10.5.1.0"), PrefixLen: 24},
+			Attrs:      lease.LeaseAttrs{BackendType: "extension", BackendData: json.RawMessage(`"data"`)},
+		},
+		leases: make(map[string]lease.Lease),
+	}
+	defer n.plugin.stop()
+
+	remote := lease.Lease{
+		EnableIPv4: true,
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4("10.5.2.0"), PrefixLen: 24},
+		Attrs:      lease.LeaseAttrs{BackendType: "extension", PublicIP: ip.MustParseIP4("192.168.0.2")},
+	}
+	other := remote
+	other.Subnet = ip.IP4Net{IP: ip.MustParseIP4("10.5.3.0"), PrefixLen: 24}
+	other.Attrs.BackendType = "vxlan"
+	events := n.track([]lease.Event{{Type: lease.EventAdded, Lease: remote}, {Type: lease.EventAdded, Lease: other}})
+	if len(events) != 1 || events[0].Type != "added" || len(n.leases) != 1 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	// The plugin receives the configuration and the leases when it starts
+	if err := n.sync(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{requestInit, requestConfigure, requestSync} {
+		req := <-requests
+		if req.Type != expected {
+			t.Fatalf("expected the %s request, got %+v", expected, req)
+		}
+		switch req.Type {
+		case requestInit:
+			if req.Config == nil || req.Config.Network.String() != "10.5.0.0/16" || req.Config.MTU != 1500 {
+				t.Errorf("unexpected config %+v", req.Config)
+			}
+		case requestConfigure:
+			if req.Lease == nil || !req.Lease.Subnet.Equal(n.lease.Subnet) {
+				t.Errorf("unexpected lease %+v", req.Lease)
+			}
+		case requestSync:
+			if len(req.Leases) != 1 || !req.Leases[0].Subnet.Equal(remote.Subnet) || req.Leases[0].Attrs.PublicIP != remote.Attrs.PublicIP {
+				t.Errorf("unexpected leases %+v", req.Leases)
+			}
+		}
+	}
+	if n.MTU() != 1400 {
+		t.Errorf("the MTU of the plugin wasn't used: %d", n.MTU())
+	}
+
+	// The errors of the plugin are reported without restarting it
+	_, err := n.plugin.call(context.Background(), &request{Type: requestEvents, Events: events})
+	var pe *pluginError
+	if !errors.As(err, &pe) {
+		t.Errorf("expected the error of the plugin, got %v", err)
+	}
+	if req := <-requests; req.Type != requestEvents || len(req.Events) != 1 || req.Events[0].Lease.Subnet != remote.Subnet {
+		t.Errorf("unexpected events request %+v", req)
+	}
+
+	events = n.track([]lease.Event{{Type: lease.EventRemoved, Lease: remote}})
+	if len(events) != 1 || events[0].Type != "removed" || len(n.leases) != 0 {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package geneve
+
+// Some design notes:
+// Unlike vxlan, the kernel geneve device has no forwarding database: a geneve device sends all its
+// packets to a single remote (or relies on lightweight tunnel metadata, which netlink doesn't expose).
+// So the geneve backend creates one geneve device per remote host and per address family, named
+// flannel<hash of the remote public IP>. As for vxlan, for each remote host:
+// 1) The device of the remote host is created with the remote public IP, the VNI and the port.
+// 2) A static ARP (or NDP) entry maps the flannel IP of the remote host to its VTEP MAC.
+// 3) A route to the remote subnet goes through the device, with the flannel IP of the remote host as next hop.
+//
+// The receiving device is the one of the sending host, so all the geneve devices of a host share the
+// same MAC address: the VTEP MAC published in the lease. It is derived from the public IP so that it
+// doesn't change when flanneld restarts.
+//
+// The "directRouting" option skips the encapsulation for hosts on the same subnet, like vxlan.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	backendType = "geneve"
+	defaultVNI  = 1
+	// defaultPort is the IANA assigned port of geneve
+	defaultPort = 6081
+)
+
+func init() {
+	backend.Register(backendType, New)
+}
+
+type GeneveBackend struct {
+	subnetMgr subnet.Manager
+	extIface  *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	be := &GeneveBackend{
+		subnetMgr: sm,
+		extIface:  extIface,
+	}
+
+	return be, nil
+}
+
+type GeneveConfig struct {
+	VNI           int  `json:"vni"`
+	Port          int  `json:"port"`
+	MTU           int  `json:"mtu"`
+	DirectRouting bool `json:"directRouting"`
+}
+
+type geneveLeaseAttrs struct {
+	VNI     uint32
+	VtepMAC hardwareAddr
+}
+
+func parseGeneveConfig(config json.RawMessage, defaultMTU int) (GeneveConfig, error) {
+	cfg := GeneveConfig{
+		VNI:  defaultVNI,
+		Port: defaultPort,
+		MTU:  defaultMTU,
+	}
+
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return GeneveConfig{}, err
+		}
+	}
+
+	// The VNI is a 24 bits field of the geneve header
+	if cfg.VNI < 0 || cfg.VNI > 0xffffff {
+		return GeneveConfig{}, fmt.Errorf("invalid VNI %d", cfg.VNI)
+	}
+	if cfg.Port <= 0 || cfg.Port > 0xffff {
+		return GeneveConfig{}, fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	return cfg, nil
+}
+
+func newSubnetAttrs(publicIP net.IP, publicIPv6 net.IP, vni uint32, mac, v6MAC net.HardwareAddr) (*lease.LeaseAttrs, error) {
+	leaseAttrs := &lease.LeaseAttrs{
+		BackendType: backendType,
+	}
+	if publicIP != nil && mac != nil {
+		data, err := json.Marshal(&geneveLeaseAttrs{
+			VNI:     vni,
+			VtepMAC: hardwareAddr(mac),
+		})
+		if err != nil {
+			return nil, err
+		}
+		leaseAttrs.PublicIP = ip.FromIP(publicIP)
+		leaseAttrs.BackendData = json.RawMessage(data)
+	}
+
+	if publicIPv6 != nil && v6MAC != nil {
+		data, err := json.Marshal(&geneveLeaseAttrs{
+			VNI:     vni,
+			VtepMAC: hardwareAddr(v6MAC),
+		})
+		if err != nil {
+			return nil, err
+		}
+		leaseAttrs.PublicIPv6 = ip.FromIP6(publicIPv6)
+		leaseAttrs.BackendV6Data = json.RawMessage(data)
+	}
+	return leaseAttrs, nil
+}
+
+func (be *GeneveBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg, err := parseGeneveConfig(config.Backend, be.extIface.Iface.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding geneve backend config: %w", err)
+	}
+	log.Infof("Geneve config: VNI=%d Port=%d MTU=%d DirectRouting=%v", cfg.VNI, cfg.Port, cfg.MTU, cfg.DirectRouting)
+
+	var mac, v6MAC net.HardwareAddr
+	if config.EnableIPv4 {
+		if be.extIface.ExtAddr == nil {
+			return nil, fmt.Errorf("IPv4 is enabled but the external interface has no IPv4 address")
+		}
+		mac = vtepMAC(be.extIface.ExtAddr)
+	}
+	if config.EnableIPv6 {
+		if be.extIface.ExtV6Addr == nil {
+			return nil, fmt.Errorf("IPv6 is enabled but the external interface has no IPv6 address")
+		}
+		v6MAC = vtepMAC(be.extIface.ExtV6Addr)
+	}
+
+	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, be.extIface.ExtV6Addr, uint32(cfg.VNI), mac, v6MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := be.subnetMgr.AcquireLease(ctx, subnetAttrs)
+	switch err {
+	case nil:
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	if config.EnableIPv4 && l.Subnet.Empty() {
+		return nil, fmt.Errorf("IPv4 is enabled but the lease has no IPv4")
+	}
+	if config.EnableIPv6 && l.IPv6Subnet.Empty() {
+		return nil, fmt.Errorf("IPv6 is enabled but the lease has no IPv6")
+	}
+
+	return newNetwork(be.subnetMgr, be.extIface, config, l, cfg, mac, v6MAC), nil
+}
+
+// vtepMAC derives the MAC address of the geneve devices from the public IP of
+// the host. The address is unicast and locally administered.
+func vtepMAC(publicIP net.IP) net.HardwareAddr {
+	h := fnv.New64a()
+	_, _ = h.Write(ipBytes(publicIP))
+	sum := h.Sum(nil)
+
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] &^ 0x01) | 0x02
+	return mac
+}
+
+// deviceName returns the name of the geneve device used to reach the given
+// remote host. It fits in the 15 characters allowed by the kernel.
+func deviceName(remote net.IP) string {
+	h := fnv.New32a()
+	_, _ = h.Write(ipBytes(remote))
+	return fmt.Sprintf("%s%08x", devicePrefix, h.Sum32())
+}
+
+// ipBytes returns the 4 bytes form of IPv4 addresses, so that an address
+// hashes the same whatever its representation.
+func ipBytes(addr net.IP) []byte {
+	if v4 := addr.To4(); v4 != nil {
+		return v4
+	}
+	return addr
+}
+
+// So we can make it JSON (un)marshalable
+type hardwareAddr net.HardwareAddr
+
+func (hw hardwareAddr) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", net.HardwareAddr(hw))), nil
+}
+
+func (hw *hardwareAddr) UnmarshalJSON(bytes []byte) error {
+	if len(bytes) < 2 || bytes[0] != '"' || bytes[len(bytes)-1] != '"' {
+		return fmt.Errorf("error parsing hardware addr")
+	}
+
+	bytes = bytes[1 : len(bytes)-1]
+
+	mac, err := net.ParseMAC(string(bytes))
+	if err != nil {
+		return err
+	}
+
+	*hw = hardwareAddr(mac)
+	return nil
+}
@@ -0,0 +1,524 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package geneve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
+	"github.com/flannel-io/flannel/pkg/retry"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	devicePrefix = "flannel"
+	// encapOverhead is the outer IPv4 (20), UDP (8), geneve (8) and inner
+	// ethernet (14) headers. v6EncapOverhead has an outer IPv6 header (40).
+	encapOverhead   = 50
+	v6EncapOverhead = 70
+	// Geneve devices left by a previous run are removed once the remote hosts
+	// had time to show up again.
+	staleDevicesGracePeriod = time.Minute
+)
+
+// peer is the geneve device of a remote host, along with the subnets routed
+// through it.
+type peer struct {
+	link    *netlink.Geneve
+	subnets map[string]bool
+}
+
+type network struct {
+	backend.SimpleNetwork
+	subnetMgr subnet.Manager
+	config    *subnet.Config
+	cfg       GeneveConfig
+	mac       net.HardwareAddr
+	v6MAC     net.HardwareAddr
+	overhead  int
+
+	// mu serializes the handling of lease events with configuration updates,
+	// leases holds the remote leases currently programmed, keyed by subnet,
+	// and peers the geneve devices, keyed by name.
+	mu     sync.Mutex
+	leases map[string]lease.Lease
+	peers  map[string]*peer
+}
+
+func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, config *subnet.Config, myLease *lease.Lease, cfg GeneveConfig, mac, v6MAC net.HardwareAddr) *network {
+	overhead := encapOverhead
+	if config.EnableIPv6 {
+		overhead = v6EncapOverhead
+	}
+
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: myLease,
+			ExtIface:    extIface,
+		},
+		subnetMgr: subnetMgr,
+		config:    config,
+		cfg:       cfg,
+		mac:       mac,
+		v6MAC:     v6MAC,
+		overhead:  overhead,
+		leases:    make(map[string]lease.Lease),
+		peers:     make(map[string]*peer),
+	}
+}
+
+func (nw *network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.V(0).Info("watching for new subnet leases")
+	leaseEvents := make(chan []lease.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, nw.subnetMgr, nw.SubnetLease, leaseEvents)
+		log.V(1).Info("WatchLeases exited")
+		wg.Done()
+	}()
+
+	defer wg.Wait()
+
+	staleDevices := time.NewTimer(staleDevicesGracePeriod)
+	defer staleDevices.Stop()
+
+	for {
+		select {
+		case evtBatch, ok := <-leaseEvents:
+			if !ok {
+				log.Infof("leaseEvents chan closed")
+				return
+			}
+			nw.mu.Lock()
+			nw.handleSubnetEvents(evtBatch)
+			nw.trackLeases(evtBatch)
+			nw.mu.Unlock()
+
+		case <-staleDevices.C:
+			nw.mu.Lock()
+			nw.removeStaleDevices()
+			nw.mu.Unlock()
+		}
+	}
+}
+
+func (nw *network) MTU() int {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return nw.cfg.MTU - nw.overhead
+}
+
+func (nw *network) trackLeases(batch []lease.Event) {
+	for _, event := range batch {
+		key := subnet.MakeSubnetKey(event.Lease.Subnet, event.Lease.IPv6Subnet)
+		switch event.Type {
+		case lease.EventAdded:
+			nw.leases[key] = event.Lease
+		case lease.EventRemoved:
+			delete(nw.leases, key)
+		}
+	}
+}
+
+// UpdateConfig applies a new backend configuration to the running network.
+// The MTU and DirectRouting can be changed in place, the VNI and the port
+// require a restart.
+func (nw *network) UpdateConfig(ctx context.Context, config *subnet.Config) error {
+	cfg, err := parseGeneveConfig(config.Backend, nw.ExtIface.Iface.MTU)
+	if err != nil {
+		return fmt.Errorf("error decoding geneve backend config: %w", err)
+	}
+
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	if cfg.VNI != nw.cfg.VNI || cfg.Port != nw.cfg.Port {
+		return fmt.Errorf("changing VNI or Port of the geneve backend requires a restart of flanneld")
+	}
+
+	if cfg.MTU != nw.cfg.MTU {
+		for name, p := range nw.peers {
+			if err := netlink.LinkSetMTU(p.link, cfg.MTU-nw.overhead); err != nil {
+				return fmt.Errorf("failed to set MTU of %s: %w", name, err)
+			}
+		}
+		log.Infof("Geneve MTU changed from %d to %d", nw.cfg.MTU, cfg.MTU)
+		nw.cfg.MTU = cfg.MTU
+	}
+
+	if cfg.DirectRouting != nw.cfg.DirectRouting {
+		// Remove the entries programmed with the previous mode and add them back with the new one
+		removed := make([]lease.Event, 0, len(nw.leases))
+		added := make([]lease.Event, 0, len(nw.leases))
+		for _, l := range nw.leases {
+			removed = append(removed, lease.Event{Type: lease.EventRemoved, Lease: l})
+			added = append(added, lease.Event{Type: lease.EventAdded, Lease: l})
+		}
+
+		nw.handleSubnetEvents(removed)
+		nw.cfg.DirectRouting = cfg.DirectRouting
+		nw.handleSubnetEvents(added)
+
+		log.Infof("Geneve DirectRouting changed from %v to %v", !cfg.DirectRouting, cfg.DirectRouting)
+	}
+
+	return nil
+}
+
+func (nw *network) handleSubnetEvents(batch []lease.Event) {
+	defer metrics.ObserveSubnetEvents(backendType, time.Now())
+
+	for _, event := range batch {
+		sn := event.Lease.Subnet
+		v6Sn := event.Lease.IPv6Subnet
+		attrs := event.Lease.Attrs
+		if attrs.BackendType != backendType {
+			log.Warningf("ignoring non-geneve v4Subnet(%s) v6Subnet(%s): type=%v", sn, v6Sn, attrs.BackendType)
+			continue
+		}
+
+		if event.Lease.EnableIPv4 && nw.mac != nil {
+			var geneveAttrs geneveLeaseAttrs
+			if err := json.Unmarshal(attrs.BackendData, &geneveAttrs); err != nil {
+				log.Error("error decoding subnet lease JSON: ", err)
+				metrics.SubnetEventFailed(backendType)
+			} else if geneveAttrs.VNI != uint32(nw.cfg.VNI) {
+				log.Warningf("ignoring subnet %s with VNI %d, expected %d", sn, geneveAttrs.VNI, nw.cfg.VNI)
+			} else {
+				nw.handlePeerEvent(event.Type, attrs.PublicIP.ToIP(), sn.IP.ToIP(), sn.ToIPNet(), net.HardwareAddr(geneveAttrs.VtepMAC))
+			}
+		}
+
+		if event.Lease.EnableIPv6 && nw.v6MAC != nil && v6Sn.IP != nil {
+			var geneveAttrs geneveLeaseAttrs
+			if err := json.Unmarshal(attrs.BackendV6Data, &geneveAttrs); err != nil {
+				log.Error("error decoding v6 subnet lease JSON: ", err)
+				metrics.SubnetEventFailed(backendType)
+			} else if geneveAttrs.VNI != uint32(nw.cfg.VNI) {
+				log.Warningf("ignoring v6 subnet %s with VNI %d, expected %d", v6Sn, geneveAttrs.VNI, nw.cfg.VNI)
+			} else {
+				nw.handlePeerEvent(event.Type, attrs.PublicIPv6.ToIP(), v6Sn.IP.ToIP(), v6Sn.ToIPNet(), net.HardwareAddr(geneveAttrs.VtepMAC))
+			}
+		}
+	}
+}
+
+// handlePeerEvent programs or removes the route to the subnet dst of the
+// remote host with the given public IP. gw is the flannel IP of the remote
+// host and mac its VTEP MAC.
+func (nw *network) handlePeerEvent(eventType lease.EventType, publicIP, gw net.IP, dst *net.IPNet, mac net.HardwareAddr) {
+	// directRouting is where the remote host is on the same subnet so geneve isn't required.
+	directRoutingOK := false
+	if nw.cfg.DirectRouting {
+		if dr, err := ip.DirectRouting(publicIP); err != nil {
+			log.Error(err)
+		} else {
+			directRoutingOK = dr
+		}
+	}
+	directRoute := netlink.Route{
+		Dst: dst,
+		Gw:  publicIP,
+	}
+
+	switch eventType {
+	case lease.EventAdded:
+		if directRoutingOK {
+			log.V(2).Infof("Adding direct route to subnet: %s PublicIP: %s", dst, publicIP)
+			if err := retry.Do(func() error {
+				return netlink.RouteReplace(&directRoute)
+			}); err != nil {
+				log.Errorf("Error adding route to %v via %v: %v", dst, publicIP, err)
+				metrics.SubnetEventFailed(backendType)
+			}
+			return
+		}
+
+		log.V(2).Infof("adding subnet: %s PublicIP: %s VtepMAC: %s", dst, publicIP, mac)
+		if err := nw.addPeerSubnet(publicIP, gw, dst, mac); err != nil {
+			log.Errorf("failed to add subnet %s through geneve: %v", dst, err)
+			metrics.SubnetEventFailed(backendType)
+		}
+
+	case lease.EventRemoved:
+		if directRoutingOK {
+			log.V(2).Infof("Removing direct route to subnet: %s PublicIP: %s", dst, publicIP)
+			if err := retry.Do(func() error {
+				return netlink.RouteDel(&directRoute)
+			}); err != nil {
+				log.Errorf("Error deleting route to %v via %v: %v", dst, publicIP, err)
+				metrics.SubnetEventFailed(backendType)
+			}
+			return
+		}
+
+		log.V(2).Infof("removing subnet: %s PublicIP: %s VtepMAC: %s", dst, publicIP, mac)
+		if err := nw.removePeerSubnet(publicIP, gw, dst); err != nil {
+			log.Errorf("failed to remove subnet %s through geneve: %v", dst, err)
+			metrics.SubnetEventFailed(backendType)
+		}
+
+	default:
+		log.Error("internal error: unknown event type: ", int(eventType))
+	}
+}
+
+func (nw *network) addPeerSubnet(publicIP, gw net.IP, dst *net.IPNet, mac net.HardwareAddr) error {
+	p, err := nw.ensurePeer(publicIP)
+	if err != nil {
+		return err
+	}
+
+	family := syscall.AF_INET
+	if gw.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	if err := retry.Do(func() error {
+		return netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    p.link.Index,
+			State:        netlink.NUD_PERMANENT,
+			Type:         syscall.RTN_UNICAST,
+			Family:       family,
+			IP:           gw,
+			HardwareAddr: mac,
+		})
+	}); err != nil {
+		nw.releasePeer(publicIP, p)
+		return fmt.Errorf("failed to add neighbor %s (%s): %w", gw, mac, err)
+	}
+
+	// Set the route - the kernel would ARP for the Gw IP address if it hadn't already been set above so make sure
+	// this is done last.
+	route := peerRoute(p.link, gw, dst)
+	if err := retry.Do(func() error {
+		return netlink.RouteReplace(route)
+	}); err != nil {
+		nw.releasePeer(publicIP, p)
+		return fmt.Errorf("failed to add route (%s -> %s): %w", dst, gw, err)
+	}
+
+	p.subnets[dst.String()] = true
+	return nil
+}
+
+func (nw *network) removePeerSubnet(publicIP, gw net.IP, dst *net.IPNet) error {
+	p, ok := nw.peers[deviceName(publicIP)]
+	if !ok {
+		return nil
+	}
+
+	delete(p.subnets, dst.String())
+	if len(p.subnets) > 0 {
+		// Other subnets of the host still go through the device
+		route := peerRoute(p.link, gw, dst)
+		return retry.Do(func() error {
+			return netlink.RouteDel(route)
+		})
+	}
+
+	// Deleting the device removes its routes and neighbors too
+	return nw.releasePeer(publicIP, p)
+}
+
+func peerRoute(link *netlink.Geneve, gw net.IP, dst *net.IPNet) *netlink.Route {
+	route := &netlink.Route{
+		LinkIndex: link.Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       dst,
+		Gw:        gw,
+	}
+	route.SetFlag(syscall.RTNH_F_ONLINK)
+	return route
+}
+
+// ensurePeer returns the geneve device of the remote host with the given
+// public IP, creating and configuring it if needed.
+func (nw *network) ensurePeer(publicIP net.IP) (*peer, error) {
+	name := deviceName(publicIP)
+	if p, ok := nw.peers[name]; ok {
+		return p, nil
+	}
+
+	v6 := publicIP.To4() == nil
+	mac := nw.mac
+	if v6 {
+		mac = nw.v6MAC
+	}
+
+	link, err := ensureLink(&netlink.Geneve{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         name,
+			HardwareAddr: mac,
+			MTU:          nw.cfg.MTU - nw.overhead,
+		},
+		ID:     uint32(nw.cfg.VNI),
+		Remote: publicIP,
+		Dport:  uint16(nw.cfg.Port),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", name), "0")
+
+	// Ensure that the device has a /32 (or /128) address so that no broadcast routes are created.
+	// This IP is just used as a source address for host to workload traffic (so
+	// the return path for the traffic has an address on the flannel network to use as the destination)
+	if v6 {
+		err = ip.EnsureV6AddressOnLink(ip.IP6Net{IP: nw.SubnetLease.IPv6Subnet.IP, PrefixLen: 128}, nw.config.IPv6Network, link)
+	} else {
+		err = ip.EnsureV4AddressOnLink(ip.IP4Net{IP: nw.SubnetLease.Subnet.IP, PrefixLen: 32}, nw.config.Network, link)
+	}
+	if err != nil {
+		_ = netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to ensure address of interface %s: %w", name, err)
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		_ = netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to set interface %s to UP state: %w", name, err)
+	}
+
+	p := &peer{
+		link:    link,
+		subnets: make(map[string]bool),
+	}
+	nw.peers[name] = p
+	return p, nil
+}
+
+// releasePeer deletes the geneve device of the remote host if no subnet goes
+// through it anymore.
+func (nw *network) releasePeer(publicIP net.IP, p *peer) error {
+	if len(p.subnets) > 0 {
+		return nil
+	}
+
+	name := deviceName(publicIP)
+	delete(nw.peers, name)
+	if err := netlink.LinkDel(p.link); err != nil {
+		return fmt.Errorf("failed to delete interface %s: %w", name, err)
+	}
+	return nil
+}
+
+func ensureLink(geneve *netlink.Geneve) (*netlink.Geneve, error) {
+	err := netlink.LinkAdd(geneve)
+	if err == syscall.EEXIST {
+		// it's ok if the device already exists as long as config is similar
+		existing, err := netlink.LinkByName(geneve.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		incompat := geneveLinksIncompat(geneve, existing)
+		if incompat == "" {
+			log.V(1).Infof("Reusing existing geneve device %s", geneve.Name)
+			if existing.Attrs().MTU != geneve.MTU {
+				if err := netlink.LinkSetMTU(existing, geneve.MTU); err != nil {
+					return nil, fmt.Errorf("failed to set MTU of %s: %w", geneve.Name, err)
+				}
+			}
+			return existing.(*netlink.Geneve), nil
+		}
+
+		// delete existing
+		log.Warningf("%q already exists with incompatible configuration: %v; recreating device", geneve.Name, incompat)
+		if err = netlink.LinkDel(existing); err != nil {
+			return nil, fmt.Errorf("failed to delete interface: %w", err)
+		}
+
+		// create new
+		if err = netlink.LinkAdd(geneve); err != nil {
+			return nil, fmt.Errorf("failed to create geneve interface: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create geneve interface %s: %w", geneve.Name, err)
+	}
+
+	link, err := netlink.LinkByName(geneve.Name)
+	if err != nil {
+		return nil, fmt.Errorf("can't locate created geneve device %s: %w", geneve.Name, err)
+	}
+
+	created, ok := link.(*netlink.Geneve)
+	if !ok {
+		return nil, fmt.Errorf("created device %s is not geneve", geneve.Name)
+	}
+	return created, nil
+}
+
+func geneveLinksIncompat(l1 *netlink.Geneve, l2 netlink.Link) string {
+	if l1.Type() != l2.Type() {
+		return fmt.Sprintf("link type: %v vs %v", l1.Type(), l2.Type())
+	}
+
+	geneve := l2.(*netlink.Geneve)
+	if l1.ID != geneve.ID {
+		return fmt.Sprintf("vni: %v vs %v", l1.ID, geneve.ID)
+	}
+	if !l1.Remote.Equal(geneve.Remote) {
+		return fmt.Sprintf("remote: %v vs %v", l1.Remote, geneve.Remote)
+	}
+	if l1.Dport != geneve.Dport {
+		return fmt.Sprintf("port: %v vs %v", l1.Dport, geneve.Dport)
+	}
+	if l1.HardwareAddr.String() != geneve.HardwareAddr.String() {
+		return fmt.Sprintf("mac: %v vs %v", l1.HardwareAddr, geneve.HardwareAddr)
+	}
+	return ""
+}
+
+// removeStaleDevices deletes the geneve devices created by flannel which
+// don't lead to a known remote host, like the ones of hosts which left the
+// cluster while flanneld wasn't running.
+func (nw *network) removeStaleDevices() {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("failed to list links: %v", err)
+		return
+	}
+
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "geneve" || !strings.HasPrefix(name, devicePrefix) {
+			continue
+		}
+		if _, ok := nw.peers[name]; ok {
+			continue
+		}
+		log.Infof("Removing stale geneve device %s", name)
+		if err := netlink.LinkDel(link); err != nil {
+			log.Errorf("failed to delete interface %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package geneve
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestParseGeneveConfig(t *testing.T) {
+	cfg, err := parseGeneveConfig(nil, 1500)
+	if err != nil {
+		t.Fatalf("parseGeneveConfig() failed: %v", err)
+	}
+	if cfg.VNI != defaultVNI || cfg.Port != defaultPort || cfg.MTU != 1500 || cfg.DirectRouting {
+		t.Errorf("unexpected default config: %+v", cfg)
+	}
+
+	cfg, err = parseGeneveConfig(json.RawMessage(`{"VNI":42,"Port":7000,"MTU":9000,"DirectRouting":true}`), 1500)
+	if err != nil {
+		t.Fatalf("parseGeneveConfig() failed: %v", err)
+	}
+	if cfg.VNI != 42 || cfg.Port != 7000 || cfg.MTU != 9000 || !cfg.DirectRouting {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	for _, invalid := range []string{`{"VNI":16777216}`, `{"VNI":-1}`, `{"Port":0}`, `{"Port":65536}`, `{"VNI":"1"}`} {
+		if _, err := parseGeneveConfig(json.RawMessage(invalid), 1500); err == nil {
+			t.Errorf("parseGeneveConfig(%s) should have failed", invalid)
+		}
+	}
+}
+
+func TestVtepMAC(t *testing.T) {
+	mac := vtepMAC(net.ParseIP("10.0.0.1"))
+	if len(mac) != 6 {
+		t.Fatalf("unexpected MAC length: %v", mac)
+	}
+	if mac[0]&0x01 != 0 || mac[0]&0x02 == 0 {
+		t.Errorf("MAC %s should be unicast and locally administered", mac)
+	}
+	if vtepMAC(net.ParseIP("10.0.0.1").To4()).String() != mac.String() {
+		t.Errorf("MAC should not depend on the IPv4 representation")
+	}
+	if vtepMAC(net.ParseIP("10.0.0.2")).String() == mac.String() {
+		t.Errorf("hosts should have different MACs")
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	for _, remote := range []string{"10.0.0.1", "fc00::1"} {
+		name := deviceName(net.ParseIP(remote))
+		if len(name) > 15 {
+			t.Errorf("device name %q is too long", name)
+		}
+		if name[:len(devicePrefix)] != devicePrefix {
+			t.Errorf("device name %q should start with %q", name, devicePrefix)
+		}
+	}
+	if deviceName(net.ParseIP("10.0.0.1")) != deviceName(net.ParseIP("10.0.0.1").To4()) {
+		t.Errorf("device name should not depend on the IPv4 representation")
+	}
+	if deviceName(net.ParseIP("10.0.0.1")) == deviceName(net.ParseIP("10.0.0.2")) {
+		t.Errorf("hosts should have different device names")
+	}
+}
+
+func TestNewSubnetAttrs(t *testing.T) {
+	mac := vtepMAC(net.ParseIP("10.0.0.1"))
+	v6MAC := vtepMAC(net.ParseIP("fc00::1"))
+	attrs, err := newSubnetAttrs(net.ParseIP("10.0.0.1"), net.ParseIP("fc00::1"), 7, mac, v6MAC)
+	if err != nil {
+		t.Fatalf("newSubnetAttrs() failed: %v", err)
+	}
+	if attrs.BackendType != backendType {
+		t.Errorf("unexpected backend type %q", attrs.BackendType)
+	}
+
+	var geneveAttrs, v6GeneveAttrs geneveLeaseAttrs
+	if err := json.Unmarshal(attrs.BackendData, &geneveAttrs); err != nil {
+		t.Fatalf("failed to decode backend data %s: %v", attrs.BackendData, err)
+	}
+	if geneveAttrs.VNI != 7 || net.HardwareAddr(geneveAttrs.VtepMAC).String() != mac.String() {
+		t.Errorf("unexpected backend data %s", attrs.BackendData)
+	}
+	if err := json.Unmarshal(attrs.BackendV6Data, &v6GeneveAttrs); err != nil {
+		t.Fatalf("failed to decode v6 backend data %s: %v", attrs.BackendV6Data, err)
+	}
+	if v6GeneveAttrs.VNI != 7 || net.HardwareAddr(v6GeneveAttrs.VtepMAC).String() != v6MAC.String() {
+		t.Errorf("unexpected v6 backend data %s", attrs.BackendV6Data)
+	}
+
+	// IPv6 only
+	attrs, err = newSubnetAttrs(nil, net.ParseIP("fc00::1"), 7, nil, v6MAC)
+	if err != nil {
+		t.Fatalf("newSubnetAttrs() failed: %v", err)
+	}
+	if attrs.BackendData != nil || attrs.BackendV6Data == nil {
+		t.Errorf("unexpected backend data for an IPv6 only lease: %s / %s", attrs.BackendData, attrs.BackendV6Data)
+	}
+}
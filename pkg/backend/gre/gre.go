@@ -0,0 +1,209 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gre
+
+// The gre backend works like the ipip backend with GRE tunnels: a gre device
+// for the IPv4 subnets and an ip6gre device for the IPv6 subnets, without
+// remote address. The route to a remote subnet goes through the device with
+// the public IP of the remote host as gateway, which the kernel uses as the
+// destination of the encapsulated packets. The optional GRE key is set on
+// both directions, the packets of the hosts of another network with a
+// different key aren't received by the devices.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	backendType  = "gre"
+	tunnelName   = "flannel.gre"
+	v6TunnelName = "flannel.gre6"
+
+	greHeaderLen = 4
+	greKeyLen    = 4
+	v4Overhead   = 20 + greHeaderLen
+	// ip6gre adds the tunnel encapsulation limit option after the IPv6 header
+	v6Overhead = 40 + 8 + greHeaderLen
+)
+
+func init() {
+	backend.Register(backendType, New)
+}
+
+type GREBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	be := &GREBackend{
+		sm:       sm,
+		extIface: extIface,
+	}
+	return be, nil
+}
+
+func (be *GREBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg := struct {
+		DirectRouting bool
+		Key           uint32
+	}{}
+
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding GRE backend config: %v", err)
+		}
+	}
+
+	log.Infof("GRE config: DirectRouting=%v Key=%d", cfg.DirectRouting, cfg.Key)
+
+	n := &backend.RouteNetwork{
+		SimpleNetwork: backend.SimpleNetwork{
+			ExtIface: be.extIface,
+		},
+		SM:          be.sm,
+		BackendType: backendType,
+	}
+
+	attrs := &lease.LeaseAttrs{
+		BackendType: backendType,
+	}
+	if config.EnableIPv4 {
+		attrs.PublicIP = ip.FromIP(be.extIface.ExtAddr)
+	}
+	if config.EnableIPv6 {
+		if be.extIface.IfaceV6Addr == nil {
+			return nil, fmt.Errorf("no IPv6 address on %s for the IPv6 tunnel", be.extIface.Iface.Name)
+		}
+		attrs.PublicIPv6 = ip.FromIP6(be.extIface.ExtV6Addr)
+	}
+
+	l, err := be.sm.AcquireLease(ctx, attrs)
+	switch err {
+	case nil:
+		n.SubnetLease = l
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	if config.EnableIPv4 {
+		link, err := be.configureGREDevice(tunnelName, be.extIface.IfaceAddr, cfg.Key, v4Overhead)
+		if err != nil {
+			return nil, err
+		}
+		// Ensure that the device has a /32 address so that no broadcast routes are created.
+		// This IP is just used as a source address for host to workload traffic (so
+		// the return path for the traffic has an address on the flannel network to use as the destination)
+		if err := ip.EnsureV4AddressOnLink(ip.IP4Net{IP: l.Subnet.IP, PrefixLen: 32}, config.Network, link); err != nil {
+			return nil, fmt.Errorf("failed to ensure address of interface %s: %s", link.Attrs().Name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("failed to set %v UP: %v", tunnelName, err)
+		}
+
+		n.Mtu = link.MTU
+		n.LinkIndex = link.Index
+		n.GetRoute = func(lease *lease.Lease) *netlink.Route {
+			return backend.TunnelRoute(lease.Subnet.ToIPNet(), lease.Attrs.PublicIP.ToIP(), n.LinkIndex, n.ExtIface.Iface.Index, cfg.DirectRouting)
+		}
+	}
+
+	if config.EnableIPv6 {
+		link, err := be.configureGREDevice(v6TunnelName, be.extIface.IfaceV6Addr, cfg.Key, v6Overhead)
+		if err != nil {
+			return nil, err
+		}
+		if err := ip.EnsureV6AddressOnLink(ip.IP6Net{IP: l.IPv6Subnet.IP, PrefixLen: 128}, config.IPv6Network, link); err != nil {
+			return nil, fmt.Errorf("failed to ensure address of interface %s: %s", link.Attrs().Name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("failed to set %v UP: %v", v6TunnelName, err)
+		}
+
+		if n.Mtu == 0 || link.MTU < n.Mtu {
+			n.Mtu = link.MTU
+		}
+		if n.LinkIndex == 0 {
+			n.LinkIndex = link.Index
+		}
+		v6LinkIndex := link.Index
+		n.GetV6Route = func(lease *lease.Lease) *netlink.Route {
+			if lease.Attrs.PublicIPv6 == nil {
+				return nil
+			}
+			return backend.TunnelRoute(lease.IPv6Subnet.ToIPNet(), lease.Attrs.PublicIPv6.ToIP(), v6LinkIndex, n.ExtIface.Iface.Index, cfg.DirectRouting)
+		}
+	}
+
+	return n, nil
+}
+
+// configureGREDevice creates the gre or ip6gre device, depending on the
+// family of local. As for the ipip backend, the local address distinguishes
+// the device from the fallback device of the gre module, which receives the
+// packets of the tunnels without local address.
+func (be *GREBackend) configureGREDevice(name string, local net.IP, key uint32, overhead int) (*netlink.Gretun, error) {
+	link := &netlink.Gretun{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Local:     local,
+		IKey:      key,
+		OKey:      key,
+	}
+	if key != 0 {
+		overhead += greKeyLen
+	}
+
+	expectMTU := be.extIface.Iface.MTU - overhead
+	if expectMTU <= 0 {
+		return nil, fmt.Errorf("MTU %d of iface %s is too small for %s mode to work", be.extIface.Iface.MTU, be.extIface.Iface.Name, link.Type())
+	}
+
+	err := backend.EnsureTunnelLink(link, func(existing netlink.Link) (bool, error) {
+		// flannel shouldn't delete a user's device
+		gre, ok := existing.(*netlink.Gretun)
+		if !ok || existing.Type() != link.Type() {
+			return false, fmt.Errorf("%v isn't a %s mode device, please remove device and try again", name, link.Type())
+		}
+
+		if gre.Local == nil || !gre.Local.Equal(local) || (gre.Remote != nil && !gre.Remote.IsUnspecified()) ||
+			gre.IKey != key || gre.OKey != key {
+			log.Warningf("%q already exists with incompatible attributes: local=%v remote=%v ikey=%d okey=%d; recreating device",
+				name, gre.Local, gre.Remote, gre.IKey, gre.OKey)
+			return false, nil
+		}
+		return true, nil
+	}, expectMTU)
+	if err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
@@ -0,0 +1,82 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gre
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestConfigureGREDevice(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	ext := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "ext", MTU: 1500}}
+	if err := netlink.LinkAdd(ext); err != nil {
+		t.Fatal(err)
+	}
+	iface, err := net.InterfaceByName("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := net.ParseIP("192.168.0.1")
+	be := &GREBackend{extIface: &backend.ExternalInterface{Iface: iface, IfaceAddr: local, ExtAddr: local}}
+
+	link, err := be.configureGREDevice(tunnelName, local, 42, v4Overhead)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("the ip_gre module isn't available")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.MTU != 1500-v4Overhead-greKeyLen {
+		t.Errorf("unexpected MTU %d", link.MTU)
+	}
+
+	for _, key := range []uint32{42, 43} {
+		link, err = be.configureGREDevice(tunnelName, local, key, v4Overhead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing, err := netlink.LinkByName(tunnelName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gre, ok := existing.(*netlink.Gretun)
+		if !ok || existing.Type() != "gre" || !gre.Local.Equal(local) || gre.IKey != key || gre.OKey != key {
+			t.Errorf("unexpected device %+v", existing)
+		}
+	}
+
+	// A device of another type isn't removed
+	if err := netlink.LinkDel(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: tunnelName}}); err != nil {
+		t.Skip("the dummy module isn't available")
+	}
+	if _, err := be.configureGREDevice(tunnelName, local, 42, v4Overhead); err == nil {
+		t.Errorf("the device of another type should be reported")
+	}
+}
@@ -0,0 +1,170 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+// With a Fallback, the host-gw routes are only used for the hosts on the same
+// subnet, and the fallback backend runs beside them for the other hosts, like
+// the DirectRouting option of the vxlan backend in reverse. Both share the
+// host-gw lease, whose backend data carries the backend data of the fallback.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/backend/ipip"
+	"github.com/flannel-io/flannel/pkg/backend/vxlan"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	log "k8s.io/klog/v2"
+)
+
+// fallbackData is the backend data, and the IPv6 backend data, of the leases
+// with a fallback.
+type fallbackData struct {
+	Fallback string
+	Data     json.RawMessage `json:",omitempty"`
+}
+
+func (be *HostgwBackend) registerFallbackNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config, cfg *hostgwConfig) (backend.Network, error) {
+	var newFallback backend.BackendCtor
+	switch cfg.Fallback {
+	case "ipip":
+		newFallback = ipip.New
+	case "vxlan":
+		newFallback = vxlan.New
+	default:
+		return nil, fmt.Errorf("unsupported Fallback %q, must be ipip or vxlan", cfg.Fallback)
+	}
+	log.Infof("Routing the hosts on other subnets through the %s backend", cfg.Fallback)
+
+	shared := backend.NewSharedLease(be.sm, newFallbackCodec(cfg.Fallback), 2)
+	n, err := be.registerRouteNetwork(ctx, shared.Manager(0), config)
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackConfig := *config
+	fallbackConfig.BackendType = cfg.Fallback
+	fallbackConfig.Backend, err = backend.BackendConfig(cfg.Fallback, cfg.FallbackOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding FallbackOptions: %v", err)
+	}
+	fbe, err := newFallback(shared.Manager(1), be.extIface)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := fbe.RegisterNetwork(ctx, wg, &fallbackConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register the network of the %s fallback: %v", cfg.Fallback, err)
+	}
+
+	return &backend.SharedNetwork{Shared: shared, Networks: []backend.Network{n, fn}}, nil
+}
+
+// fallbackCodec is the backend.LeaseCodec of the host-gw routes, the first
+// backend, and of the fallback backend.
+type fallbackCodec struct {
+	fallback string
+	// directRouting tells if a host is on the same subnet
+	directRouting func(net.IP) (bool, error)
+
+	unreachable backend.UnreachablePeers
+}
+
+func newFallbackCodec(fallback string) *fallbackCodec {
+	return &fallbackCodec{
+		fallback:      fallback,
+		directRouting: ip.DirectRouting,
+	}
+}
+
+// Merge adds the backend data of the fallback to the attributes of the
+// host-gw routes, which must acquire the lease first.
+func (c *fallbackCodec) Merge(attrs []*lease.LeaseAttrs) (*lease.LeaseAttrs, error) {
+	if attrs[0] == nil {
+		return nil, fmt.Errorf("the host-gw routes must acquire the lease before the %s fallback", c.fallback)
+	}
+	merged := *attrs[0]
+	if f := attrs[1]; f != nil {
+		var err error
+		if merged.BackendData, err = json.Marshal(&fallbackData{Fallback: c.fallback, Data: f.BackendData}); err != nil {
+			return nil, err
+		}
+		if merged.PublicIPv6 != nil {
+			if merged.BackendV6Data, err = json.Marshal(&fallbackData{Fallback: c.fallback, Data: f.BackendV6Data}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &merged, nil
+}
+
+func (c *fallbackCodec) View(l lease.Lease, i int) (lease.Lease, bool) {
+	if l.Attrs.BackendType != "host-gw" {
+		return l, false
+	}
+	if i == 0 {
+		return l, true
+	}
+
+	var data, v6Data fallbackData
+	if backend.IsBackendData(l.Attrs.BackendData) {
+		if err := json.Unmarshal(l.Attrs.BackendData, &data); err != nil {
+			return l, false
+		}
+	}
+	if backend.IsBackendData(l.Attrs.BackendV6Data) {
+		if err := json.Unmarshal(l.Attrs.BackendV6Data, &v6Data); err != nil {
+			return l, false
+		}
+		if len(data.Fallback) == 0 {
+			data.Fallback = v6Data.Fallback
+		}
+	}
+	if data.Fallback != c.fallback {
+		return l, false
+	}
+
+	l.Attrs.BackendType = c.fallback
+	l.Attrs.BackendData = data.Data
+	l.Attrs.BackendV6Data = v6Data.Data
+	return l, true
+}
+
+// Select returns the host-gw routes for the hosts on the same subnet and the
+// fallback for the others, if they have the same fallback.
+func (c *fallbackCodec) Select(l lease.Lease) int {
+	if l.Attrs.BackendType != "host-gw" {
+		return -1
+	}
+
+	if backend.Adjacent(&l, c.directRouting) {
+		return 0
+	}
+	if _, ok := c.View(l, 1); ok {
+		c.unreachable.Reachable(&l)
+		return 1
+	}
+	c.unreachable.Report(&l, fmt.Sprintf("the host is on another subnet and doesn't have the %s fallback", c.fallback))
+	return -1
+}
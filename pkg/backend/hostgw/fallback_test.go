@@ -0,0 +1,128 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+// onLocalSubnet tells if a host is on 192.168.0.0/24, the subnet of the node.
+func onLocalSubnet(host net.IP) (bool, error) {
+	_, local, _ := net.ParseCIDR("192.168.0.0/24")
+	return local.Contains(host), nil
+}
+
+func TestFallbackLease(t *testing.T) {
+	c := newFallbackCodec("vxlan")
+	if _, err := c.Merge([]*lease.LeaseAttrs{nil, {BackendType: "vxlan"}}); err == nil {
+		t.Error("the vxlan fallback shouldn't acquire the lease before the host-gw routes")
+	}
+
+	// The lease stays a host-gw lease, the nodes without fallback still
+	// route to it
+	pub := ip.MustParseIP4("192.168.1.2")
+	vtep := json.RawMessage(`{"VNI":1,"VtepMAC":"02:00:00:00:00:01"}`)
+	attrs, err := c.Merge([]*lease.LeaseAttrs{
+		{PublicIP: pub, BackendType: "host-gw"},
+		{PublicIP: pub, BackendType: "vxlan", BackendData: vtep},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.BackendType != "host-gw" || attrs.PublicIP != pub || attrs.BackendV6Data != nil {
+		t.Fatalf("unexpected lease attributes %+v", attrs)
+	}
+	if string(attrs.BackendData) != `{"Fallback":"vxlan","Data":{"VNI":1,"VtepMAC":"02:00:00:00:00:01"}}` {
+		t.Errorf("unexpected backend data %s", attrs.BackendData)
+	}
+
+	// The vxlan fallback sees its own backend data
+	l := lease.Lease{EnableIPv4: true, Attrs: *attrs}
+	if vl, ok := c.View(l, 1); !ok || vl.Attrs.BackendType != "vxlan" || string(vl.Attrs.BackendData) != string(vtep) {
+		t.Errorf("unexpected vxlan lease %+v", vl.Attrs)
+	}
+
+	// The fallback of an IPv6 only lease is in its IPv6 data
+	pub6 := ip.MustParseIP6("fd00::2")
+	attrs, err = c.Merge([]*lease.LeaseAttrs{
+		{PublicIPv6: pub6, BackendType: "host-gw"},
+		{PublicIPv6: pub6, BackendType: "vxlan", BackendV6Data: vtep},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = lease.Lease{EnableIPv6: true, Attrs: *attrs}
+	l.Attrs.BackendData = nil
+	if vl, ok := c.View(l, 1); !ok || vl.Attrs.BackendV6Data == nil || string(vl.Attrs.BackendV6Data) != string(vtep) {
+		t.Errorf("unexpected IPv6 vxlan lease %+v", vl.Attrs)
+	}
+}
+
+// TestFallbackUpgrade follows a host on another subnet while it's upgraded
+// from plain host-gw routes to the ipip fallback, and then to vxlan.
+func TestFallbackUpgrade(t *testing.T) {
+	c := newFallbackCodec("ipip")
+	c.directRouting = onLocalSubnet
+	pub := ip.MustParseIP4("192.168.1.3")
+	host := lease.Lease{
+		EnableIPv4: true,
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4("10.5.3.0"), PrefixLen: 24},
+		Attrs:      lease.LeaseAttrs{PublicIP: pub, BackendType: "host-gw"},
+	}
+	if i := c.Select(host); i != -1 {
+		t.Errorf("the host without fallback shouldn't be routed, got the backend %d", i)
+	}
+
+	host.Attrs.BackendData = json.RawMessage(`{"Fallback":"ipip"}`)
+	if i := c.Select(host); i != 1 {
+		t.Errorf("expected the host to be routed through ipip, got the backend %d", i)
+	}
+
+	host.Attrs.BackendData = json.RawMessage(`{"Fallback":"vxlan","Data":{"VNI":1}}`)
+	if i := c.Select(host); i != -1 {
+		t.Errorf("the host with the vxlan fallback shouldn't be routed, got the backend %d", i)
+	}
+
+	// Moved to the subnet of the node, host-gw routes to it whatever its
+	// fallback
+	host.Attrs.PublicIP = ip.MustParseIP4("192.168.0.3")
+	if i := c.Select(host); i != 0 {
+		t.Errorf("expected the host to be routed through host-gw, got the backend %d", i)
+	}
+
+	host.Attrs.BackendType = "vxlan"
+	if i := c.Select(host); i != -1 {
+		t.Errorf("the vxlan lease shouldn't be routed, got the backend %d", i)
+	}
+}
+
+func TestUnsupportedFallback(t *testing.T) {
+	be := &HostgwBackend{}
+	config := &subnet.Config{BackendType: "host-gw", Backend: json.RawMessage(`{"Type":"host-gw","Fallback":"udp"}`)}
+	if _, err := be.RegisterNetwork(context.Background(), &sync.WaitGroup{}, config); err == nil {
+		t.Error("the udp fallback should be refused")
+	}
+}
@@ -19,6 +19,7 @@ package hostgw
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
 
@@ -50,12 +51,35 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
+type hostgwConfig struct {
+	// Fallback is the backend, ipip or vxlan, encapsulating the traffic to
+	// the hosts on other subnets
+	Fallback        string
+	FallbackOptions json.RawMessage
+}
+
 func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg := hostgwConfig{}
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding host-gw backend config: %v", err)
+		}
+	}
+
+	if len(cfg.Fallback) > 0 {
+		return be.registerFallbackNetwork(ctx, wg, config, &cfg)
+	}
+	return be.registerRouteNetwork(ctx, be.sm, config)
+}
+
+// registerRouteNetwork registers the network of the direct routes to the
+// public IP of the hosts.
+func (be *HostgwBackend) registerRouteNetwork(ctx context.Context, sm subnet.Manager, config *subnet.Config) (*backend.RouteNetwork, error) {
 	n := &backend.RouteNetwork{
 		SimpleNetwork: backend.SimpleNetwork{
 			ExtIface: be.extIface,
 		},
-		SM:          be.sm,
+		SM:          sm,
 		BackendType: "host-gw",
 		Mtu:         be.extIface.Iface.MTU,
 		LinkIndex:   be.extIface.Iface.Index,
@@ -87,7 +111,7 @@ func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 		}
 	}
 
-	l, err := be.sm.AcquireLease(ctx, &attrs)
+	l, err := sm.AcquireLease(ctx, &attrs)
 	switch err {
 	case nil:
 		n.SubnetLease = l
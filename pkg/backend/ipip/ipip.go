@@ -33,8 +33,13 @@ import (
 )
 
 const (
-	backendType = "ipip"
-	tunnelName  = "flannel.ipip"
+	backendType  = "ipip"
+	tunnelName   = "flannel.ipip"
+	v6TunnelName = "flannel.ipip6"
+
+	// The IPv6 tunnel doesn't add the encapsulation limit option, its
+	// overhead is the IPv6 header
+	v6TunnelOverhead = 40
 )
 
 func init() {
@@ -76,9 +81,17 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 	}
 
 	attrs := &lease.LeaseAttrs{
-		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
 		BackendType: backendType,
 	}
+	if config.EnableIPv4 {
+		attrs.PublicIP = ip.FromIP(be.extIface.ExtAddr)
+	}
+	if config.EnableIPv6 {
+		if be.extIface.IfaceV6Addr == nil {
+			return nil, fmt.Errorf("no IPv6 address on %s for the IPv6 tunnel", be.extIface.Iface.Name)
+		}
+		attrs.PublicIPv6 = ip.FromIP6(be.extIface.ExtV6Addr)
+	}
 
 	l, err := be.sm.AcquireLease(ctx, attrs)
 	switch err {
@@ -90,36 +103,39 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
-	link, err := be.configureIPIPDevice(n.SubnetLease, config.Network)
+	if config.EnableIPv4 {
+		link, err := be.configureIPIPDevice(n.SubnetLease, config.Network)
 
-	if err != nil {
-		return nil, err
-	}
-
-	n.Mtu = link.MTU
-	n.LinkIndex = link.Index
-	n.GetRoute = func(lease *lease.Lease) *netlink.Route {
-		route := netlink.Route{
-			Dst:       lease.Subnet.ToIPNet(),
-			Gw:        lease.Attrs.PublicIP.ToIP(),
-			LinkIndex: n.LinkIndex,
-			Flags:     int(netlink.FLAG_ONLINK),
+		if err != nil {
+			return nil, err
 		}
 
-		if cfg.DirectRouting {
-			dr, err := ip.DirectRouting(lease.Attrs.PublicIP.ToIP())
+		n.Mtu = link.MTU
+		n.LinkIndex = link.Index
+		n.GetRoute = func(lease *lease.Lease) *netlink.Route {
+			return backend.TunnelRoute(lease.Subnet.ToIPNet(), lease.Attrs.PublicIP.ToIP(), n.LinkIndex, n.ExtIface.Iface.Index, cfg.DirectRouting)
+		}
+	}
 
-			if err != nil {
-				log.Error(err)
-			}
+	if config.EnableIPv6 {
+		link, err := be.configureIP6TnlDevice(n.SubnetLease, config.IPv6Network)
+		if err != nil {
+			return nil, err
+		}
 
-			if dr {
-				log.V(2).Infof("configure route to %v via direct routing", lease.Attrs.PublicIP.String())
-				route.LinkIndex = n.ExtIface.Iface.Index
+		if n.Mtu == 0 || link.MTU < n.Mtu {
+			n.Mtu = link.MTU
+		}
+		if n.LinkIndex == 0 {
+			n.LinkIndex = link.Index
+		}
+		v6LinkIndex := link.Index
+		n.GetV6Route = func(lease *lease.Lease) *netlink.Route {
+			if lease.Attrs.PublicIPv6 == nil {
+				return nil
 			}
+			return backend.TunnelRoute(lease.IPv6Subnet.ToIPNet(), lease.Attrs.PublicIPv6.ToIP(), v6LinkIndex, n.ExtIface.Iface.Index, cfg.DirectRouting)
 		}
-
-		return &route
 	}
 
 	return n, nil
@@ -137,25 +153,22 @@ func (be *IPIPBackend) configureIPIPDevice(lease *lease.Lease, flannelnet ip.IP4
 	// Considering tunl0 might be used by users, so choose the later option.
 	link := &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName}, Local: be.extIface.IfaceAddr}
 
-	if err := netlink.LinkAdd(link); err != nil {
-		if err != syscall.EEXIST {
-			return nil, err
-		}
-
-		// The link already exists, so check existing link attributes.
-		existing, err := netlink.LinkByName(tunnelName)
-		if err != nil {
-			return nil, err
-		}
+	// Due to the extra 20 byte IP header that the tunnel will add to each packet,
+	// MTU size for both the workload and tunnel interfaces should be 20 bytes less than the selected iface (specified with the --iface option).
+	expectMTU := be.extIface.Iface.MTU - 20
+	if expectMTU <= 0 {
+		return nil, fmt.Errorf("MTU %d of iface %s is too small for ipip mode to work", be.extIface.Iface.MTU, be.extIface.Iface.Name)
+	}
 
+	err := backend.EnsureTunnelLink(link, func(existing netlink.Link) (bool, error) {
 		// If there's an exists device but it's not an ipip/IpTun device then get the user to fix it (flannel shouldn't
 		// delete a user's device)
 		if existing.Type() != "ipip" {
-			return nil, fmt.Errorf("%v isn't an ipip mode device, please remove device and try again", tunnelName)
+			return false, fmt.Errorf("%v isn't an ipip mode device, please remove device and try again", tunnelName)
 		}
 		ipip, ok := existing.(*netlink.Iptun)
 		if !ok {
-			return nil, fmt.Errorf("%s isn't an iptun device (%#v), please remove device and try again", tunnelName, link)
+			return false, fmt.Errorf("%s isn't an iptun device (%#v), please remove device and try again", tunnelName, link)
 		}
 
 		// local attribute may change if a user changes iface configuration, we need to recreate the device to ensure
@@ -164,45 +177,71 @@ func (be *IPIPBackend) configureIPIPDevice(lease *lease.Lease, flannelnet ip.IP4
 		if ipip.Local == nil || !ipip.Local.Equal(be.extIface.IfaceAddr) || (ipip.Remote != nil && ipip.Remote.String() != "0.0.0.0") {
 			log.Warningf("%q already exists with incompatible attributes: local=%v remote=%v; recreating device",
 				tunnelName, ipip.Local, ipip.Remote)
+			return false, nil
+		}
+		return true, nil
+	}, expectMTU)
+	if err != nil {
+		return nil, err
+	}
 
-			if err = netlink.LinkDel(existing); err != nil {
-				return nil, fmt.Errorf("failed to delete interface: %v", err)
-			}
+	// Ensure that the device has a /32 address so that no broadcast routes are created.
+	// This IP is just used as a source address for host to workload traffic (so
+	// the return path for the traffic has an address on the flannel network to use as the destination)
+	if err := ip.EnsureV4AddressOnLink(ip.IP4Net{IP: lease.Subnet.IP, PrefixLen: 32}, flannelnet, link); err != nil {
+		return nil, fmt.Errorf("failed to ensure address of interface %s: %s", link.Attrs().Name, err)
+	}
 
-			if err = netlink.LinkAdd(link); err != nil {
-				return nil, fmt.Errorf("failed to create ipip interface: %v", err)
-			}
-		}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set %v UP: %v", tunnelName, err)
 	}
 
-	// Due to the extra 20 byte IP header that the tunnel will add to each packet,
-	// MTU size for both the workload and tunnel interfaces should be 20 bytes less than the selected iface (specified with the --iface option).
-	expectMTU := be.extIface.Iface.MTU - 20
+	return link, nil
+}
+
+// configureIP6TnlDevice creates the ip6tnl device of the IPv6 subnets, which
+// encapsulates IPv6 in IPv6. As for the ipip device, its local address
+// distinguishes it from the ip6tnl0 fallback device.
+func (be *IPIPBackend) configureIP6TnlDevice(lease *lease.Lease, flannelnet ip.IP6Net) (*netlink.Ip6tnl, error) {
+	link := &netlink.Ip6tnl{
+		LinkAttrs: netlink.LinkAttrs{Name: v6TunnelName},
+		Local:     be.extIface.IfaceV6Addr,
+		Proto:     syscall.IPPROTO_IPV6,
+		Flags:     uint32(netlink.IP6_TNL_F_IGN_ENCAP_LIMIT),
+	}
+
+	expectMTU := be.extIface.Iface.MTU - v6TunnelOverhead
 	if expectMTU <= 0 {
-		return nil, fmt.Errorf("MTU %d of iface %s is too small for ipip mode to work", be.extIface.Iface.MTU, be.extIface.Iface.Name)
+		return nil, fmt.Errorf("MTU %d of iface %s is too small for ip6tnl mode to work", be.extIface.Iface.MTU, be.extIface.Iface.Name)
 	}
 
-	oldMTU := link.Attrs().MTU
-	if oldMTU > expectMTU || oldMTU == 0 {
-		log.Infof("current MTU of %s is %d, setting it to %d", tunnelName, oldMTU, expectMTU)
-		err := netlink.LinkSetMTU(link, expectMTU)
+	err := backend.EnsureTunnelLink(link, func(existing netlink.Link) (bool, error) {
+		// flannel shouldn't delete a user's device
+		ip6tnl, ok := existing.(*netlink.Ip6tnl)
+		if !ok {
+			return false, fmt.Errorf("%v isn't an ip6tnl mode device, please remove device and try again", v6TunnelName)
+		}
 
-		if err != nil {
-			return nil, fmt.Errorf("failed to set %v MTU to %d: %v", tunnelName, expectMTU, err)
+		if ip6tnl.Local == nil || !ip6tnl.Local.Equal(be.extIface.IfaceV6Addr) || (ip6tnl.Remote != nil && !ip6tnl.Remote.IsUnspecified()) ||
+			ip6tnl.Proto != link.Proto || ip6tnl.Flags != link.Flags {
+			log.Warningf("%q already exists with incompatible attributes: local=%v remote=%v proto=%d flags=%d; recreating device",
+				v6TunnelName, ip6tnl.Local, ip6tnl.Remote, ip6tnl.Proto, ip6tnl.Flags)
+			return false, nil
 		}
-		// change MTU as it will be written into /run/flannel/subnet.env
-		link.Attrs().MTU = expectMTU
+		return true, nil
+	}, expectMTU)
+	if err != nil {
+		return nil, err
 	}
 
-	// Ensure that the device has a /32 address so that no broadcast routes are created.
-	// This IP is just used as a source address for host to workload traffic (so
-	// the return path for the traffic has an address on the flannel network to use as the destination)
-	if err := ip.EnsureV4AddressOnLink(ip.IP4Net{IP: lease.Subnet.IP, PrefixLen: 32}, flannelnet, link); err != nil {
+	// As for the IPv4 device, the /128 address is the source address of the host
+	// to workload traffic
+	if err := ip.EnsureV6AddressOnLink(ip.IP6Net{IP: lease.IPv6Subnet.IP, PrefixLen: 128}, flannelnet, link); err != nil {
 		return nil, fmt.Errorf("failed to ensure address of interface %s: %s", link.Attrs().Name, err)
 	}
 
 	if err := netlink.LinkSetUp(link); err != nil {
-		return nil, fmt.Errorf("failed to set %v UP: %v", tunnelName, err)
+		return nil, fmt.Errorf("failed to set %v UP: %v", v6TunnelName, err)
 	}
 
 	return link, nil
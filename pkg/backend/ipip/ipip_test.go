@@ -0,0 +1,101 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package ipip
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestConfigureIP6TnlDevice(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	ext := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "ext", MTU: 1500}}
+	if err := netlink.LinkAdd(ext); err != nil {
+		t.Fatal(err)
+	}
+	_, extNet, _ := net.ParseCIDR("fd00::1/64")
+	extNet.IP = net.ParseIP("fd00::1")
+	if err := netlink.AddrAdd(ext, &netlink.Addr{IPNet: extNet}); err != nil {
+		t.Fatal(err)
+	}
+	iface, err := net.InterfaceByName("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := &IPIPBackend{extIface: &backend.ExternalInterface{
+		Iface:       iface,
+		IfaceV6Addr: extNet.IP,
+		ExtV6Addr:   extNet.IP,
+	}}
+	_, subnet, _ := net.ParseCIDR("fd00:10:244:1::/64")
+	_, network, _ := net.ParseCIDR("fd00:10:244::/56")
+	l := &lease.Lease{EnableIPv6: true, IPv6Subnet: ip.FromIP6Net(subnet)}
+
+	link, err := be.configureIP6TnlDevice(l, ip.FromIP6Net(network))
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("the ip6_tunnel module isn't available")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.MTU != 1500-v6TunnelOverhead {
+		t.Errorf("unexpected MTU %d", link.MTU)
+	}
+
+	// The existing device is reused
+	link, err = be.configureIP6TnlDevice(l, ip.FromIP6Net(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := netlink.LinkByName(v6TunnelName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip6tnl, ok := existing.(*netlink.Ip6tnl)
+	if !ok || !ip6tnl.Local.Equal(extNet.IP) || ip6tnl.Proto != syscall.IPPROTO_IPV6 || ip6tnl.Index != link.Index {
+		t.Errorf("unexpected device %+v", existing)
+	}
+	addrs, err := netlink.AddrList(existing, netlink.FAMILY_V6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, addr := range addrs {
+		found = found || addr.IPNet.String() == "fd00:10:244:1::/128"
+	}
+	if !found {
+		t.Errorf("the address of the subnet is missing: %v", addrs)
+	}
+
+	// The route to a remote subnet goes through the tunnel to the public IP
+	_, remoteSubnet, _ := net.ParseCIDR("fd00:10:244:2::/64")
+	route := backend.TunnelRoute(remoteSubnet, net.ParseIP("fd00::2"), link.Index, iface.Index, false)
+	if err := netlink.RouteAdd(route); err != nil {
+		t.Fatalf("failed to add the route %+v: %v", route, err)
+	}
+}
@@ -28,7 +28,6 @@ import (
 	"time"
 
 	"github.com/bronze1man/goStrongswanVici"
-	"github.com/flannel-io/flannel/pkg/lease"
 	log "k8s.io/klog/v2"
 )
 
@@ -152,8 +151,7 @@ func (charon *CharonIKEDaemon) LoadSharedKey(remotePublicIP, password string) er
 	return nil
 }
 
-func (charon *CharonIKEDaemon) LoadConnection(localLease, remoteLease *lease.Lease,
-	reqID, encap string) error {
+func (charon *CharonIKEDaemon) LoadConnection(t tunnel, reqID, encap string) error {
 	var err error
 	var client *goStrongswanVici.ClientConn
 
@@ -171,8 +169,8 @@ func (charon *CharonIKEDaemon) LoadConnection(localLease, remoteLease *lease.Lea
 
 	childConfMap := make(map[string]goStrongswanVici.ChildSAConf)
 	childSAConf := goStrongswanVici.ChildSAConf{
-		Local_ts:      []string{localLease.Subnet.String()},
-		Remote_ts:     []string{remoteLease.Subnet.String()},
+		Local_ts:      []string{t.localSubnet.String()},
+		Remote_ts:     []string{t.remoteSubnet.String()},
 		ESPProposals:  []string{charon.espProposal},
 		StartAction:   "start",
 		CloseAction:   "trap",
@@ -183,7 +181,7 @@ func (charon *CharonIKEDaemon) LoadConnection(localLease, remoteLease *lease.Lea
 		InstallPolicy: "no",
 	}
 
-	childSAConfName := formatChildSAConfName(localLease, remoteLease)
+	childSAConfName := formatChildSAConfName(t)
 
 	childConfMap[childSAConfName] = childSAConf
 
@@ -195,8 +193,8 @@ func (charon *CharonIKEDaemon) LoadConnection(localLease, remoteLease *lease.Lea
 	}
 
 	ikeConf := goStrongswanVici.IKEConf{
-		LocalAddrs:  []string{localLease.Attrs.PublicIP.String()},
-		RemoteAddrs: []string{remoteLease.Attrs.PublicIP.String()},
+		LocalAddrs:  []string{t.localIP.String()},
+		RemoteAddrs: []string{t.remoteIP.String()},
 		Proposals:   []string{"aes256-sha256-modp4096"},
 		Version:     "2",
 		KeyingTries: "0", //continues to retry
@@ -207,7 +205,7 @@ func (charon *CharonIKEDaemon) LoadConnection(localLease, remoteLease *lease.Lea
 	}
 	ikeConfMap := make(map[string]goStrongswanVici.IKEConf)
 
-	connectionName := formatConnectionName(localLease, remoteLease)
+	connectionName := formatConnectionName(t)
 	ikeConfMap[connectionName] = ikeConf
 
 	err = client.LoadConn(&ikeConfMap)
@@ -219,8 +217,7 @@ func (charon *CharonIKEDaemon) LoadConnection(localLease, remoteLease *lease.Lea
 	return nil
 }
 
-func (charon *CharonIKEDaemon) UnloadCharonConnection(localLease,
-	remoteLease *lease.Lease) error {
+func (charon *CharonIKEDaemon) UnloadCharonConnection(t tunnel) error {
 	client, err := charon.getClient(false)
 	if err != nil {
 		log.Errorf("Failed to acquire Vici client: %s", err)
@@ -233,7 +230,7 @@ func (charon *CharonIKEDaemon) UnloadCharonConnection(localLease,
 		}
 	}()
 
-	connectionName := formatConnectionName(localLease, remoteLease)
+	connectionName := formatConnectionName(t)
 	unloadConnRequest := &goStrongswanVici.UnloadConnRequest{
 		Name: connectionName,
 	}
@@ -247,13 +244,13 @@ func (charon *CharonIKEDaemon) UnloadCharonConnection(localLease,
 	return nil
 }
 
-func formatConnectionName(localLease, remoteLease *lease.Lease) string {
-	return fmt.Sprintf("%s-%s-%s-%s", localLease.Attrs.PublicIP,
-		localLease.Subnet, remoteLease.Subnet, remoteLease.Attrs.PublicIP)
+func formatConnectionName(t tunnel) string {
+	return fmt.Sprintf("%s-%s-%s-%s", t.localIP,
+		t.localSubnet, t.remoteSubnet, t.remoteIP)
 }
 
-func formatChildSAConfName(localLease, remoteLease *lease.Lease) string {
-	return fmt.Sprintf("%s-%s", localLease.Subnet, remoteLease.Subnet)
+func formatChildSAConfName(t tunnel) string {
+	return fmt.Sprintf("%s-%s", t.localSubnet, t.remoteSubnet)
 }
 
 func findExecPath() (string, error) {
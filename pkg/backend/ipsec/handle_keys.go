@@ -0,0 +1,373 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package ipsec
+
+/*
+	The native key management installs the ESP SAs without an IKE daemon. The key and the SPI of the SA from a host to
+	another are derived with HKDF from the PSK, the public IPs of both hosts, a random nonce published by each host in
+	its lease and the current epoch. Both hosts compute the same SAs without exchanging any message.
+
+	The epoch is the number of rekey intervals since the Unix epoch, so the keys are renewed at the same time on all the
+	hosts. The inbound SAs of the previous, current and next epochs are installed and only the outbound SA of the
+	current epoch, so the hosts switch to the new keys without dropping packets as long as their clocks are closer than
+	the rekey interval. The nonce is renewed when flannel starts, the sequence numbers of the SAs restart from zero and
+	would be rejected by the replay protection of the peers otherwise.
+
+	For the same reason an outbound SA is never installed twice: the IVs of AES-GCM are the sequence numbers, they
+	would be reused with the same key. When a peer is removed and added again with the same nonce, the outbound SA of
+	the next epoch is used if the SA of the current epoch was already installed. The peer doesn't get any traffic until
+	the next epoch if both were.
+*/
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	keyManagementStrongswan = "strongswan"
+	keyManagementNative     = "native"
+
+	defaultRekeyInterval = 3600
+
+	// AES-GCM with a 128 bits key, followed by the 4 bytes salt
+	espAEAD      = "rfc4106(gcm(aes))"
+	espKeyLength = 16 + 4
+	espICVLength = 128
+
+	nonceLength  = 16
+	replayWindow = 32
+	// The SPIs below 256 are reserved
+	minSPI = 0x100
+)
+
+// ipsecLeaseAttrs are the backend data of the leases with the native key
+// management.
+type ipsecLeaseAttrs struct {
+	KeyNonce []byte
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// sa identifies an installed SA.
+type sa struct {
+	epoch uint64
+	spi   int
+}
+
+// peerSAs are the SAs installed with a remote host on an address family.
+type peerSAs struct {
+	localIP  net.IP
+	publicIP net.IP
+	nonce    []byte
+	outbound []sa
+	inbound  []sa
+}
+
+type xfrmKeyManager struct {
+	psk           string
+	nonce         []byte
+	rekeyInterval time.Duration
+	reqID         int
+
+	// mu protects peers, keyed by public IP, and usedOutbound, the last
+	// epoch of the outbound SAs installed with each peer, keyed by public IP
+	// and nonce. The SAs are renewed by run concurrently with the lease
+	// events.
+	mu           sync.Mutex
+	peers        map[string]*peerSAs
+	usedOutbound map[string]uint64
+}
+
+func newXFRMKeyManager(psk string, nonce []byte, rekeyInterval time.Duration, reqID int) *xfrmKeyManager {
+	return &xfrmKeyManager{
+		psk:           psk,
+		nonce:         nonce,
+		rekeyInterval: rekeyInterval,
+		reqID:         reqID,
+		peers:         make(map[string]*peerSAs),
+		usedOutbound:  make(map[string]uint64),
+	}
+}
+
+func (km *xfrmKeyManager) epoch(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(km.rekeyInterval/time.Second)
+}
+
+// deriveSA returns the SPI and the key of the SA from src to dst for an epoch.
+func deriveSA(psk string, src, dst net.IP, srcNonce, dstNonce []byte, epoch uint64) (int, []byte, error) {
+	info := fmt.Sprintf("flannel ipsec %s %s %x %x %d", src, dst, srcNonce, dstNonce, epoch)
+	material, err := hkdf.Key(sha256.New, []byte(psk), nil, info, 4+espKeyLength)
+	if err != nil {
+		return 0, nil, err
+	}
+	spi := int(binary.BigEndian.Uint32(material[:4]) | minSPI)
+	return spi, material[4:], nil
+}
+
+// state returns the SA from src to dst for an epoch.
+func (km *xfrmKeyManager) state(src, dst net.IP, srcNonce, dstNonce []byte, epoch uint64) (*netlink.XfrmState, error) {
+	spi, key, err := deriveSA(km.psk, src, dst, srcNonce, dstNonce, epoch)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.XfrmState{
+		Src:          src,
+		Dst:          dst,
+		Proto:        netlink.XFRM_PROTO_ESP,
+		Mode:         netlink.XFRM_MODE_TUNNEL,
+		Spi:          spi,
+		Reqid:        km.reqID,
+		ReplayWindow: replayWindow,
+		Aead: &netlink.XfrmStateAlgo{
+			Name:   espAEAD,
+			Key:    key,
+			ICVLen: espICVLength,
+		},
+	}, nil
+}
+
+// flush removes the SAs left by a previous run.
+func (km *xfrmKeyManager) flush() error {
+	states, err := netlink.XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("error listing the ipsec states: %v", err)
+	}
+	for _, s := range states {
+		if s.Reqid != km.reqID || s.Proto != netlink.XFRM_PROTO_ESP {
+			continue
+		}
+		log.Infof("Deleting stale ipsec state %v -> %v spi 0x%x", s.Src, s.Dst, s.Spi)
+		if err := netlink.XfrmStateDel(&s); err != nil {
+			return fmt.Errorf("error deleting ipsec state: %v", err)
+		}
+	}
+	return nil
+}
+
+// addPeer installs the SAs between localIP and remoteIP, the public IP of the
+// host of a lease on one address family.
+func (km *xfrmKeyManager) addPeer(localIP, remoteIP net.IP, remoteLease *lease.Lease) error {
+	var attrs ipsecLeaseAttrs
+	if len(remoteLease.Attrs.BackendData) > 0 {
+		if err := json.Unmarshal(remoteLease.Attrs.BackendData, &attrs); err != nil {
+			return fmt.Errorf("error decoding the backend data: %v", err)
+		}
+	}
+	if len(attrs.KeyNonce) == 0 {
+		return fmt.Errorf("the host %s doesn't use the native key management", remoteLease.Attrs.PublicIP)
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	key := remoteIP.String()
+	p, ok := km.peers[key]
+	if ok && string(p.nonce) != string(attrs.KeyNonce) {
+		// The host restarted, all the SAs change
+		log.Infof("Key nonce of %s changed, renewing its SAs", remoteIP)
+		km.deleteSAs(p)
+		ok = false
+	}
+	if !ok {
+		p = &peerSAs{localIP: localIP, publicIP: remoteIP, nonce: attrs.KeyNonce}
+		km.peers[key] = p
+	}
+	return km.sync(p, km.epoch(time.Now()))
+}
+
+// removePeer removes the SAs with remoteIP.
+func (km *xfrmKeyManager) removePeer(remoteIP net.IP) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	key := remoteIP.String()
+	if p, ok := km.peers[key]; ok {
+		km.deleteSAs(p)
+		delete(km.peers, key)
+	}
+}
+
+// sync installs the SAs of an epoch with a peer and removes the older ones.
+// It must be called with km.mu held.
+func (km *xfrmKeyManager) sync(p *peerSAs, epoch uint64) error {
+	var errs []error
+
+	// The newest outbound SA is used by the kernel, the previous one is
+	// removed once the new one is installed
+	if outboundEpoch, ok := km.outboundEpoch(p, epoch); ok {
+		outbound, err := km.install(p.localIP, p.publicIP, km.nonce, p.nonce, p.outbound, []uint64{outboundEpoch})
+		if err == nil {
+			km.usedOutbound[usedKey(p)] = outboundEpoch
+			outbound = km.prune(p.localIP, p.publicIP, outbound, []uint64{outboundEpoch})
+		}
+		p.outbound = outbound
+		errs = append(errs, err)
+	} else {
+		log.Warningf("The outbound ipsec SAs with %s of epochs %d and %d were already used, waiting for the next epoch", p.publicIP, epoch, epoch+1)
+	}
+
+	inboundEpochs := []uint64{epoch, epoch + 1}
+	if epoch > 0 {
+		inboundEpochs = append(inboundEpochs, epoch-1)
+	}
+	inbound, err := km.install(p.publicIP, p.localIP, p.nonce, km.nonce, p.inbound, inboundEpochs)
+	errs = append(errs, err)
+	p.inbound = km.prune(p.publicIP, p.localIP, inbound, inboundEpochs)
+
+	return errors.Join(errs...)
+}
+
+// outboundEpoch returns the epoch of the outbound SA with a peer: the epoch
+// of the installed SA if it's still accepted by the peer, otherwise the
+// current epoch, or the next one if the SA of the current epoch was already
+// installed. It returns false if both were. It must be called with km.mu
+// held.
+func (km *xfrmKeyManager) outboundEpoch(p *peerSAs, epoch uint64) (uint64, bool) {
+	for _, s := range p.outbound {
+		if s.epoch == epoch || s.epoch == epoch+1 {
+			return s.epoch, true
+		}
+	}
+
+	next := epoch
+	if used, ok := km.usedOutbound[usedKey(p)]; ok && used >= next {
+		next = used + 1
+	}
+	return next, next <= epoch+1
+}
+
+func usedKey(p *peerSAs) string {
+	return fmt.Sprintf("%s/%x", p.publicIP, p.nonce)
+}
+
+// install adds the SAs from src to dst of the epochs missing from installed.
+func (km *xfrmKeyManager) install(src, dst net.IP, srcNonce, dstNonce []byte, installed []sa, epochs []uint64) ([]sa, error) {
+	for _, epoch := range epochs {
+		if containsEpoch(installed, epoch) {
+			continue
+		}
+		state, err := km.state(src, dst, srcNonce, dstNonce, epoch)
+		if err != nil {
+			return installed, err
+		}
+		log.V(2).Infof("Adding ipsec state %v -> %v spi 0x%x for epoch %d", src, dst, state.Spi, epoch)
+		if err := netlink.XfrmStateAdd(state); err != nil {
+			if !errors.Is(err, syscall.EEXIST) {
+				return installed, fmt.Errorf("error adding ipsec state %v -> %v: %v", src, dst, err)
+			}
+			if err := netlink.XfrmStateUpdate(state); err != nil {
+				return installed, fmt.Errorf("error updating ipsec state %v -> %v: %v", src, dst, err)
+			}
+		}
+		installed = append(installed, sa{epoch: epoch, spi: state.Spi})
+	}
+	return installed, nil
+}
+
+// prune removes the SAs from src to dst which are not of the epochs.
+func (km *xfrmKeyManager) prune(src, dst net.IP, installed []sa, epochs []uint64) []sa {
+	kept := installed[:0]
+	for _, s := range installed {
+		wanted := false
+		for _, epoch := range epochs {
+			wanted = wanted || s.epoch == epoch
+		}
+		if wanted {
+			kept = append(kept, s)
+			continue
+		}
+		if err := km.deleteState(src, dst, s.spi); err != nil {
+			log.Error(err)
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// deleteSAs removes all the SAs with a peer. It must be called with km.mu held.
+func (km *xfrmKeyManager) deleteSAs(p *peerSAs) {
+	p.outbound = km.prune(p.localIP, p.publicIP, p.outbound, nil)
+	p.inbound = km.prune(p.publicIP, p.localIP, p.inbound, nil)
+}
+
+func (km *xfrmKeyManager) deleteState(src, dst net.IP, spi int) error {
+	log.V(2).Infof("Deleting ipsec state %v -> %v spi 0x%x", src, dst, spi)
+	state := &netlink.XfrmState{Src: src, Dst: dst, Proto: netlink.XFRM_PROTO_ESP, Spi: spi}
+	if err := netlink.XfrmStateDel(state); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("error deleting ipsec state %v -> %v spi 0x%x: %v", src, dst, spi, err)
+	}
+	return nil
+}
+
+func containsEpoch(sas []sa, epoch uint64) bool {
+	for _, s := range sas {
+		if s.epoch == epoch {
+			return true
+		}
+	}
+	return false
+}
+
+// run renews the SAs at the beginning of each epoch.
+func (km *xfrmKeyManager) run(ctx context.Context) {
+	for {
+		now := time.Now()
+		next := time.Unix(int64((km.epoch(now)+1)*uint64(km.rekeyInterval/time.Second)), 0)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		km.mu.Lock()
+		epoch := km.epoch(time.Now())
+		log.Infof("Renewing the ipsec SAs for epoch %d", epoch)
+		for key, used := range km.usedOutbound {
+			// The SAs of the past epochs are never installed again
+			if used < epoch {
+				delete(km.usedOutbound, key)
+			}
+		}
+		for _, p := range km.peers {
+			if err := km.sync(p, epoch); err != nil {
+				log.Errorf("error renewing the ipsec SAs with %s: %v", p.publicIP, err)
+			}
+		}
+		km.mu.Unlock()
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package ipsec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDeriveSA(t *testing.T) {
+	hostA, hostB := net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2")
+	nonceA, nonceB := []byte("nonce of host a"), []byte("nonce of host b")
+
+	spi, key, err := deriveSA("psk", hostA, hostB, nonceA, nonceB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spi < minSPI || len(key) != espKeyLength {
+		t.Errorf("unexpected spi 0x%x, key length %d", spi, len(key))
+	}
+
+	// Both hosts derive the same SA
+	spi2, key2, _ := deriveSA("psk", hostA, hostB, nonceA, nonceB, 1)
+	if spi != spi2 || !bytes.Equal(key, key2) {
+		t.Errorf("the derivation isn't deterministic")
+	}
+
+	for name, derive := range map[string]func() (int, []byte, error){
+		"reverse direction": func() (int, []byte, error) { return deriveSA("psk", hostB, hostA, nonceB, nonceA, 1) },
+		"next epoch":        func() (int, []byte, error) { return deriveSA("psk", hostA, hostB, nonceA, nonceB, 2) },
+		"new nonce":         func() (int, []byte, error) { return deriveSA("psk", hostA, hostB, []byte("restarted"), nonceB, 1) },
+		"other psk":         func() (int, []byte, error) { return deriveSA("other", hostA, hostB, nonceA, nonceB, 1) },
+	} {
+		otherSPI, otherKey, err := derive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if otherSPI == spi || bytes.Equal(otherKey, key) {
+			t.Errorf("%s: the SA should change", name)
+		}
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	km := newXFRMKeyManager("psk", nil, time.Hour, defaultReqID)
+	start := time.Unix(3600*42, 0)
+	if epoch := km.epoch(start); epoch != 42 {
+		t.Errorf("unexpected epoch %d", epoch)
+	}
+	if epoch := km.epoch(start.Add(time.Hour - time.Second)); epoch != 42 {
+		t.Errorf("unexpected epoch %d", epoch)
+	}
+	if epoch := km.epoch(start.Add(time.Hour)); epoch != 43 {
+		t.Errorf("unexpected epoch %d", epoch)
+	}
+}
+
+func TestReAddPeer(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	local, remote := net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2")
+	// The epoch doesn't change during the test
+	km := newXFRMKeyManager("psk", []byte("local nonce"), 24*365*time.Hour, defaultReqID)
+	remoteLease := newTestLease("10.244.2.0/24", "192.168.0.2", "", "")
+	remoteLease.Attrs.BackendData, _ = json.Marshal(&ipsecLeaseAttrs{KeyNonce: []byte("remote nonce")})
+
+	outboundKey := func() []byte {
+		t.Helper()
+		states, err := netlink.XfrmStateList(netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var key []byte
+		for _, s := range states {
+			if s.Src.Equal(local) {
+				if key != nil {
+					t.Fatalf("more than one outbound SA: %+v", states)
+				}
+				key = s.Aead.Key
+			}
+		}
+		return key
+	}
+
+	// The states need the esp4 module and the AES-GCM algorithm
+	probe, err := km.state(local, remote, []byte("probe"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.XfrmStateAdd(probe); errors.Is(err, syscall.ENOSYS) {
+		t.Skip("the ESP states aren't supported")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.XfrmStateDel(probe); err != nil {
+		t.Fatal(err)
+	}
+	if err := km.addPeer(local, remote, remoteLease); err != nil {
+		t.Fatal(err)
+	}
+	first := outboundKey()
+	if first == nil {
+		t.Fatal("no outbound SA installed")
+	}
+
+	// The lease of the peer is removed and added again with the same nonce,
+	// the outbound SA of the next epoch is used
+	km.removePeer(remote)
+	if err := km.addPeer(local, remote, remoteLease); err != nil {
+		t.Fatal(err)
+	}
+	second := outboundKey()
+	if second == nil || bytes.Equal(first, second) {
+		t.Fatal("the outbound SA was installed again with the same key")
+	}
+
+	// Both SAs were used, none is installed until the next epoch
+	km.removePeer(remote)
+	if err := km.addPeer(local, remote, remoteLease); err != nil {
+		t.Fatal(err)
+	}
+	if key := outboundKey(); key != nil {
+		t.Fatalf("an outbound SA was installed again: %x", key)
+	}
+	if err := km.sync(km.peers[remote.String()], km.epoch(time.Now())+1); err != nil {
+		t.Fatal(err)
+	}
+	if third := outboundKey(); third == nil || bytes.Equal(third, first) || bytes.Equal(third, second) {
+		t.Fatal("the outbound SA of the next epoch reused a key")
+	}
+}
+
+func TestOutboundEpoch(t *testing.T) {
+	km := newXFRMKeyManager("psk", []byte("local nonce"), time.Hour, defaultReqID)
+	p := &peerSAs{localIP: net.ParseIP("192.168.0.1"), publicIP: net.ParseIP("192.168.0.2"), nonce: []byte("remote nonce")}
+
+	if epoch, ok := km.outboundEpoch(p, 42); !ok || epoch != 42 {
+		t.Errorf("expected the SA of the current epoch, got %d", epoch)
+	}
+	// The installed SA is kept until the next epoch
+	p.outbound = []sa{{epoch: 42}}
+	km.usedOutbound[usedKey(p)] = 42
+	if epoch, ok := km.outboundEpoch(p, 42); !ok || epoch != 42 {
+		t.Errorf("expected the installed SA, got %d", epoch)
+	}
+	if epoch, ok := km.outboundEpoch(p, 43); !ok || epoch != 43 {
+		t.Errorf("expected the SA of the next epoch, got %d", epoch)
+	}
+
+	// The peer was removed, the SA of the current epoch was already used
+	p.outbound = nil
+	if epoch, ok := km.outboundEpoch(p, 42); !ok || epoch != 43 {
+		t.Errorf("expected the SA of the next epoch, got %d", epoch)
+	}
+	km.usedOutbound[usedKey(p)] = 43
+	if epoch, ok := km.outboundEpoch(p, 42); ok {
+		t.Errorf("the SA of the epoch %d was already used", epoch)
+	}
+
+	// The SAs are only used once with the nonce of the peer
+	p.nonce = []byte("restarted")
+	if epoch, ok := km.outboundEpoch(p, 42); !ok || epoch != 42 {
+		t.Errorf("expected the SA of the current epoch, got %d", epoch)
+	}
+}
@@ -22,15 +22,13 @@ import (
 	"net"
 	"syscall"
 
-	"github.com/flannel-io/flannel/pkg/lease"
 	"github.com/vishvananda/netlink"
 	log "k8s.io/klog/v2"
 )
 
-func AddXFRMPolicy(myLease, remoteLease *lease.Lease, dir netlink.Dir, reqID int) error {
-	src := myLease.Subnet.ToIPNet()
-
-	dst := remoteLease.Subnet.ToIPNet()
+func AddXFRMPolicy(localSubnet, remoteSubnet *net.IPNet, localPublicIP, remotePublicIP net.IP, dir netlink.Dir, reqID int) error {
+	src := localSubnet
+	dst := remoteSubnet
 
 	policy := &netlink.XfrmPolicy{
 		Src: src,
@@ -38,8 +36,8 @@ func AddXFRMPolicy(myLease, remoteLease *lease.Lease, dir netlink.Dir, reqID int
 		Dir: dir,
 	}
 
-	tunnelLeft := myLease.Attrs.PublicIP.ToIP()
-	tunnelRight := remoteLease.Attrs.PublicIP.ToIP()
+	tunnelLeft := localPublicIP
+	tunnelRight := remotePublicIP
 
 	tmpl := netlink.XfrmPolicyTmpl{
 		Src:   tunnelLeft,
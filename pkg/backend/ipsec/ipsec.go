@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/flannel-io/flannel/pkg/ip"
@@ -42,6 +43,9 @@ import (
 
 	The file "handle_xfrm.go" contains functions for adding and removing the ipsec polcies.
 
+	The file "handle_keys.go" contains the native key management, used instead of the charon when KeyManagement is
+	"native". It derives the ESP keys from the PSK and installs the SAs directly in the kernel.
+
 	ipsec_network.go ties it all together, loading the PSK for current host on startu and as new hosts are added and
 	removed it, adds/removes the PSK and connection details to strongswan and adds/remove the policy to the kernel.
 */
@@ -74,12 +78,16 @@ func (be *IPSECBackend) RegisterNetwork(
 	ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 
 	cfg := struct {
-		UDPEncap    bool
-		ESPProposal string
-		PSK         string
+		UDPEncap      bool
+		ESPProposal   string
+		PSK           string
+		KeyManagement string
+		RekeyInterval int
 	}{
-		UDPEncap:    false,
-		ESPProposal: defaultESPProposal,
+		UDPEncap:      false,
+		ESPProposal:   defaultESPProposal,
+		KeyManagement: keyManagementStrongswan,
+		RekeyInterval: defaultRekeyInterval,
 	}
 
 	if len(config.Backend) > 0 {
@@ -92,12 +100,46 @@ func (be *IPSECBackend) RegisterNetwork(
 		return nil, fmt.Errorf("config error, password is too short")
 	}
 
-	log.Infof("IPSec config: UDPEncap=%v ESPProposal=%s", cfg.UDPEncap, cfg.ESPProposal)
+	switch cfg.KeyManagement {
+	case keyManagementStrongswan:
+		log.Infof("IPSec config: UDPEncap=%v ESPProposal=%s", cfg.UDPEncap, cfg.ESPProposal)
+	case keyManagementNative:
+		if cfg.UDPEncap {
+			return nil, fmt.Errorf("config error, UDPEncap is not supported with the native key management")
+		}
+		if cfg.RekeyInterval <= 0 {
+			return nil, fmt.Errorf("config error, RekeyInterval must be positive")
+		}
+		log.Infof("IPSec config: KeyManagement=%s RekeyInterval=%d", cfg.KeyManagement, cfg.RekeyInterval)
+	default:
+		return nil, fmt.Errorf("config error, unknown KeyManagement %q", cfg.KeyManagement)
+	}
 
 	attrs := lease.LeaseAttrs{
-		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
 		BackendType: "ipsec",
 	}
+	if config.EnableIPv4 {
+		attrs.PublicIP = ip.FromIP(be.extIface.ExtAddr)
+	}
+	if config.EnableIPv6 {
+		if be.extIface.ExtV6Addr == nil {
+			return nil, fmt.Errorf("no IPv6 public address to encrypt the IPv6 traffic")
+		}
+		attrs.PublicIPv6 = ip.FromIP6(be.extIface.ExtV6Addr)
+	}
+
+	var nonce []byte
+	if cfg.KeyManagement == keyManagementNative {
+		var err error
+		if nonce, err = newNonce(); err != nil {
+			return nil, fmt.Errorf("error generating the key nonce: %v", err)
+		}
+		data, err := json.Marshal(&ipsecLeaseAttrs{KeyNonce: nonce})
+		if err != nil {
+			return nil, err
+		}
+		attrs.BackendData = json.RawMessage(data)
+	}
 
 	l, err := be.sm.AcquireLease(ctx, &attrs)
 
@@ -111,10 +153,18 @@ func (be *IPSECBackend) RegisterNetwork(
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
+	if cfg.KeyManagement == keyManagementNative {
+		keys := newXFRMKeyManager(cfg.PSK, nonce, time.Duration(cfg.RekeyInterval)*time.Second, defaultReqID)
+		if err := keys.flush(); err != nil {
+			return nil, err
+		}
+		return newNetwork(be.sm, be.extIface, cfg.UDPEncap, cfg.PSK, nil, keys, l)
+	}
+
 	ikeDaemon, err := NewCharonIKEDaemon(ctx, wg, cfg.ESPProposal)
 	if err != nil {
 		return nil, fmt.Errorf("error creating CharonIKEDaemon struct: %v", err)
 	}
 
-	return newNetwork(be.sm, be.extIface, cfg.UDPEncap, cfg.PSK, ikeDaemon, l)
+	return newNetwork(be.sm, be.extIface, cfg.UDPEncap, cfg.PSK, ikeDaemon, nil, l)
 }
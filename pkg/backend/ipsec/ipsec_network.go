@@ -43,6 +43,8 @@ const (
 	*/
 	ipsecOverhead    = 77
 	udpEncapOverhead = 8
+	// The IPv6 header is 20 bytes longer than the IPv4 header
+	ipv6Overhead = 20
 
 	defaultReqID = 11
 )
@@ -53,10 +55,45 @@ type network struct {
 	UDPEncap bool
 	sm       subnet.Manager
 	iked     *CharonIKEDaemon
+	// keys installs the SAs with the native key management, instead of iked
+	keys *xfrmKeyManager
+}
+
+// tunnel is the IPsec tunnel between the subnets of two hosts on an address
+// family.
+type tunnel struct {
+	localSubnet  *net.IPNet
+	remoteSubnet *net.IPNet
+	localIP      net.IP
+	remoteIP     net.IP
+}
+
+// tunnels returns the tunnels between the local and the remote lease, on the
+// address families enabled on both hosts.
+func tunnels(localLease, remoteLease *lease.Lease) []tunnel {
+	var ts []tunnel
+	if localLease.EnableIPv4 && remoteLease.EnableIPv4 {
+		ts = append(ts, tunnel{
+			localSubnet:  localLease.Subnet.ToIPNet(),
+			remoteSubnet: remoteLease.Subnet.ToIPNet(),
+			localIP:      localLease.Attrs.PublicIP.ToIP(),
+			remoteIP:     remoteLease.Attrs.PublicIP.ToIP(),
+		})
+	}
+	if localLease.EnableIPv6 && remoteLease.EnableIPv6 &&
+		localLease.Attrs.PublicIPv6 != nil && remoteLease.Attrs.PublicIPv6 != nil {
+		ts = append(ts, tunnel{
+			localSubnet:  localLease.IPv6Subnet.ToIPNet(),
+			remoteSubnet: remoteLease.IPv6Subnet.ToIPNet(),
+			localIP:      localLease.Attrs.PublicIPv6.ToIP(),
+			remoteIP:     remoteLease.Attrs.PublicIPv6.ToIP(),
+		})
+	}
+	return ts
 }
 
 func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface,
-	UDPEncap bool, password string, ikeDaemon *CharonIKEDaemon,
+	UDPEncap bool, password string, ikeDaemon *CharonIKEDaemon, keys *xfrmKeyManager,
 	l *lease.Lease) (*network, error) {
 	n := &network{
 		SimpleNetwork: backend.SimpleNetwork{
@@ -65,6 +102,7 @@ func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface,
 		},
 		sm:       sm,
 		iked:     ikeDaemon,
+		keys:     keys,
 		password: password,
 		UDPEncap: UDPEncap,
 	}
@@ -73,16 +111,25 @@ func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface,
 }
 
 func (n *network) Run(ctx context.Context) {
-
-	err := n.iked.LoadSharedKey(n.SimpleNetwork.SubnetLease.Attrs.PublicIP.ToIP().String(), n.password)
-	if err != nil {
-		log.Errorf("Failed to load PSK: %v", err)
-		return
-	}
-
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
 
+	if n.keys != nil {
+		wg.Add(1)
+		go func() {
+			n.keys.run(ctx)
+			wg.Done()
+		}()
+	} else {
+		for _, publicIP := range n.publicIPs() {
+			err := n.iked.LoadSharedKey(publicIP.String(), n.password)
+			if err != nil {
+				log.Errorf("Failed to load PSK: %v", err)
+				return
+			}
+		}
+	}
+
 	log.Info("Watching for new subnet leases")
 
 	evts := make(chan []lease.Event)
@@ -109,77 +156,128 @@ func (n *network) handleSubnetEvents(batch []lease.Event) {
 	for _, evt := range batch {
 		switch evt.Type {
 		case lease.EventAdded:
-			log.Info("Subnet added: ", evt.Lease.Subnet)
+			log.Info("Subnet added: ", subnetsOf(&evt.Lease))
 
 			if evt.Lease.Attrs.BackendType != "ipsec" {
 				log.Warningf("Ignoring non-ipsec event: type: %v", evt.Lease.Attrs.BackendType)
 				continue
 			}
 
-			if evt.Lease.Subnet.Equal(n.SubnetLease.Subnet) {
+			if n.isOwnLease(&evt.Lease) {
 				log.Warningf("Ignoring own lease add event: %+v", evt.Lease)
 				continue
 			}
 
-			if err := n.AddIPSECPolicies(&evt.Lease, defaultReqID); err != nil {
-				log.Errorf("error adding ipsec policy: %v", err)
-			}
-
-			if err := n.iked.LoadSharedKey(evt.Lease.Attrs.PublicIP.String(), n.password); err != nil {
-				log.Errorf("error loading shared key into IKE daemon: %v", err)
-			}
-
-			if err := n.iked.LoadConnection(n.SubnetLease, &evt.Lease, strconv.Itoa(defaultReqID),
-				strconv.FormatBool(n.UDPEncap)); err != nil {
-				log.Errorf("error loading connection into IKE daemon: %v", err)
+			for _, t := range tunnels(n.SubnetLease, &evt.Lease) {
+				if err := n.AddIPSECPolicies(t, defaultReqID); err != nil {
+					log.Errorf("error adding ipsec policy: %v", err)
+				}
+
+				if n.keys != nil {
+					if err := n.keys.addPeer(t.localIP, t.remoteIP, &evt.Lease); err != nil {
+						log.Errorf("error adding ipsec states: %v", err)
+					}
+					continue
+				}
+
+				if err := n.iked.LoadSharedKey(t.remoteIP.String(), n.password); err != nil {
+					log.Errorf("error loading shared key into IKE daemon: %v", err)
+				}
+
+				if err := n.iked.LoadConnection(t, strconv.Itoa(defaultReqID),
+					strconv.FormatBool(n.UDPEncap)); err != nil {
+					log.Errorf("error loading connection into IKE daemon: %v", err)
+				}
 			}
 
 		case lease.EventRemoved:
-			log.Info("Subnet removed: ", evt.Lease.Subnet)
+			log.Info("Subnet removed: ", subnetsOf(&evt.Lease))
 			if evt.Lease.Attrs.BackendType != "ipsec" {
 				log.Warningf("Ignoring non-ipsec event: type: %v", evt.Lease.Attrs.BackendType)
 				continue
 			}
 
-			if evt.Lease.Subnet.Equal(n.SubnetLease.Subnet) {
+			if n.isOwnLease(&evt.Lease) {
 				log.Warningf("Ignoring own lease remove event: %+v", evt.Lease)
 				continue
 			}
 
-			if err := n.iked.UnloadCharonConnection(n.SubnetLease, &evt.Lease); err != nil {
-				log.Errorf("error unloading charon connections: %v", err)
-			}
+			for _, t := range tunnels(n.SubnetLease, &evt.Lease) {
+				if n.keys != nil {
+					n.keys.removePeer(t.remoteIP)
+				} else if err := n.iked.UnloadCharonConnection(t); err != nil {
+					log.Errorf("error unloading charon connections: %v", err)
+				}
 
-			if err := n.DeleteIPSECPolicies(n.SubnetLease.Subnet.ToIPNet(), evt.Lease.Subnet.ToIPNet(),
-				n.SubnetLease.Attrs.PublicIP.ToIP(), evt.Lease.Attrs.PublicIP.ToIP(), defaultReqID); err != nil {
+				if err := n.DeleteIPSECPolicies(t.localSubnet, t.remoteSubnet,
+					t.localIP, t.remoteIP, defaultReqID); err != nil {
 
-				log.Errorf("error deleting ipsec policies: %v", err)
+					log.Errorf("error deleting ipsec policies: %v", err)
+				}
 			}
 		}
 	}
 }
 
+// isOwnLease tells if a lease has the subnets of the local lease.
+func (n *network) isOwnLease(l *lease.Lease) bool {
+	if n.SubnetLease.EnableIPv4 && l.EnableIPv4 {
+		return l.Subnet.Equal(n.SubnetLease.Subnet)
+	}
+	if n.SubnetLease.EnableIPv6 && l.EnableIPv6 && l.IPv6Subnet.IP != nil && n.SubnetLease.IPv6Subnet.IP != nil {
+		return l.IPv6Subnet.Equal(n.SubnetLease.IPv6Subnet)
+	}
+	return false
+}
+
+// publicIPs returns the public IPs of the local host on the enabled address
+// families.
+func (n *network) publicIPs() []net.IP {
+	var ips []net.IP
+	if n.SubnetLease.EnableIPv4 {
+		ips = append(ips, n.SubnetLease.Attrs.PublicIP.ToIP())
+	}
+	if n.SubnetLease.EnableIPv6 && n.SubnetLease.Attrs.PublicIPv6 != nil {
+		ips = append(ips, n.SubnetLease.Attrs.PublicIPv6.ToIP())
+	}
+	return ips
+}
+
+func subnetsOf(l *lease.Lease) []string {
+	var subnets []string
+	if l.EnableIPv4 {
+		subnets = append(subnets, l.Subnet.String())
+	}
+	if l.EnableIPv6 {
+		subnets = append(subnets, l.IPv6Subnet.String())
+	}
+	return subnets
+}
+
 func (n *network) MTU() int {
 	mtu := n.ExtIface.Iface.MTU - ipsecOverhead
 	if n.UDPEncap {
 		mtu -= udpEncapOverhead
 	}
+	if n.SubnetLease.EnableIPv6 {
+		mtu -= ipv6Overhead
+	}
 
 	return mtu
 }
 
-func (n *network) AddIPSECPolicies(remoteLease *lease.Lease, reqID int) error {
-	err := AddXFRMPolicy(n.SubnetLease, remoteLease, netlink.XFRM_DIR_OUT, reqID)
+func (n *network) AddIPSECPolicies(t tunnel, reqID int) error {
+	err := AddXFRMPolicy(t.localSubnet, t.remoteSubnet, t.localIP, t.remoteIP, netlink.XFRM_DIR_OUT, reqID)
 	if err != nil {
 		return fmt.Errorf("error adding ipsec out policy: %v", err)
 	}
 
-	err = AddXFRMPolicy(remoteLease, n.SubnetLease, netlink.XFRM_DIR_IN, reqID)
+	err = AddXFRMPolicy(t.remoteSubnet, t.localSubnet, t.remoteIP, t.localIP, netlink.XFRM_DIR_IN, reqID)
 	if err != nil {
 		return fmt.Errorf("error adding ipsec in policy: %v", err)
 	}
 
-	err = AddXFRMPolicy(remoteLease, n.SubnetLease, netlink.XFRM_DIR_FWD, reqID)
+	err = AddXFRMPolicy(t.remoteSubnet, t.localSubnet, t.remoteIP, t.localIP, netlink.XFRM_DIR_FWD, reqID)
 	if err != nil {
 		return fmt.Errorf("error adding ipsec fwd policy: %v", err)
 	}
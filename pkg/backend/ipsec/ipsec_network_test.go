@@ -0,0 +1,84 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package ipsec
+
+import (
+	"net"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+)
+
+func newTestLease(subnet, publicIP, v6Subnet, publicIPv6 string) *lease.Lease {
+	l := &lease.Lease{}
+	if subnet != "" {
+		_, n, _ := net.ParseCIDR(subnet)
+		l.EnableIPv4 = true
+		l.Subnet = ip.FromIPNet(n)
+		l.Attrs.PublicIP = ip.FromIP(net.ParseIP(publicIP))
+	}
+	if v6Subnet != "" {
+		_, n, _ := net.ParseCIDR(v6Subnet)
+		l.EnableIPv6 = true
+		l.IPv6Subnet = ip.FromIP6Net(n)
+		l.Attrs.PublicIPv6 = ip.FromIP6(net.ParseIP(publicIPv6))
+	}
+	return l
+}
+
+func TestTunnels(t *testing.T) {
+	local := newTestLease("10.244.1.0/24", "192.168.0.1", "fd00:10:244:1::/64", "fd00::1")
+	remote := newTestLease("10.244.2.0/24", "192.168.0.2", "fd00:10:244:2::/64", "fd00::2")
+
+	ts := tunnels(local, remote)
+	if len(ts) != 2 {
+		t.Fatalf("expected a tunnel per family, got %+v", ts)
+	}
+	if ts[0].localSubnet.String() != "10.244.1.0/24" || ts[0].remoteSubnet.String() != "10.244.2.0/24" ||
+		!ts[0].localIP.Equal(net.ParseIP("192.168.0.1")) || !ts[0].remoteIP.Equal(net.ParseIP("192.168.0.2")) {
+		t.Errorf("unexpected IPv4 tunnel %+v", ts[0])
+	}
+	if ts[1].localSubnet.String() != "fd00:10:244:1::/64" || ts[1].remoteSubnet.String() != "fd00:10:244:2::/64" ||
+		!ts[1].localIP.Equal(net.ParseIP("fd00::1")) || !ts[1].remoteIP.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("unexpected IPv6 tunnel %+v", ts[1])
+	}
+	if name := formatConnectionName(ts[0]); name != "192.168.0.1-10.244.1.0/24-10.244.2.0/24-192.168.0.2" {
+		t.Errorf("unexpected connection name %q", name)
+	}
+
+	// Only the families enabled on both hosts are encrypted
+	v4Only := newTestLease("10.244.3.0/24", "192.168.0.3", "", "")
+	if ts := tunnels(local, v4Only); len(ts) != 1 || ts[0].remoteSubnet.String() != "10.244.3.0/24" {
+		t.Errorf("unexpected tunnels %+v", ts)
+	}
+	v6Only := newTestLease("", "", "fd00:10:244:4::/64", "fd00::4")
+	if ts := tunnels(v4Only, v6Only); len(ts) != 0 {
+		t.Errorf("unexpected tunnels %+v", ts)
+	}
+}
+
+func TestIsOwnLease(t *testing.T) {
+	n := &network{}
+	n.SubnetLease = newTestLease("", "", "fd00:10:244:1::/64", "fd00::1")
+	if !n.isOwnLease(newTestLease("", "", "fd00:10:244:1::/64", "fd00::1")) {
+		t.Errorf("the IPv6 lease should be the own lease")
+	}
+	if n.isOwnLease(newTestLease("", "", "fd00:10:244:2::/64", "fd00::2")) {
+		t.Errorf("the IPv6 lease shouldn't be the own lease")
+	}
+}
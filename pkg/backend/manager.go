@@ -27,6 +27,10 @@ var constructors = make(map[string]BackendCtor)
 
 type Manager interface {
 	GetBackend(backendType string) (Backend, error)
+	// GetMigrationBackend returns a backend running the backends of both
+	// types, the migration backend being used with the peers which support
+	// it.
+	GetMigrationBackend(backendType, migrationBackendType string) (Backend, error)
 }
 
 type manager struct {
@@ -88,6 +92,33 @@ func (bm *manager) GetBackend(backendType string) (Backend, error) {
 	return be, nil
 }
 
+func (bm *manager) GetMigrationBackend(backendType, migrationBackendType string) (Backend, error) {
+	betype := strings.ToLower(backendType)
+	mbetype := strings.ToLower(migrationBackendType)
+	if betype == mbetype {
+		return nil, fmt.Errorf("cannot migrate from the %v backend to itself", betype)
+	}
+
+	shared := NewSharedLease(bm.sm, &migrationCodec{backendType: betype, migrationBackendType: mbetype}, 2)
+	var backends []Backend
+	for i, bt := range []string{betype, mbetype} {
+		befunc, ok := constructors[bt]
+		if !ok {
+			return nil, fmt.Errorf("unknown backend type: %v", bt)
+		}
+
+		// The backends get the leases of the peers they handle from their
+		// own subnet manager
+		be, err := befunc(shared.Manager(i), bm.extIface)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, be)
+	}
+
+	return &migrationBackend{shared: shared, backend: backends[0], migration: backends[1]}, nil
+}
+
 func Register(name string, ctor BackendCtor) {
 	constructors[name] = ctor
 }
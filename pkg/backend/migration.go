@@ -0,0 +1,122 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+// A migration runs the backend of the cluster and the backend the cluster
+// migrates to side by side. The lease of the node advertises the backend
+// data of both backends:
+//   - the migration backend handles the peers which advertise it,
+//   - the other backend handles the remaining peers.
+//
+// Both ends of a connection make the same choice, so the migration backend is
+// used between the nodes which support it and the cluster keeps working while
+// the nodes are restarted with the new configuration one by one.
+type migrationCodec struct {
+	backendType          string
+	migrationBackendType string
+}
+
+// Merge adds the backend data of the migration backend to the attributes of
+// the backend, which must acquire the lease first.
+func (c *migrationCodec) Merge(attrs []*lease.LeaseAttrs) (*lease.LeaseAttrs, error) {
+	if attrs[0] == nil {
+		return nil, fmt.Errorf("the %s backend must acquire the lease before the %s backend", c.backendType, c.migrationBackendType)
+	}
+	merged := *attrs[0]
+	if m := attrs[1]; m != nil {
+		merged.MigrationBackendType = m.BackendType
+		merged.MigrationBackendData = m.BackendData
+		merged.MigrationBackendV6Data = m.BackendV6Data
+		if merged.PublicIPv6 == nil {
+			merged.PublicIPv6 = m.PublicIPv6
+		}
+	}
+	return &merged, nil
+}
+
+func (c *migrationCodec) View(l lease.Lease, i int) (lease.Lease, bool) {
+	if i == 0 {
+		return migrationView(l, c.backendType)
+	}
+	return migrationView(l, c.migrationBackendType)
+}
+
+func (c *migrationCodec) Select(l lease.Lease) int {
+	if _, ok := migrationView(l, c.migrationBackendType); ok {
+		return 1
+	}
+	if _, ok := migrationView(l, c.backendType); ok {
+		return 0
+	}
+	return -1
+}
+
+// migrationView returns the lease as seen by the backend of the given type,
+// with the backend data of this backend, or false if the lease doesn't
+// advertise the backend.
+func migrationView(l lease.Lease, backendType string) (lease.Lease, bool) {
+	attrs := l.Attrs
+	switch backendType {
+	case attrs.BackendType:
+	case attrs.MigrationBackendType:
+		attrs.BackendType = attrs.MigrationBackendType
+		attrs.BackendData = attrs.MigrationBackendData
+		attrs.BackendV6Data = attrs.MigrationBackendV6Data
+	default:
+		return l, false
+	}
+	attrs.MigrationBackendType = ""
+	attrs.MigrationBackendData = nil
+	attrs.MigrationBackendV6Data = nil
+	l.Attrs = attrs
+	return l, true
+}
+
+type migrationBackend struct {
+	shared    *SharedLease
+	backend   Backend
+	migration Backend
+}
+
+// RegisterNetwork registers the network of the backend and then the network of
+// the migration backend, each with its own section of the config.
+func (be *migrationBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (Network, error) {
+	backendConfig := *config
+	backendConfig.MigrationBackend = nil
+	backendConfig.MigrationBackendType = ""
+	migrationConfig := backendConfig
+	migrationConfig.Backend = config.MigrationBackend
+	migrationConfig.BackendType = config.MigrationBackendType
+
+	bn, err := be.backend.RegisterNetwork(ctx, wg, &backendConfig)
+	if err != nil {
+		return nil, err
+	}
+	mn, err := be.migration.RegisterNetwork(ctx, wg, &migrationConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register the network of the %s migration backend: %v", config.MigrationBackendType, err)
+	}
+
+	return &SharedNetwork{Shared: be.shared, Networks: []Network{bn, mn}}, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+// fakeLeaseManager allocates the same subnet to the node and sends the watch
+// results of the test.
+type fakeLeaseManager struct {
+	subnet.Manager
+	attrs   []lease.LeaseAttrs
+	results chan []lease.LeaseWatchResult
+}
+
+func (m *fakeLeaseManager) AcquireLease(ctx context.Context, attrs *lease.LeaseAttrs) (*lease.Lease, error) {
+	m.attrs = append(m.attrs, *attrs)
+	return &lease.Lease{
+		EnableIPv4: true,
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4("10.5.1.0"), PrefixLen: 24},
+		Attrs:      *attrs,
+	}, nil
+}
+
+func (m *fakeLeaseManager) WatchLeases(ctx context.Context, receiver chan []lease.LeaseWatchResult) error {
+	for {
+		select {
+		case results := <-m.results:
+			receiver <- results
+		case <-ctx.Done():
+			close(receiver)
+			return ctx.Err()
+		}
+	}
+}
+
+func migrationLease(subnet string, backends ...string) lease.Lease {
+	l := lease.Lease{
+		EnableIPv4: true,
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4(subnet), PrefixLen: 24},
+		Attrs: lease.LeaseAttrs{
+			BackendType: backends[0],
+			BackendData: json.RawMessage(`"` + backends[0] + `"`),
+		},
+	}
+	if len(backends) > 1 {
+		l.Attrs.MigrationBackendType = backends[1]
+		l.Attrs.MigrationBackendData = json.RawMessage(`"` + backends[1] + `"`)
+	}
+	return l
+}
+
+func TestMigrationAcquireLease(t *testing.T) {
+	sm := &fakeLeaseManager{}
+	shared := NewSharedLease(sm, &migrationCodec{backendType: "vxlan", migrationBackendType: "wireguard"}, 2)
+
+	if _, err := shared.Manager(1).AcquireLease(context.Background(), &lease.LeaseAttrs{BackendType: "wireguard"}); err == nil {
+		t.Fatal("the migration backend shouldn't acquire the lease first")
+	}
+
+	attrs := migrationLease("10.5.1.0", "vxlan").Attrs
+	if _, err := shared.Manager(0).AcquireLease(context.Background(), &attrs); err != nil {
+		t.Fatal(err)
+	}
+	attrs = migrationLease("10.5.1.0", "wireguard").Attrs
+	l, err := shared.Manager(1).AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Attrs.BackendType != "wireguard" || string(l.Attrs.BackendData) != `"wireguard"` || l.Attrs.MigrationBackendType != "" {
+		t.Errorf("unexpected lease of the migration backend %+v", l.Attrs)
+	}
+
+	// The lease advertises both backends
+	advertised := migrationLease("10.5.1.0", "vxlan", "wireguard").Attrs
+	if len(sm.attrs) != 2 || sm.attrs[1].String() != advertised.String() || string(sm.attrs[1].MigrationBackendData) != `"wireguard"` {
+		t.Errorf("unexpected lease attributes %+v", sm.attrs)
+	}
+	if shared.Lease().Attrs.MigrationBackendType != "wireguard" {
+		t.Errorf("the lease of the node doesn't advertise the migration backend: %+v", shared.Lease().Attrs)
+	}
+}
+
+func expectEvents(t *testing.T, receiver chan []lease.Event, expected ...lease.Event) {
+	t.Helper()
+	select {
+	case batch := <-receiver:
+		if len(batch) != len(expected) {
+			t.Fatalf("expected %d events, got %+v", len(expected), batch)
+		}
+		for i := range batch {
+			if batch[i].Type != expected[i].Type || !batch[i].Lease.Subnet.Equal(expected[i].Lease.Subnet) ||
+				string(batch[i].Lease.Attrs.BackendData) != string(expected[i].Lease.Attrs.BackendData) {
+				t.Errorf("expected the event %+v, got %+v", expected[i], batch[i])
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %+v", expected)
+	}
+}
+
+func TestMigrationWatchLeases(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm := &fakeLeaseManager{results: make(chan []lease.LeaseWatchResult)}
+	shared := NewSharedLease(sm, &migrationCodec{backendType: "vxlan", migrationBackendType: "wireguard"}, 2)
+	own := migrationLease("10.5.1.0", "vxlan", "wireguard")
+	vxlanEvents, wireguardEvents := make(chan []lease.Event), make(chan []lease.Event)
+	go subnet.WatchLeases(ctx, shared.Manager(0), &own, vxlanEvents)
+	go subnet.WatchLeases(ctx, shared.Manager(1), &own, wireguardEvents)
+
+	// The peers are reached through the migration backend if they support
+	// it, and through the other backend otherwise
+	sm.results <- []lease.LeaseWatchResult{{Events: []lease.Event{
+		{Type: lease.EventAdded, Lease: migrationLease("10.5.2.0", "vxlan")},
+		{Type: lease.EventAdded, Lease: migrationLease("10.5.3.0", "vxlan", "wireguard")},
+		{Type: lease.EventAdded, Lease: migrationLease("10.5.4.0", "wireguard")},
+		{Type: lease.EventAdded, Lease: migrationLease("10.5.5.0", "udp")},
+	}}}
+	expectEvents(t, vxlanEvents, lease.Event{Type: lease.EventAdded, Lease: migrationLease("10.5.2.0", "vxlan")})
+	expectEvents(t, wireguardEvents,
+		lease.Event{Type: lease.EventAdded, Lease: migrationLease("10.5.3.0", "wireguard")},
+		lease.Event{Type: lease.EventAdded, Lease: migrationLease("10.5.4.0", "wireguard")})
+
+	// The peer moves to the migration backend when it's restarted
+	sm.results <- []lease.LeaseWatchResult{{Events: []lease.Event{
+		{Type: lease.EventAdded, Lease: migrationLease("10.5.2.0", "vxlan", "wireguard")},
+	}}}
+	expectEvents(t, vxlanEvents, lease.Event{Type: lease.EventRemoved, Lease: migrationLease("10.5.2.0", "vxlan")})
+	expectEvents(t, wireguardEvents, lease.Event{Type: lease.EventAdded, Lease: migrationLease("10.5.2.0", "wireguard")})
+
+	// The removal is only sent to the backend of the peer
+	sm.results <- []lease.LeaseWatchResult{{Events: []lease.Event{
+		{Type: lease.EventRemoved, Lease: migrationLease("10.5.2.0", "vxlan", "wireguard")},
+		{Type: lease.EventRemoved, Lease: migrationLease("10.5.5.0", "udp")},
+	}}}
+	expectEvents(t, wireguardEvents, lease.Event{Type: lease.EventRemoved, Lease: migrationLease("10.5.2.0", "wireguard")})
+
+	sm.results <- []lease.LeaseWatchResult{{Snapshot: []lease.Lease{
+		migrationLease("10.5.3.0", "vxlan", "wireguard"),
+		migrationLease("10.5.6.0", "vxlan"),
+	}}}
+	expectEvents(t, vxlanEvents, lease.Event{Type: lease.EventAdded, Lease: migrationLease("10.5.6.0", "vxlan")})
+	expectEvents(t, wireguardEvents, lease.Event{Type: lease.EventRemoved, Lease: migrationLease("10.5.4.0", "wireguard")})
+}
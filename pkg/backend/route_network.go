@@ -25,20 +25,30 @@ import (
 	"time"
 
 	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
 	"github.com/flannel-io/flannel/pkg/subnet"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	log "k8s.io/klog/v2"
 )
 
 const (
 	routeCheckRetries = 10
+	// routeResyncPeriod is the period of the full scan of the routes when the
+	// route updates of the kernel are watched
+	routeResyncPeriod = time.Minute
 )
 
+// RouteNetwork programs a route to the subnet of each lease. GetRoute and
+// GetV6Route return the route of a lease, or nil if its subnet doesn't need one.
+// The routes deleted or modified by someone else are restored as soon as the
+// kernel reports it, the periodic scan of the routes is only a safety net.
 type RouteNetwork struct {
 	SimpleNetwork
 	BackendType string
-	routes      []netlink.Route
-	v6Routes    []netlink.Route
+	mu          sync.Mutex
+	routes      map[string]netlink.Route // keyed by destination
+	v6Routes    map[string]netlink.Route // keyed by destination
 	SM          subnet.Manager
 	GetRoute    func(lease *lease.Lease) *netlink.Route
 	GetV6Route  func(lease *lease.Lease) *netlink.Route
@@ -61,7 +71,6 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 		wg.Done()
 	}()
 
-	n.routes = make([]netlink.Route, 0, 10)
 	wg.Add(1)
 	go func() {
 		n.routeCheck(ctx)
@@ -81,6 +90,11 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 }
 
 func (n *RouteNetwork) handleSubnetEvents(batch []lease.Event) {
+	defer metrics.ObserveSubnetEvents(n.BackendType, time.Now())
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
 	for _, evt := range batch {
 		switch evt.Type {
 		case lease.EventAdded:
@@ -93,14 +107,22 @@ func (n *RouteNetwork) handleSubnetEvents(batch []lease.Event) {
 				log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
 
 				route := n.GetRoute(&evt.Lease)
-				routeAdd(route, netlink.FAMILY_V4, n.addToRouteList, n.removeFromV4RouteList)
+				if route != nil {
+					if err := routeAdd(route, netlink.FAMILY_V4, n.addToRouteList, n.removeFromV4RouteList); err != nil {
+						metrics.SubnetEventFailed(n.BackendType)
+					}
+				}
 			}
 
 			if evt.Lease.EnableIPv6 {
 				log.Infof("Subnet added: %v via %v", evt.Lease.IPv6Subnet, evt.Lease.Attrs.PublicIPv6)
 
 				route := n.GetV6Route(&evt.Lease)
-				routeAdd(route, netlink.FAMILY_V6, n.addToV6RouteList, n.removeFromV6RouteList)
+				if route != nil {
+					if err := routeAdd(route, netlink.FAMILY_V6, n.addToV6RouteList, n.removeFromV6RouteList); err != nil {
+						metrics.SubnetEventFailed(n.BackendType)
+					}
+				}
 			}
 
 		case lease.EventRemoved:
@@ -113,11 +135,14 @@ func (n *RouteNetwork) handleSubnetEvents(batch []lease.Event) {
 				log.Info("Subnet removed: ", evt.Lease.Subnet)
 
 				route := n.GetRoute(&evt.Lease)
-				// Always remove the route from the route list.
-				n.removeFromV4RouteList(*route)
+				if route != nil {
+					// Always remove the route from the route list.
+					n.removeFromV4RouteList(*route)
 
-				if err := netlink.RouteDel(route); err != nil {
-					log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
+					if err := netlink.RouteDel(route); err != nil {
+						log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
+						metrics.SubnetEventFailed(n.BackendType)
+					}
 				}
 			}
 
@@ -125,11 +150,14 @@ func (n *RouteNetwork) handleSubnetEvents(batch []lease.Event) {
 				log.Info("Subnet removed: ", evt.Lease.IPv6Subnet)
 
 				route := n.GetV6Route(&evt.Lease)
-				// Always remove the route from the route list.
-				n.removeFromV6RouteList(*route)
+				if route != nil {
+					// Always remove the route from the route list.
+					n.removeFromV6RouteList(*route)
 
-				if err := netlink.RouteDel(route); err != nil {
-					log.Errorf("Error deleting route to %v: %v", evt.Lease.IPv6Subnet, err)
+					if err := netlink.RouteDel(route); err != nil {
+						log.Errorf("Error deleting route to %v: %v", evt.Lease.IPv6Subnet, err)
+						metrics.SubnetEventFailed(n.BackendType)
+					}
 				}
 			}
 
@@ -139,7 +167,7 @@ func (n *RouteNetwork) handleSubnetEvents(batch []lease.Event) {
 	}
 }
 
-func routeAdd(route *netlink.Route, ipFamily int, addToRouteList, removeFromRouteList func(netlink.Route)) {
+func routeAdd(route *netlink.Route, ipFamily int, addToRouteList, removeFromRouteList func(netlink.Route)) error {
 	addToRouteList(*route)
 	// Check if route exists before attempting to add it
 	routeList, err := netlink.RouteListFiltered(ipFamily, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
@@ -152,7 +180,7 @@ func routeAdd(route *netlink.Route, ipFamily int, addToRouteList, removeFromRout
 		log.Warningf("Replacing existing route to %v with %v", routeList[0], route)
 		if err := netlink.RouteDel(&routeList[0]); err != nil {
 			log.Errorf("Effor deleteing route to %v: %v", routeList[0].Dst, err)
-			return
+			return err
 		}
 		removeFromRouteList(routeList[0])
 	}
@@ -166,12 +194,13 @@ func routeAdd(route *netlink.Route, ipFamily int, addToRouteList, removeFromRout
 		log.Infof("Route to %v already exists, skipping.", route)
 	} else if err := netlink.RouteAdd(route); err != nil {
 		log.Errorf("Error adding route to %v: %s", route, err)
-		return
+		return err
 	}
 	_, err = netlink.RouteListFiltered(ipFamily, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
 	if err != nil {
 		log.Warningf("Unable to list routes: %v", err)
 	}
+	return nil
 }
 
 func (n *RouteNetwork) addToRouteList(route netlink.Route) {
@@ -182,13 +211,14 @@ func (n *RouteNetwork) addToV6RouteList(route netlink.Route) {
 	n.v6Routes = addToRouteList(&route, n.v6Routes)
 }
 
-func addToRouteList(route *netlink.Route, routes []netlink.Route) []netlink.Route {
-	for _, r := range routes {
-		if routeEqual(r, *route) {
-			return routes
-		}
+// addToRouteList sets the route to the destination of route. A subnet has a
+// single route, the route of its previous lease is replaced.
+func addToRouteList(route *netlink.Route, routes map[string]netlink.Route) map[string]netlink.Route {
+	if routes == nil {
+		routes = make(map[string]netlink.Route)
 	}
-	return append(routes, *route)
+	routes[route.Dst.String()] = *route
+	return routes
 }
 
 func (n *RouteNetwork) removeFromV4RouteList(route netlink.Route) {
@@ -199,45 +229,137 @@ func (n *RouteNetwork) removeFromV6RouteList(route netlink.Route) {
 	n.v6Routes = n.removeFromRouteList(&route, n.v6Routes)
 }
 
-func (n *RouteNetwork) removeFromRouteList(route *netlink.Route, routes []netlink.Route) []netlink.Route {
-	for index, r := range routes {
-		if routeEqual(r, *route) {
-			routes = append(routes[:index], routes[index+1:]...)
-			return routes
-		}
+// removeFromRouteList removes route, unless another route to its destination
+// replaced it.
+func (n *RouteNetwork) removeFromRouteList(route *netlink.Route, routes map[string]netlink.Route) map[string]netlink.Route {
+	key := route.Dst.String()
+	if r, ok := routes[key]; ok && routeEqual(r, *route) {
+		delete(routes, key)
 	}
 	return routes
 }
 
 func (n *RouteNetwork) routeCheck(ctx context.Context) {
+	updates := subscribeRoutes(ctx)
+	ticker := time.NewTicker(routeCheckPeriod(updates))
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(routeCheckRetries * time.Second):
+		case u, ok := <-updates:
+			if !ok {
+				log.Warning("The route updates subscription was closed, polling the routes until it is restored")
+				updates = nil
+				ticker.Reset(routeCheckPeriod(updates))
+				continue
+			}
+			n.handleRouteUpdate(u)
+		case <-ticker.C:
+			if updates == nil {
+				if updates = subscribeRoutes(ctx); updates != nil {
+					ticker.Reset(routeCheckPeriod(updates))
+				}
+			}
 			n.checkSubnetExistInV4Routes()
 			n.checkSubnetExistInV6Routes()
 		}
 	}
 }
 
+// subscribeRoutes returns the route updates of the kernel, or nil if the
+// subscription failed.
+func subscribeRoutes(ctx context.Context) chan netlink.RouteUpdate {
+	updates := make(chan netlink.RouteUpdate)
+	err := netlink.RouteSubscribeWithOptions(updates, ctx.Done(), netlink.RouteSubscribeOptions{
+		ErrorCallback: func(err error) {
+			log.Errorf("Error receiving the route updates: %v", err)
+		},
+	})
+	if err != nil {
+		log.Errorf("Failed to subscribe to the route updates, polling the routes instead: %v", err)
+		return nil
+	}
+	return updates
+}
+
+func routeCheckPeriod(updates chan netlink.RouteUpdate) time.Duration {
+	if updates == nil {
+		return routeCheckRetries * time.Second
+	}
+	return routeResyncPeriod
+}
+
+// handleRouteUpdate restores the route of a lease when the kernel reports that
+// it was deleted, or that a route to the same subnet replaced it.
+func (n *RouteNetwork) handleRouteUpdate(u netlink.RouteUpdate) {
+	if u.Dst == nil || (u.Type != unix.RTM_DELROUTE && u.Type != unix.RTM_NEWROUTE) {
+		return
+	}
+	if u.Table != 0 && u.Table != unix.RT_TABLE_MAIN {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	routes, ipFamily := n.routes, netlink.FAMILY_V4
+	if u.Dst.IP.To4() == nil {
+		routes, ipFamily = n.v6Routes, netlink.FAMILY_V6
+	}
+	route, ok := routes[u.Dst.String()]
+	if !ok {
+		return
+	}
+	if u.Type == unix.RTM_NEWROUTE && routeEqual(u.Route, route) {
+		// Our own route
+		return
+	}
+
+	routeList, err := netlink.RouteListFiltered(ipFamily, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		log.Errorf("Error fetching the routes to %v, the next scan will retry: %v", route.Dst, err)
+		return
+	}
+	for _, r := range routeList {
+		if routeEqual(r, route) {
+			return
+		}
+	}
+	if err := netlink.RouteReplace(&route); err != nil {
+		log.Errorf("Error recovering route to %v via %v, the next scan will retry: %v", route.Dst, route.Gw, err)
+		return
+	}
+	log.Infof("Route recovered %v : %v", route.Dst, route.Gw)
+	metrics.ReconcileRepaired(n.BackendType, "route", "restored", 1)
+}
+
 func (n *RouteNetwork) checkSubnetExistInV4Routes() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	n.checkSubnetExistInRoutes(n.routes, netlink.FAMILY_V4)
 }
 
 func (n *RouteNetwork) checkSubnetExistInV6Routes() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	n.checkSubnetExistInRoutes(n.v6Routes, netlink.FAMILY_V6)
 }
 
-func (n *RouteNetwork) checkSubnetExistInRoutes(routes []netlink.Route, ipFamily int) {
+func (n *RouteNetwork) checkSubnetExistInRoutes(routes map[string]netlink.Route, ipFamily int) {
 	routeList, err := netlink.RouteList(nil, ipFamily)
 	if err == nil {
-		for _, route := range routes {
+		existing := make(map[string][]netlink.Route, len(routeList))
+		for _, r := range routeList {
+			if r.Dst != nil {
+				existing[r.Dst.String()] = append(existing[r.Dst.String()], r)
+			}
+		}
+
+		for key, route := range routes {
 			exist := false
-			for _, r := range routeList {
-				if r.Dst == nil {
-					continue
-				}
+			for _, r := range existing[key] {
 				if routeEqual(r, route) {
 					exist = true
 					break
@@ -252,6 +374,7 @@ func (n *RouteNetwork) checkSubnetExistInRoutes(routes []netlink.Route, ipFamily
 					continue
 				} else {
 					log.Infof("Route recovered %v : %v", route.Dst, route.Gw)
+					metrics.ReconcileRepaired(n.BackendType, "route", "restored", 1)
 				}
 			}
 		}
@@ -17,13 +17,16 @@
 package backend
 
 import (
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
 	"github.com/flannel-io/flannel/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 func TestRouteCache(t *testing.T) {
@@ -63,8 +66,8 @@ func TestRouteCache(t *testing.T) {
 	if len(nw.routes) != 1 {
 		t.Fatal(nw.routes)
 	}
-	if !routeEqual(nw.routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw1.ToIP(), LinkIndex: lo.Attrs().Index}) {
-		t.Fatal(nw.routes[0])
+	if !routeEqual(nw.routes[subnet1.String()], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw1.ToIP(), LinkIndex: lo.Attrs().Index}) {
+		t.Fatal(nw.routes[subnet1.String()])
 	}
 	// change gateway of previous route
 	nw.handleSubnetEvents([]lease.Event{
@@ -73,8 +76,8 @@ func TestRouteCache(t *testing.T) {
 	if len(nw.routes) != 1 {
 		t.Fatal(nw.routes)
 	}
-	if !routeEqual(nw.routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw2.ToIP(), LinkIndex: lo.Attrs().Index}) {
-		t.Fatal(nw.routes[0])
+	if !routeEqual(nw.routes[subnet1.String()], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw2.ToIP(), LinkIndex: lo.Attrs().Index}) {
+		t.Fatal(nw.routes[subnet1.String()])
 	}
 }
 
@@ -118,8 +121,8 @@ func TestV6RouteCache(t *testing.T) {
 	if len(nw.v6Routes) != 1 {
 		t.Fatal(nw.v6Routes)
 	}
-	if !routeEqual(nw.v6Routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw1.ToIP(), LinkIndex: br.Attrs().Index}) {
-		t.Fatal(nw.v6Routes[0])
+	if !routeEqual(nw.v6Routes[subnet1.String()], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw1.ToIP(), LinkIndex: br.Attrs().Index}) {
+		t.Fatal(nw.v6Routes[subnet1.String()])
 	}
 	// change gateway of previous route
 	nw.handleSubnetEvents([]lease.Event{
@@ -141,7 +144,127 @@ func TestV6RouteCache(t *testing.T) {
 	if len(nw.v6Routes) != 1 {
 		t.Fatal(nw.v6Routes)
 	}
-	if !routeEqual(nw.v6Routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw2.ToIP(), LinkIndex: br.Attrs().Index}) {
-		t.Fatal(nw.v6Routes[0])
+	if !routeEqual(nw.v6Routes[subnet1.String()], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw2.ToIP(), LinkIndex: br.Attrs().Index}) {
+		t.Fatal(nw.v6Routes[subnet1.String()])
+	}
+}
+
+func TestRouteUpdates(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	la := netlink.NewLinkAttrs()
+	la.Name = "br"
+	br := &netlink.Bridge{LinkAttrs: la}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(24, 32)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		t.Fatal(err)
+	}
+
+	// The subscription must be created from the thread in the test namespace
+	updates := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	if err := netlink.RouteSubscribe(updates, done); err != nil {
+		t.Fatal(err)
+	}
+
+	nw := RouteNetwork{
+		SimpleNetwork: SimpleNetwork{
+			ExtIface: &ExternalInterface{Iface: &net.Interface{Index: br.Attrs().Index}},
+		},
+		BackendType: "host-gw",
+		LinkIndex:   br.Attrs().Index,
+	}
+	nw.GetRoute = func(lease *lease.Lease) *netlink.Route {
+		return &netlink.Route{
+			Dst:       lease.Subnet.ToIPNet(),
+			Gw:        lease.Attrs.PublicIP.ToIP(),
+			LinkIndex: nw.LinkIndex,
+		}
+	}
+	gw := ip.FromIP(net.ParseIP("192.168.1.2"))
+	subnet1 := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.1.0")), PrefixLen: 24}
+	nw.handleSubnetEvents([]lease.Event{
+		{Type: lease.EventAdded, Lease: lease.Lease{
+			Subnet: subnet1, EnableIPv4: true, Attrs: lease.LeaseAttrs{PublicIP: gw, BackendType: "host-gw"}}},
+	})
+	expected := netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw.ToIP(), LinkIndex: br.Attrs().Index}
+
+	// handleRouteUpdate is fed with the updates of the route to subnet1
+	// until the expected route is restored
+	waitRestored := func() {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case u := <-updates:
+				if u.Dst == nil || u.Dst.String() != subnet1.String() {
+					continue
+				}
+				nw.handleRouteUpdate(u)
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: subnet1.ToIPNet()}, netlink.RT_FILTER_DST)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(routes) == 1 && routeEqual(routes[0], expected) {
+					return
+				}
+			case <-timeout:
+				t.Fatal("the route was not restored")
+			}
+		}
+	}
+
+	// Deleted route
+	if err := netlink.RouteDel(&expected); err != nil {
+		t.Fatal(err)
+	}
+	waitRestored()
+
+	// Modified route
+	if err := netlink.RouteReplace(&netlink.Route{Dst: subnet1.ToIPNet(), Gw: net.ParseIP("192.168.1.3"), LinkIndex: br.Attrs().Index}); err != nil {
+		t.Fatal(err)
+	}
+	waitRestored()
+
+	// The route of a removed lease is not restored
+	nw.handleSubnetEvents([]lease.Event{
+		{Type: lease.EventRemoved, Lease: lease.Lease{
+			Subnet: subnet1, EnableIPv4: true, Attrs: lease.LeaseAttrs{PublicIP: gw, BackendType: "host-gw"}}},
+	})
+	nw.handleRouteUpdate(netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: expected})
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: subnet1.ToIPNet()}, netlink.RT_FILTER_DST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 0 {
+		t.Errorf("unexpected routes %v", routes)
+	}
+}
+
+func BenchmarkRouteList(b *testing.B) {
+	for _, size := range []int{100, 1000, 5000} {
+		routes := make([]netlink.Route, size)
+		for i := range routes {
+			sn := ip.IP4Net{IP: ip.MustParseIP4("10.0.0.0") + ip.IP4(i<<8), PrefixLen: 24}
+			routes[i] = netlink.Route{Dst: sn.ToIPNet(), Gw: net.ParseIP("192.168.0.1"), LinkIndex: 1}
+		}
+		b.Run(fmt.Sprintf("%d routes", size), func(b *testing.B) {
+			nw := RouteNetwork{}
+			for i := 0; i < b.N; i++ {
+				for _, r := range routes {
+					nw.addToRouteList(r)
+				}
+				for _, r := range routes {
+					nw.removeFromV4RouteList(r)
+				}
+			}
+		})
 	}
 }
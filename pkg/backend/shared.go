@@ -0,0 +1,439 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	log "k8s.io/klog/v2"
+)
+
+// LeaseCodec describes how several backends share the lease of the node and
+// which of them handles each peer.
+type LeaseCodec interface {
+	// Merge returns the attributes of the lease of the node from the
+	// attributes of the backends which acquired it so far, nil for the
+	// others.
+	Merge(attrs []*lease.LeaseAttrs) (*lease.LeaseAttrs, error)
+	// View returns the lease as seen by the i-th backend, with the backend
+	// type and data of this backend, or false if the lease doesn't
+	// advertise it.
+	View(l lease.Lease, i int) (lease.Lease, bool)
+	// Select returns the index of the backend handling the peer, or -1 if
+	// no backend can reach it.
+	Select(l lease.Lease) int
+}
+
+// SharedLease runs several backends on the lease of the node. Each backend
+// gets its own subnet manager from Manager: the lease acquired by a backend
+// advertises the attributes of all the backends, and a backend only sees the
+// peers it handles according to the codec.
+type SharedLease struct {
+	sm    subnet.Manager
+	codec LeaseCodec
+	views []*leaseView
+
+	mu    sync.Mutex
+	attrs []*lease.LeaseAttrs
+	lease *lease.Lease
+
+	watchOnce sync.Once
+	// watchMu guards the leases of the peers and the queues of the views
+	watchMu sync.Mutex
+	watcher lease.LeaseWatcher
+	synced  bool
+	cursor  interface{}
+	closed  bool
+}
+
+// leaseView is the subnet manager of one of the backends of a SharedLease.
+type leaseView struct {
+	subnet.Manager
+	s     *SharedLease
+	index int
+	// pending are the watch results the backend didn't read yet: each
+	// backend has its own queue, so that a backend which doesn't watch the
+	// leases doesn't stall the others
+	watching bool
+	pending  []lease.LeaseWatchResult
+	notify   chan struct{}
+	// announced are the leases this backend was given, as seen by the
+	// backend, keyed by lease key
+	announced map[string]lease.Lease
+}
+
+func NewSharedLease(sm subnet.Manager, codec LeaseCodec, backends int) *SharedLease {
+	s := &SharedLease{
+		sm:    sm,
+		codec: codec,
+		attrs: make([]*lease.LeaseAttrs, backends),
+	}
+	for i := 0; i < backends; i++ {
+		s.views = append(s.views, &leaseView{
+			Manager:   sm,
+			s:         s,
+			index:     i,
+			notify:    make(chan struct{}, 1),
+			announced: make(map[string]lease.Lease),
+		})
+	}
+	return s
+}
+
+// Manager returns the subnet manager of the i-th backend.
+func (s *SharedLease) Manager(i int) subnet.Manager {
+	return s.views[i]
+}
+
+// Lease returns the lease of the node, advertising all the backends.
+func (s *SharedLease) Lease() *lease.Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lease
+}
+
+// AcquireLease updates the lease of the node with the attributes of the
+// backend and returns the lease as seen by the backend.
+func (v *leaseView) AcquireLease(ctx context.Context, attrs *lease.LeaseAttrs) (*lease.Lease, error) {
+	s := v.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := append([]*lease.LeaseAttrs{}, s.attrs...)
+	a := *attrs
+	all[v.index] = &a
+	merged, err := s.codec.Merge(all)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := s.sm.AcquireLease(ctx, merged)
+	if err != nil {
+		return nil, err
+	}
+	if s.lease != nil && (!l.Subnet.Equal(s.lease.Subnet) || !l.IPv6Subnet.Equal(s.lease.IPv6Subnet)) {
+		return nil, fmt.Errorf("the lease of the node changed from %s to %s while adding the %s backend", s.lease.Subnet, l.Subnet, attrs.BackendType)
+	}
+	s.attrs = all
+	s.lease = l
+
+	vl, ok := s.codec.View(*l, v.index)
+	if !ok {
+		return nil, fmt.Errorf("the lease of the node doesn't advertise the %s backend", attrs.BackendType)
+	}
+	return &vl, nil
+}
+
+// view returns the lease as seen by the backend of the view, or false if the
+// peer is handled by another backend.
+func (v *leaseView) view(l lease.Lease) (lease.Lease, bool) {
+	if v.s.codec.Select(l) != v.index {
+		return l, false
+	}
+	return v.s.codec.View(l, v.index)
+}
+
+// WatchLeases sends the leases of the peers handled by the backend of the
+// view. The leases are watched once and dispatched to all the views, as the
+// subnet managers may not support concurrent watches.
+func (v *leaseView) WatchLeases(ctx context.Context, receiver chan []lease.LeaseWatchResult) error {
+	v.start()
+	v.s.watchOnce.Do(func() {
+		go v.s.watchLeases(ctx)
+	})
+
+	for {
+		select {
+		case <-v.notify:
+			results, closed := v.take()
+			if filtered := v.filter(results); len(filtered) > 0 {
+				receiver <- filtered
+			}
+			if closed {
+				close(receiver)
+				return nil
+			}
+		case <-ctx.Done():
+			close(receiver)
+			return ctx.Err()
+		}
+	}
+}
+
+// WatchesLeaseSubset tells subnet.WatchLeases that the view only sees some of
+// the leases, the lease metrics are recorded by the SharedLease.
+func (v *leaseView) WatchesLeaseSubset() bool {
+	return true
+}
+
+// start queues the watch results for the view, starting with the leases
+// received before the backend watched them.
+func (v *leaseView) start() {
+	s := v.s
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	v.watching = true
+	if s.synced {
+		snapshot := make([]lease.Lease, 0, len(s.watcher.Leases))
+		for _, l := range s.watcher.Leases {
+			snapshot = append(snapshot, l)
+		}
+		sort.Slice(snapshot, func(i, j int) bool {
+			return sharedLeaseKey(&snapshot[i]) < sharedLeaseKey(&snapshot[j])
+		})
+		v.pending = append(v.pending, lease.LeaseWatchResult{Snapshot: snapshot, Cursor: s.cursor})
+	}
+	if s.synced || s.closed {
+		v.signal()
+	}
+}
+
+// take returns the queued watch results and whether the watch ended.
+func (v *leaseView) take() ([]lease.LeaseWatchResult, bool) {
+	v.s.watchMu.Lock()
+	defer v.s.watchMu.Unlock()
+	results := v.pending
+	v.pending = nil
+	return results, v.s.closed
+}
+
+func (v *leaseView) signal() {
+	select {
+	case v.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *SharedLease) watchLeases(ctx context.Context) {
+	own := s.Lease()
+	if own == nil {
+		own = &lease.Lease{}
+	}
+	s.watchMu.Lock()
+	s.watcher.OwnLease = own
+	s.watchMu.Unlock()
+
+	upstream := make(chan []lease.LeaseWatchResult)
+	go func() {
+		if err := s.sm.WatchLeases(ctx, upstream); err != nil && ctx.Err() == nil {
+			log.Errorf("could not watch leases: %s", err)
+		}
+	}()
+
+	for {
+		select {
+		case results, ok := <-upstream:
+			s.dispatch(results, ok)
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch records the watch results, and the lease metrics of all the
+// backends, and queues them for the views watching the leases.
+func (s *SharedLease) dispatch(results []lease.LeaseWatchResult, ok bool) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if !ok {
+		s.closed = true
+	}
+	for _, wr := range results {
+		var batch []lease.Event
+		if len(wr.Events) > 0 {
+			batch = s.watcher.Update(wr.Events)
+		} else {
+			batch = s.watcher.Reset(wr.Snapshot)
+		}
+		for _, e := range batch {
+			metrics.LeaseEvents.WithLabelValues(e.Type.String()).Inc()
+		}
+		s.cursor = wr.Cursor
+		s.synced = true
+	}
+	if ok {
+		metrics.Leases.Set(float64(len(s.watcher.Leases)))
+	}
+
+	for _, v := range s.views {
+		if v.watching {
+			v.pending = append(v.pending, results...)
+			v.signal()
+		}
+	}
+}
+
+// filter keeps the leases handled by the backend of the view. The peers which
+// are now handled by another backend, or no longer advertise this backend,
+// are removed with the lease the backend was given: the new lease may be of
+// another backend type, which the backend would ignore.
+func (v *leaseView) filter(results []lease.LeaseWatchResult) []lease.LeaseWatchResult {
+	var filtered []lease.LeaseWatchResult
+	for _, wr := range results {
+		if len(wr.Events) == 0 {
+			snapshot := []lease.Lease{}
+			v.announced = make(map[string]lease.Lease)
+			for _, l := range wr.Snapshot {
+				if vl, ok := v.view(l); ok {
+					snapshot = append(snapshot, vl)
+					v.announced[sharedLeaseKey(&l)] = vl
+				}
+			}
+			filtered = append(filtered, lease.LeaseWatchResult{Snapshot: snapshot, Cursor: wr.Cursor})
+			continue
+		}
+
+		var events []lease.Event
+		for _, e := range wr.Events {
+			key := sharedLeaseKey(&e.Lease)
+			vl, ok := v.view(e.Lease)
+			announced, wasAnnounced := v.announced[key]
+			switch {
+			case e.Type == lease.EventAdded && ok:
+				v.announced[key] = vl
+				events = append(events, lease.Event{Type: lease.EventAdded, Lease: vl})
+			case wasAnnounced:
+				// The lease watcher removes the lease it gave the backend
+				delete(v.announced, key)
+				events = append(events, lease.Event{Type: lease.EventRemoved, Lease: announced})
+			}
+		}
+		// A result without events would be read as an empty snapshot
+		if len(events) > 0 {
+			filtered = append(filtered, lease.LeaseWatchResult{Events: events, Cursor: wr.Cursor})
+		}
+	}
+	return filtered
+}
+
+// sharedLeaseKey returns the key of a lease in the lease watcher.
+func sharedLeaseKey(l *lease.Lease) string {
+	if !l.EnableIPv4 && l.EnableIPv6 {
+		return l.IPv6Subnet.String()
+	}
+	return l.Subnet.String()
+}
+
+// SharedNetwork runs the networks of the backends of a SharedLease.
+type SharedNetwork struct {
+	Shared   *SharedLease
+	Networks []Network
+}
+
+// Lease returns the lease advertising all the backends.
+func (n *SharedNetwork) Lease() *lease.Lease {
+	return n.Shared.Lease()
+}
+
+// MTU returns the MTU fitting all the backends, as the pods reach their peers
+// through any of them.
+func (n *SharedNetwork) MTU() int {
+	mtu := 0
+	for i, network := range n.Networks {
+		if i == 0 || network.MTU() < mtu {
+			mtu = network.MTU()
+		}
+	}
+	return mtu
+}
+
+func (n *SharedNetwork) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, network := range n.Networks {
+		wg.Add(1)
+		go func(network Network) {
+			network.Run(ctx)
+			wg.Done()
+		}(network)
+	}
+	wg.Wait()
+}
+
+// The helpers below are shared by the codecs choosing between the backends of
+// a SharedLease.
+
+// IsBackendData tells if the backend data of a lease is set.
+func IsBackendData(data json.RawMessage) bool {
+	return len(data) > 0 && string(data) != "null"
+}
+
+// BackendConfig returns the backend config of a backend run on a
+// SharedLease, from its options in the config of the parent backend.
+func BackendConfig(backendType string, options json.RawMessage) (json.RawMessage, error) {
+	config := map[string]json.RawMessage{}
+	if len(options) > 0 {
+		if err := json.Unmarshal(options, &config); err != nil {
+			return nil, err
+		}
+	}
+	config["Type"], _ = json.Marshal(backendType)
+	return json.Marshal(config)
+}
+
+// Adjacent tells if the peer of the lease is on the same network as the node,
+// according to directRouting.
+func Adjacent(l *lease.Lease, directRouting func(net.IP) (bool, error)) bool {
+	peer := l.Attrs.PublicIP.ToIP()
+	if l.Attrs.PublicIP == 0 && l.Attrs.PublicIPv6 != nil {
+		peer = l.Attrs.PublicIPv6.ToIP()
+	}
+	direct, err := directRouting(peer)
+	if err != nil {
+		log.Warningf("failed to check if %s is on the same network: %v", peer, err)
+		return false
+	}
+	return direct
+}
+
+// UnreachablePeers logs once that a peer can't be reached by any backend, as
+// Select is called on every lease event.
+type UnreachablePeers struct {
+	mu      sync.Mutex
+	subnets map[string]bool
+}
+
+// Report logs that the peer of the lease is unreachable, unless it was
+// already reported.
+func (u *UnreachablePeers) Report(l *lease.Lease, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.subnets[l.Subnet.String()] {
+		return
+	}
+	if u.subnets == nil {
+		u.subnets = make(map[string]bool)
+	}
+	u.subnets[l.Subnet.String()] = true
+	log.Warningf("The subnet %s of %s is unreachable: %s", l.Subnet, l.Attrs.PublicIP, reason)
+}
+
+// Reachable records that the peer of the lease is reachable again, it's
+// reported again if it becomes unreachable.
+func (u *UnreachablePeers) Reachable(l *lease.Lease) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.subnets, l.Subnet.String())
+}
@@ -0,0 +1,190 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// indexCodec hands each peer to the backend whose index is the backend data
+// of its lease. The backends see the type "backend-<index>".
+type indexCodec struct{}
+
+func (indexCodec) Merge(attrs []*lease.LeaseAttrs) (*lease.LeaseAttrs, error) {
+	return attrs[0], nil
+}
+
+func (indexCodec) View(l lease.Lease, i int) (lease.Lease, bool) {
+	l.Attrs.BackendType = fmt.Sprintf("backend-%d", i)
+	return l, true
+}
+
+func (indexCodec) Select(l lease.Lease) int {
+	var i int
+	if err := json.Unmarshal(l.Attrs.BackendData, &i); err != nil {
+		return -1
+	}
+	return i
+}
+
+func indexLease(backend int) lease.Lease {
+	return lease.Lease{
+		EnableIPv4: true,
+		Subnet:     ip.IP4Net{IP: ip.MustParseIP4("10.5.2.0"), PrefixLen: 24},
+		Attrs: lease.LeaseAttrs{
+			BackendType: "shared",
+			BackendData: json.RawMessage(fmt.Sprint(backend)),
+		},
+	}
+}
+
+func TestSharedLeaseFilterSwitch(t *testing.T) {
+	shared := NewSharedLease(&fakeLeaseManager{}, indexCodec{}, 2)
+	v0, v1 := shared.views[0], shared.views[1]
+
+	added := []lease.LeaseWatchResult{{Events: []lease.Event{{Type: lease.EventAdded, Lease: indexLease(0)}}}}
+	if results := v0.filter(added); len(results) != 1 || results[0].Events[0].Lease.Attrs.BackendType != "backend-0" {
+		t.Fatalf("unexpected results of the first backend %+v", results)
+	}
+	if results := v1.filter(added); len(results) != 0 {
+		t.Fatalf("unexpected results of the second backend %+v", results)
+	}
+
+	// The peer switches to the second backend, the first backend removes
+	// the lease it was given
+	switched := []lease.LeaseWatchResult{{Events: []lease.Event{{Type: lease.EventAdded, Lease: indexLease(1)}}}}
+	results := v0.filter(switched)
+	if len(results) != 1 || len(results[0].Events) != 1 {
+		t.Fatalf("unexpected results of the first backend %+v", results)
+	}
+	if e := results[0].Events[0]; e.Type != lease.EventRemoved || e.Lease.Attrs.BackendType != "backend-0" || string(e.Lease.Attrs.BackendData) != "0" {
+		t.Errorf("expected the removal of the lease of the first backend, got %+v", e)
+	}
+	results = v1.filter(switched)
+	if len(results) != 1 || results[0].Events[0].Type != lease.EventAdded || results[0].Events[0].Lease.Attrs.BackendType != "backend-1" {
+		t.Errorf("unexpected results of the second backend %+v", results)
+	}
+
+	// The peer leaves, only the second backend removes it
+	removed := []lease.LeaseWatchResult{{Events: []lease.Event{{Type: lease.EventRemoved, Lease: indexLease(1)}}}}
+	if results := v0.filter(removed); len(results) != 0 {
+		t.Errorf("unexpected results of the first backend %+v", results)
+	}
+	if results := v1.filter(removed); len(results) != 1 || results[0].Events[0].Lease.Attrs.BackendType != "backend-1" {
+		t.Errorf("unexpected results of the second backend %+v", results)
+	}
+}
+
+func TestSharedLeaseStalledView(t *testing.T) {
+	m := &fakeLeaseManager{results: make(chan []lease.LeaseWatchResult)}
+	shared := NewSharedLease(m, indexCodec{}, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Only the second backend watches the leases
+	receiver := make(chan []lease.LeaseWatchResult)
+	go func() {
+		_ = shared.Manager(1).WatchLeases(ctx, receiver)
+	}()
+	for i, backend := range []int{1, 0, 1} {
+		l := indexLease(backend)
+		l.Subnet.IP = ip.MustParseIP4(fmt.Sprintf("10.5.%d.0", i+2))
+		select {
+		case m.results <- []lease.LeaseWatchResult{{Events: []lease.Event{{Type: lease.EventAdded, Lease: l}}}}:
+		case <-time.After(time.Second):
+			t.Fatalf("the lease %s wasn't dispatched", l.Subnet)
+		}
+	}
+	var subnets []string
+	for len(subnets) < 2 {
+		select {
+		case results := <-receiver:
+			for _, wr := range results {
+				for _, e := range wr.Events {
+					subnets = append(subnets, e.Lease.Subnet.String())
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the second backend only got the leases %v", subnets)
+		}
+	}
+	if len(subnets) != 2 || subnets[0] != "10.5.2.0/24" || subnets[1] != "10.5.4.0/24" {
+		t.Errorf("unexpected leases of the second backend %v", subnets)
+	}
+
+	// The leases are counted once for all the backends
+	out := &dto.Metric{}
+	if err := metrics.Leases.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.GetGauge().GetValue(); got != 3 {
+		t.Errorf("expected 3 leases, got %v", got)
+	}
+
+	// The first backend gets the leases received before it watched them
+	receiver = make(chan []lease.LeaseWatchResult)
+	go func() {
+		_ = shared.Manager(0).WatchLeases(ctx, receiver)
+	}()
+	select {
+	case results := <-receiver:
+		if len(results) != 1 || len(results[0].Snapshot) != 1 || results[0].Snapshot[0].Subnet.String() != "10.5.3.0/24" {
+			t.Errorf("unexpected results of the first backend %+v", results)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first backend didn't get the leases")
+	}
+}
+
+func TestBackendConfig(t *testing.T) {
+	for _, tc := range []struct {
+		options  string
+		expected string
+	}{
+		{"", `{"Type":"vxlan"}`},
+		{`{"VNI": 4, "Type": "udp"}`, `{"Type":"vxlan","VNI":4}`},
+	} {
+		config, err := BackendConfig("vxlan", json.RawMessage(tc.options))
+		if err != nil || string(config) != tc.expected {
+			t.Errorf("expected the config %s of the options %q, got %s: %v", tc.expected, tc.options, config, err)
+		}
+	}
+	if _, err := BackendConfig("vxlan", json.RawMessage(`[]`)); err == nil {
+		t.Error("the options should be an object")
+	}
+}
+
+func TestUnreachablePeers(t *testing.T) {
+	var u UnreachablePeers
+	l := indexLease(-1)
+	u.Report(&l, "no backend")
+	u.Report(&l, "no backend")
+	if len(u.subnets) != 1 || !u.subnets[l.Subnet.String()] {
+		t.Fatalf("expected %s to be reported, got %v", l.Subnet, u.subnets)
+	}
+	u.Reachable(&l)
+	if len(u.subnets) != 0 {
+		t.Errorf("expected %s to be reachable, got %v", l.Subnet, u.subnets)
+	}
+}
@@ -21,22 +21,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/flannel-io/flannel/pkg/backend"
-	"github.com/flannel-io/flannel/pkg/ip"
-	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/backend/cloudroute"
 	"github.com/flannel-io/flannel/pkg/subnet"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
-	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
 	log "k8s.io/klog/v2"
 )
 
+const (
+	backendType             = "tencent-vpc"
+	defaultMetadataEndpoint = "http://metadata.tencentyun.com/latest/meta-data"
+	gatewayType             = "NORMAL_CVM"
+	routeType               = "USER"
+)
+
 func init() {
-	backend.Register("tencent-vpc", New)
+	backend.Register(backendType, New)
 }
 
 type TencentVpcBackend struct {
@@ -54,9 +64,8 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 
 func get_vm_metadata(url string) (string, error) {
 	resp, err := http.Get(url)
-
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("get vm region error: %v", err)
+	if err != nil {
+		return "", fmt.Errorf("get vm metadata %s error: %v", url, err)
 	}
 
 	defer func() {
@@ -66,24 +75,31 @@ func get_vm_metadata(url string) (string, error) {
 		}
 	}()
 
-	metadata, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get vm metadata %s error: %s", url, resp.Status)
+	}
+
+	metadata, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("get vm metadata %s error: %v", url, err)
+	}
 	return string(metadata), nil
 }
 
-func get_vm_region() (string, error) {
-	url := "http://metadata.tencentyun.com/latest/meta-data/placement/region"
+func get_vm_region(endpoint string) (string, error) {
+	url := fmt.Sprintf("%s/placement/region", endpoint)
 	return get_vm_metadata(url)
 }
 
-func get_vm_vpcid() (string, error) {
-	macUrl := "http://metadata.tencentyun.com/latest/meta-data/mac"
+func get_vm_vpcid(endpoint string) (string, error) {
+	macUrl := fmt.Sprintf("%s/mac", endpoint)
 	mac, err := get_vm_metadata(macUrl)
 
 	if err != nil {
 		return "", fmt.Errorf("get vm mac error: %v", err)
 	}
 
-	vpcUrl := fmt.Sprintf("http://metadata.tencentyun.com/latest/meta-data/network/interfaces/macs/%s/vpc-id", mac)
+	vpcUrl := fmt.Sprintf("%s/network/interfaces/macs/%s/vpc-id", endpoint, mac)
 	vpcid, err := get_vm_metadata(vpcUrl)
 
 	if err != nil {
@@ -93,35 +109,43 @@ func get_vm_vpcid() (string, error) {
 	return vpcid, nil
 }
 
+// newVPCClient returns the client of the VPC API of the region. The endpoint
+// replaces the default endpoint of the API if set, with an optional http://
+// or https:// scheme.
+func newVPCClient(accessKeyID, accessKeySecret, region, endpoint string) (*vpc.Client, error) {
+	credential := common.NewCredential(accessKeyID, accessKeySecret)
+	cpf := profile.NewClientProfile()
+	if len(endpoint) > 0 {
+		if host, ok := strings.CutPrefix(endpoint, "http://"); ok {
+			cpf.HttpProfile.Scheme = "HTTP"
+			endpoint = host
+		} else if host, ok := strings.CutPrefix(endpoint, "https://"); ok {
+			endpoint = host
+		}
+		cpf.HttpProfile.Endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+
+	return vpc.NewClient(credential, region, cpf)
+}
+
 func (be *TencentVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// 1. Parse our configuration
 	cfg := struct {
-		AccessKeyID     string
-		AccessKeySecret string
-	}{}
+		AccessKeyID       string
+		AccessKeySecret   string
+		MetadataEndpoint  string
+		APIEndpoint       string
+		ReconcileInterval int
+	}{
+		MetadataEndpoint: defaultMetadataEndpoint,
+	}
 
 	if len(config.Backend) > 0 {
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
 			return nil, fmt.Errorf("error decoding VPC backend config: %v", err)
 		}
 	}
-	log.Infof("Unmarshal Configure : %v\n", cfg)
-
-	// 2. Acquire the lease form subnet manager
-	attrs := lease.LeaseAttrs{
-		PublicIP: ip.FromIP(be.extIface.ExtAddr),
-	}
-
-	l, err := be.sm.AcquireLease(ctx, &attrs)
-	switch err {
-	case nil:
-
-	case context.Canceled, context.DeadlineExceeded:
-		return nil, err
 
-	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
-	}
 	if cfg.AccessKeyID == "" || cfg.AccessKeySecret == "" {
 		cfg.AccessKeyID = os.Getenv("ACCESS_KEY_ID")
 		cfg.AccessKeySecret = os.Getenv("ACCESS_KEY_SECRET")
@@ -131,89 +155,193 @@ func (be *TencentVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitG
 		}
 	}
 
-	region, err := get_vm_region()
+	// 2. Find the VPC of the instance
+	metadataEndpoint := strings.TrimSuffix(cfg.MetadataEndpoint, "/")
+	region, err := get_vm_region(metadataEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	vpcid, err := get_vm_vpcid(metadataEndpoint)
 	if err != nil {
 		return nil, err
 	}
-	vpcid, err := get_vm_vpcid()
+
+	c, err := newVPCClient(cfg.AccessKeyID, cfg.AccessKeySecret, region, cfg.APIEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the VPC client: %v", err)
+	}
+
+	// 3. Acquire the lease and manage the routes of the route table
+	provider := &vpcRouteProvider{
+		client:     c,
+		vpcID:      vpcid,
+		instanceIP: be.extIface.ExtAddr.String(),
+	}
+	n, err := cloudroute.RegisterNetwork(ctx, be.sm, be.extIface, config, backendType, provider)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.ReconcileInterval > 0 {
+		n.ReconcileInterval = time.Duration(cfg.ReconcileInterval) * time.Second
+	}
+	return n, nil
+}
+
+// vpcRouteProvider manages the routes of the first route table of the VPC. The
+// targets of the routes are the private IPv4 addresses of the CVM instances,
+// for the IPv4 and the IPv6 routes.
+type vpcRouteProvider struct {
+	client     *vpc.Client
+	vpcID      string
+	instanceIP string
+}
 
-	c, _ := vpc.NewClientWithSecretId(cfg.AccessKeyID, cfg.AccessKeySecret, region)
+func (p *vpcRouteProvider) Instance(ctx context.Context) (string, error) {
+	return p.instanceIP, nil
+}
+
+func (p *vpcRouteProvider) routeTable(ctx context.Context) (*vpc.RouteTable, error) {
 	request := vpc.NewDescribeRouteTablesRequest()
 	request.Filters = []*vpc.Filter{
-		&vpc.Filter{
+		{
 			Name:   common.StringPtr("vpc-id"),
-			Values: common.StringPtrs([]string{vpcid}),
+			Values: common.StringPtrs([]string{p.vpcID}),
 		},
 	}
 
-	res, err := c.DescribeRouteTables(request)
-	if _, ok := err.(*errors.TencentCloudSDKError); ok {
-		return nil, fmt.Errorf("describe route table error: %v", ok)
+	res, err := p.client.DescribeRouteTablesWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("describe route table error: %v", err)
+	}
+	if len(res.Response.RouteTableSet) <= 0 {
+		return nil, fmt.Errorf("no suitable routing table found")
+	}
+
+	return res.Response.RouteTableSet[0], nil
+}
+
+// isFlannelRoute returns true for the routes to a CVM created by users, which
+// include the routes created by flannel.
+func isFlannelRoute(route *vpc.Route) bool {
+	return len(routeDestination(route)) > 0 && route.GatewayId != nil && route.RouteId != nil &&
+		route.GatewayType != nil && *route.GatewayType == gatewayType &&
+		route.RouteType != nil && *route.RouteType == routeType
+}
+
+// routeDestination returns the IPv4 or IPv6 destination of a route.
+func routeDestination(route *vpc.Route) string {
+	if route.DestinationCidrBlock != nil && len(*route.DestinationCidrBlock) > 0 {
+		return *route.DestinationCidrBlock
+	}
+	if route.DestinationIpv6CidrBlock != nil {
+		return *route.DestinationIpv6CidrBlock
+	}
+	return ""
+}
+
+// sameDestination compares two CIDRs, the IPv6 ones may not be in the same
+// form.
+func sameDestination(a, b string) bool {
+	_, netA, errA := net.ParseCIDR(a)
+	_, netB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return a == b
 	}
+	return netA.String() == netB.String()
+}
 
+func (p *vpcRouteProvider) ListRoutes(ctx context.Context) ([]cloudroute.Route, error) {
+	routeTable, err := p.routeTable(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	response := res.Response
+	// The disabled routes are left out, they are replaced by EnsureRoute
+	routes := []cloudroute.Route{}
+	for _, route := range routeTable.RouteSet {
+		if !isFlannelRoute(route) || route.Enabled == nil || !*route.Enabled {
+			continue
+		}
+		routes = append(routes, cloudroute.Route{
+			ID:          strconv.FormatUint(*route.RouteId, 10),
+			Destination: routeDestination(route),
+			Target:      *route.GatewayId,
+		})
+	}
+	return routes, nil
+}
 
-	if len(response.RouteTableSet) <= 0 {
-		return nil, fmt.Errorf("no suitable routing table found")
+func (p *vpcRouteProvider) EnsureRoute(ctx context.Context, want cloudroute.Route) error {
+	routeTable, err := p.routeTable(ctx)
+	if err != nil {
+		return err
 	}
 
-	routeTable := response.RouteTableSet[0]
 	exists := false
-	gatewayType := "NORMAL_CVM"
-	routeType := "USER"
-
+	stale := []*vpc.Route{}
 	for _, route := range routeTable.RouteSet {
-		if *route.DestinationCidrBlock == l.Subnet.String() &&
-			*route.GatewayId == be.extIface.ExtAddr.String() &&
-			*route.GatewayType == gatewayType &&
-			*route.RouteType == routeType {
-			if *route.Enabled {
-				exists = true
-			} else {
-				delRouteRequest := vpc.NewDeleteRoutesRequest()
-				delRouteRequest.RouteTableId = routeTable.RouteTableId
-				delRouteRequest.Routes = []*vpc.Route{
-					&vpc.Route{
-						RouteId: route.RouteId,
-					},
-				}
-
-				_, err := c.DeleteRoutes(delRouteRequest)
-				if err != nil {
-					return nil, err
-				}
-			}
+		if !isFlannelRoute(route) || !sameDestination(routeDestination(route), want.Destination) {
+			continue
+		}
+		if *route.GatewayId == want.Target && route.Enabled != nil && *route.Enabled && !exists {
+			exists = true
+			continue
 		}
+		// The disabled routes and the routes to other instances are replaced
+		stale = append(stale, &vpc.Route{RouteId: route.RouteId})
 	}
 
-	if !exists {
-		createRouteRequest := vpc.NewCreateRoutesRequest()
-		createRouteRequest.RouteTableId = routeTable.RouteTableId
-		createRouteRequest.Routes = []*vpc.Route{
-			&vpc.Route{
-				DestinationCidrBlock: common.StringPtr(l.Subnet.String()),
-				GatewayType:          &gatewayType,
-				GatewayId:            common.StringPtr(be.extIface.ExtAddr.String()),
-				Enabled:              common.BoolPtr(true),
-			},
-		}
+	if err := p.deleteRoutes(ctx, routeTable.RouteTableId, stale); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	route := &vpc.Route{
+		GatewayType: common.StringPtr(gatewayType),
+		GatewayId:   common.StringPtr(want.Target),
+		Enabled:     common.BoolPtr(true),
+	}
+	if strings.Contains(want.Destination, ":") {
+		route.DestinationIpv6CidrBlock = common.StringPtr(want.Destination)
+	} else {
+		route.DestinationCidrBlock = common.StringPtr(want.Destination)
+	}
+	createRouteRequest := vpc.NewCreateRoutesRequest()
+	createRouteRequest.RouteTableId = routeTable.RouteTableId
+	createRouteRequest.Routes = []*vpc.Route{route}
+	if _, err := p.client.CreateRoutesWithContext(ctx, createRouteRequest); err != nil {
+		return fmt.Errorf("create route error: %v", err)
+	}
+	return nil
+}
 
-		_, err := c.CreateRoutes(createRouteRequest)
+func (p *vpcRouteProvider) DeleteRoute(ctx context.Context, want cloudroute.Route) error {
+	routeTable, err := p.routeTable(ctx)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			return nil, err
+	stale := []*vpc.Route{}
+	for _, route := range routeTable.RouteSet {
+		if isFlannelRoute(route) && sameDestination(routeDestination(route), want.Destination) && *route.GatewayId == want.Target {
+			stale = append(stale, &vpc.Route{RouteId: route.RouteId})
 		}
 	}
+	return p.deleteRoutes(ctx, routeTable.RouteTableId, stale)
+}
+
+func (p *vpcRouteProvider) deleteRoutes(ctx context.Context, routeTableID *string, routes []*vpc.Route) error {
+	if len(routes) == 0 {
+		return nil
+	}
 
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    be.extIface,
-	}, nil
+	delRouteRequest := vpc.NewDeleteRoutesRequest()
+	delRouteRequest.RouteTableId = routeTableID
+	delRouteRequest.Routes = routes
+	if _, err := p.client.DeleteRoutesWithContext(ctx, delRouteRequest); err != nil {
+		return fmt.Errorf("delete route error: %v", err)
+	}
+	return nil
 }
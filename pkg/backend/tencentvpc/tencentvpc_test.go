@@ -0,0 +1,194 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package tencentvpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/backend/cloudroute"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
+)
+
+// mockCloud serves the metadata of an instance and the route table API.
+type mockCloud struct {
+	mu          sync.Mutex
+	routes      []*vpc.Route
+	nextRouteID uint64
+}
+
+func (m *mockCloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/meta-data/placement/region":
+		w.Write([]byte("ap-guangzhou"))
+		return
+	case "/meta-data/mac":
+		w.Write([]byte("52:54:00:00:00:01"))
+		return
+	case "/meta-data/network/interfaces/macs/52:54:00:00:00:01/vpc-id":
+		w.Write([]byte("vpc-1"))
+		return
+	case "/":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var req struct {
+		RouteTableId *string
+		Routes       []*vpc.Route
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]interface{}{"RequestId": "1"}
+	switch r.Header.Get("X-TC-Action") {
+	case "DescribeRouteTables":
+		resp["TotalCount"] = 1
+		resp["RouteTableSet"] = []*vpc.RouteTable{{
+			VpcId:        common.StringPtr("vpc-1"),
+			RouteTableId: common.StringPtr("rtb-1"),
+			RouteSet:     m.routes,
+		}}
+	case "CreateRoutes":
+		for _, route := range req.Routes {
+			m.add(route)
+		}
+	case "DeleteRoutes":
+		for _, deleted := range req.Routes {
+			for i, route := range m.routes {
+				if *route.RouteId == *deleted.RouteId {
+					m.routes = append(m.routes[:i], m.routes[i+1:]...)
+					break
+				}
+			}
+		}
+	default:
+		resp["Error"] = map[string]string{"Code": "InvalidAction", "Message": r.Header.Get("X-TC-Action")}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"Response": resp})
+}
+
+func (m *mockCloud) add(route *vpc.Route) {
+	m.nextRouteID++
+	route.RouteId = common.Uint64Ptr(m.nextRouteID)
+	route.RouteTableId = common.StringPtr("rtb-1")
+	if route.RouteType == nil {
+		route.RouteType = common.StringPtr(routeType)
+	}
+	m.routes = append(m.routes, route)
+}
+
+func TestMetadata(t *testing.T) {
+	server := httptest.NewServer(&mockCloud{})
+	defer server.Close()
+
+	region, err := get_vm_region(server.URL + "/meta-data")
+	if err != nil || region != "ap-guangzhou" {
+		t.Errorf("unexpected region %q: %v", region, err)
+	}
+	vpcid, err := get_vm_vpcid(server.URL + "/meta-data")
+	if err != nil || vpcid != "vpc-1" {
+		t.Errorf("unexpected vpc id %q: %v", vpcid, err)
+	}
+	if _, err := get_vm_region(server.URL + "/other"); err == nil {
+		t.Errorf("the missing metadata should be reported")
+	}
+}
+
+func TestVPCRouteProvider(t *testing.T) {
+	cloud := &mockCloud{}
+	// A disabled route of flannel and a route which isn't to a CVM
+	cloud.add(&vpc.Route{
+		DestinationCidrBlock: common.StringPtr("10.5.1.0/24"),
+		GatewayType:          common.StringPtr(gatewayType),
+		GatewayId:            common.StringPtr("172.16.0.1"),
+		Enabled:              common.BoolPtr(false),
+	})
+	cloud.add(&vpc.Route{
+		DestinationCidrBlock: common.StringPtr("10.5.9.0/24"),
+		GatewayType:          common.StringPtr("VPN"),
+		GatewayId:            common.StringPtr("vpngw-1"),
+		Enabled:              common.BoolPtr(true),
+	})
+	server := httptest.NewServer(cloud)
+	defer server.Close()
+
+	client, err := newVPCClient("id", "secret", "ap-guangzhou", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &vpcRouteProvider{client: client, vpcID: "vpc-1", instanceIP: "172.16.0.1"}
+	ctx := context.Background()
+
+	for _, route := range []cloudroute.Route{
+		{Destination: "10.5.1.0/24", Target: "172.16.0.1"},
+		{Destination: "fc00:0:0:1::/64", Target: "172.16.0.1"},
+		{Destination: "10.5.2.0/24", Target: "172.16.0.2"},
+		// The subnet moved to another instance
+		{Destination: "10.5.2.0/24", Target: "172.16.0.3"},
+	} {
+		if err := p.EnsureRoute(ctx, route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routes, err := p.ListRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []cloudroute.Route{
+		{ID: "3", Destination: "10.5.1.0/24", Target: "172.16.0.1"},
+		{ID: "4", Destination: "fc00:0:0:1::/64", Target: "172.16.0.1"},
+		{ID: "6", Destination: "10.5.2.0/24", Target: "172.16.0.3"},
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("expected routes %v, got %v", expected, routes)
+	}
+
+	// The route to another instance is kept
+	for _, route := range []cloudroute.Route{
+		{Destination: "10.5.2.0/24", Target: "172.16.0.2"},
+		{Destination: "fc00:0000:0:1::/64", Target: "172.16.0.1"},
+	} {
+		if err := p.DeleteRoute(ctx, route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	routes, err = p.ListRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []cloudroute.Route{expected[0], expected[2]}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected routes %v, got %v", expected, routes)
+	}
+	if len(cloud.routes) != 3 || *cloud.routes[0].GatewayType != "VPN" {
+		t.Errorf("the route which isn't to a CVM was modified")
+	}
+}
@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+// TunnelRoute returns the route to a remote subnet through a tunnel device
+// without remote address, like the ipip and gre devices: the gateway of the
+// route is the destination of the encapsulated packets. With directRouting,
+// the route goes through the external interface when the remote host is on
+// the same subnet.
+func TunnelRoute(dst *net.IPNet, publicIP net.IP, linkIndex, extIfaceIndex int, directRouting bool) *netlink.Route {
+	route := netlink.Route{
+		Dst:       dst,
+		Gw:        publicIP,
+		LinkIndex: linkIndex,
+		Flags:     int(netlink.FLAG_ONLINK),
+	}
+
+	if directRouting {
+		dr, err := ip.DirectRouting(publicIP)
+
+		if err != nil {
+			log.Error(err)
+		}
+
+		if dr {
+			log.V(2).Infof("configure route to %v via direct routing", publicIP)
+			route.LinkIndex = extIfaceIndex
+		}
+	}
+
+	return &route
+}
+
+// EnsureTunnelLink creates the tunnel device link. A device of the same name
+// is recreated if compatible returns false, compatible returns an error for
+// a device of another type as flannel shouldn't delete a user's device. The
+// MTU of the device is then lowered to mtu.
+func EnsureTunnelLink(link netlink.Link, compatible func(existing netlink.Link) (bool, error), mtu int) error {
+	name := link.Attrs().Name
+	if err := netlink.LinkAdd(link); err != nil {
+		if err != syscall.EEXIST {
+			return err
+		}
+
+		// The link already exists, so check existing link attributes.
+		existing, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+
+		ok, err := compatible(existing)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err = netlink.LinkDel(existing); err != nil {
+				return fmt.Errorf("failed to delete interface: %v", err)
+			}
+
+			if err = netlink.LinkAdd(link); err != nil {
+				return fmt.Errorf("failed to create %s interface: %v", link.Type(), err)
+			}
+		}
+	}
+
+	oldMTU := link.Attrs().MTU
+	if oldMTU > mtu || oldMTU == 0 {
+		log.Infof("current MTU of %s is %d, setting it to %d", name, oldMTU, mtu)
+		err := netlink.LinkSetMTU(link, mtu)
+
+		if err != nil {
+			return fmt.Errorf("failed to set %v MTU to %d: %v", name, mtu, err)
+		}
+		// change MTU as it will be written into /run/flannel/subnet.env
+		link.Attrs().MTU = mtu
+	}
+
+	return nil
+}
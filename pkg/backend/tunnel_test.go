@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestTunnelRoute(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("fd00:10:244:2::/64")
+	route := TunnelRoute(dst, net.ParseIP("fd00::2"), 5, 2, false)
+	if route.Dst != dst || !route.Gw.Equal(net.ParseIP("fd00::2")) || route.LinkIndex != 5 || route.Flags != int(netlink.FLAG_ONLINK) {
+		t.Errorf("unexpected route %+v", route)
+	}
+}
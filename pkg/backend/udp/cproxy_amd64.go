@@ -20,14 +20,71 @@ package udp
 import "C"
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"syscall"
 	"unsafe"
 
 	"github.com/flannel-io/flannel/pkg/ip"
 	log "k8s.io/klog/v2"
 )
 
+// cProxy runs the proxy of proxy_amd64.c, which is driven through a pair of
+// control sockets.
+type cProxy struct {
+	tun   *os.File
+	conn  *net.UDPConn
+	ctl   *os.File
+	ctl2  *os.File
+	tunIP ip.IP4
+	mtu   int
+}
+
+func newProxy(tun *os.File, conn *net.UDPConn, tunIP ip.IP4, mtu int) (proxy, error) {
+	ctl, ctl2, err := newCtlSockets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control socket: %v", err)
+	}
+	return &cProxy{tun: tun, conn: conn, ctl: ctl, ctl2: ctl2, tunIP: tunIP, mtu: mtu}, nil
+}
+
+func (p *cProxy) run() {
+	runCProxy(p.tun, p.conn, p.ctl2, p.tunIP, p.mtu)
+}
+
+func (p *cProxy) setRoute(dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int) {
+	setRoute(p.ctl, dst, nextHopIP, nextHopPort)
+}
+
+func (p *cProxy) removeRoute(dst ip.IP4Net) {
+	removeRoute(p.ctl, dst)
+}
+
+func (p *cProxy) stop() {
+	stopProxy(p.ctl)
+}
+
+func (p *cProxy) close() {
+	if err := p.ctl.Close(); err != nil {
+		log.Errorf("Failed to close control socket: %v", err)
+	}
+	if err := p.ctl2.Close(); err != nil {
+		log.Errorf("Failed to close control socket: %v", err)
+	}
+}
+
+func newCtlSockets() (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f1 := os.NewFile(uintptr(fds[0]), "ctl")
+	f2 := os.NewFile(uintptr(fds[1]), "ctl")
+	return f1, f2, nil
+}
+
 func runCProxy(tun *os.File, conn *net.UDPConn, ctl *os.File, tunIP ip.IP4, tunMTU int) {
 	var log_errors int
 	if log.V(1).Enabled() {
@@ -0,0 +1,363 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package udp
+
+// goProxy is the pure Go implementation of the proxy, used when the C proxy
+// isn't built. The packets read from the TUN device are sent with a single
+// sendmmsg for as many packets as can be read without blocking, and the
+// packets received on the UDP socket are read with recvmmsg. The TUN device
+// is read through the runtime poller, so stop unblocks the readers with
+// deadlines instead of a control socket.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	// batchSize is the maximum number of packets read or sent at once
+	batchSize = 64
+
+	icmpHeaderLen   = 8
+	icmpProtocol    = 1
+	icmpUnreachable = 3
+	icmpNetUnreach  = 0
+	icmpTTL         = 8
+)
+
+type goProxy struct {
+	// tun is a non-blocking duplicate of the TUN device
+	tun   *os.File
+	conn  *net.UDPConn
+	pconn *ipv4.PacketConn
+	tunIP ip.IP4
+	mtu   int
+
+	// mu protects routes, keyed by network, and prefixLens, the prefix
+	// lengths of the routes from the longest, with their number of routes
+	mu          sync.RWMutex
+	routes      map[ip.IP4Net]*net.UDPAddr
+	prefixLens  []uint
+	prefixCount map[uint]int
+
+	stopped atomic.Bool
+}
+
+func newGoProxy(tun *os.File, conn *net.UDPConn, tunIP ip.IP4, mtu int) (*goProxy, error) {
+	fd, err := unix.Dup(int(tun.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate the TUN device: %v", err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set the TUN device non-blocking: %v", err)
+	}
+
+	return &goProxy{
+		tun:         os.NewFile(uintptr(fd), tun.Name()),
+		conn:        conn,
+		pconn:       ipv4.NewPacketConn(conn),
+		tunIP:       tunIP,
+		mtu:         mtu,
+		routes:      make(map[ip.IP4Net]*net.UDPAddr),
+		prefixCount: make(map[uint]int),
+	}, nil
+}
+
+func (p *goProxy) run() {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		p.tunToUDP()
+		wg.Done()
+	}()
+	go func() {
+		p.udpToTun()
+		wg.Done()
+	}()
+	wg.Wait()
+}
+
+func (p *goProxy) setRoute(dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int) {
+	dst = dst.Network()
+	nextHop := &net.UDPAddr{IP: nextHopIP.ToIP(), Port: nextHopPort}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.routes[dst]; !ok {
+		p.prefixCount[dst.PrefixLen]++
+		if p.prefixCount[dst.PrefixLen] == 1 {
+			p.updatePrefixLens()
+		}
+	}
+	p.routes[dst] = nextHop
+}
+
+func (p *goProxy) removeRoute(dst ip.IP4Net) {
+	dst = dst.Network()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.routes[dst]; !ok {
+		return
+	}
+	delete(p.routes, dst)
+	p.prefixCount[dst.PrefixLen]--
+	if p.prefixCount[dst.PrefixLen] == 0 {
+		delete(p.prefixCount, dst.PrefixLen)
+		p.updatePrefixLens()
+	}
+}
+
+// updatePrefixLens must be called with p.mu held.
+func (p *goProxy) updatePrefixLens() {
+	p.prefixLens = p.prefixLens[:0]
+	for prefixLen := range p.prefixCount {
+		p.prefixLens = append(p.prefixLens, prefixLen)
+	}
+	sort.Slice(p.prefixLens, func(i, j int) bool { return p.prefixLens[i] > p.prefixLens[j] })
+}
+
+// findRoute returns the next hop of dst. It must be called with p.mu held.
+func (p *goProxy) findRoute(dst ip.IP4) *net.UDPAddr {
+	for _, prefixLen := range p.prefixLens {
+		if nextHop, ok := p.routes[ip.IP4Net{IP: dst, PrefixLen: prefixLen}.Network()]; ok {
+			return nextHop
+		}
+	}
+	return nil
+}
+
+func (p *goProxy) stop() {
+	p.stopped.Store(true)
+	now := time.Now()
+	if err := p.tun.SetReadDeadline(now); err != nil {
+		log.Errorf("Failed to stop reading the TUN device: %v", err)
+	}
+	if err := p.conn.SetReadDeadline(now); err != nil {
+		log.Errorf("Failed to stop reading the UDP socket: %v", err)
+	}
+}
+
+func (p *goProxy) close() {
+	if err := p.tun.Close(); err != nil {
+		log.Errorf("Failed to close tun device: %v", err)
+	}
+}
+
+func (p *goProxy) tunToUDP() {
+	rawConn, err := p.tun.SyscallConn()
+	if err != nil {
+		log.Errorf("Failed to read the TUN device: %v", err)
+		return
+	}
+
+	bufs := make([][]byte, batchSize)
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, p.mtu)
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+
+	pkts := make([][]byte, 0, batchSize)
+	for {
+		pkts = pkts[:0]
+		var readErr error
+		err := rawConn.Read(func(fd uintptr) bool {
+			for len(pkts) < batchSize {
+				n, err := unix.Read(int(fd), bufs[len(pkts)])
+				switch {
+				case err == unix.EINTR:
+					continue
+				case err == unix.EAGAIN:
+					// Wait for the device to be readable if nothing was read
+					return len(pkts) > 0
+				case err != nil:
+					readErr = err
+					return true
+				}
+				pkts = append(pkts, bufs[len(pkts)][:n])
+			}
+			return true
+		})
+		if err != nil {
+			if !p.stopped.Load() {
+				log.Errorf("TUN recv failed: %v", err)
+			}
+			return
+		}
+		if readErr != nil {
+			log.V(1).Infof("TUN recv failed: %v", readErr)
+		}
+
+		count := 0
+		p.mu.RLock()
+		for _, pkt := range pkts {
+			if len(pkt) < ipv4.HeaderLen {
+				log.V(1).Infof("TUN recv packet too small: %d bytes", len(pkt))
+				continue
+			}
+			nextHop := p.findRoute(ip.FromBytes(pkt[16:20]))
+			if nextHop == nil {
+				p.sendNetUnreachable(pkt)
+				continue
+			}
+			if !decrementTTL(pkt) {
+				continue
+			}
+			msgs[count].Buffers[0] = pkt
+			msgs[count].Addr = nextHop
+			count++
+		}
+		p.mu.RUnlock()
+
+		p.send(msgs[:count])
+	}
+}
+
+// send sends the messages with sendmmsg, dropping the messages which fail.
+func (p *goProxy) send(msgs []ipv4.Message) {
+	for len(msgs) > 0 {
+		n, err := p.pconn.WriteBatch(msgs, 0)
+		n = max(n, 0)
+		if err != nil {
+			log.V(1).Infof("UDP send to %v failed: %v", msgs[n].Addr, err)
+			n++
+		}
+		msgs = msgs[n:]
+	}
+}
+
+func (p *goProxy) udpToTun() {
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, p.mtu)}
+	}
+
+	for {
+		n, err := p.pconn.ReadBatch(msgs, 0)
+		if err != nil {
+			if p.stopped.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.V(1).Infof("UDP recv failed: %v", err)
+			continue
+		}
+
+		for _, msg := range msgs[:n] {
+			pkt := msg.Buffers[0][:msg.N]
+			if len(pkt) < ipv4.HeaderLen {
+				log.V(1).Infof("UDP recv packet too small: %d bytes", len(pkt))
+				continue
+			}
+			if !decrementTTL(pkt) {
+				continue
+			}
+			p.writeTun(pkt)
+		}
+	}
+}
+
+func (p *goProxy) writeTun(pkt []byte) {
+	if _, err := p.tun.Write(pkt); err != nil && !p.stopped.Load() {
+		log.V(1).Infof("TUN send failed: %v", err)
+	}
+}
+
+// sendNetUnreachable writes back an ICMP net unreachable for a packet without
+// route.
+func (p *goProxy) sendNetUnreachable(offender []byte) {
+	ihl := int(offender[0]&0x0f) * 4
+	if ihl < ipv4.HeaderLen || len(offender) < ihl+8 {
+		log.V(1).Infof("not sending net unreachable: malformed ip pkt: iph=%d", ihl)
+		return
+	}
+	if offender[9] == icmpProtocol {
+		// To avoid infinite loops, RFC 792 instructs not to send ICMPs
+		// about ICMPs
+		return
+	}
+	if binary.BigEndian.Uint16(offender[6:8])&0x1fff != 0 {
+		// ICMP messages are only sent for first fragment
+		return
+	}
+
+	// The IP header and the first 8 bytes of the payload of the offender
+	// are included
+	pkt := make([]byte, ipv4.HeaderLen+icmpHeaderLen+ihl+8)
+	pkt[0] = 4<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = icmpTTL
+	pkt[9] = icmpProtocol
+	copy(pkt[12:16], p.tunIP.ToIP().To4())
+	copy(pkt[16:20], offender[12:16])
+	binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:ipv4.HeaderLen]))
+
+	icmp := pkt[ipv4.HeaderLen:]
+	icmp[0] = icmpUnreachable
+	icmp[1] = icmpNetUnreach
+	copy(icmp[icmpHeaderLen:], offender[:ihl+8])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+
+	p.writeTun(pkt)
+}
+
+// decrementTTL decrements the TTL of an IPv4 packet and updates its checksum.
+// It returns false if the packet must be discarded.
+func decrementTTL(pkt []byte) bool {
+	if pkt[8] <= 1 {
+		log.V(1).Infof("Discarding IP fragment %v -> %v due to zero TTL", net.IP(pkt[12:16]), net.IP(pkt[16:20]))
+		return false
+	}
+	pkt[8]--
+
+	// The TTL is the high byte of its 16 bits word, see RFC 1624 for the
+	// incremental update
+	sum := uint32(binary.BigEndian.Uint16(pkt[10:12])) + 0x100
+	sum = (sum & 0xffff) + (sum >> 16)
+	binary.BigEndian.PutUint16(pkt[10:12], uint16(sum))
+	return true
+}
+
+// checksum returns the internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
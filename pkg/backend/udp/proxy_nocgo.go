@@ -0,0 +1,29 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows && (!amd64 || !cgo)
+// +build !windows
+// +build !amd64 !cgo
+
+package udp
+
+import (
+	"net"
+	"os"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+)
+
+func newProxy(tun *os.File, conn *net.UDPConn, tunIP ip.IP4, mtu int) (proxy, error) {
+	return newGoProxy(tun, conn, tunIP, mtu)
+}
@@ -0,0 +1,196 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package udp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDecrementTTL(t *testing.T) {
+	for _, ttl := range []byte{64, 2, 255} {
+		// Go through all the checksums with the identification field
+		for id := 0; id <= 0xffff; id++ {
+			pkt := []byte{0x45, 0, 0, 20, byte(id >> 8), byte(id), 0, 0, ttl, 17, 0, 0, 10, 5, 1, 0, 10, 5, 2, 7}
+			sum := checksum(pkt)
+			pkt[10], pkt[11] = byte(sum>>8), byte(sum)
+
+			if !decrementTTL(pkt) {
+				t.Fatalf("the packet with TTL %d was discarded", ttl)
+			}
+			if pkt[8] != ttl-1 || checksum(pkt) != 0 {
+				t.Fatalf("invalid header after decrement % x", pkt)
+			}
+		}
+	}
+
+	if decrementTTL([]byte{0x45, 0, 0, 20, 0, 0, 0, 0, 1, 17, 0, 0, 10, 5, 1, 0, 10, 5, 2, 7}) {
+		t.Errorf("the packet with TTL 1 should be discarded")
+	}
+}
+
+func TestGoProxyRoutes(t *testing.T) {
+	p := &goProxy{routes: make(map[ip.IP4Net]*net.UDPAddr), prefixCount: make(map[uint]int)}
+	p.setRoute(ip.IP4Net{IP: ip.MustParseIP4("10.5.2.0"), PrefixLen: 24}, ip.MustParseIP4("192.168.0.2"), 8285)
+	p.setRoute(ip.IP4Net{IP: ip.MustParseIP4("10.6.0.0"), PrefixLen: 16}, ip.MustParseIP4("192.168.0.3"), 8285)
+	p.setRoute(ip.IP4Net{IP: ip.MustParseIP4("10.6.3.0"), PrefixLen: 24}, ip.MustParseIP4("192.168.0.4"), 8285)
+
+	for dst, nextHop := range map[string]string{
+		"10.5.2.7": "192.168.0.2:8285",
+		"10.6.1.1": "192.168.0.3:8285",
+		"10.6.3.1": "192.168.0.4:8285",
+		"10.5.3.1": "<nil>",
+	} {
+		if found := p.findRoute(ip.MustParseIP4(dst)); found.String() != nextHop {
+			t.Errorf("next hop of %s: expected %s, got %s", dst, nextHop, found)
+		}
+	}
+
+	// The route is replaced and removed by its network
+	p.setRoute(ip.IP4Net{IP: ip.MustParseIP4("10.5.2.1"), PrefixLen: 24}, ip.MustParseIP4("192.168.0.5"), 8285)
+	if found := p.findRoute(ip.MustParseIP4("10.5.2.7")); found.String() != "192.168.0.5:8285" {
+		t.Errorf("the route wasn't replaced: %s", found)
+	}
+	p.removeRoute(ip.IP4Net{IP: ip.MustParseIP4("10.5.2.0"), PrefixLen: 24})
+	p.removeRoute(ip.IP4Net{IP: ip.MustParseIP4("10.6.3.0"), PrefixLen: 24})
+	if found := p.findRoute(ip.MustParseIP4("10.5.2.7")); found != nil {
+		t.Errorf("the route wasn't removed: %s", found)
+	}
+	if len(p.routes) != 1 || len(p.prefixLens) != 1 || p.prefixLens[0] != 16 {
+		t.Errorf("unexpected routes %v, prefix lengths %v", p.routes, p.prefixLens)
+	}
+}
+
+func TestGoProxy(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+
+	tun, tunName, err := ip.OpenTun("flannel%d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	tunIP := ip.MustParseIP4("10.5.1.0")
+	networks := []ip.IP4Net{
+		{IP: ip.MustParseIP4("10.5.0.0"), PrefixLen: 16},
+		{IP: ip.MustParseIP4("10.6.0.0"), PrefixLen: 16},
+	}
+	if err := configureIface(tunName, tunIP, networks, 1400); err != nil {
+		t.Fatal(err)
+	}
+	// The additional networks are routed to the tunnel too
+	routes, err := netlink.RouteGet(net.IPv4(10, 6, 3, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err := netlink.LinkByName(tunName); err != nil || len(routes) != 1 || routes[0].LinkIndex != link.Attrs().Index {
+		t.Fatalf("the additional network isn't routed to %s: %v", tunName, routes)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	p, err := newGoProxy(tun, conn, tunIP, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setRoute(ip.IP4Net{IP: ip.MustParseIP4("10.5.2.0"), PrefixLen: 24}, ip.MustParseIP4("127.0.0.1"), peer.LocalAddr().(*net.UDPAddr).Port)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		p.run()
+		wg.Done()
+	}()
+
+	// A packet to the remote subnet is sent to the peer
+	app, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(10, 5, 2, 7), Port: 9000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	if _, err := app.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	if err := peer.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := buf[:n]
+	if len(pkt) != 20+8+5 || !net.IP(pkt[16:20]).Equal(net.IPv4(10, 5, 2, 7)) || pkt[8] != 63 ||
+		checksum(pkt[:20]) != 0 || !bytes.Equal(pkt[28:], []byte("hello")) {
+		t.Fatalf("unexpected packet % x", pkt)
+	}
+
+	// The reply of the peer is delivered to the application
+	reply := append([]byte{}, pkt...)
+	copy(reply[12:16], pkt[16:20])
+	copy(reply[16:20], pkt[12:16])
+	copy(reply[20:22], pkt[22:24])
+	copy(reply[22:24], pkt[20:22])
+	reply[8] = 64
+	reply[10], reply[11] = 0, 0
+	reply[26], reply[27] = 0, 0
+	copy(reply[28:], "world")
+	sum := checksum(reply[:20])
+	reply[10], reply[11] = byte(sum>>8), byte(sum)
+	if _, err := peer.WriteTo(reply, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, err = app.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Errorf("unexpected reply %q", buf[:n])
+	}
+
+	p.stop()
+	wg.Wait()
+	p.close()
+}
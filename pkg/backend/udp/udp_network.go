@@ -1,3 +1,6 @@
+//go:build !windows && !windows
+// +build !windows,!windows
+
 // Copyright 2015 flannel authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -11,20 +14,202 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-//go:build !amd64 && !windows
-// +build !amd64,!windows
 
 package udp
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
 
 	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
 	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	encapOverhead = 28 // 20 bytes IP hdr + 8 bytes UDP hdr
 )
 
-func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int, nw ip.IP4Net, l *lease.Lease) (*backend.SimpleNetwork, error) {
-	return nil, fmt.Errorf("UDP backend is not supported on this architecture")
+// proxy forwards the packets between the TUN device and the UDP socket,
+// according to the routes of the remote subnets.
+type proxy interface {
+	// run forwards the packets until stop is called
+	run()
+	setRoute(dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int)
+	removeRoute(dst ip.IP4Net)
+	stop()
+	// close releases the resources of the proxy once run returned
+	close()
+}
+
+type network struct {
+	backend.SimpleNetwork
+	port  int
+	proxy proxy
+	tun   *os.File
+	conn  *net.UDPConn
+	tunIP ip.IP4
+	// networks are the overlay networks routed to the tunnel
+	networks []ip.IP4Net
+	sm       subnet.Manager
+}
+
+func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int, tunIP ip.IP4, networks []ip.IP4Net, l *lease.Lease) (*network, error) {
+	n := &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    extIface,
+		},
+		port: port,
+		sm:   sm,
+	}
+
+	n.tunIP = tunIP
+	n.networks = networks
+
+	if err := n.initTun(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	n.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: extIface.IfaceAddr, Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start listening on UDP socket: %v", err)
+	}
+
+	n.proxy, err = newProxy(n.tun, n.conn, n.tunIP, n.MTU())
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *network) Run(ctx context.Context) {
+	defer func() {
+		err := n.tun.Close()
+		if err != nil {
+			log.Errorf("Failed to close tun device: %v", err)
+		}
+		err = n.conn.Close()
+		if err != nil {
+			log.Errorf("Failed to close UDP connection: %v", err)
+		}
+		n.proxy.close()
+	}()
+
+	// one for each goroutine below
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		n.proxy.run()
+		wg.Done()
+	}()
+
+	log.Info("Watching for new subnet leases")
+
+	evts := make(chan []lease.Event)
+
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.sm, n.SubnetLease, evts)
+		wg.Done()
+	}()
+
+	for {
+		evtBatch, ok := <-evts
+		if !ok {
+			log.Infof("evts chan closed")
+			n.proxy.stop()
+			return
+		}
+		n.processSubnetEvents(evtBatch)
+	}
+}
+
+func (n *network) MTU() int {
+	return n.ExtIface.Iface.MTU - encapOverhead
+}
+
+func (n *network) initTun() error {
+	var tunName string
+	var err error
+
+	n.tun, tunName, err = ip.OpenTun("flannel%d")
+	if err != nil {
+		return fmt.Errorf("failed to open TUN device: %v", err)
+	}
+
+	err = configureIface(tunName, n.tunIP, n.networks, n.MTU())
+	return err
+}
+
+func configureIface(ifname string, tunIP ip.IP4, networks []ip.IP4Net, mtu int) error {
+	iface, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("failed to lookup interface %v", ifname)
+	}
+
+	// Ensure that the device has a /32 address so that no broadcast routes are created.
+	// This IP is just used as a source address for host to workload traffic (so
+	// the return path for the traffic has an address on the flannel network to use as the destination)
+	ipnLocal := ip.IP4Net{IP: tunIP, PrefixLen: 32}
+
+	err = netlink.AddrAdd(iface, &netlink.Addr{IPNet: ipnLocal.ToIPNet(), Label: ""})
+	if err != nil {
+		return fmt.Errorf("failed to add IP address %v to %v: %v", ipnLocal.String(), ifname, err)
+	}
+
+	err = netlink.LinkSetMTU(iface, mtu)
+	if err != nil {
+		return fmt.Errorf("failed to set MTU for %v: %v", ifname, err)
+	}
+
+	err = netlink.LinkSetUp(iface)
+	if err != nil {
+		return fmt.Errorf("failed to set interface %v to UP state: %v", ifname, err)
+	}
+
+	// explicitly add a route since there might be a route for a subnet already
+	// installed by Docker and then it won't get auto added
+	for _, ipn := range networks {
+		err = netlink.RouteAdd(&netlink.Route{
+			LinkIndex: iface.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       ipn.Network().ToIPNet(),
+		})
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
+		}
+	}
+
+	return nil
+}
+
+func (n *network) processSubnetEvents(batch []lease.Event) {
+	for _, evt := range batch {
+		switch evt.Type {
+		case lease.EventAdded:
+			log.Info("Subnet added: ", evt.Lease.Subnet)
+
+			n.proxy.setRoute(evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, n.port)
+
+		case lease.EventRemoved:
+			log.Info("Subnet removed: ", evt.Lease.Subnet)
+
+			n.proxy.removeRoute(evt.Lease.Subnet)
+
+		default:
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+		}
+	}
 }
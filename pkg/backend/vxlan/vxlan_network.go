@@ -28,6 +28,7 @@ import (
 	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
 	"github.com/flannel-io/flannel/pkg/retry"
 	"github.com/flannel-io/flannel/pkg/subnet"
 	"github.com/vishvananda/netlink"
@@ -41,22 +42,30 @@ type network struct {
 	v6Dev     *vxlanDevice
 	subnetMgr subnet.Manager
 	mtu       int
+	cfg       VXLANConfig
+
+	// mu serializes the handling of lease events with configuration updates,
+	// leases holds the remote leases currently programmed, keyed by subnet.
+	mu     sync.Mutex
+	leases map[string]lease.Lease
 }
 
 const (
 	encapOverhead = 50
 )
 
-func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, v6Dev *vxlanDevice, _ ip.IP4Net, lease *lease.Lease, mtu int) (*network, error) {
+func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, v6Dev *vxlanDevice, _ ip.IP4Net, myLease *lease.Lease, cfg VXLANConfig) (*network, error) {
 	nw := &network{
 		SimpleNetwork: backend.SimpleNetwork{
-			SubnetLease: lease,
+			SubnetLease: myLease,
 			ExtIface:    extIface,
 		},
 		subnetMgr: subnetMgr,
 		dev:       dev,
 		v6Dev:     v6Dev,
-		mtu:       mtu,
+		mtu:       cfg.MTU,
+		cfg:       cfg,
+		leases:    make(map[string]lease.Lease),
 	}
 
 	return nw, nil
@@ -83,8 +92,21 @@ func (nw *network) Run(ctx context.Context) {
 		wg.Done()
 	}()
 
+	kernelChanged := make(chan struct{}, 1)
+	wg.Add(1)
+	go func() {
+		nw.watchKernelState(ctx, kernelChanged)
+		log.V(1).Info("WatchKernelState exited")
+		wg.Done()
+	}()
+
 	defer wg.Wait()
 
+	reconcileTicker := time.NewTicker(reconcilePeriod)
+	defer reconcileTicker.Stop()
+	// reconcileDelayed is set while a reconciliation triggered by the kernel is pending
+	var reconcileDelayed <-chan time.Time
+
 	for {
 		select {
 		case evtBatch, ok := <-leaseEvents:
@@ -92,7 +114,26 @@ func (nw *network) Run(ctx context.Context) {
 				log.Infof("leaseEvents chan closed")
 				return
 			}
+			nw.mu.Lock()
 			nw.handleSubnetEvents(evtBatch)
+			nw.trackLeases(evtBatch)
+			nw.mu.Unlock()
+
+		case <-kernelChanged:
+			if reconcileDelayed == nil {
+				reconcileDelayed = time.After(reconcileDelay)
+			}
+
+		case <-reconcileDelayed:
+			reconcileDelayed = nil
+			nw.mu.Lock()
+			nw.reconcile()
+			nw.mu.Unlock()
+
+		case <-reconcileTicker.C:
+			nw.mu.Lock()
+			nw.reconcile()
+			nw.mu.Unlock()
 
 		case _, ok := <-vxlanMissingChan:
 			if !ok {
@@ -105,6 +146,12 @@ func (nw *network) Run(ctx context.Context) {
 			go func() {
 				if err := nw.reCreateVxlan(ctx); err != nil {
 					log.Errorf("failed to recreate vxlan: %v", err)
+					return
+				}
+				// Program the entries of the leases on the new device
+				select {
+				case kernelChanged <- struct{}{}:
+				default:
 				}
 			}()
 		}
@@ -232,9 +279,12 @@ func (nw *network) reCreateVxlan(ctx context.Context) error {
 			continue
 		}
 
+		nw.mu.Lock()
 		nw.dev = dev
 		nw.v6Dev = v6Dev
 		nw.mtu = dev.link.Attrs().MTU
+		nw.cfg = cfg
+		nw.mu.Unlock()
 		log.Infof("VXLAN device %s recreated successfully", dev.link.Attrs().Name)
 		return nil
 	}
@@ -254,15 +304,87 @@ func minDuration(a, b time.Duration) time.Duration {
 }
 
 func (nw *network) MTU() int {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
 	return nw.mtu - encapOverhead
 }
 
+func (nw *network) trackLeases(batch []lease.Event) {
+	for _, event := range batch {
+		key := subnet.MakeSubnetKey(event.Lease.Subnet, event.Lease.IPv6Subnet)
+		switch event.Type {
+		case lease.EventAdded:
+			nw.leases[key] = event.Lease
+		case lease.EventRemoved:
+			delete(nw.leases, key)
+		}
+	}
+}
+
+// UpdateConfig applies a new backend configuration to the running network.
+// The MTU and DirectRouting can be changed in place, the VNI, port, GBP and
+// learning settings are properties of the vxlan device and require a restart.
+func (nw *network) UpdateConfig(ctx context.Context, config *subnet.Config) error {
+	cfg, err := parseVXLANConfig(config.Backend, nw.ExtIface.Iface.MTU)
+	if err != nil {
+		return fmt.Errorf("error decoding VXLAN backend config: %w", err)
+	}
+
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	if cfg.VNI != nw.cfg.VNI || cfg.Port != nw.cfg.Port || cfg.GBP != nw.cfg.GBP || cfg.Learning != nw.cfg.Learning {
+		return fmt.Errorf("changing VNI, Port, GBP or Learning of the vxlan backend requires a restart of flanneld")
+	}
+
+	devs := []*vxlanDevice{}
+	for _, dev := range []*vxlanDevice{nw.dev, nw.v6Dev} {
+		if dev != nil {
+			devs = append(devs, dev)
+		}
+	}
+
+	if cfg.MTU != nw.cfg.MTU {
+		for _, dev := range devs {
+			if err := netlink.LinkSetMTU(dev.link, cfg.MTU-encapOverhead); err != nil {
+				return fmt.Errorf("failed to set MTU of %s: %w", dev.link.Attrs().Name, err)
+			}
+		}
+		log.Infof("VXLAN MTU changed from %d to %d", nw.cfg.MTU, cfg.MTU)
+		nw.mtu = cfg.MTU
+		nw.cfg.MTU = cfg.MTU
+	}
+
+	if cfg.DirectRouting != nw.cfg.DirectRouting {
+		// Remove the entries programmed with the previous mode and add them back with the new one
+		removed := make([]lease.Event, 0, len(nw.leases))
+		added := make([]lease.Event, 0, len(nw.leases))
+		for _, l := range nw.leases {
+			removed = append(removed, lease.Event{Type: lease.EventRemoved, Lease: l})
+			added = append(added, lease.Event{Type: lease.EventAdded, Lease: l})
+		}
+
+		nw.handleSubnetEvents(removed)
+		for _, dev := range devs {
+			dev.directRouting = cfg.DirectRouting
+		}
+		nw.handleSubnetEvents(added)
+
+		log.Infof("VXLAN DirectRouting changed from %v to %v", nw.cfg.DirectRouting, cfg.DirectRouting)
+		nw.cfg.DirectRouting = cfg.DirectRouting
+	}
+
+	return nil
+}
+
 type vxlanLeaseAttrs struct {
 	VNI     uint32
 	VtepMAC hardwareAddr
 }
 
 func (nw *network) handleSubnetEvents(batch []lease.Event) {
+	defer metrics.ObserveSubnetEvents("vxlan", time.Now())
+
 	for _, event := range batch {
 		sn := event.Lease.Subnet
 		v6Sn := event.Lease.IPv6Subnet
@@ -283,6 +405,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 		if event.Lease.EnableIPv4 && nw.dev != nil {
 			if err := json.Unmarshal(attrs.BackendData, &vxlanAttrs); err != nil {
 				log.Error("error decoding subnet lease JSON: ", err)
+				metrics.SubnetEventFailed("vxlan")
 				continue
 			}
 
@@ -312,6 +435,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 		if event.Lease.EnableIPv6 && nw.v6Dev != nil {
 			if err := json.Unmarshal(attrs.BackendV6Data, &v6VxlanAttrs); err != nil {
 				log.Error("error decoding v6 subnet lease JSON: ", err)
+				metrics.SubnetEventFailed("vxlan")
 				continue
 			}
 			if v6Sn.IP != nil && nw.v6Dev != nil {
@@ -349,6 +473,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return netlink.RouteReplace(&directRoute)
 					}); err != nil {
 						log.Errorf("Error adding route to %v via %v: %v", sn, attrs.PublicIP, err)
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 				} else {
@@ -357,6 +482,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return nw.dev.AddARP(neighbor{IP: sn.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)})
 					}); err != nil {
 						log.Error("AddARP failed: ", err)
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 
@@ -372,6 +498,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 							log.Error("DelARP failed: ", err)
 						}
 
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 
@@ -391,6 +518,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 							log.Error("DelFDB failed: ", err)
 						}
 
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 				}
@@ -403,6 +531,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return netlink.RouteReplace(&v6DirectRoute)
 					}); err != nil {
 						log.Errorf("Error adding v6 route to %v via %v: %v", v6Sn, attrs.PublicIPv6, err)
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 				} else {
@@ -411,6 +540,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return nw.v6Dev.AddV6ARP(neighbor{IP6: v6Sn.IP, MAC: net.HardwareAddr(v6VxlanAttrs.VtepMAC)})
 					}); err != nil {
 						log.Error("AddV6ARP failed: ", err)
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 
@@ -424,6 +554,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 							log.Error("DelV6ARP failed: ", err)
 						}
 
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 
@@ -447,6 +578,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 							log.Error("DelV6FDB failed: ", err)
 						}
 
+						metrics.SubnetEventFailed("vxlan")
 						continue
 					}
 				}
@@ -459,6 +591,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return netlink.RouteDel(&directRoute)
 					}); err != nil {
 						log.Errorf("Error deleting route to %v via %v: %v", sn, attrs.PublicIP, err)
+						metrics.SubnetEventFailed("vxlan")
 					}
 				} else {
 					log.V(2).Infof("removing subnet: %s PublicIP: %s VtepMAC: %s", sn, attrs.PublicIP, net.HardwareAddr(vxlanAttrs.VtepMAC))
@@ -480,6 +613,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return netlink.RouteDel(&vxlanRoute)
 					}); err != nil {
 						log.Errorf("failed to delete vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+						metrics.SubnetEventFailed("vxlan")
 					}
 				}
 			}
@@ -490,6 +624,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return netlink.RouteDel(&v6DirectRoute)
 					}); err != nil {
 						log.Errorf("Error deleting v6 route to %v via %v: %v", v6Sn, attrs.PublicIPv6, err)
+						metrics.SubnetEventFailed("vxlan")
 					}
 				} else {
 					log.V(2).Infof("removing v6subnet: %s PublicIPv6: %s VtepMAC: %s", v6Sn, attrs.PublicIPv6, net.HardwareAddr(v6VxlanAttrs.VtepMAC))
@@ -511,6 +646,7 @@ func (nw *network) handleSubnetEvents(batch []lease.Event) {
 						return netlink.RouteDel(&v6VxlanRoute)
 					}); err != nil {
 						log.Errorf("failed to delete v6 vxlanRoute (%s -> %s): %v", v6VxlanRoute.Dst, v6VxlanRoute.Gw, err)
+						metrics.SubnetEventFailed("vxlan")
 					}
 				}
 			}
@@ -0,0 +1,332 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package vxlan
+
+// The lease events are the only trigger for programming the routes, ARP and
+// FDB entries, so an entry removed by someone else (ip neigh flush, a network
+// manager...) would stay missing until the lease of the remote host changes.
+// The reconciler compares the entries expected from the current leases with
+// the kernel state and repairs the drift. It runs periodically and shortly
+// after the kernel reports the deletion of a neighbor or a route of the
+// flannel devices.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/metrics"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	reconcilePeriod = time.Minute
+	// reconcileDelay coalesces the kernel events triggering a reconciliation
+	reconcileDelay = time.Second
+)
+
+// kernelEntries are the routes, ARP/NDP and FDB entries of the vxlan network.
+type kernelEntries struct {
+	routes []netlink.Route
+	neighs []netlink.Neigh
+	fdbs   []netlink.Neigh
+}
+
+// reconcileCounts counts the entries restored and removed, by kind.
+type reconcileCounts map[string]int
+
+// expectedEntries returns the entries the leases currently tracked should
+// have programmed in the kernel. It must be called with nw.mu held.
+func (nw *network) expectedEntries() kernelEntries {
+	var entries kernelEntries
+	for _, l := range nw.leases {
+		attrs := l.Attrs
+		if attrs.BackendType != "vxlan" {
+			continue
+		}
+
+		if l.EnableIPv4 && nw.dev != nil {
+			var vxlanAttrs vxlanLeaseAttrs
+			if err := json.Unmarshal(attrs.BackendData, &vxlanAttrs); err == nil {
+				entries.add(nw.dev, l.Subnet.ToIPNet(), l.Subnet.IP.ToIP(), attrs.PublicIP.ToIP(), net.HardwareAddr(vxlanAttrs.VtepMAC))
+			}
+		}
+
+		if l.EnableIPv6 && nw.v6Dev != nil && l.IPv6Subnet.IP != nil {
+			var vxlanAttrs vxlanLeaseAttrs
+			if err := json.Unmarshal(attrs.BackendV6Data, &vxlanAttrs); err == nil {
+				entries.add(nw.v6Dev, l.IPv6Subnet.ToIPNet(), l.IPv6Subnet.IP.ToIP(), attrs.PublicIPv6.ToIP(), net.HardwareAddr(vxlanAttrs.VtepMAC))
+			}
+		}
+	}
+	return entries
+}
+
+// add appends the entries handleSubnetEvents programs for a subnet.
+func (e *kernelEntries) add(dev *vxlanDevice, dst *net.IPNet, gw, publicIP net.IP, mac net.HardwareAddr) {
+	if dev.directRouting {
+		if dr, err := ip.DirectRouting(publicIP); err == nil && dr {
+			e.routes = append(e.routes, netlink.Route{Dst: dst, Gw: publicIP})
+			return
+		}
+	}
+
+	e.neighs = append(e.neighs, netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           gw,
+		HardwareAddr: mac,
+	})
+	e.fdbs = append(e.fdbs, netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		State:        netlink.NUD_PERMANENT,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		IP:           publicIP,
+		HardwareAddr: mac,
+	})
+	route := netlink.Route{
+		LinkIndex: dev.link.Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       dst,
+		Gw:        gw,
+	}
+	route.SetFlag(syscall.RTNH_F_ONLINK)
+	e.routes = append(e.routes, route)
+}
+
+// reconcile repairs the kernel entries which drifted from the leases. It must
+// be called with nw.mu held.
+func (nw *network) reconcile() {
+	expected := nw.expectedEntries()
+	restored, removed := reconcileCounts{}, reconcileCounts{}
+
+	for _, dev := range []*vxlanDevice{nw.dev, nw.v6Dev} {
+		if dev == nil {
+			continue
+		}
+		if _, err := netlink.LinkByIndex(dev.link.Index); err != nil {
+			// The device is being recreated, it is reconciled once done
+			log.V(2).Infof("Skipping the reconciliation of %s: %v", dev.link.Attrs().Name, err)
+			continue
+		}
+		family := netlink.FAMILY_V4
+		if dev == nw.v6Dev {
+			family = netlink.FAMILY_V6
+		}
+		reconcileNeighs(dev, family, expected.neighs, "neighbor", restored, removed)
+		reconcileNeighs(dev, syscall.AF_BRIDGE, expected.fdbs, "fdb", restored, removed)
+		reconcileRoutes(dev, family, expected.routes, restored, removed)
+	}
+
+	for _, kind := range []string{"route", "neighbor", "fdb"} {
+		metrics.ReconcileRepaired("vxlan", kind, "restored", restored[kind])
+		metrics.ReconcileRepaired("vxlan", kind, "removed", removed[kind])
+	}
+	if len(restored) > 0 || len(removed) > 0 {
+		log.Infof("Reconciled the vxlan kernel state: restored %d routes, %d neighbors and %d FDB entries, removed %d routes, %d neighbors and %d FDB entries",
+			restored["route"], restored["neighbor"], restored["fdb"], removed["route"], removed["neighbor"], removed["fdb"])
+	} else {
+		log.V(4).Info("The vxlan kernel state matches the leases")
+	}
+}
+
+// reconcileNeighs restores the expected neighbors (or FDB entries) of the
+// family missing from the device and removes the permanent ones which are not
+// expected.
+func reconcileNeighs(dev *vxlanDevice, family int, expected []netlink.Neigh, kind string, restored, removed reconcileCounts) {
+	existing, err := netlink.NeighList(dev.link.Index, family)
+	if err != nil {
+		log.Errorf("Failed to list the %s entries of %s: %v", kind, dev.link.Attrs().Name, err)
+		return
+	}
+
+	var wanted []netlink.Neigh
+	wantedKeys := map[string]bool{}
+	for _, n := range expected {
+		if n.LinkIndex == dev.link.Index && (family == syscall.AF_BRIDGE || sameFamily(n.IP, family)) {
+			wanted = append(wanted, n)
+			wantedKeys[neighKey(n)] = true
+		}
+	}
+
+	// Remove the stale entries first, an entry with the wrong MAC would
+	// otherwise be removed after being replaced
+	for _, n := range existing {
+		if n.State&netlink.NUD_PERMANENT == 0 || n.IP == nil || wantedKeys[neighKey(n)] {
+			continue
+		}
+		if err := netlink.NeighDel(&n); err != nil {
+			log.Errorf("Failed to remove stale %s %s (%s) from %s: %v", kind, n.IP, n.HardwareAddr, dev.link.Attrs().Name, err)
+			continue
+		}
+		removed[kind]++
+	}
+
+	for _, n := range wanted {
+		if containsNeigh(existing, n) {
+			continue
+		}
+		if err := netlink.NeighSet(&n); err != nil {
+			log.Errorf("Failed to restore %s %s (%s) on %s: %v", kind, n.IP, n.HardwareAddr, dev.link.Attrs().Name, err)
+			continue
+		}
+		restored[kind]++
+	}
+}
+
+// reconcileRoutes restores the expected routes of the family and removes the
+// routes through the device which are not expected.
+func reconcileRoutes(dev *vxlanDevice, family int, expected []netlink.Route, restored, removed reconcileCounts) {
+	existing, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		log.Errorf("Failed to list routes: %v", err)
+		return
+	}
+
+	var wanted []netlink.Route
+	wantedKeys := map[string]bool{}
+	for _, r := range expected {
+		if sameFamily(r.Dst.IP, family) && (r.LinkIndex == 0 || r.LinkIndex == dev.link.Index) {
+			wanted = append(wanted, r)
+			wantedKeys[routeKey(r)] = true
+		}
+	}
+
+	for _, r := range existing {
+		if r.LinkIndex != dev.link.Index || r.Dst == nil || r.Gw == nil || wantedKeys[routeKey(r)] {
+			continue
+		}
+		if err := netlink.RouteDel(&r); err != nil {
+			log.Errorf("Failed to remove stale route to %s via %s: %v", r.Dst, r.Gw, err)
+			continue
+		}
+		removed["route"]++
+	}
+
+	for _, r := range wanted {
+		if containsRoute(existing, r) {
+			continue
+		}
+		if err := netlink.RouteReplace(&r); err != nil {
+			log.Errorf("Failed to restore route to %s via %s: %v", r.Dst, r.Gw, err)
+			continue
+		}
+		restored["route"]++
+	}
+}
+
+func sameFamily(addr net.IP, family int) bool {
+	return (addr.To4() != nil) == (family == netlink.FAMILY_V4)
+}
+
+func neighKey(n netlink.Neigh) string {
+	return n.IP.String() + "/" + n.HardwareAddr.String()
+}
+
+func containsNeigh(neighs []netlink.Neigh, n netlink.Neigh) bool {
+	for _, existing := range neighs {
+		if existing.IP.Equal(n.IP) && bytes.Equal(existing.HardwareAddr, n.HardwareAddr) && existing.State&netlink.NUD_PERMANENT != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func routeKey(r netlink.Route) string {
+	return r.Dst.String() + "/" + r.Gw.String()
+}
+
+func containsRoute(routes []netlink.Route, r netlink.Route) bool {
+	for _, existing := range routes {
+		if existing.Dst == nil || existing.Dst.String() != r.Dst.String() || !existing.Gw.Equal(r.Gw) {
+			continue
+		}
+		if r.LinkIndex == 0 || existing.LinkIndex == r.LinkIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// watchKernelState signals on changed when a neighbor, an FDB entry or a
+// route of the vxlan devices or the external interface is deleted.
+func (nw *network) watchKernelState(ctx context.Context, changed chan<- struct{}) {
+	neighUpdates := make(chan netlink.NeighUpdate)
+	routeUpdates := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	defer close(done)
+
+	if err := netlink.NeighSubscribe(neighUpdates, done); err != nil {
+		log.Errorf("Failed to subscribe to the neighbor updates, relying on the periodic reconciliation: %v", err)
+		return
+	}
+	if err := netlink.RouteSubscribe(routeUpdates, done); err != nil {
+		log.Errorf("Failed to subscribe to the route updates, relying on the periodic reconciliation: %v", err)
+		return
+	}
+
+	for {
+		var linkIndex int
+		select {
+		case <-ctx.Done():
+			return
+		case u, ok := <-neighUpdates:
+			if !ok {
+				return
+			}
+			if u.Type != unix.RTM_DELNEIGH {
+				continue
+			}
+			linkIndex = u.LinkIndex
+		case u, ok := <-routeUpdates:
+			if !ok {
+				return
+			}
+			if u.Type != unix.RTM_DELROUTE {
+				continue
+			}
+			linkIndex = u.LinkIndex
+		}
+
+		if nw.isManagedLink(linkIndex) {
+			select {
+			case changed <- struct{}{}:
+			default:
+				// A reconciliation is already pending
+			}
+		}
+	}
+}
+
+func (nw *network) isManagedLink(index int) bool {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	for _, dev := range []*vxlanDevice{nw.dev, nw.v6Dev} {
+		if dev != nil && dev.link.Index == index {
+			return true
+		}
+	}
+	return nw.ExtIface != nil && nw.ExtIface.Iface != nil && nw.ExtIface.Iface.Index == index
+}
@@ -0,0 +1,159 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package vxlan
+
+import (
+	"encoding/json"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+)
+
+func TestReconcile(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	// The underlay
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("192.168.0.1"), Mask: net.CIDRMask(24, 32)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := newVXLANDevice(&vxlanDeviceAttrs{
+		vni:       1,
+		name:      "flannel.1",
+		MTU:       1500,
+		vtepIndex: br.Index,
+		vtepAddr:  net.ParseIP("192.168.0.1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.0.0")), PrefixLen: 16}
+	if err := dev.Configure(ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.1.0")), PrefixLen: 32}, network); err != nil {
+		t.Fatal(err)
+	}
+
+	nw, err := newNetwork(nil, &backend.ExternalInterface{Iface: &net.Interface{Index: br.Index}}, dev, nil, ip.IP4Net{}, nil, VXLANConfig{VNI: 1, MTU: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac, _ := net.ParseMAC("0e:00:00:00:00:02")
+	data, _ := json.Marshal(&vxlanLeaseAttrs{VNI: 1, VtepMAC: hardwareAddr(mac)})
+	sn := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.2.0")), PrefixLen: 24}
+	l := lease.Lease{
+		EnableIPv4: true,
+		Subnet:     sn,
+		Attrs: lease.LeaseAttrs{
+			BackendType: "vxlan",
+			PublicIP:    ip.FromIP(net.ParseIP("192.168.0.2")),
+			BackendData: json.RawMessage(data),
+		},
+	}
+	nw.leases[subnet.MakeSubnetKey(sn, ip.IP6Net{})] = l
+
+	checkState := func() {
+		t.Helper()
+		neighs, err := netlink.NeighList(dev.link.Index, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(neighs) != 1 || !neighs[0].IP.Equal(net.ParseIP("10.244.2.0")) || neighs[0].HardwareAddr.String() != mac.String() {
+			t.Errorf("unexpected neighbors %v", neighs)
+		}
+		fdbs, err := netlink.NeighList(dev.link.Index, syscall.AF_BRIDGE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fdbs) != 1 || !fdbs[0].IP.Equal(net.ParseIP("192.168.0.2")) || fdbs[0].HardwareAddr.String() != mac.String() {
+			t.Errorf("unexpected FDB entries %v", fdbs)
+		}
+		routes, err := netlink.RouteList(dev.link, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gwRoutes []netlink.Route
+		for _, r := range routes {
+			if r.Gw != nil {
+				gwRoutes = append(gwRoutes, r)
+			}
+		}
+		if len(gwRoutes) != 1 || gwRoutes[0].Dst.String() != "10.244.2.0/24" || !gwRoutes[0].Gw.Equal(net.ParseIP("10.244.2.0")) {
+			t.Errorf("unexpected routes %v", gwRoutes)
+		}
+	}
+
+	// Nothing was programmed, everything is restored
+	nw.reconcile()
+	checkState()
+
+	// A flushed neighbor and FDB entry are restored
+	if err := dev.DelARP(neighbor{IP: sn.IP, MAC: mac}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.DelFDB(neighbor{IP: ip.FromIP(net.ParseIP("192.168.0.2")), MAC: mac}); err != nil {
+		t.Fatal(err)
+	}
+	nw.reconcile()
+	checkState()
+
+	// A neighbor with the wrong MAC is fixed, stale entries are removed
+	wrongMAC, _ := net.ParseMAC("0e:00:00:00:00:99")
+	if err := dev.AddARP(neighbor{IP: sn.IP, MAC: wrongMAC}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.AddARP(neighbor{IP: ip.FromIP(net.ParseIP("10.244.3.0")), MAC: wrongMAC}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.AddFDB(neighbor{IP: ip.FromIP(net.ParseIP("192.168.0.3")), MAC: wrongMAC}); err != nil {
+		t.Fatal(err)
+	}
+	stale := netlink.Route{
+		LinkIndex: dev.link.Index,
+		Dst:       &net.IPNet{IP: net.ParseIP("10.244.3.0"), Mask: net.CIDRMask(24, 32)},
+		Gw:        net.ParseIP("10.244.3.0"),
+	}
+	stale.SetFlag(syscall.RTNH_F_ONLINK)
+	if err := netlink.RouteAdd(&stale); err != nil {
+		t.Fatal(err)
+	}
+	nw.reconcile()
+	checkState()
+
+	// Once the lease is gone, its entries are removed
+	delete(nw.leases, subnet.MakeSubnetKey(sn, ip.IP6Net{}))
+	nw.reconcile()
+	neighs, _ := netlink.NeighList(dev.link.Index, netlink.FAMILY_V4)
+	fdbs, _ := netlink.NeighList(dev.link.Index, syscall.AF_BRIDGE)
+	if len(neighs) != 0 || len(fdbs) != 0 {
+		t.Errorf("unexpected entries left: %v %v", neighs, fdbs)
+	}
+}
@@ -42,11 +42,14 @@ type wgDeviceAttrs struct {
 	keepalive  *time.Duration
 	name       string
 	MTU        int
+
+	implementation Implementation
 }
 
 type wgDevice struct {
-	link  *netlink.GenericLink
-	attrs *wgDeviceAttrs
+	link      netlink.Link
+	attrs     *wgDeviceAttrs
+	userspace *userspaceDevice
 }
 
 func writePrivateKey(path string, content string) error {
@@ -79,13 +82,19 @@ func writePrivateKey(path string, content string) error {
 	return nil
 }
 
-func (devAttrs *wgDeviceAttrs) setupKeys(psk string) error {
+// keyFilePath returns the path of the private key file.
+func keyFilePath() string {
 	keyFile := "/run/flannel/wgkey"
 
 	envKeyFile, envExists := os.LookupEnv("WIREGUARD_KEY_FILE")
 	if envExists {
 		keyFile = envKeyFile
 	}
+	return keyFile
+}
+
+func (devAttrs *wgDeviceAttrs) setupKeys(psk string) error {
+	keyFile := keyFilePath()
 
 	if _, err := os.Stat(keyFile); errors.Is(err, os.ErrNotExist) {
 		privateKey, err := wgtypes.GeneratePrivateKey()
@@ -127,21 +136,33 @@ func (devAttrs *wgDeviceAttrs) setupKeys(psk string) error {
 }
 
 func newWGDevice(devAttrs *wgDeviceAttrs, ctx context.Context, wg *sync.WaitGroup) (*wgDevice, error) {
-	// Create network device
-	la := netlink.LinkAttrs{
-		Name: devAttrs.name,
-		MTU:  devAttrs.MTU - overhead,
+	dev := wgDevice{
+		attrs: devAttrs,
 	}
-	link := &netlink.GenericLink{LinkAttrs: la, LinkType: "wireguard"}
 
-	link, err := ensureLink(link)
-	if err != nil {
-		return nil, err
+	// Create network device
+	if devAttrs.implementation != UserspaceImplementation {
+		la := netlink.LinkAttrs{
+			Name: devAttrs.name,
+			MTU:  devAttrs.MTU - overhead,
+		}
+		link, err := ensureLink(&netlink.GenericLink{LinkAttrs: la, LinkType: "wireguard"})
+		switch {
+		case err == nil:
+			dev.link = link
+		case devAttrs.implementation == AutoImplementation && kernelUnsupported(err):
+			log.Warningf("The wireguard kernel module is not available, using the userspace implementation: %v", err)
+		default:
+			return nil, err
+		}
 	}
-
-	dev := wgDevice{
-		link:  link,
-		attrs: devAttrs,
+	if dev.link == nil {
+		userspace, link, err := newUserspaceDevice(devAttrs.name, devAttrs.MTU-overhead)
+		if err != nil {
+			return nil, err
+		}
+		dev.userspace = userspace
+		dev.link = link
 	}
 
 	// Create wireguard interface
@@ -153,6 +174,7 @@ func newWGDevice(devAttrs *wgDeviceAttrs, ctx context.Context, wg *sync.WaitGrou
 
 	client, err := wgctrl.New()
 	if err != nil {
+		_ = dev.remove()
 		return nil, fmt.Errorf("failed to open wgctrl: %w", err)
 	}
 	defer func() {
@@ -164,6 +186,7 @@ func newWGDevice(devAttrs *wgDeviceAttrs, ctx context.Context, wg *sync.WaitGrou
 
 	err = client.ConfigureDevice(dev.attrs.name, wgcfg)
 	if err != nil {
+		_ = dev.remove()
 		return nil, fmt.Errorf("failed to configure device %w", err)
 	}
 
@@ -214,6 +237,11 @@ func ensureLink(wglan *netlink.GenericLink) (*netlink.GenericLink, error) {
 }
 
 func (dev *wgDevice) remove() error {
+	if dev.userspace != nil {
+		dev.userspace.close()
+		return nil
+	}
+
 	err := netlink.LinkDel(dev.link)
 	if err != nil {
 		return fmt.Errorf("could not remove wireguard device: %w", err)
@@ -355,3 +383,70 @@ func (dev *wgDevice) removePeer(peerPublicKeyRaw string) error {
 
 	return nil
 }
+
+// setKeepalive changes the persistent keepalive interval used for new peers
+// and applies it to the peers already configured on the device.
+func (dev *wgDevice) setKeepalive(keepalive time.Duration) error {
+	*dev.attrs.keepalive = keepalive
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("failed to open wgctrl: %w", err)
+	}
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			log.Errorf("failed to close wgctrl client: %v", err)
+		}
+	}()
+
+	device, err := client.Device(dev.attrs.name)
+	if err != nil {
+		return fmt.Errorf("failed to get device %s: %w", dev.attrs.name, err)
+	}
+
+	wgcfg := wgtypes.Config{
+		ReplacePeers: false,
+	}
+	for _, peer := range device.Peers {
+		wgcfg.Peers = append(wgcfg.Peers, wgtypes.PeerConfig{
+			PublicKey:                   peer.PublicKey,
+			UpdateOnly:                  true,
+			PersistentKeepaliveInterval: dev.attrs.keepalive,
+		})
+	}
+
+	err = client.ConfigureDevice(dev.attrs.name, wgcfg)
+	if err != nil {
+		return fmt.Errorf("failed to configure device %w", err)
+	}
+
+	return nil
+}
+
+// setPrivateKey replaces the private key of the device. The sessions with the
+// peers are renegotiated with the new key.
+func (dev *wgDevice) setPrivateKey(privateKey *wgtypes.Key) error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("failed to open wgctrl: %w", err)
+	}
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			log.Errorf("failed to close wgctrl client: %v", err)
+		}
+	}()
+
+	wgcfg := wgtypes.Config{
+		PrivateKey:   privateKey,
+		ReplacePeers: false,
+	}
+	err = client.ConfigureDevice(dev.attrs.name, wgcfg)
+	if err != nil {
+		return fmt.Errorf("failed to configure device %w", err)
+	}
+
+	dev.attrs.privateKey = privateKey
+	return nil
+}
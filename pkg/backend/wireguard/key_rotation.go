@@ -0,0 +1,236 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wireguard
+
+// A WireGuard device has a single private key and its peers are identified by
+// their public key, so a key can't be replaced without the peers learning
+// the new public key at the same time. The rotation is done in two steps:
+//   - the next public key is published in the lease with the time it becomes
+//     active, KeyRotationGracePeriod later. The peers pick it up through
+//     handleSubnetEvents and schedule the replacement of the peer.
+//   - once the time is reached, the node and its peers switch to the new key
+//     and the old key is retired from the lease and from the key file.
+// The traffic is only interrupted for the clock skew between the nodes, and
+// for the lease propagation delay with peers running an older flannel.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	log "k8s.io/klog/v2"
+)
+
+// nextKey is the public key a node switches to at ActiveFrom.
+type nextKey struct {
+	PublicKey  string
+	ActiveFrom time.Time
+}
+
+// peer is a peer configured on a device, with the pending replacement of its
+// public key.
+type peer struct {
+	publicKey string
+	rotation  *time.Timer
+}
+
+// activeKey returns the public key of the peer at now, and its next key if
+// it isn't active yet.
+func activeKey(attrs wireguardLeaseAttrs, now time.Time) (string, *nextKey) {
+	if attrs.NextKey == nil {
+		return attrs.PublicKey, nil
+	}
+	if !now.Before(attrs.NextKey.ActiveFrom) {
+		return attrs.NextKey.PublicKey, nil
+	}
+	return attrs.PublicKey, attrs.NextKey
+}
+
+func peerKey(dev *wgDevice, subnet *net.IPNet) string {
+	return dev.attrs.name + "/" + subnet.String()
+}
+
+// setPeer configures the peer of a remote subnet on dev. The previous public
+// key of the peer is removed and the switch to its next key is scheduled. It
+// must be called with n.mu held.
+func (n *network) setPeer(dev *wgDevice, endpoint string, attrs wireguardLeaseAttrs, allowedIPs []net.IPNet) error {
+	key := peerKey(dev, &allowedIPs[0])
+	publicKey, next := activeKey(attrs, time.Now())
+
+	previous, found := n.peers[key]
+	if found && previous.rotation != nil {
+		previous.rotation.Stop()
+	}
+
+	if err := dev.addPeer(endpoint, publicKey, allowedIPs); err != nil {
+		delete(n.peers, key)
+		return err
+	}
+	if found && previous.publicKey != publicKey {
+		// The allowed IPs were moved to the new peer
+		log.Infof("Public key of peer %s changed from %s to %s", endpoint, previous.publicKey, publicKey)
+		if err := dev.removePeer(previous.publicKey); err != nil {
+			log.Errorf("failed to remove the previous peer (%s): %v", previous.publicKey, err)
+		}
+	}
+
+	p := &peer{publicKey: publicKey}
+	if next != nil {
+		log.Infof("Public key of peer %s changes to %s at %v", endpoint, next.PublicKey, next.ActiveFrom)
+		p.rotation = time.AfterFunc(time.Until(next.ActiveFrom), func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.peers[key] != p {
+				// The peer was updated or removed since
+				return
+			}
+			if err := n.setPeer(dev, endpoint, wireguardLeaseAttrs{PublicKey: next.PublicKey}, allowedIPs); err != nil {
+				log.Errorf("failed to switch peer %s to its next key (%s): %v", endpoint, next.PublicKey, err)
+			}
+		})
+	}
+	n.peers[key] = p
+	return nil
+}
+
+// deletePeer removes the peer of a remote subnet from dev. publicKey is used
+// if the peer isn't known. It must be called with n.mu held.
+func (n *network) deletePeer(dev *wgDevice, subnet *net.IPNet, publicKey string) error {
+	key := peerKey(dev, subnet)
+	if p, found := n.peers[key]; found {
+		if p.rotation != nil {
+			p.rotation.Stop()
+		}
+		delete(n.peers, key)
+		publicKey = p.publicKey
+	}
+	return dev.removePeer(publicKey)
+}
+
+// stopRotations cancels the pending switches of the peers to their next key.
+func (n *network) stopRotations() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, p := range n.peers {
+		if p.rotation != nil {
+			p.rotation.Stop()
+		}
+	}
+}
+
+func (n *network) devices() []*wgDevice {
+	devs := []*wgDevice{}
+	for _, dev := range []*wgDevice{n.dev, n.v6Dev} {
+		if dev != nil {
+			devs = append(devs, dev)
+		}
+	}
+	return devs
+}
+
+// publishKeys updates the keys in the lease of the node.
+func (n *network) publishKeys(ctx context.Context, publicKey string, next *nextKey) error {
+	attrs, err := newSubnetAttrs(n.extIface.ExtAddr, n.extIface.ExtV6Addr, n.enableIPv4, n.enableIPv6, publicKey, next, uint16(n.cfg.ListenPort), uint16(n.cfg.ListenPortV6))
+	if err != nil {
+		return err
+	}
+
+	l, err := n.sm.AcquireLease(ctx, attrs)
+	if err != nil {
+		return fmt.Errorf("failed to update lease: %w", err)
+	}
+	// The lease is replaced rather than updated, as it's read by the lease
+	// renewal. The etcd subnet manager renews it with the attributes of the
+	// lease updates it watches.
+	n.leaseMu.Lock()
+	defer n.leaseMu.Unlock()
+	updated := *n.lease
+	updated.Attrs = l.Attrs
+	n.lease = &updated
+	return nil
+}
+
+// announceKey generates the next private key and publishes its public key.
+// It returns the time the key becomes active.
+func (n *network) announceKey(ctx context.Context) (time.Time, error) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not generate private key: %w", err)
+	}
+	next := &nextKey{
+		PublicKey:  privateKey.PublicKey().String(),
+		ActiveFrom: time.Now().Add(n.cfg.KeyRotationGracePeriod * time.Second),
+	}
+
+	n.mu.Lock()
+	publicKey := n.devices()[0].attrs.publicKey.String()
+	n.mu.Unlock()
+
+	if err := n.publishKeys(ctx, publicKey, next); err != nil {
+		return time.Time{}, err
+	}
+	n.nextPrivateKey = &privateKey
+	log.Infof("Announced the next wireguard public key %s, active at %v", next.PublicKey, next.ActiveFrom)
+	return next.ActiveFrom, nil
+}
+
+// switchKey configures the devices with the next private key, and retires the
+// previous key.
+func (n *network) switchKey(ctx context.Context) error {
+	privateKey := n.nextPrivateKey
+	if privateKey == nil {
+		return nil
+	}
+	n.nextPrivateKey = nil
+	publicKey := privateKey.PublicKey()
+
+	// The key file is written first, flannel restarts with the new key if it
+	// stops in between
+	if err := replacePrivateKey(keyFilePath(), privateKey.String()); err != nil {
+		return fmt.Errorf("could not write key file: %w", err)
+	}
+
+	n.mu.Lock()
+	for _, dev := range n.devices() {
+		if err := dev.setPrivateKey(privateKey); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		dev.attrs.publicKey = &publicKey
+	}
+	n.mu.Unlock()
+	log.Infof("Switched to the wireguard public key %s", publicKey)
+
+	// The peers already switched using the next key of the lease, this only
+	// retires the previous key
+	return n.publishKeys(ctx, publicKey.String(), nil)
+}
+
+// replacePrivateKey atomically replaces the content of the key file.
+func replacePrivateKey(path string, content string) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writePrivateKey(tmp, content); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,158 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wireguard
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+func TestActiveKey(t *testing.T) {
+	now := time.Now()
+	attrs := wireguardLeaseAttrs{PublicKey: "old"}
+	if key, next := activeKey(attrs, now); key != "old" || next != nil {
+		t.Errorf("unexpected key %q, next %v", key, next)
+	}
+
+	attrs.NextKey = &nextKey{PublicKey: "new", ActiveFrom: now.Add(time.Minute)}
+	if key, next := activeKey(attrs, now); key != "old" || next != attrs.NextKey {
+		t.Errorf("unexpected key %q, next %v", key, next)
+	}
+	if key, next := activeKey(attrs, now.Add(time.Minute)); key != "new" || next != nil {
+		t.Errorf("unexpected key %q, next %v", key, next)
+	}
+}
+
+func TestLeaseAttrsNextKey(t *testing.T) {
+	activeFrom := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	attrs, err := newSubnetAttrs(nil, nil, true, false, "old", &nextKey{PublicKey: "new", ActiveFrom: activeFrom}, 51820, 51821)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wgAttrs wireguardLeaseAttrs
+	if err := json.Unmarshal(attrs.BackendData, &wgAttrs); err != nil {
+		t.Fatal(err)
+	}
+	if wgAttrs.PublicKey != "old" || wgAttrs.NextKey == nil || wgAttrs.NextKey.PublicKey != "new" || !wgAttrs.NextKey.ActiveFrom.Equal(activeFrom) {
+		t.Errorf("unexpected attributes %+v", wgAttrs)
+	}
+
+	// Without rotation, the attributes are unchanged for the older versions
+	attrs, err = newSubnetAttrs(nil, nil, true, false, "old", nil, 51820, 51821)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(attrs.BackendData) != `{"PublicKey":"old","Port":51820}` {
+		t.Errorf("unexpected backend data %s", attrs.BackendData)
+	}
+}
+
+func TestParseKeyRotationConfig(t *testing.T) {
+	cfg, err := parseWireguardConfig(json.RawMessage(`{"KeyRotationInterval": 86400}`), 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.KeyRotationInterval != 86400 || cfg.KeyRotationGracePeriod != 300 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	for _, config := range []string{
+		`{"KeyRotationInterval": 300}`,
+		`{"KeyRotationInterval": 3600, "KeyRotationGracePeriod": 3600}`,
+		`{"KeyRotationInterval": -1}`,
+	} {
+		if _, err := parseWireguardConfig(json.RawMessage(config), 1500); err == nil {
+			t.Errorf("parseWireguardConfig(%s) should fail", config)
+		}
+	}
+}
+
+func TestReplacePrivateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wgkey")
+	if err := writePrivateKey(path, "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replacePrivateKey(path, "new"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Errorf("unexpected key %q", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was left: %v", err)
+	}
+}
+
+// acquireManager returns the attributes it's given in the acquired leases.
+type acquireManager struct {
+	subnet.Manager
+}
+
+func (acquireManager) AcquireLease(ctx context.Context, attrs *lease.LeaseAttrs) (*lease.Lease, error) {
+	return &lease.Lease{Attrs: *attrs}, nil
+}
+
+func TestPublishKeys(t *testing.T) {
+	renewed := &lease.Lease{EnableIPv4: true}
+	n := &network{
+		extIface: &backend.ExternalInterface{ExtAddr: net.ParseIP("192.168.0.1")},
+		sm:       acquireManager{},
+		lease:    renewed,
+		cfg:      wireguardConfig{ListenPort: 51820},
+
+		enableIPv4: true,
+	}
+
+	// The lease renewal reads the lease while the keys are published
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = n.Lease().Attrs.String()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := n.publishKeys(context.Background(), "old", &nextKey{PublicKey: "new"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	var attrs wireguardLeaseAttrs
+	if err := json.Unmarshal(n.Lease().Attrs.BackendData, &attrs); err != nil {
+		t.Fatal(err)
+	}
+	if attrs.PublicKey != "old" || attrs.NextKey == nil || attrs.NextKey.PublicKey != "new" {
+		t.Errorf("the keys aren't published in the lease: %+v", attrs)
+	}
+	if renewed.Attrs.BackendData != nil {
+		t.Errorf("the lease read by the renewal was updated: %+v", renewed.Attrs)
+	}
+}
@@ -0,0 +1,122 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wireguard
+
+// The userspace implementation runs wireguard-go on a TUN device with the name
+// of the kernel device. It serves the configuration protocol on the socket
+// wgctrl connects to for the userspace devices, so the devices are configured
+// with the same code whatever the implementation.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+	log "k8s.io/klog/v2"
+)
+
+type Implementation string
+
+const (
+	AutoImplementation      Implementation = "auto"
+	KernelImplementation    Implementation = "kernel"
+	UserspaceImplementation Implementation = "userspace"
+)
+
+type userspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+// kernelUnsupported tells if the creation of the kernel device failed because
+// the wireguard module is not available.
+func kernelUnsupported(err error) bool {
+	return errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+// newUserspaceDevice creates the TUN device and starts wireguard-go on it.
+func newUserspaceDevice(name string, mtu int) (*userspaceDevice, netlink.Link, error) {
+	// Remove the device left by a previous run with the kernel implementation
+	if existing, err := netlink.LinkByName(name); err == nil {
+		log.Warningf("%q already exists; recreating device", name)
+		if err := netlink.LinkDel(existing); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tunDev, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create TUN device: %w", err)
+	}
+
+	logger := &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			log.V(4).Infof("%s: "+format, append([]any{name}, args...)...)
+		},
+		Errorf: func(format string, args ...any) {
+			log.Errorf("%s: "+format, append([]any{name}, args...)...)
+		},
+	}
+	dev := &userspaceDevice{
+		device: device.NewDevice(tunDev, conn.NewDefaultBind(), logger),
+	}
+
+	uapiFile, err := ipc.UAPIOpen(name)
+	if err != nil {
+		dev.device.Close()
+		return nil, nil, fmt.Errorf("could not open the configuration socket of %s: %w", name, err)
+	}
+	dev.uapi, err = ipc.UAPIListen(name, uapiFile)
+	if err != nil {
+		uapiFile.Close()
+		dev.device.Close()
+		return nil, nil, fmt.Errorf("could not listen on the configuration socket of %s: %w", name, err)
+	}
+	go func() {
+		for {
+			c, err := dev.uapi.Accept()
+			if err != nil {
+				// The listener was closed
+				return
+			}
+			go dev.device.IpcHandle(c)
+		}
+	}()
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		dev.close()
+		return nil, nil, fmt.Errorf("can't locate created wireguard device %s: %w", name, err)
+	}
+
+	log.Infof("Started userspace wireguard device %s", name)
+	return dev, link, nil
+}
+
+// close stops wireguard-go, which removes the TUN device.
+func (dev *userspaceDevice) close() {
+	if err := dev.uapi.Close(); err != nil {
+		log.Errorf("failed to close the configuration socket: %v", err)
+	}
+	dev.device.Close()
+}
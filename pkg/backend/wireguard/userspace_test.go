@@ -0,0 +1,116 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wireguard
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestUserspaceDevice(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepalive := time.Duration(0)
+	devAttrs := &wgDeviceAttrs{
+		listenPort:     0,
+		privateKey:     &privateKey,
+		keepalive:      &keepalive,
+		name:           "flannel-wg",
+		MTU:            1500,
+		implementation: UserspaceImplementation,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	dev, err := newWGDevice(devAttrs, ctx, &wg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	if dev.userspace == nil || dev.link.Attrs().MTU != 1500-overhead {
+		t.Errorf("unexpected device %+v", dev.link.Attrs())
+	}
+	network := ip.IP4Net{IP: ip.MustParseIP4("10.244.0.0"), PrefixLen: 16}
+	if err := dev.Configure(ip.MustParseIP4("10.244.1.0"), network); err != nil {
+		t.Error(err)
+	}
+
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, peerSubnet, _ := net.ParseCIDR("10.244.2.0/24")
+	if err := dev.addPeer("192.168.0.2:51820", peerKey.PublicKey().String(), []net.IPNet{*peerSubnet}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	device, err := client.Device("flannel-wg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.PrivateKey != privateKey || len(device.Peers) != 1 || device.Peers[0].PublicKey != peerKey.PublicKey() ||
+		len(device.Peers[0].AllowedIPs) != 1 || device.Peers[0].AllowedIPs[0].String() != "10.244.2.0/24" {
+		t.Errorf("unexpected device configuration %+v", device)
+	}
+
+	if err := dev.removePeer(peerKey.PublicKey().String()); err != nil {
+		t.Fatal(err)
+	}
+	if device, err := client.Device("flannel-wg"); err != nil || len(device.Peers) != 0 {
+		t.Errorf("the peer was not removed: %v, %v", device, err)
+	}
+
+	// The device is removed on shutdown
+	cancel()
+	wg.Wait()
+	if _, err := netlink.LinkByName("flannel-wg"); err == nil {
+		t.Errorf("the device was not removed")
+	}
+}
+
+func TestKernelUnsupported(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	link := &netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: "flannel-wg"}, LinkType: "wireguard"}
+	_, err := ensureLink(link)
+	if err == nil {
+		t.Skip("the wireguard kernel module is available")
+	}
+	if !kernelUnsupported(err) {
+		t.Errorf("the error should trigger the userspace fallback: %v", err)
+	}
+}
@@ -57,10 +57,11 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
-func newSubnetAttrs(publicIP net.IP, publicIPv6 net.IP, enableIPv4, enableIPv6 bool, publicKey string, v4Port, v6Port uint16) (*lease.LeaseAttrs, error) {
+func newSubnetAttrs(publicIP net.IP, publicIPv6 net.IP, enableIPv4, enableIPv6 bool, publicKey string, next *nextKey, v4Port, v6Port uint16) (*lease.LeaseAttrs, error) {
 	v4Data, err := json.Marshal(&wireguardLeaseAttrs{
 		PublicKey: publicKey,
 		Port:      v4Port,
+		NextKey:   next,
 	})
 	if err != nil {
 		return nil, err
@@ -68,6 +69,7 @@ func newSubnetAttrs(publicIP net.IP, publicIPv6 net.IP, enableIPv4, enableIPv6 b
 	v6Data, err := json.Marshal(&wireguardLeaseAttrs{
 		PublicKey: publicKey,
 		Port:      v6Port,
+		NextKey:   next,
 	})
 	if err != nil {
 		return nil, err
@@ -96,12 +98,13 @@ func newSubnetAttrs(publicIP net.IP, publicIPv6 net.IP, enableIPv4, enableIPv6 b
 	return leaseAttrs, nil
 }
 
-func createWGDev(ctx context.Context, wg *sync.WaitGroup, name string, psk string, keepalive *time.Duration, listenPort int, mtu int) (*wgDevice, error) {
+func createWGDev(ctx context.Context, wg *sync.WaitGroup, name string, psk string, keepalive *time.Duration, listenPort int, mtu int, implementation Implementation) (*wgDevice, error) {
 	devAttrs := wgDeviceAttrs{
-		keepalive:  keepalive,
-		listenPort: listenPort,
-		name:       name,
-		MTU:        mtu,
+		keepalive:      keepalive,
+		listenPort:     listenPort,
+		name:           name,
+		MTU:            mtu,
+		implementation: implementation,
 	}
 	err := devAttrs.setupKeys(psk)
 	if err != nil {
@@ -110,52 +113,79 @@ func createWGDev(ctx context.Context, wg *sync.WaitGroup, name string, psk strin
 	return newWGDevice(&devAttrs, ctx, wg)
 }
 
-func (be *WireguardBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
-	// Parse out configuration
-	cfg := struct {
-		ListenPort                  int
-		ListenPortV6                int
-		MTU                         int
-		PSK                         string
-		PersistentKeepaliveInterval time.Duration
-		Mode                        Mode
-	}{
+type wireguardConfig struct {
+	ListenPort                  int
+	ListenPortV6                int
+	MTU                         int
+	PSK                         string
+	PersistentKeepaliveInterval time.Duration
+	Mode                        Mode
+	Implementation              Implementation
+	KeyRotationInterval         time.Duration
+	KeyRotationGracePeriod      time.Duration
+}
+
+func parseWireguardConfig(config json.RawMessage, defaultMTU int) (wireguardConfig, error) {
+	cfg := wireguardConfig{
 		ListenPort:                  51820,
 		ListenPortV6:                51821,
-		MTU:                         be.extIface.Iface.MTU,
+		MTU:                         defaultMTU,
 		PersistentKeepaliveInterval: 0,
 		Mode:                        Separate,
+		Implementation:              AutoImplementation,
+		KeyRotationInterval:         0,
+		KeyRotationGracePeriod:      300,
 	}
 
-	if len(config.Backend) > 0 {
-		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
-			return nil, fmt.Errorf("error decoding backend config: %w", err)
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return wireguardConfig{}, fmt.Errorf("error decoding backend config: %w", err)
 		}
 	}
 
+	switch cfg.Implementation {
+	case AutoImplementation, KernelImplementation, UserspaceImplementation:
+	default:
+		return wireguardConfig{}, fmt.Errorf("unknown Implementation %q, must be auto, kernel or userspace", cfg.Implementation)
+	}
+	if cfg.KeyRotationInterval < 0 || cfg.KeyRotationGracePeriod < 0 {
+		return wireguardConfig{}, fmt.Errorf("KeyRotationInterval and KeyRotationGracePeriod can't be negative")
+	}
+	if cfg.KeyRotationInterval > 0 && cfg.KeyRotationInterval <= cfg.KeyRotationGracePeriod {
+		return wireguardConfig{}, fmt.Errorf("KeyRotationInterval (%d) must be greater than KeyRotationGracePeriod (%d)", cfg.KeyRotationInterval, cfg.KeyRotationGracePeriod)
+	}
+	return cfg, nil
+}
+
+func (be *WireguardBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	// Parse out configuration
+	cfg, err := parseWireguardConfig(config.Backend, be.extIface.Iface.MTU)
+	if err != nil {
+		return nil, err
+	}
+
 	keepalive := cfg.PersistentKeepaliveInterval * time.Second
 
-	var err error
 	var dev, v6Dev *wgDevice
 	var publicKey string
 	switch cfg.Mode {
 	case Separate:
 		if config.EnableIPv4 {
-			dev, err = createWGDev(ctx, wg, "flannel-wg", cfg.PSK, &keepalive, cfg.ListenPort, cfg.MTU)
+			dev, err = createWGDev(ctx, wg, "flannel-wg", cfg.PSK, &keepalive, cfg.ListenPort, cfg.MTU, cfg.Implementation)
 			if err != nil {
 				return nil, err
 			}
 			publicKey = dev.attrs.publicKey.String()
 		}
 		if config.EnableIPv6 {
-			v6Dev, err = createWGDev(ctx, wg, "flannel-wg-v6", cfg.PSK, &keepalive, cfg.ListenPortV6, cfg.MTU)
+			v6Dev, err = createWGDev(ctx, wg, "flannel-wg-v6", cfg.PSK, &keepalive, cfg.ListenPortV6, cfg.MTU, cfg.Implementation)
 			if err != nil {
 				return nil, err
 			}
 			publicKey = v6Dev.attrs.publicKey.String()
 		}
 	case Auto, Ipv4, Ipv6:
-		dev, err = createWGDev(ctx, wg, "flannel-wg", cfg.PSK, &keepalive, cfg.ListenPort, cfg.MTU)
+		dev, err = createWGDev(ctx, wg, "flannel-wg", cfg.PSK, &keepalive, cfg.ListenPort, cfg.MTU, cfg.Implementation)
 		if err != nil {
 			return nil, err
 		}
@@ -164,7 +194,7 @@ func (be *WireguardBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGr
 		return nil, fmt.Errorf("no valid Mode configured")
 	}
 
-	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, be.extIface.ExtV6Addr, config.EnableIPv4, config.EnableIPv6, publicKey, uint16(cfg.ListenPort), uint16(cfg.ListenPortV6))
+	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, be.extIface.ExtV6Addr, config.EnableIPv4, config.EnableIPv6, publicKey, nil, uint16(cfg.ListenPort), uint16(cfg.ListenPortV6))
 	if err != nil {
 		return nil, err
 	}
@@ -205,5 +235,5 @@ func (be *WireguardBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGr
 		}
 	}
 
-	return newNetwork(be.sm, be.extIface, dev, v6Dev, cfg.Mode, lease, cfg.MTU)
+	return newNetwork(be.sm, be.extIface, dev, v6Dev, cfg, lease, config.EnableIPv4, config.EnableIPv6)
 }
@@ -22,11 +22,15 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
 	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	log "k8s.io/klog/v2"
 )
 
@@ -48,30 +52,52 @@ type network struct {
 	v6Dev    *wgDevice
 	extIface *backend.ExternalInterface
 	mode     Mode
-	lease    *lease.Lease
 	sm       subnet.Manager
 	mtu      int
+	cfg      wireguardConfig
+
+	enableIPv4 bool
+	enableIPv6 bool
+	// leaseMu protects lease, replaced when the keys are published
+	leaseMu sync.Mutex
+	lease   *lease.Lease
+	// nextPrivateKey is the key announced in the lease, only used by Run
+	nextPrivateKey *wgtypes.Key
+
+	// mu serializes the handling of lease events with configuration updates
+	// and key rotations. It protects peers, the peers configured on the
+	// devices keyed by device and subnet.
+	mu    sync.Mutex
+	peers map[string]*peer
 }
 
-func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, dev, v6Dev *wgDevice, mode Mode, lease *lease.Lease, mtu int) (*network, error) {
+func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, dev, v6Dev *wgDevice, cfg wireguardConfig, lease *lease.Lease, enableIPv4, enableIPv6 bool) (*network, error) {
 	n := &network{
-		dev:      dev,
-		v6Dev:    v6Dev,
-		extIface: extIface,
-		mode:     mode,
-		lease:    lease,
-		sm:       sm,
-		mtu:      mtu,
+		dev:        dev,
+		v6Dev:      v6Dev,
+		extIface:   extIface,
+		mode:       cfg.Mode,
+		lease:      lease,
+		sm:         sm,
+		mtu:        cfg.MTU,
+		cfg:        cfg,
+		enableIPv4: enableIPv4,
+		enableIPv6: enableIPv6,
+		peers:      make(map[string]*peer),
 	}
 
 	return n, nil
 }
 
 func (n *network) Lease() *lease.Lease {
+	n.leaseMu.Lock()
+	defer n.leaseMu.Unlock()
 	return n.lease
 }
 
 func (n *network) MTU() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	return n.mtu - overhead
 }
 
@@ -82,16 +108,41 @@ func (n *network) Run(ctx context.Context) {
 	events := make(chan []lease.Event)
 	wg.Add(1)
 	go func() {
-		subnet.WatchLeases(ctx, n.sm, n.lease, events)
+		subnet.WatchLeases(ctx, n.sm, n.Lease(), events)
 		wg.Done()
 	}()
 
 	defer wg.Wait()
+	defer n.stopRotations()
+
+	var rotation, switchKey <-chan time.Time
+	if n.cfg.KeyRotationInterval > 0 {
+		log.Infof("Rotating the wireguard key every %v", n.cfg.KeyRotationInterval*time.Second)
+		ticker := time.NewTicker(n.cfg.KeyRotationInterval * time.Second)
+		defer ticker.Stop()
+		rotation = ticker.C
+	}
 
 	for {
 		select {
 		case evtBatch := <-events:
+			n.mu.Lock()
 			n.handleSubnetEvents(ctx, evtBatch)
+			n.mu.Unlock()
+
+		case <-rotation:
+			activeFrom, err := n.announceKey(ctx)
+			if err != nil {
+				log.Errorf("Failed to announce the next wireguard key, retrying at the next rotation: %v", err)
+				continue
+			}
+			switchKey = time.After(time.Until(activeFrom))
+
+		case <-switchKey:
+			switchKey = nil
+			if err := n.switchKey(ctx); err != nil {
+				log.Errorf("Failed to switch to the next wireguard key: %v", err)
+			}
 
 		case <-ctx.Done():
 			return
@@ -99,9 +150,55 @@ func (n *network) Run(ctx context.Context) {
 	}
 }
 
+// UpdateConfig applies a new backend configuration to the running network.
+// Only the MTU and the PersistentKeepaliveInterval can be changed in place,
+// the ports, the PSK and the mode are part of the lease or of the peers
+// configuration and require a restart.
+func (n *network) UpdateConfig(ctx context.Context, config *subnet.Config) error {
+	cfg, err := parseWireguardConfig(config.Backend, n.extIface.Iface.MTU)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if cfg.ListenPort != n.cfg.ListenPort || cfg.ListenPortV6 != n.cfg.ListenPortV6 || cfg.PSK != n.cfg.PSK || cfg.Mode != n.cfg.Mode || cfg.Implementation != n.cfg.Implementation ||
+		cfg.KeyRotationInterval != n.cfg.KeyRotationInterval || cfg.KeyRotationGracePeriod != n.cfg.KeyRotationGracePeriod {
+		return fmt.Errorf("changing ListenPort, ListenPortV6, PSK, Mode, Implementation or the key rotation of the wireguard backend requires a restart of flanneld")
+	}
+
+	devs := n.devices()
+
+	if cfg.MTU != n.cfg.MTU {
+		for _, dev := range devs {
+			if err := netlink.LinkSetMTU(dev.link, cfg.MTU-overhead); err != nil {
+				return fmt.Errorf("failed to set MTU of %s: %w", dev.attrs.name, err)
+			}
+		}
+		log.Infof("wireguard MTU changed from %d to %d", n.cfg.MTU, cfg.MTU)
+		n.mtu = cfg.MTU
+		n.cfg.MTU = cfg.MTU
+	}
+
+	if cfg.PersistentKeepaliveInterval != n.cfg.PersistentKeepaliveInterval {
+		keepalive := cfg.PersistentKeepaliveInterval * time.Second
+		for _, dev := range devs {
+			if err := dev.setKeepalive(keepalive); err != nil {
+				return err
+			}
+		}
+		log.Infof("wireguard PersistentKeepaliveInterval changed from %d to %d", n.cfg.PersistentKeepaliveInterval, cfg.PersistentKeepaliveInterval)
+		n.cfg.PersistentKeepaliveInterval = cfg.PersistentKeepaliveInterval
+	}
+
+	return nil
+}
+
 type wireguardLeaseAttrs struct {
 	PublicKey string
 	Port      uint16
+	NextKey   *nextKey `json:",omitempty"`
 }
 
 // Select the mode that is most likely to allow for a successful connection.
@@ -129,6 +226,8 @@ func (n *network) selectMode(ip4 ip.IP4, ip6 *ip.IP6) Mode {
 }
 
 func (n *network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
+	defer metrics.ObserveSubnetEvents("wireguard", time.Now())
+
 	for _, event := range batch {
 		switch event.Type {
 		case lease.EventAdded:
@@ -144,6 +243,7 @@ func (n *network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
 				if len(event.Lease.Attrs.BackendData) > 0 {
 					if err := json.Unmarshal(event.Lease.Attrs.BackendData, &v4wireguardAttrs); err != nil {
 						log.Errorf("failed to unmarshal BackendData: %v", err)
+						metrics.SubnetEventFailed("wireguard")
 						continue
 					}
 				}
@@ -155,6 +255,7 @@ func (n *network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
 				if len(event.Lease.Attrs.BackendV6Data) > 0 {
 					if err := json.Unmarshal(event.Lease.Attrs.BackendV6Data, &v6wireguardAttrs); err != nil {
 						log.Errorf("failed to unmarshal BackendData: %v", err)
+						metrics.SubnetEventFailed("wireguard")
 						continue
 					}
 				}
@@ -181,37 +282,47 @@ func (n *network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
 			if n.mode == Separate {
 				if event.Lease.EnableIPv4 {
 					log.Infof("Subnet added: %v via %v", event.Lease.Subnet, v4PeerEndpoint)
-					if err := n.dev.addPeer(
+					if err := n.setPeer(
+						n.dev,
 						v4PeerEndpoint,
-						v4wireguardAttrs.PublicKey,
+						v4wireguardAttrs,
 						[]net.IPNet{*event.Lease.Subnet.ToIPNet()}); err != nil {
 						log.Errorf("failed to setup ipv4 peer (%s): %v", v4wireguardAttrs.PublicKey, err)
+						metrics.SubnetEventFailed("wireguard")
 					}
 					netconf, err := n.sm.GetNetworkConfig(ctx)
 					if err != nil {
 						log.Errorf("could not read network config: %v", err)
 					}
 
-					if err := n.dev.addRoute(netconf.Network.ToIPNet()); err != nil {
-						log.Errorf("failed to add ipv4 route to (%s): %v", netconf.Network, err)
+					for _, network := range netconf.Networks() {
+						if err := n.dev.addRoute(network.ToIPNet()); err != nil {
+							log.Errorf("failed to add ipv4 route to (%s): %v", network, err)
+							metrics.SubnetEventFailed("wireguard")
+						}
 					}
 				}
 
 				if event.Lease.EnableIPv6 {
 					log.Infof("Subnet added: %v via %v", event.Lease.IPv6Subnet, v6PeerEndpoint)
-					if err := n.v6Dev.addPeer(
+					if err := n.setPeer(
+						n.v6Dev,
 						v6PeerEndpoint,
-						v6wireguardAttrs.PublicKey,
+						v6wireguardAttrs,
 						[]net.IPNet{*event.Lease.IPv6Subnet.ToIPNet()}); err != nil {
 						log.Errorf("failed to setup ipv6 peer (%s): %v", v6wireguardAttrs.PublicKey, err)
+						metrics.SubnetEventFailed("wireguard")
 					}
 					netconf, err := n.sm.GetNetworkConfig(ctx)
 					if err != nil {
 						log.Errorf("could not read network config: %v", err)
 					}
 
-					if err := n.v6Dev.addRoute(netconf.IPv6Network.ToIPNet()); err != nil {
-						log.Errorf("failed to add ipv6 route to (%s): %v", netconf.IPv6Network, err)
+					for _, network := range netconf.IPv6Networks() {
+						if err := n.v6Dev.addRoute(network.ToIPNet()); err != nil {
+							log.Errorf("failed to add ipv6 route to (%s): %v", network, err)
+							metrics.SubnetEventFailed("wireguard")
+						}
 					}
 				}
 			} else {
@@ -232,23 +343,31 @@ func (n *network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
 				for _, v := range subnets {
 					peers = append(peers, *v)
 				}
-				if err := n.dev.addPeer(
+				if err := n.setPeer(
+					n.dev,
 					publicEndpoint,
-					wireguardAttrs.PublicKey,
+					wireguardAttrs,
 					peers); err != nil {
 					log.Errorf("failed to setup peer (%s): %v", v4wireguardAttrs.PublicKey, err)
+					metrics.SubnetEventFailed("wireguard")
 				}
 				netconf, err := n.sm.GetNetworkConfig(ctx)
 				if err != nil {
 					log.Errorf("could not read network config: %v", err)
 				}
 
-				if err := n.dev.addRoute(netconf.Network.ToIPNet()); err != nil {
-					log.Errorf("failed to add ipv4 route to (%s): %v", netconf.Network, err)
+				for _, network := range netconf.Networks() {
+					if err := n.dev.addRoute(network.ToIPNet()); err != nil {
+						log.Errorf("failed to add ipv4 route to (%s): %v", network, err)
+						metrics.SubnetEventFailed("wireguard")
+					}
 				}
 
-				if err := n.dev.addRoute(netconf.IPv6Network.ToIPNet()); err != nil {
-					log.Errorf("failed to add ipv6 route to (%s): %v", netconf.IPv6Network, err)
+				for _, network := range netconf.IPv6Networks() {
+					if err := n.dev.addRoute(network.ToIPNet()); err != nil {
+						log.Errorf("failed to add ipv6 route to (%s): %v", network, err)
+						metrics.SubnetEventFailed("wireguard")
+					}
 				}
 			}
 
@@ -265,14 +384,18 @@ func (n *network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
 				if len(event.Lease.Attrs.BackendData) > 0 {
 					if err := json.Unmarshal(event.Lease.Attrs.BackendData, &wireguardAttrs); err != nil {
 						log.Errorf("failed to unmarshal BackendData: %v", err)
+						metrics.SubnetEventFailed("wireguard")
 						continue
 					}
 				}
 
-				if err := n.dev.removePeer(
+				if err := n.deletePeer(
+					n.dev,
+					event.Lease.Subnet.ToIPNet(),
 					wireguardAttrs.PublicKey,
 				); err != nil {
 					log.Errorf("failed to remove ipv4 peer (%s): %v", wireguardAttrs.PublicKey, err)
+					metrics.SubnetEventFailed("wireguard")
 				}
 			}
 
@@ -281,18 +404,20 @@ func (n *network) handleSubnetEvents(ctx context.Context, batch []lease.Event) {
 				if len(event.Lease.Attrs.BackendV6Data) > 0 {
 					if err := json.Unmarshal(event.Lease.Attrs.BackendV6Data, &wireguardAttrs); err != nil {
 						log.Errorf("failed to unmarshal BackendData: %v", err)
+						metrics.SubnetEventFailed("wireguard")
 						continue
 					}
 				}
 
 				var err error
 				if n.mode == Separate && n.v6Dev != nil {
-					err = n.v6Dev.removePeer(wireguardAttrs.PublicKey)
+					err = n.deletePeer(n.v6Dev, event.Lease.IPv6Subnet.ToIPNet(), wireguardAttrs.PublicKey)
 				} else {
-					err = n.dev.removePeer(wireguardAttrs.PublicKey)
+					err = n.deletePeer(n.dev, event.Lease.IPv6Subnet.ToIPNet(), wireguardAttrs.PublicKey)
 				}
 				if err != nil {
 					log.Errorf("failed to remove ipv6 peer (%s): %v", wireguardAttrs.PublicKey, err)
+					metrics.SubnetEventFailed("wireguard")
 				}
 			}
 		default:
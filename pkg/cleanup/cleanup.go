@@ -0,0 +1,378 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+// Package cleanup finds and removes what flanneld installed on a host: the
+// backend devices, routes and ipsec policies, the traffic manager rules and
+// the files written by flanneld. It backs the "flanneld cleanup" command.
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	log "k8s.io/klog/v2"
+	"sigs.k8s.io/knftables"
+)
+
+const (
+	// All the devices created by the backends are named flannel.<VNI>,
+	// flannel-v6.<VNI>, flannel-wg, flannel.ipip, flannel<N>...
+	linkPrefix = "flannel"
+	// ipsecReqID is the reqid of the XFRM policies of the ipsec backend
+	ipsecReqID = 11
+	// defaultWireguardKeyFile is the private key of the wireguard backend
+	defaultWireguardKeyFile = "/run/flannel/wgkey"
+)
+
+// Options tells where to look for the flannel artifacts.
+type Options struct {
+	// SubnetFile is the subnet.env file written by flanneld
+	SubnetFile string
+	// Networks and IPv6Networks are the flannel networks. The routes to
+	// subnets of these networks are removed.
+	Networks     []ip.IP4Net
+	IPv6Networks []ip.IP6Net
+}
+
+// Artifact is something installed by flanneld on the host.
+type Artifact struct {
+	Kind   string
+	Name   string
+	remove func(ctx context.Context) error
+}
+
+func (a Artifact) String() string {
+	return fmt.Sprintf("%s %s", a.Kind, a.Name)
+}
+
+// Remove deletes the artifact from the host.
+func (a Artifact) Remove(ctx context.Context) error {
+	return a.remove(ctx)
+}
+
+// Discover returns the flannel artifacts found on the host. The artifacts
+// are ordered so that they can be removed in sequence. Errors are returned
+// along with the artifacts which could be found.
+func Discover(ctx context.Context, opts Options) ([]Artifact, error) {
+	var artifacts []Artifact
+	var errs []error
+
+	for _, discover := range []func(context.Context, Options) ([]Artifact, error){
+		discoverIPTables,
+		discoverNFTables,
+		discoverXFRM,
+		discoverRoutes,
+		discoverLinks,
+		discoverFiles,
+	} {
+		found, err := discover(ctx, opts)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		artifacts = append(artifacts, found...)
+	}
+
+	return artifacts, errors.Join(errs...)
+}
+
+// Run removes all the flannel artifacts found on the host. With dryRun, the
+// artifacts are only logged.
+func Run(ctx context.Context, opts Options, dryRun bool) error {
+	artifacts, err := Discover(ctx, opts)
+	if err != nil {
+		log.Warningf("Some flannel artifacts couldn't be discovered: %v", err)
+	}
+	if len(artifacts) == 0 {
+		log.Info("No flannel artifact found")
+		return err
+	}
+
+	errs := []error{err}
+	for _, a := range artifacts {
+		if dryRun {
+			log.Infof("Would remove %s", a)
+			continue
+		}
+		if rerr := a.Remove(ctx); rerr != nil {
+			log.Errorf("Failed to remove %s: %v", a, rerr)
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", a, rerr))
+			continue
+		}
+		log.Infof("Removed %s", a)
+	}
+	return errors.Join(errs...)
+}
+
+// iptablesChain is a chain created by the IPTablesManager along with the
+// rule jumping to it.
+type iptablesChain struct {
+	table    string
+	chain    string
+	parent   string
+	rulespec []string
+}
+
+var iptablesChains = []iptablesChain{
+	{table: "nat", chain: "FLANNEL-POSTRTG", parent: "POSTROUTING", rulespec: []string{"-m", "comment", "--comment", "flanneld masq", "-j", "FLANNEL-POSTRTG"}},
+	{table: "filter", chain: "FLANNEL-FWD", parent: "FORWARD", rulespec: []string{"-m", "comment", "--comment", "flanneld forward", "-j", "FLANNEL-FWD"}},
+}
+
+func discoverIPTables(ctx context.Context, opts Options) ([]Artifact, error) {
+	var artifacts []Artifact
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			// No iptables binary, so no iptables rules either
+			log.V(2).Infof("iptables (%v) not available: %v", proto, err)
+			continue
+		}
+		kind := "iptables chain"
+		if proto == iptables.ProtocolIPv6 {
+			kind = "ip6tables chain"
+		}
+		for _, c := range iptablesChains {
+			exists, err := ipt.ChainExists(c.table, c.chain)
+			if err != nil {
+				return artifacts, fmt.Errorf("failed to check %s %s/%s: %w", kind, c.table, c.chain, err)
+			}
+			if !exists {
+				continue
+			}
+			artifacts = append(artifacts, Artifact{
+				Kind: kind,
+				Name: c.table + "/" + c.chain,
+				remove: func(ctx context.Context) error {
+					if err := ipt.DeleteIfExists(c.table, c.parent, c.rulespec...); err != nil {
+						return err
+					}
+					return ipt.ClearAndDeleteChain(c.table, c.chain)
+				},
+			})
+		}
+	}
+	return artifacts, nil
+}
+
+func discoverNFTables(ctx context.Context, opts Options) ([]Artifact, error) {
+	var artifacts []Artifact
+	for _, t := range []struct {
+		family knftables.Family
+		table  string
+	}{
+		{knftables.IPv4Family, "flannel-ipv4"},
+		{knftables.IPv6Family, "flannel-ipv6"},
+	} {
+		family, table := t.family, t.table
+		nft, err := knftables.New(family, table)
+		if err != nil {
+			log.V(2).Infof("nftables (%s) not available: %v", family, err)
+			continue
+		}
+		if _, err := nft.List(ctx, "chains"); err != nil {
+			if !knftables.IsNotFound(err) {
+				return artifacts, fmt.Errorf("failed to list nftables table %s: %w", table, err)
+			}
+			continue
+		}
+		artifacts = append(artifacts, Artifact{
+			Kind: "nftables table",
+			Name: fmt.Sprintf("%s %s", family, table),
+			remove: func(ctx context.Context) error {
+				tx := nft.NewTransaction()
+				tx.Delete(&knftables.Table{})
+				return nft.Run(ctx, tx)
+			},
+		})
+	}
+	return artifacts, nil
+}
+
+func discoverXFRM(ctx context.Context, opts Options) ([]Artifact, error) {
+	var artifacts []Artifact
+
+	policies, err := netlink.XfrmPolicyList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list XFRM policies: %w", err)
+	}
+	for _, policy := range policies {
+		if !isIPsecPolicy(policy) {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{
+			Kind: "XFRM policy",
+			Name: fmt.Sprintf("%s -> %s dir %s", policy.Src, policy.Dst, policy.Dir),
+			remove: func(ctx context.Context) error {
+				return netlink.XfrmPolicyDel(&policy)
+			},
+		})
+	}
+
+	states, err := netlink.XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		return artifacts, fmt.Errorf("failed to list XFRM states: %w", err)
+	}
+	for _, state := range states {
+		if state.Reqid != ipsecReqID || state.Proto != netlink.XFRM_PROTO_ESP {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{
+			Kind: "XFRM state",
+			Name: fmt.Sprintf("%s -> %s spi 0x%x", state.Src, state.Dst, state.Spi),
+			remove: func(ctx context.Context) error {
+				return netlink.XfrmStateDel(&state)
+			},
+		})
+	}
+	return artifacts, nil
+}
+
+func isIPsecPolicy(policy netlink.XfrmPolicy) bool {
+	for _, tmpl := range policy.Tmpls {
+		if tmpl.Reqid == ipsecReqID && tmpl.Proto == netlink.XFRM_PROTO_ESP && tmpl.Mode == netlink.XFRM_MODE_TUNNEL {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverRoutes returns the gateway and blackhole routes to the flannel
+// networks. The routes through the flannel devices are removed along with
+// the devices.
+func discoverRoutes(ctx context.Context, opts Options) ([]Artifact, error) {
+	if len(opts.Networks) == 0 && len(opts.IPv6Networks) == 0 {
+		log.Warning("The flannel network is unknown, skipping the routes")
+		return nil, nil
+	}
+
+	flannelLinks := map[int]bool{}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+	for _, link := range links {
+		if strings.HasPrefix(link.Attrs().Name, linkPrefix) {
+			flannelLinks[link.Attrs().Index] = true
+		}
+	}
+
+	var artifacts []Artifact
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return artifacts, fmt.Errorf("failed to list routes: %w", err)
+		}
+		for _, route := range routes {
+			if route.Dst == nil || flannelLinks[route.LinkIndex] || !inNetworks(route.Dst, opts) {
+				continue
+			}
+			if route.Type != unix.RTN_BLACKHOLE && route.Gw == nil {
+				// Routes without gateway, like the one of the cni bridge, don't belong to flannel
+				continue
+			}
+			name := route.Dst.String()
+			if route.Type == unix.RTN_BLACKHOLE {
+				name = "blackhole " + name
+			} else {
+				name = fmt.Sprintf("%s via %s", name, route.Gw)
+			}
+			artifacts = append(artifacts, Artifact{
+				Kind: "route",
+				Name: name,
+				remove: func(ctx context.Context) error {
+					return netlink.RouteDel(&route)
+				},
+			})
+		}
+	}
+	return artifacts, nil
+}
+
+func inNetworks(dst *net.IPNet, opts Options) bool {
+	if dst.IP.To4() != nil {
+		sn := ip.FromIPNet(dst)
+		for _, n := range opts.Networks {
+			if n.ContainsCIDR(&sn) {
+				return true
+			}
+		}
+		return false
+	}
+	sn := ip.FromIP6Net(dst)
+	for _, n := range opts.IPv6Networks {
+		if n.ContainsCIDR(&sn) {
+			return true
+		}
+	}
+	return false
+}
+
+func discoverLinks(ctx context.Context, opts Options) ([]Artifact, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+
+	var artifacts []Artifact
+	for _, link := range links {
+		if !strings.HasPrefix(link.Attrs().Name, linkPrefix) {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{
+			Kind: link.Type() + " device",
+			Name: link.Attrs().Name,
+			remove: func(ctx context.Context) error {
+				return netlink.LinkDel(link)
+			},
+		})
+	}
+	return artifacts, nil
+}
+
+func discoverFiles(ctx context.Context, opts Options) ([]Artifact, error) {
+	keyFile := defaultWireguardKeyFile
+	if envKeyFile, ok := os.LookupEnv("WIREGUARD_KEY_FILE"); ok {
+		keyFile = envKeyFile
+	}
+
+	var artifacts []Artifact
+	for _, path := range []string{opts.SubnetFile, keyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return artifacts, err
+		}
+		artifacts = append(artifacts, Artifact{
+			Kind: "file",
+			Name: path,
+			remove: func(ctx context.Context) error {
+				return os.Remove(path)
+			},
+		})
+	}
+	return artifacts, nil
+}
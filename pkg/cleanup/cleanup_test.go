@@ -0,0 +1,144 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package cleanup
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestCleanup(t *testing.T) {
+	teardown := ns.SetUpNetlinkTest(t)
+	defer teardown()
+
+	t.Setenv("WIREGUARD_KEY_FILE", filepath.Join(t.TempDir(), "wgkey"))
+
+	// An external interface with a host-gw route and a blackhole route to the flannel network
+	eth := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+	if err := netlink.LinkAdd(eth); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(eth); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(eth, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(24, 32)}}); err != nil {
+		t.Fatal(err)
+	}
+	hostgwRoute := &netlink.Route{
+		Dst:       ip.IP4Net{IP: ip.MustParseIP4("10.5.2.0"), PrefixLen: 24}.ToIPNet(),
+		Gw:        net.ParseIP("192.168.1.2"),
+		LinkIndex: eth.Attrs().Index,
+	}
+	if err := netlink.RouteAdd(hostgwRoute); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.AddBlackholeV4Route(ip.IP4Net{IP: ip.MustParseIP4("10.5.1.0"), PrefixLen: 24}.ToIPNet()); err != nil {
+		t.Fatal(err)
+	}
+	// A route outside of the flannel network must be kept
+	otherRoute := &netlink.Route{
+		Dst:       ip.IP4Net{IP: ip.MustParseIP4("172.16.0.0"), PrefixLen: 16}.ToIPNet(),
+		Gw:        net.ParseIP("192.168.1.2"),
+		LinkIndex: eth.Attrs().Index,
+	}
+	if err := netlink.RouteAdd(otherRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flannel device
+	dev := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "flannel.1"}}
+	if err := netlink.LinkAdd(dev); err != nil {
+		t.Fatal(err)
+	}
+
+	subnetFile := filepath.Join(t.TempDir(), "subnet.env")
+	if err := os.WriteFile(subnetFile, []byte("FLANNEL_NETWORK=10.5.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{
+		SubnetFile: subnetFile,
+		Networks:   []ip.IP4Net{{IP: ip.MustParseIP4("10.5.0.0"), PrefixLen: 16}},
+	}
+
+	artifacts, err := Discover(context.Background(), opts)
+	if err != nil {
+		t.Logf("Discover returned an error: %v", err)
+	}
+	expected := map[string]bool{
+		"route 10.5.2.0/24 via 192.168.1.2": false,
+		"route blackhole 10.5.1.0/24":       false,
+		"bridge device flannel.1":           false,
+		"file " + subnetFile:                false,
+	}
+	for _, a := range artifacts {
+		if _, ok := expected[a.String()]; !ok {
+			t.Errorf("unexpected artifact %s", a)
+			continue
+		}
+		expected[a.String()] = true
+	}
+	for name, found := range expected {
+		if !found {
+			t.Errorf("artifact %s not found", name)
+		}
+	}
+
+	// A dry run doesn't remove anything
+	_ = Run(context.Background(), opts, true)
+	if _, err := netlink.LinkByName("flannel.1"); err != nil {
+		t.Errorf("flannel.1 removed by a dry run: %v", err)
+	}
+	if _, err := os.Stat(subnetFile); err != nil {
+		t.Errorf("subnet file removed by a dry run: %v", err)
+	}
+
+	_ = Run(context.Background(), opts, false)
+	if _, err := netlink.LinkByName("flannel.1"); err == nil {
+		t.Error("flannel.1 not removed")
+	}
+	if _, err := os.Stat(subnetFile); !os.IsNotExist(err) {
+		t.Errorf("subnet file not removed: %v", err)
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptOther := false
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		if opts.Networks[0].Contains(ip.FromIP(r.Dst.IP)) {
+			t.Errorf("route %v not removed", r)
+		}
+		if r.Dst.String() == otherRoute.Dst.String() {
+			keptOther = true
+		}
+	}
+	if !keptOther {
+		t.Error("route outside of the flannel network removed")
+	}
+}
@@ -45,6 +45,15 @@ type LeaseAttrs struct {
 	BackendType   string          `json:",omitempty"`
 	BackendData   json.RawMessage `json:",omitempty"`
 	BackendV6Data json.RawMessage `json:",omitempty"`
+	// MigrationBackendType, MigrationBackendData and MigrationBackendV6Data
+	// advertise the backend the node migrates to, which runs alongside
+	// BackendType.
+	MigrationBackendType   string          `json:",omitempty"`
+	MigrationBackendData   json.RawMessage `json:",omitempty"`
+	MigrationBackendV6Data json.RawMessage `json:",omitempty"`
+	// NodeID identifies the node owning the lease independently of its
+	// public IP. Only used in etcd.
+	NodeID string `json:",omitempty"`
 }
 
 // Lease includes information about the lease
@@ -69,13 +78,30 @@ type LeaseWatchResult struct {
 }
 
 type LeaseWatcher struct {
-	OwnLease *Lease  //Lease with the subnet of the local node
-	Leases   []Lease //Leases with subnets from other nodes
+	OwnLease *Lease           //Lease with the subnet of the local node
+	Leases   map[string]Lease //Leases with subnets from other nodes, keyed by subnet
+}
+
+func (et EventType) String() string {
+	switch et {
+	case EventAdded:
+		return "added"
+	case EventRemoved:
+		return "removed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(et))
+	}
 }
 
 func (la *LeaseAttrs) String() string {
 	var buffer bytes.Buffer
 	buffer.WriteString(fmt.Sprintf("BackendType: %s, PublicIP: %s, ", la.BackendType, la.PublicIP.String()))
+	if la.NodeID != "" {
+		buffer.WriteString(fmt.Sprintf("NodeID: %s, ", la.NodeID))
+	}
+	if la.MigrationBackendType != "" {
+		buffer.WriteString(fmt.Sprintf("MigrationBackendType: %s, ", la.MigrationBackendType))
+	}
 	if la.PublicIPv6 != nil {
 		buffer.WriteString(fmt.Sprintf("PublicIPv6: %s, ", la.PublicIPv6.String()))
 	} else {
@@ -108,34 +134,27 @@ func (la *LeaseAttrs) String() string {
 func (lw *LeaseWatcher) Reset(leases []Lease) []Event {
 	batch := []Event{}
 
+	old := lw.Leases
+	lw.Leases = make(map[string]Lease, len(leases))
 	for _, nl := range leases {
-		found := false
 		if sameSubnet(nl.EnableIPv4, nl.EnableIPv6, *lw.OwnLease, nl) {
 			continue
 		}
 
-		for i, ol := range lw.Leases {
-			if sameSubnet(ol.EnableIPv4, ol.EnableIPv6, ol, nl) {
-				lw.Leases = append(lw.Leases[:i], lw.Leases[i+1:]...)
-				found = true
-				break
-			}
-		}
-
-		if !found {
+		key := leaseKey(&nl)
+		if _, found := old[key]; found {
+			delete(old, key)
+		} else {
 			// new lease
 			batch = append(batch, Event{EventAdded, nl})
 		}
+		lw.Leases[key] = nl
 	}
 
-	for _, l := range lw.Leases {
+	for _, l := range old {
 		batch = append(batch, Event{EventRemoved, l})
 	}
 
-	// copy the leases over (caution: don't just assign a slice)
-	lw.Leases = make([]Lease, len(leases))
-	copy(lw.Leases, leases)
-
 	return batch
 }
 
@@ -160,33 +179,38 @@ func (lw *LeaseWatcher) Update(events []Event) []Event {
 	return batch
 }
 
-// add updates lw.Leases, adding the passed lease (either overwriting or appending). It makes lw.Leases a set
+// add updates lw.Leases, adding the passed lease (either overwriting or inserting)
 func (lw *LeaseWatcher) add(lease *Lease) Event {
-	for i, l := range lw.Leases {
-		if sameSubnet(l.EnableIPv4, l.EnableIPv6, l, *lease) {
-			lw.Leases[i] = *lease
-			return Event{EventAdded, lw.Leases[i]}
-		}
+	if lw.Leases == nil {
+		lw.Leases = make(map[string]Lease)
 	}
+	lw.Leases[leaseKey(lease)] = *lease
 
-	lw.Leases = append(lw.Leases, *lease)
-
-	return Event{EventAdded, lw.Leases[len(lw.Leases)-1]}
+	return Event{EventAdded, *lease}
 }
 
 // remove updates lw.Leases, removing the passed lease
 func (lw *LeaseWatcher) remove(lease *Lease) Event {
-	for i, l := range lw.Leases {
-		if sameSubnet(l.EnableIPv4, l.EnableIPv6, l, *lease) {
-			lw.Leases = append(lw.Leases[:i], lw.Leases[i+1:]...)
-			return Event{EventRemoved, l}
-		}
+	key := leaseKey(lease)
+	if l, found := lw.Leases[key]; found {
+		delete(lw.Leases, key)
+		return Event{EventRemoved, l}
 	}
 
 	log.Errorf("Removed subnet (%s) and ipv6 subnet (%s) were not found", lease.Subnet, lease.IPv6Subnet)
 	return Event{EventRemoved, *lease}
 }
 
+// leaseKey returns the key of a lease in LeaseWatcher.Leases: its IPv4 subnet,
+// or its IPv6 subnet in the ipv6 only case. A node keeps its IPv4 subnet when
+// it switches to dual stack, so its lease is then replaced.
+func leaseKey(lease *Lease) string {
+	if !lease.EnableIPv4 && lease.EnableIPv6 {
+		return lease.IPv6Subnet.String()
+	}
+	return lease.Subnet.String()
+}
+
 // sameSubnet checks if the subnets are the same in ipv4-only, ipv6-only and dualStack cases
 func sameSubnet(ipv4Enabled, ipv6Enabled bool, firstLease, secondLease Lease) bool {
 	// ipv4 only case
@@ -0,0 +1,140 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics holds the prometheus collectors exported by flanneld on
+// the /metrics endpoint of the healthz server.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "flannel"
+
+var (
+	// Leases is the number of subnet leases of other nodes currently known to the lease watcher.
+	Leases = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "subnet",
+		Name:      "leases",
+		Help:      "Number of subnet leases of remote nodes currently known by flanneld.",
+	})
+
+	// LeaseEvents counts the lease events handed over to the backend, by event type.
+	LeaseEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "subnet",
+		Name:      "lease_events_total",
+		Help:      "Number of subnet lease events received from the subnet manager.",
+	}, []string{"type"})
+
+	// LeaseRenewalTimestamp is the time of the last successful renewal of the local lease.
+	LeaseRenewalTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "subnet",
+		Name:      "lease_last_renewal_timestamp_seconds",
+		Help:      "Unix time of the last successful renewal of the local subnet lease.",
+	})
+
+	// LeaseExpirationTimestamp is the expiration time of the local lease.
+	LeaseExpirationTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "subnet",
+		Name:      "lease_expiration_timestamp_seconds",
+		Help:      "Unix time at which the local subnet lease expires.",
+	})
+
+	// SubnetEventsDuration tracks how long a backend takes to handle a batch of lease events.
+	SubnetEventsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "backend",
+		Name:      "subnet_events_duration_seconds",
+		Help:      "Time spent by the backend handling a batch of subnet lease events.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"backend"})
+
+	// SubnetEventFailures counts the lease events a backend failed to apply.
+	SubnetEventFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "backend",
+		Name:      "subnet_event_failures_total",
+		Help:      "Number of subnet lease events the backend failed to apply to the datapath.",
+	}, []string{"backend"})
+
+	// ReconcileRepairs counts the kernel entries a backend restored or removed
+	// while reconciling its datapath with the leases.
+	ReconcileRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "backend",
+		Name:      "reconcile_repairs_total",
+		Help:      "Number of kernel entries (routes, neighbors, FDB entries) restored or removed by the backend reconciler.",
+	}, []string{"backend", "kind", "action"})
+
+	// TrafficResyncs counts the periodic resyncs of the traffic manager rules.
+	TrafficResyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "trafficmngr",
+		Name:      "resyncs_total",
+		Help:      "Number of periodic resyncs of the masquerade and forward rules.",
+	}, []string{"manager", "family"})
+
+	// TrafficResyncFailures counts the resyncs of the traffic manager rules that failed.
+	TrafficResyncFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "trafficmngr",
+		Name:      "resync_failures_total",
+		Help:      "Number of periodic resyncs of the masquerade and forward rules that failed.",
+	}, []string{"manager", "family"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Leases,
+		LeaseEvents,
+		LeaseRenewalTimestamp,
+		LeaseExpirationTimestamp,
+		SubnetEventsDuration,
+		SubnetEventFailures,
+		ReconcileRepairs,
+		TrafficResyncs,
+		TrafficResyncFailures,
+	)
+}
+
+// ObserveSubnetEvents records the time spent handling a batch of lease events
+// since start. It is meant to be deferred at the top of handleSubnetEvents.
+func ObserveSubnetEvents(backendType string, start time.Time) {
+	SubnetEventsDuration.WithLabelValues(backendType).Observe(time.Since(start).Seconds())
+}
+
+// SubnetEventFailed records a lease event that could not be applied by the backend.
+func SubnetEventFailed(backendType string) {
+	SubnetEventFailures.WithLabelValues(backendType).Inc()
+}
+
+// ReconcileRepaired records count kernel entries of the given kind (route,
+// neighbor, fdb) restored or removed by the reconciler of a backend.
+func ReconcileRepaired(backendType, kind, action string, count int) {
+	if count > 0 {
+		ReconcileRepairs.WithLabelValues(backendType, kind, action).Add(float64(count))
+	}
+}
+
+// LeaseRenewed records a successful renewal of the local lease.
+func LeaseRenewed(expiration time.Time) {
+	LeaseRenewalTimestamp.SetToCurrentTime()
+	LeaseExpirationTimestamp.Set(float64(expiration.Unix()))
+}
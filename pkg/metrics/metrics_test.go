@@ -0,0 +1,61 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func readMetric(t *testing.T, m prometheus.Metric) *dto.Metric {
+	t.Helper()
+
+	out := &dto.Metric{}
+	if err := m.Write(out); err != nil {
+		t.Fatalf("failed to read metric: %v", err)
+	}
+	return out
+}
+
+func TestSubnetEventFailed(t *testing.T) {
+	before := readMetric(t, SubnetEventFailures.WithLabelValues("test")).GetCounter().GetValue()
+	SubnetEventFailed("test")
+	SubnetEventFailed("test")
+	if got := readMetric(t, SubnetEventFailures.WithLabelValues("test")).GetCounter().GetValue() - before; got != 2 {
+		t.Fatalf("expected 2 failures, got %v", got)
+	}
+}
+
+func TestObserveSubnetEvents(t *testing.T) {
+	ObserveSubnetEvents("test", time.Now().Add(-time.Second))
+	h := readMetric(t, SubnetEventsDuration.WithLabelValues("test").(prometheus.Histogram)).GetHistogram()
+	if h.GetSampleCount() == 0 || h.GetSampleSum() < 1 {
+		t.Fatalf("unexpected histogram: count=%d sum=%v", h.GetSampleCount(), h.GetSampleSum())
+	}
+}
+
+func TestLeaseRenewed(t *testing.T) {
+	exp := time.Now().Add(24 * time.Hour)
+	LeaseRenewed(exp)
+	if got := readMetric(t, LeaseExpirationTimestamp).GetGauge().GetValue(); got != float64(exp.Unix()) {
+		t.Fatalf("expected expiration %d, got %v", exp.Unix(), got)
+	}
+	if got := readMetric(t, LeaseRenewalTimestamp).GetGauge().GetValue(); got < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Fatalf("unexpected renewal timestamp %v", got)
+	}
+}
@@ -28,7 +28,10 @@ func SetUpNetlinkTest(t *testing.T) func() {
 	// new temporary namespace so we don't pollute the host
 	// lock thread since the namespace is thread local
 	runtime.LockOSThread()
-	var err error
+	origns, err := netns.Get()
+	if err != nil {
+		t.Fatalf("Failed to get the current netns: %v", err)
+	}
 	ns, err := netns.New()
 	if err != nil {
 		t.Fatalf("Failed to create newns: %v", err)
@@ -39,6 +42,13 @@ func SetUpNetlinkTest(t *testing.T) func() {
 		if err != nil {
 			t.Errorf("Failed to close netns: %v", err)
 		}
+		// switch back to the original namespace before releasing the thread,
+		// otherwise the goroutines scheduled on it later would run in the
+		// namespace of the test
+		if err := netns.Set(origns); err != nil {
+			t.Errorf("Failed to restore netns: %v", err)
+		}
+		origns.Close()
 		runtime.UnlockOSThread()
 	}
 }
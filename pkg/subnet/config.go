@@ -15,10 +15,12 @@
 package subnet
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/flannel-io/flannel/pkg/ip"
 )
@@ -37,8 +39,48 @@ type Config struct {
 	IPv6SubnetLen  uint
 	BackendType    string          `json:"-"`
 	Backend        json.RawMessage `json:",omitempty"`
+	// MigrationBackend is the backend the cluster migrates to. It runs
+	// alongside Backend and is used with the peers which support it.
+	MigrationBackendType string          `json:"-"`
+	MigrationBackend     json.RawMessage `json:",omitempty"`
+	// AllocationStrategy selects how the etcd subnet manager picks the subnet
+	// of a node which has no lease yet.
+	AllocationStrategy string `json:",omitempty"`
+	// ExcludedSubnets and IPv6ExcludedSubnets are ranges of the networks
+	// which are not allocated to nodes.
+	ExcludedSubnets     []ip.IP4Net `json:",omitempty"`
+	IPv6ExcludedSubnets []ip.IP6Net `json:",omitempty"`
+	// AdditionalNetworks and IPv6AdditionalNetworks are pools used in order
+	// once all the subnets of Network (resp. IPv6Network) are allocated.
+	AdditionalNetworks     []ip.IP4Net `json:",omitempty"`
+	IPv6AdditionalNetworks []ip.IP6Net `json:",omitempty"`
 }
 
+// SubnetRange is a range of subnets which can be allocated in a network pool
+type SubnetRange struct {
+	Network ip.IP4Net
+	Min     ip.IP4
+	Max     ip.IP4
+}
+
+// IPv6SubnetRange is a range of IPv6 subnets which can be allocated in a network pool
+type IPv6SubnetRange struct {
+	Network ip.IP6Net
+	Min     *ip.IP6
+	Max     *ip.IP6
+}
+
+// Subnet allocation strategies of the etcd subnet manager
+const (
+	// AllocationRandom picks a random subnet among the first free ones
+	AllocationRandom = "random"
+	// AllocationFirstFit picks the lowest free subnet
+	AllocationFirstFit = "first-fit"
+	// AllocationHash derives the subnet from a hash of the node identity, so
+	// that a node gets the same subnet every time it is rebuilt
+	AllocationHash = "hash"
+)
+
 func parseBackendType(be json.RawMessage) (string, error) {
 	var bt struct {
 		Type string
@@ -68,12 +110,31 @@ func ParseConfig(s string) (*Config, error) {
 	}
 	cfg.BackendType = bt
 
+	if len(cfg.MigrationBackend) > 0 {
+		mbt, err := parseBackendType(cfg.MigrationBackend)
+		if err != nil {
+			return nil, err
+		}
+		if mbt == bt {
+			return nil, fmt.Errorf("MigrationBackend must have another type than Backend, got %q for both", bt)
+		}
+		cfg.MigrationBackendType = mbt
+	}
+
 	return cfg, nil
 }
 
 // CheckNetworkConfig checks the coherence of the flannel configuration.
 // It is used only with the local network manager, not with the kubernetes-based manager.
 func CheckNetworkConfig(config *Config) error {
+	switch config.AllocationStrategy {
+	case "":
+		config.AllocationStrategy = AllocationRandom
+	case AllocationRandom, AllocationFirstFit, AllocationHash:
+	default:
+		return fmt.Errorf("unknown AllocationStrategy %q, must be one of %s, %s or %s", config.AllocationStrategy, AllocationRandom, AllocationFirstFit, AllocationHash)
+	}
+
 	if config.EnableIPv4 {
 		if config.Network.Empty() {
 			return errors.New("please define a correct Network parameter in the flannel config")
@@ -194,5 +255,291 @@ func CheckNetworkConfig(config *Config) error {
 			return fmt.Errorf("IPv6SubnetMax is not on a SubnetLen boundary: %v", config.IPv6SubnetMax)
 		}
 	}
+	if err := checkAdditionalNetworks(config); err != nil {
+		return err
+	}
+	return checkExcludedSubnets(config)
+}
+
+func checkAdditionalNetworks(config *Config) error {
+	networks := []ip.IP4Net{config.Network}
+	for _, n := range config.AdditionalNetworks {
+		if !config.EnableIPv4 {
+			return fmt.Errorf("additional network %s requires EnableIPv4", n)
+		}
+		if config.SubnetLen < n.PrefixLen+2 {
+			return fmt.Errorf("additional network %s must be able to accommodate at least four subnets", n)
+		}
+		for _, other := range networks {
+			if n.Overlaps(other) {
+				return fmt.Errorf("additional network %s overlaps %s", n, other)
+			}
+		}
+		networks = append(networks, n)
+	}
+
+	ipv6Networks := []ip.IP6Net{config.IPv6Network}
+	for _, n := range config.IPv6AdditionalNetworks {
+		if !config.EnableIPv6 {
+			return fmt.Errorf("additional network %s requires EnableIPv6", n)
+		}
+		if config.IPv6SubnetLen < n.PrefixLen+2 {
+			return fmt.Errorf("additional network %s must be able to accommodate at least four subnets", n)
+		}
+		for _, other := range ipv6Networks {
+			if n.Overlaps(other) {
+				return fmt.Errorf("additional network %s overlaps %s", n, other)
+			}
+		}
+		ipv6Networks = append(ipv6Networks, n)
+	}
+	return nil
+}
+
+func checkExcludedSubnets(config *Config) error {
+	for _, sn := range config.ExcludedSubnets {
+		if !containsIP4Net(config.Networks(), sn) {
+			return fmt.Errorf("excluded subnet %s is not in the range of the Network", sn)
+		}
+	}
+	for _, sn := range config.IPv6ExcludedSubnets {
+		if !containsIP6Net(config.IPv6Networks(), sn) {
+			return fmt.Errorf("excluded subnet %s is not in the range of the IPv6Network", sn)
+		}
+	}
+	return nil
+}
+
+func containsIP4Net(networks []ip.IP4Net, sn ip.IP4Net) bool {
+	for _, n := range networks {
+		if n.ContainsCIDR(&sn) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP6Net(networks []ip.IP6Net, sn ip.IP6Net) bool {
+	for _, n := range networks {
+		if n.ContainsCIDR(&sn) {
+			return true
+		}
+	}
+	return false
+}
+
+// Networks returns the IPv4 network followed by the additional pools, or
+// nothing when IPv4 is disabled.
+func (c *Config) Networks() []ip.IP4Net {
+	if !c.EnableIPv4 || c.Network.Empty() {
+		return nil
+	}
+	return append([]ip.IP4Net{c.Network}, c.AdditionalNetworks...)
+}
+
+// IPv6Networks returns the IPv6 network followed by the additional pools, or
+// nothing when IPv6 is disabled.
+func (c *Config) IPv6Networks() []ip.IP6Net {
+	if !c.EnableIPv6 || c.IPv6Network.Empty() {
+		return nil
+	}
+	return append([]ip.IP6Net{c.IPv6Network}, c.IPv6AdditionalNetworks...)
+}
+
+// ContainsSubnet returns true if sn is in one of the network pools
+func (c *Config) ContainsSubnet(sn ip.IP4Net) bool {
+	return containsIP4Net(c.Networks(), sn)
+}
+
+// ContainsIPv6Subnet returns true if sn is in one of the IPv6 network pools
+func (c *Config) ContainsIPv6Subnet(sn ip.IP6Net) bool {
+	return containsIP6Net(c.IPv6Networks(), sn)
+}
+
+// SubnetRanges returns the ranges of subnets to allocate, in order. The first
+// one is SubnetMin-SubnetMax, the additional networks follow and, like the
+// default range of Network, skip their first subnet.
+// It must be called on a config validated by CheckNetworkConfig.
+func (c *Config) SubnetRanges() []SubnetRange {
+	if !c.EnableIPv4 {
+		return nil
+	}
+	ranges := []SubnetRange{{Network: c.Network, Min: c.SubnetMin, Max: c.SubnetMax}}
+	subnetSize := ip.IP4(1 << (32 - c.SubnetLen))
+	for _, n := range c.AdditionalNetworks {
+		ranges = append(ranges, SubnetRange{
+			Network: n,
+			Min:     n.IP + subnetSize,
+			Max:     n.Next().IP - subnetSize,
+		})
+	}
+	return ranges
+}
+
+// IPv6SubnetRanges is the IPv6 counterpart of SubnetRanges
+func (c *Config) IPv6SubnetRanges() []IPv6SubnetRange {
+	if !c.EnableIPv6 {
+		return nil
+	}
+	ranges := []IPv6SubnetRange{{Network: c.IPv6Network, Min: c.IPv6SubnetMin, Max: c.IPv6SubnetMax}}
+	ipv6SubnetSize := big.NewInt(0).Lsh(big.NewInt(1), 128-c.IPv6SubnetLen)
+	for _, n := range c.IPv6AdditionalNetworks {
+		ranges = append(ranges, IPv6SubnetRange{
+			Network: n,
+			Min:     ip.GetIPv6SubnetMin(n.IP, ipv6SubnetSize),
+			Max:     ip.GetIPv6SubnetMax(n.Next().IP, ipv6SubnetSize),
+		})
+	}
+	return ranges
+}
+
+// IsSubnetExcluded returns true if sn overlaps one of the ExcludedSubnets
+func IsSubnetExcluded(config *Config, sn ip.IP4Net) bool {
+	for _, excluded := range config.ExcludedSubnets {
+		if excluded.Overlaps(sn) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIPv6SubnetExcluded returns true if sn overlaps one of the IPv6ExcludedSubnets
+func IsIPv6SubnetExcluded(config *Config, sn ip.IP6Net) bool {
+	if sn.Empty() {
+		return false
+	}
+	for _, excluded := range config.IPv6ExcludedSubnets {
+		if excluded.Overlaps(sn) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckConfigUpdate checks whether the running network configuration can be
+// replaced by updated while flanneld is running. Changes to the network ranges,
+// the subnet sizes, the IP families or the backend type require a restart and
+// are reported in the returned error.
+func CheckConfigUpdate(running, updated *Config) error {
+	changed := unsafeConfigChanges(running, updated)
+	if len(changed) > 0 {
+		return fmt.Errorf("changing %s requires a restart of flanneld", strings.Join(changed, ", "))
+	}
 	return nil
 }
+
+// ConfigEqual returns true if both configurations are the same
+func ConfigEqual(c1, c2 *Config) bool {
+	return len(unsafeConfigChanges(c1, c2)) == 0 && !BackendConfigChanged(c1, c2) && !allocationConfigChanged(c1, c2)
+}
+
+// allocationConfigChanged returns true if the settings used to allocate the
+// subnet of new nodes differ. They can be changed at runtime.
+func allocationConfigChanged(c1, c2 *Config) bool {
+	return c1.AllocationStrategy != c2.AllocationStrategy ||
+		!ip4NetsEqual(c1.ExcludedSubnets, c2.ExcludedSubnets) ||
+		!ip6NetsEqual(c1.IPv6ExcludedSubnets, c2.IPv6ExcludedSubnets)
+}
+
+// BackendConfigChanged returns true if the Backend section of the configurations differ
+func BackendConfigChanged(running, updated *Config) bool {
+	return !rawJSONEqual(running.Backend, updated.Backend)
+}
+
+func rawJSONEqual(j1, j2 json.RawMessage) bool {
+	var b1, b2 bytes.Buffer
+	if err := json.Compact(&b1, j1); err != nil {
+		b1.Write(j1)
+	}
+	if err := json.Compact(&b2, j2); err != nil {
+		b2.Write(j2)
+	}
+	return bytes.Equal(b1.Bytes(), b2.Bytes())
+}
+
+// unsafeConfigChanges returns the name of the settings that differ between
+// running and updated and can't be applied without restarting flanneld.
+func unsafeConfigChanges(running, updated *Config) []string {
+	var changed []string
+	if running.EnableIPv4 != updated.EnableIPv4 {
+		changed = append(changed, "EnableIPv4")
+	}
+	if running.EnableIPv6 != updated.EnableIPv6 {
+		changed = append(changed, "EnableIPv6")
+	}
+	if running.EnableNFTables != updated.EnableNFTables {
+		changed = append(changed, "EnableNFTables")
+	}
+	if !running.Network.Equal(updated.Network) {
+		changed = append(changed, "Network")
+	}
+	if !ip6NetEqual(running.IPv6Network, updated.IPv6Network) {
+		changed = append(changed, "IPv6Network")
+	}
+	if running.SubnetLen != updated.SubnetLen {
+		changed = append(changed, "SubnetLen")
+	}
+	if running.IPv6SubnetLen != updated.IPv6SubnetLen {
+		changed = append(changed, "IPv6SubnetLen")
+	}
+	if running.SubnetMin != updated.SubnetMin {
+		changed = append(changed, "SubnetMin")
+	}
+	if running.SubnetMax != updated.SubnetMax {
+		changed = append(changed, "SubnetMax")
+	}
+	if !ip6Equal(running.IPv6SubnetMin, updated.IPv6SubnetMin) {
+		changed = append(changed, "IPv6SubnetMin")
+	}
+	if !ip6Equal(running.IPv6SubnetMax, updated.IPv6SubnetMax) {
+		changed = append(changed, "IPv6SubnetMax")
+	}
+	if !ip4NetsEqual(running.AdditionalNetworks, updated.AdditionalNetworks) {
+		changed = append(changed, "AdditionalNetworks")
+	}
+	if !ip6NetsEqual(running.IPv6AdditionalNetworks, updated.IPv6AdditionalNetworks) {
+		changed = append(changed, "IPv6AdditionalNetworks")
+	}
+	if running.BackendType != updated.BackendType {
+		changed = append(changed, "Backend.Type")
+	}
+	if !rawJSONEqual(running.MigrationBackend, updated.MigrationBackend) {
+		changed = append(changed, "MigrationBackend")
+	}
+	return changed
+}
+
+func ip4NetsEqual(n1, n2 []ip.IP4Net) bool {
+	if len(n1) != len(n2) {
+		return false
+	}
+	for i := range n1 {
+		if !n1[i].Equal(n2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func ip6NetsEqual(n1, n2 []ip.IP6Net) bool {
+	if len(n1) != len(n2) {
+		return false
+	}
+	for i := range n1 {
+		if !ip6NetEqual(n1[i], n2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func ip6NetEqual(n1, n2 ip.IP6Net) bool {
+	return n1.PrefixLen == n2.PrefixLen && ip6Equal(n1.IP, n2.IP)
+}
+
+func ip6Equal(ip1, ip2 *ip.IP6) bool {
+	if ip.IsEmpty(ip1) || ip.IsEmpty(ip2) {
+		return ip.IsEmpty(ip1) == ip.IsEmpty(ip2)
+	}
+	return ip1.Cmp(ip2) == 0
+}
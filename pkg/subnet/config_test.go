@@ -15,7 +15,11 @@
 package subnet
 
 import (
+	"net"
+	"strings"
 	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
 )
 
 func TestConfigDefaults(t *testing.T) {
@@ -129,3 +133,192 @@ func TestIPv6ConfigOverrides(t *testing.T) {
 		t.Errorf("IPv6SubnetLen mismatch: expected 124, got %d", cfg.IPv6SubnetLen)
 	}
 }
+
+func TestCheckConfigUpdate(t *testing.T) {
+	parse := func(s string) *Config {
+		cfg, err := ParseConfig(s)
+		if err != nil {
+			t.Fatalf("ParseConfig failed: %s", err)
+		}
+		if err := CheckNetworkConfig(cfg); err != nil {
+			t.Fatalf("CheckNetworkConfig failed: %s", err)
+		}
+		return cfg
+	}
+
+	running := parse(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "DirectRouting": false } }`)
+
+	same := parse(`{"Network":"10.3.0.0/16","Backend":{"Type":"vxlan","DirectRouting":false}}`)
+	if !ConfigEqual(running, same) {
+		t.Error("expected configs to be equal")
+	}
+
+	backend := parse(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "DirectRouting": true } }`)
+	if ConfigEqual(running, backend) {
+		t.Error("expected configs to differ")
+	}
+	if !BackendConfigChanged(running, backend) {
+		t.Error("expected backend config to have changed")
+	}
+	if err := CheckConfigUpdate(running, backend); err != nil {
+		t.Errorf("backend change should be accepted: %s", err)
+	}
+
+	network := parse(`{ "Network": "10.4.0.0/16", "SubnetLen": 26, "Backend": { "Type": "vxlan" } }`)
+	err := CheckConfigUpdate(running, network)
+	if err == nil {
+		t.Fatal("Network and SubnetLen changes should be refused")
+	}
+	if !strings.Contains(err.Error(), "Network") || !strings.Contains(err.Error(), "SubnetLen") {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	backendType := parse(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "wireguard" } }`)
+	if err := CheckConfigUpdate(running, backendType); err == nil {
+		t.Error("backend type change should be refused")
+	}
+
+	migration := parse(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "DirectRouting": false }, "MigrationBackend": { "Type": "wireguard" } }`)
+	if migration.MigrationBackendType != "wireguard" {
+		t.Errorf("unexpected migration backend type %q", migration.MigrationBackendType)
+	}
+	if err := CheckConfigUpdate(running, migration); err == nil {
+		t.Error("migration backend change should be refused")
+	}
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan" }, "MigrationBackend": { "Type": "vxlan" } }`); err == nil {
+		t.Error("migration to the same backend type should be refused")
+	}
+
+	dualStack := parse(`{ "Network": "10.3.0.0/16", "EnableIPv6": true, "IPv6Network": "fc00::/48", "Backend": { "Type": "vxlan" } }`)
+	if err := CheckConfigUpdate(running, dualStack); err == nil {
+		t.Error("enabling IPv6 should be refused")
+	}
+}
+
+func TestExcludedSubnets(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "EnableIPv6": true, "IPv6Network": "fc00::/48", "ExcludedSubnets": ["10.3.8.0/21"], "IPv6ExcludedSubnets": ["fc00:0:0:ff00::/56"] }`
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if err := CheckNetworkConfig(cfg); err != nil {
+		t.Fatalf("CheckNetworkConfig failed: %s", err)
+	}
+
+	for _, tc := range []struct {
+		subnet   string
+		excluded bool
+	}{
+		{"10.3.7.0/24", false},
+		{"10.3.8.0/24", true},
+		{"10.3.15.0/24", true},
+		{"10.3.16.0/24", false},
+	} {
+		_, ipn, err := net.ParseCIDR(tc.subnet)
+		if err != nil {
+			t.Fatalf("ParseCIDR failed: %s", err)
+		}
+		if IsSubnetExcluded(cfg, ip.FromIPNet(ipn)) != tc.excluded {
+			t.Errorf("IsSubnetExcluded(%s): expected %v", tc.subnet, tc.excluded)
+		}
+	}
+
+	for _, tc := range []struct {
+		subnet   string
+		excluded bool
+	}{
+		{"fc00:0:0:fe00::/64", false},
+		{"fc00:0:0:ff42::/64", true},
+	} {
+		_, ipn, err := net.ParseCIDR(tc.subnet)
+		if err != nil {
+			t.Fatalf("ParseCIDR failed: %s", err)
+		}
+		if IsIPv6SubnetExcluded(cfg, ip.FromIP6Net(ipn)) != tc.excluded {
+			t.Errorf("IsIPv6SubnetExcluded(%s): expected %v", tc.subnet, tc.excluded)
+		}
+	}
+	if IsIPv6SubnetExcluded(cfg, ip.IP6Net{}) {
+		t.Error("an empty IPv6 subnet should not be excluded")
+	}
+
+	// The excluded subnets can be changed at runtime
+	updated, err := ParseConfig(`{ "Network": "10.3.0.0/16", "EnableIPv6": true, "IPv6Network": "fc00::/48", "ExcludedSubnets": ["10.3.16.0/21"] }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if err := CheckNetworkConfig(updated); err != nil {
+		t.Fatalf("CheckNetworkConfig failed: %s", err)
+	}
+	if ConfigEqual(cfg, updated) {
+		t.Error("expected configs to differ")
+	}
+	if err := CheckConfigUpdate(cfg, updated); err != nil {
+		t.Errorf("excluded subnets change should be accepted: %s", err)
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "ExcludedSubnets": ["10.4.0.0/24"] }`,
+		`{ "Network": "10.3.0.0/16", "IPv6ExcludedSubnets": ["fc00::/64"] }`,
+	} {
+		cfg, err := ParseConfig(s)
+		if err != nil {
+			t.Fatalf("ParseConfig failed: %s", err)
+		}
+		if err := CheckNetworkConfig(cfg); err == nil {
+			t.Errorf("expected an error for %s", s)
+		}
+	}
+}
+
+func TestAdditionalNetworks(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetLen": 24, "AdditionalNetworks": ["10.4.0.0/16", "10.5.0.0/20"], "EnableIPv6": true, "IPv6Network": "fc00::/48", "IPv6AdditionalNetworks": ["fc01::/48"] }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if err := CheckNetworkConfig(cfg); err != nil {
+		t.Fatalf("CheckNetworkConfig failed: %s", err)
+	}
+
+	if len(cfg.Networks()) != 3 || !cfg.Networks()[0].Equal(cfg.Network) {
+		t.Errorf("unexpected networks: %v", cfg.Networks())
+	}
+	ranges := cfg.SubnetRanges()
+	if len(ranges) != 3 {
+		t.Fatalf("expected 3 subnet ranges, got %v", ranges)
+	}
+	if ranges[1].Min != ip.MustParseIP4("10.4.1.0") || ranges[1].Max != ip.MustParseIP4("10.4.255.0") {
+		t.Errorf("unexpected range of 10.4.0.0/16: %v", ranges[1])
+	}
+	if ranges[2].Min != ip.MustParseIP4("10.5.1.0") || ranges[2].Max != ip.MustParseIP4("10.5.15.0") {
+		t.Errorf("unexpected range of 10.5.0.0/20: %v", ranges[2])
+	}
+	ipv6Ranges := cfg.IPv6SubnetRanges()
+	if len(ipv6Ranges) != 2 || ipv6Ranges[1].Min.Cmp(ip.MustParseIP6("fc01:0:0:1::")) != 0 {
+		t.Errorf("unexpected IPv6 subnet ranges: %v", ipv6Ranges)
+	}
+
+	_, ipn, _ := net.ParseCIDR("10.4.7.0/24")
+	if !cfg.ContainsSubnet(ip.FromIPNet(ipn)) {
+		t.Error("10.4.7.0/24 should be in the networks")
+	}
+	_, ipn, _ = net.ParseCIDR("10.6.7.0/24")
+	if cfg.ContainsSubnet(ip.FromIPNet(ipn)) {
+		t.Error("10.6.7.0/24 should not be in the networks")
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "AdditionalNetworks": ["10.3.128.0/17"] }`,
+		`{ "Network": "10.3.0.0/16", "AdditionalNetworks": ["10.4.0.0/16", "10.4.0.0/20"] }`,
+		`{ "Network": "10.3.0.0/16", "AdditionalNetworks": ["10.4.0.0/24"] }`,
+		`{ "Network": "10.3.0.0/16", "IPv6AdditionalNetworks": ["fc01::/48"] }`,
+	} {
+		cfg, err := ParseConfig(s)
+		if err != nil {
+			t.Fatalf("ParseConfig failed: %s", err)
+		}
+		if err := CheckNetworkConfig(cfg); err == nil {
+			t.Errorf("expected an error for %s", s)
+		}
+	}
+}
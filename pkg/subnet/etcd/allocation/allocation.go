@@ -0,0 +1,148 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package allocation picks the subnets leased by the nodes in etcd, and finds
+// the lease a node already owns.
+package allocation
+
+import (
+	"errors"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	log "k8s.io/klog/v2"
+)
+
+// Allocate picks a free subnet, and IPv6 subnet, for a new lease according to
+// the AllocationStrategy of config. The hash strategy hashes the node
+// identity.
+func Allocate(config *subnet.Config, leases []lease.Lease, identity string) (ip.IP4Net, ip.IP6Net, error) {
+	ranges := config.SubnetRanges()
+	ipv6Ranges := config.IPv6SubnetRanges()
+	for _, r := range ranges {
+		log.Infof("Picking subnet in range %s ... %s", r.Min, r.Max)
+	}
+	for _, r := range ipv6Ranges {
+		log.Infof("Picking ipv6 subnet in range %s ... %s", r.Min, r.Max)
+	}
+
+	if config.AllocationStrategy == subnet.AllocationHash {
+		if identity != "" {
+			return allocateByHash(config, leases, identity)
+		}
+		log.Warning("No node identity to hash, falling back to random subnet allocation")
+	}
+
+	var availableIPs []ip.IP4
+	var availableIPv6s []*ip.IP6
+
+	// The ranges are used in order: the subnets of a pool are only picked
+	// once all the subnets of the previous ones are allocated.
+	for i, r := range ranges {
+	OuterLoop:
+		for sn := (ip.IP4Net{IP: r.Min, PrefixLen: config.SubnetLen}); sn.IP <= r.Max && len(availableIPs) < 100; sn = sn.Next() {
+			if subnet.IsSubnetExcluded(config, sn) {
+				continue
+			}
+			for _, l := range leases {
+				if sn.Overlaps(l.Subnet) {
+					continue OuterLoop
+				}
+			}
+			availableIPs = append(availableIPs, sn.IP)
+		}
+		if len(availableIPs) > 0 {
+			if i > 0 {
+				log.Infof("Subnets of the previous networks are exhausted, allocating from %s", r.Network)
+			}
+			break
+		}
+	}
+
+	for i, r := range ipv6Ranges {
+	OuterLoopv6:
+		for sn6 := (ip.IP6Net{IP: r.Min, PrefixLen: config.IPv6SubnetLen}); sn6.IP.Cmp(r.Max) <= 0 && len(availableIPv6s) < 100; sn6 = sn6.Next() {
+			if subnet.IsIPv6SubnetExcluded(config, sn6) {
+				continue
+			}
+			for _, l := range leases {
+				if sn6.Overlaps(l.IPv6Subnet) {
+					continue OuterLoopv6
+				}
+			}
+			availableIPv6s = append(availableIPv6s, sn6.IP)
+		}
+		if len(availableIPv6s) > 0 {
+			if i > 0 {
+				log.Infof("IPv6 subnets of the previous networks are exhausted, allocating from %s", r.Network)
+			}
+			break
+		}
+	}
+
+	if (config.EnableIPv4 && len(availableIPs) == 0) || (config.EnableIPv6 && len(availableIPv6s) == 0) {
+		return ip.IP4Net{}, ip.IP6Net{}, errors.New("out of subnets")
+	}
+
+	pick := func(n int) int {
+		if config.AllocationStrategy == subnet.AllocationFirstFit {
+			return 0
+		}
+		return randInt(0, n)
+	}
+
+	var ipnet ip.IP4Net
+	if config.EnableIPv4 {
+		ipnet = ip.IP4Net{IP: availableIPs[pick(len(availableIPs))], PrefixLen: config.SubnetLen}
+	}
+	if !config.EnableIPv6 {
+		return ipnet, ip.IP6Net{}, nil
+	}
+	return ipnet, ip.IP6Net{IP: availableIPv6s[pick(len(availableIPv6s))], PrefixLen: config.IPv6SubnetLen}, nil
+}
+
+// SubnetCompatible tells if the subnet of an existing lease can be kept with
+// config.
+func SubnetCompatible(config *subnet.Config, sn ip.IP4Net) bool {
+	if !config.EnableIPv4 {
+		return sn.Empty()
+	}
+	if sn.PrefixLen != config.SubnetLen || subnet.IsSubnetExcluded(config, sn) {
+		return false
+	}
+	for _, r := range config.SubnetRanges() {
+		if sn.IP >= r.Min && sn.IP <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// IPv6SubnetCompatible tells if the IPv6 subnet of an existing lease can be
+// kept with config.
+func IPv6SubnetCompatible(config *subnet.Config, sn6 ip.IP6Net) bool {
+	if !config.EnableIPv6 {
+		return sn6.Empty()
+	}
+	if sn6.Empty() || sn6.PrefixLen != config.IPv6SubnetLen || subnet.IsIPv6SubnetExcluded(config, sn6) {
+		return false
+	}
+	for _, r := range config.IPv6SubnetRanges() {
+		if sn6.IP.Cmp(r.Min) >= 0 && sn6.IP.Cmp(r.Max) <= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocation
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+func TestAllocationStrategies(t *testing.T) {
+	parseConfig := func(s string) *subnet.Config {
+		config, err := subnet.ParseConfig(s)
+		if err != nil {
+			t.Fatal("ParseConfig failed: ", err)
+		}
+		if err := subnet.CheckNetworkConfig(config); err != nil {
+			t.Fatal("CheckNetworkConfig failed: ", err)
+		}
+		return config
+	}
+
+	leases := []lease.Lease{
+		{EnableIPv4: true, Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}},
+		{EnableIPv4: true, Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.2.0"), PrefixLen: 24}},
+	}
+
+	config := parseConfig(`{ "Network": "10.3.0.0/16", "AllocationStrategy": "first-fit" }`)
+	sn, _, err := Allocate(config, leases, "")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if expected := ip.MustParseIP4("10.3.3.0"); sn.IP != expected {
+		t.Errorf("first-fit allocated %v, expected %v", sn, expected)
+	}
+
+	config = parseConfig(`{ "Network": "10.3.0.0/16", "EnableIPv6": true, "IPv6Network": "fc00::/48", "AllocationStrategy": "hash" }`)
+	sn, sn6, err := Allocate(config, leases, "node-1")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if !config.Network.Contains(sn.IP) || !config.IPv6Network.Contains(sn6.IP) {
+		t.Fatalf("hash allocated %v %v outside of the network", sn, sn6)
+	}
+
+	sn2, sn62, err := Allocate(config, leases, "node-1")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if !sn.Equal(sn2) || !sn6.Equal(sn62) {
+		t.Errorf("hash allocation is not stable: got %v %v then %v %v", sn, sn6, sn2, sn62)
+	}
+
+	// When the hashed subnet is taken, the next free one is used
+	taken := append(leases, lease.Lease{EnableIPv4: true, Subnet: sn, EnableIPv6: true, IPv6Subnet: sn6})
+	sn3, sn63, err := Allocate(config, taken, "node-1")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if sn3.Equal(sn) || sn63.Equal(sn6) {
+		t.Errorf("hash allocation reused the leased subnets %v %v", sn, sn6)
+	}
+
+	if err := subnet.CheckNetworkConfig(&subnet.Config{AllocationStrategy: "round-robin"}); err == nil {
+		t.Error("expected an error for an unknown AllocationStrategy")
+	}
+}
+
+func TestAllocateExcluded(t *testing.T) {
+	config, err := subnet.ParseConfig(`{ "Network": "10.3.0.0/16", "EnableIPv6": true, "IPv6Network": "fc00::/48", "ExcludedSubnets": ["10.3.0.0/21"], "IPv6ExcludedSubnets": ["fc00::/60"], "AllocationStrategy": "first-fit" }`)
+	if err != nil {
+		t.Fatal("ParseConfig failed: ", err)
+	}
+	if err := subnet.CheckNetworkConfig(config); err != nil {
+		t.Fatal("CheckNetworkConfig failed: ", err)
+	}
+
+	sn, sn6, err := Allocate(config, nil, "")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if expected := ip.MustParseIP4("10.3.8.0"); sn.IP != expected {
+		t.Errorf("allocated %v, expected %v", sn, expected)
+	}
+	if expected := ip.MustParseIP6("fc00:0:0:10::"); sn6.IP.Cmp(expected) != 0 {
+		t.Errorf("allocated %v, expected %v", sn6, expected)
+	}
+
+	for i := 0; i < 20; i++ {
+		sn, sn6, err := Allocate(config, nil, fmt.Sprintf("node-%d", i))
+		if err != nil {
+			t.Fatal("Allocate failed: ", err)
+		}
+		if subnet.IsSubnetExcluded(config, sn) || subnet.IsIPv6SubnetExcluded(config, sn6) {
+			t.Errorf("hash allocated the excluded subnets %v %v", sn, sn6)
+		}
+	}
+
+	// A previous lease in an excluded range is not reused
+	if SubnetCompatible(config, ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}) {
+		t.Error("an excluded subnet should not be config compatible")
+	}
+}
+
+func TestAllocateAdditionalNetworks(t *testing.T) {
+	config, err := subnet.ParseConfig(`{ "Network": "10.3.0.0/28", "SubnetLen": 30, "AdditionalNetworks": ["10.4.0.0/28"] }`)
+	if err != nil {
+		t.Fatal("ParseConfig failed: ", err)
+	}
+	if err := subnet.CheckNetworkConfig(config); err != nil {
+		t.Fatal("CheckNetworkConfig failed: ", err)
+	}
+
+	var leases []lease.Lease
+	// 10.3.0.0/28 has 3 subnets after the first one, then 10.4.0.0/28 is used
+	for i := 0; i < 6; i++ {
+		sn, _, err := Allocate(config, leases, "")
+		if err != nil {
+			t.Fatalf("Allocate %d failed: %v", i, err)
+		}
+		network := config.Network
+		if i >= 3 {
+			network = config.AdditionalNetworks[0]
+		}
+		if !network.ContainsCIDR(&sn) {
+			t.Errorf("allocation %d: %v is not in %v", i, sn, network)
+		}
+		if !SubnetCompatible(config, sn) {
+			t.Errorf("allocation %d: %v should be config compatible", i, sn)
+		}
+		leases = append(leases, lease.Lease{EnableIPv4: true, Subnet: sn})
+	}
+
+	if _, _, err := Allocate(config, leases, ""); err == nil {
+		t.Error("expected the networks to be out of subnets")
+	}
+
+	// The hash strategy expands to the additional networks too
+	config.AllocationStrategy = subnet.AllocationHash
+	sn, _, err := Allocate(config, leases[:3], "node-1")
+	if err != nil {
+		t.Fatal("Allocate failed: ", err)
+	}
+	if !config.AdditionalNetworks[0].ContainsCIDR(&sn) {
+		t.Errorf("hash allocated %v outside of %v", sn, config.AdditionalNetworks[0])
+	}
+}
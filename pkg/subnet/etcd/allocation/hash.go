@@ -0,0 +1,112 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocation
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/big"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/subnet"
+)
+
+// allocateByHash picks the subnet at the position given by the hash of
+// the node identity in the SubnetMin-SubnetMax range. When that subnet is
+// already leased or excluded, the next free one is used, wrapping around at
+// SubnetMax. The additional networks are only used once the range is full.
+func allocateByHash(config *subnet.Config, leases []lease.Lease, identity string) (ip.IP4Net, ip.IP6Net, error) {
+	h := fnv.New64a()
+	// Write on a hash.Hash never returns an error
+	_, _ = h.Write([]byte(identity))
+	hash := new(big.Int).SetUint64(h.Sum64())
+
+	var sn ip.IP4Net
+	if config.EnableIPv4 {
+		found := false
+		for _, r := range config.SubnetRanges() {
+			if sn, found = hashIP4Subnet(config, r, leases, hash); found {
+				break
+			}
+		}
+		if !found {
+			return ip.IP4Net{}, ip.IP6Net{}, errors.New("out of subnets")
+		}
+	}
+
+	if !config.EnableIPv6 {
+		return sn, ip.IP6Net{}, nil
+	}
+
+	for _, r := range config.IPv6SubnetRanges() {
+		if sn6, found := hashIP6Subnet(config, r, leases, hash); found {
+			return sn, sn6, nil
+		}
+	}
+	return ip.IP4Net{}, ip.IP6Net{}, errors.New("out of subnets")
+}
+
+func hashIP4Subnet(config *subnet.Config, r subnet.SubnetRange, leases []lease.Lease, hash *big.Int) (ip.IP4Net, bool) {
+	shift := 32 - config.SubnetLen
+	count := uint64(r.Max-r.Min)>>shift + 1
+	start := new(big.Int).Mod(hash, new(big.Int).SetUint64(count)).Uint64()
+
+OuterLoop:
+	for i := uint64(0); i < count; i++ {
+		sn := ip.IP4Net{
+			IP:        r.Min + ip.IP4(((start+i)%count)<<shift),
+			PrefixLen: config.SubnetLen,
+		}
+		if subnet.IsSubnetExcluded(config, sn) {
+			continue
+		}
+		for _, l := range leases {
+			if sn.Overlaps(l.Subnet) {
+				continue OuterLoop
+			}
+		}
+		return sn, true
+	}
+	return ip.IP4Net{}, false
+}
+
+func hashIP6Subnet(config *subnet.Config, r subnet.IPv6SubnetRange, leases []lease.Lease, hash *big.Int) (ip.IP6Net, bool) {
+	first := (*big.Int)(r.Min)
+	shift := 128 - config.IPv6SubnetLen
+	count := new(big.Int).Sub((*big.Int)(r.Max), first)
+	count.Rsh(count, shift).Add(count, big.NewInt(1))
+	start := new(big.Int).Mod(hash, count)
+
+OuterLoop:
+	for i := big.NewInt(0); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+		offset := new(big.Int).Add(start, i)
+		offset.Mod(offset, count).Lsh(offset, shift)
+		sn6 := ip.IP6Net{
+			IP:        (*ip.IP6)(offset.Add(offset, first)),
+			PrefixLen: config.IPv6SubnetLen,
+		}
+		if subnet.IsIPv6SubnetExcluded(config, sn6) {
+			continue
+		}
+		for _, l := range leases {
+			if !l.IPv6Subnet.Empty() && sn6.Overlaps(l.IPv6Subnet) {
+				continue OuterLoop
+			}
+		}
+		return sn6, true
+	}
+	return ip.IP6Net{}, false
+}
@@ -0,0 +1,92 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocation
+
+import (
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	log "k8s.io/klog/v2"
+)
+
+// recentRenewal is how long after its renewal a lease is considered in use by
+// the node which renewed it.
+const recentRenewal = 10 * time.Minute
+
+// FindNodeLease returns the lease owned by the node. The lease is looked up
+// by node identity first, then by public IP for the leases created before
+// the node identity was recorded.
+//
+// The public IP of a node may change when it reboots, so the lease of its
+// identity is taken over from another IP, unless it may be in use by another
+// node with the same identity: the lease doesn't have prevSubnet, the subnet
+// of the node before it restarted, and it was renewed recently. The leases
+// are renewed for ttl.
+func FindNodeLease(leases []lease.Lease, nodeID string, pubIP ip.IP4, prevSubnet ip.IP4Net, ttl time.Duration) *lease.Lease {
+	if nodeID != "" {
+		if l := findLeaseByNodeID(leases, nodeID, pubIP, prevSubnet, ttl); l != nil {
+			return l
+		}
+	}
+
+	l := findLeaseByIP(leases, pubIP)
+	if l != nil && l.Attrs.NodeID != "" && l.Attrs.NodeID != nodeID {
+		// The IP was reassigned, this lease belongs to another node
+		return nil
+	}
+	return l
+}
+
+func findLeaseByIP(leases []lease.Lease, pubIP ip.IP4) *lease.Lease {
+	for _, l := range leases {
+		if pubIP == l.Attrs.PublicIP {
+			return &l
+		}
+	}
+
+	return nil
+}
+
+func findLeaseByNodeID(leases []lease.Lease, nodeID string, pubIP ip.IP4, prevSubnet ip.IP4Net, ttl time.Duration) *lease.Lease {
+	var moved *lease.Lease
+	for _, l := range leases {
+		if nodeID != l.Attrs.NodeID {
+			continue
+		}
+		switch {
+		case pubIP == l.Attrs.PublicIP:
+			return &l
+		case !prevSubnet.Empty() && prevSubnet.Equal(l.Subnet):
+			moved = &l
+		case inUse(&l, ttl):
+			log.Warningf("Lease %v of the node identity %q was renewed by %v at %v, not reusing it as another node may have the same identity",
+				l.Subnet, nodeID, l.Attrs.PublicIP, l.Expiration.Add(-ttl).Format(time.RFC3339))
+		case moved == nil:
+			moved = &l
+		}
+	}
+
+	return moved
+}
+
+// inUse tells if the lease was renewed recently. The reservations, which
+// don't expire, aren't renewed.
+func inUse(l *lease.Lease, ttl time.Duration) bool {
+	if l.Expiration.IsZero() {
+		return false
+	}
+	return time.Since(l.Expiration.Add(-ttl)) < recentRenewal
+}
@@ -0,0 +1,75 @@
+// Copyright 2026 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+)
+
+func TestFindNodeLease(t *testing.T) {
+	const ttl = 24 * time.Hour
+	nodeLease := func(sn, pubIP, nodeID string, renewed time.Duration) lease.Lease {
+		l := lease.Lease{
+			EnableIPv4: true,
+			Subnet:     ip.IP4Net{IP: ip.MustParseIP4(sn), PrefixLen: 24},
+			Attrs:      lease.LeaseAttrs{PublicIP: ip.MustParseIP4(pubIP), NodeID: nodeID},
+		}
+		if renewed >= 0 {
+			l.Expiration = time.Now().Add(ttl - renewed)
+		}
+		return l
+	}
+	leases := []lease.Lease{
+		nodeLease("10.3.1.0", "1.2.3.4", "node-1", 3*time.Hour),
+		nodeLease("10.3.2.0", "1.2.3.5", "node-2", time.Minute),
+		nodeLease("10.3.3.0", "1.2.3.6", "", time.Hour),
+		// a reservation, which isn't renewed
+		nodeLease("10.3.4.0", "1.2.3.7", "node-4", -1),
+	}
+
+	for _, tc := range []struct {
+		name       string
+		nodeID     string
+		pubIP      string
+		prevSubnet string
+		expected   string
+	}{
+		{"same IP", "node-1", "1.2.3.4", "", "10.3.1.0"},
+		{"rebooted with a new IP", "node-1", "1.2.3.10", "", "10.3.1.0"},
+		{"IP reassigned to another node", "node-5", "1.2.3.4", "", ""},
+		{"same identity as a running node", "node-2", "1.2.3.10", "", ""},
+		{"restarted with a new IP", "node-2", "1.2.3.10", "10.3.2.0", "10.3.2.0"},
+		{"lease without identity", "node-3", "1.2.3.6", "", "10.3.3.0"},
+		{"reservation", "node-4", "1.2.3.10", "", "10.3.4.0"},
+	} {
+		var prevSubnet ip.IP4Net
+		if tc.prevSubnet != "" {
+			prevSubnet = ip.IP4Net{IP: ip.MustParseIP4(tc.prevSubnet), PrefixLen: 24}
+		}
+		l := FindNodeLease(leases, tc.nodeID, ip.MustParseIP4(tc.pubIP), prevSubnet, ttl)
+		switch {
+		case tc.expected == "" && l != nil:
+			t.Errorf("%s: expected no lease, got %v", tc.name, l.Subnet)
+		case tc.expected != "" && l == nil:
+			t.Errorf("%s: expected the lease %s, got none", tc.name, tc.expected)
+		case tc.expected != "" && l.Subnet.IP != ip.MustParseIP4(tc.expected):
+			t.Errorf("%s: expected the lease %s, got %v", tc.name, tc.expected, l.Subnet)
+		}
+	}
+}
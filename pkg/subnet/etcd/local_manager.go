@@ -18,13 +18,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
 	"github.com/flannel-io/flannel/pkg/subnet"
+	"github.com/flannel-io/flannel/pkg/subnet/etcd/allocation"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	log "k8s.io/klog/v2"
 )
@@ -45,6 +48,13 @@ type LocalManager struct {
 	previousSubnet         ip.IP4Net
 	previousIPv6Subnet     ip.IP6Net
 	subnetLeaseRenewMargin int
+	// nodeIdentity is stored in the lease attributes to find the lease of the
+	// node and hashed to pick its subnet with the hash allocation strategy
+	nodeIdentity string
+
+	// config is the network config in use, set once live reload is enabled
+	mu     sync.Mutex
+	config *subnet.Config
 }
 
 type watchCursor struct {
@@ -62,15 +72,35 @@ func (c watchCursor) String() string {
 	return strconv.FormatInt(c.index, 10)
 }
 
-func NewLocalManager(ctx context.Context, config *EtcdConfig, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, subnetLeaseRenewMargin int) (subnet.Manager, error) {
+// NewLocalManager creates a subnet manager storing the leases in etcd. The
+// leases are looked up by nodeIdentity, or when empty by the hostname of the
+// node.
+func NewLocalManager(ctx context.Context, config *EtcdConfig, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, subnetLeaseRenewMargin int, nodeIdentity string) (subnet.Manager, error) {
 	r, err := newEtcdSubnetRegistry(ctx, config, nil)
 	if err != nil {
 		return nil, err
 	}
-	return newLocalManager(r, prevSubnet, prevIPv6Subnet, subnetLeaseRenewMargin), nil
+	sm := newLocalManager(r, prevSubnet, prevIPv6Subnet, subnetLeaseRenewMargin)
+	sm.nodeIdentity = getNodeIdentity(nodeIdentity)
+	log.Infof("Using node identity %q for the subnet lease", sm.nodeIdentity)
+	return sm, nil
 }
 
-func newLocalManager(r Registry, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, subnetLeaseRenewMargin int) subnet.Manager {
+// getNodeIdentity returns identity if set, otherwise the hostname of the node.
+// The machine-id isn't used as it's often shared by the VMs cloned from the
+// same image.
+func getNodeIdentity(identity string) string {
+	if identity != "" {
+		return identity
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warningf("Failed to get the hostname: %v", err)
+	}
+	return hostname
+}
+
+func newLocalManager(r Registry, prevSubnet ip.IP4Net, prevIPv6Subnet ip.IP6Net, subnetLeaseRenewMargin int) *LocalManager {
 	return &LocalManager{
 		registry:               r,
 		previousSubnet:         prevSubnet,
@@ -88,6 +118,18 @@ func (m *LocalManager) GetStoredPublicIP(ctx context.Context) (string, string) {
 }
 
 func (m *LocalManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	m.mu.Lock()
+	config := m.config
+	m.mu.Unlock()
+	if config != nil {
+		return config, nil
+	}
+	return m.LoadNetworkConfig(ctx)
+}
+
+// LoadNetworkConfig reads the network config from etcd, ignoring the one set
+// with SetNetworkConfig.
+func (m *LocalManager) LoadNetworkConfig(ctx context.Context) (*subnet.Config, error) {
 	cfg, err := m.registry.getNetworkConfig(ctx)
 	if err != nil {
 		return nil, err
@@ -104,16 +146,29 @@ func (m *LocalManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, er
 	return config, nil
 }
 
+// SetNetworkConfig pins the network config returned by GetNetworkConfig, so
+// that a change in etcd is only taken into account once flanneld applied it.
+func (m *LocalManager) SetNetworkConfig(config *subnet.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = config
+}
+
 func (m *LocalManager) AcquireLease(ctx context.Context, attrs *lease.LeaseAttrs) (*lease.Lease, error) {
 	config, err := m.GetNetworkConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if attrs.NodeID == "" {
+		attrs.NodeID = m.nodeIdentity
+	}
+
 	for i := 0; i < raceRetries; i++ {
 		l, err := m.tryAcquireLease(ctx, config, attrs.PublicIP, attrs)
 		switch err {
 		case nil:
+			metrics.LeaseRenewed(l.Expiration)
 			return l, nil
 		case errTryAgain:
 			continue
@@ -125,16 +180,6 @@ func (m *LocalManager) AcquireLease(ctx context.Context, attrs *lease.LeaseAttrs
 	return nil, errors.New("max retries reached trying to acquire a subnet")
 }
 
-func findLeaseByIP(leases []lease.Lease, pubIP ip.IP4) *lease.Lease {
-	for _, l := range leases {
-		if pubIP == l.Attrs.PublicIP {
-			return &l
-		}
-	}
-
-	return nil
-}
-
 func findLeaseBySubnet(leases []lease.Lease, subnet ip.IP4Net) *lease.Lease {
 	for _, l := range leases {
 		if subnet.Equal(l.Subnet) {
@@ -151,11 +196,14 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *subnet.Confi
 		return nil, err
 	}
 
-	// Try to reuse a subnet if there's one that matches our IP
-	if l := findLeaseByIP(leases, extIaddr); l != nil {
+	// Try to reuse a subnet if there's one that matches our identity or our IP
+	if l := allocation.FindNodeLease(leases, attrs.NodeID, extIaddr, m.previousSubnet, subnetTTL); l != nil {
 		// Make sure the existing subnet is still within the configured network
-		if isSubnetConfigCompat(config, l.Subnet) && isIPv6SubnetConfigCompat(config, l.IPv6Subnet) {
-			log.Infof("Found lease (ip: %v ipv6: %v) for current IP (%v), reusing", l.Subnet, l.IPv6Subnet, extIaddr)
+		if allocation.SubnetCompatible(config, l.Subnet) && allocation.IPv6SubnetCompatible(config, l.IPv6Subnet) {
+			log.Infof("Found lease (ip: %v ipv6: %v) for current node (%v), reusing", l.Subnet, l.IPv6Subnet, extIaddr)
+			if l.Attrs.PublicIP != extIaddr {
+				log.Infof("Public IP of the node changed from %v to %v, updating the lease", l.Attrs.PublicIP, extIaddr)
+			}
 
 			ttl := time.Duration(0)
 			if !l.Expiration.IsZero() {
@@ -171,7 +219,7 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *subnet.Confi
 			l.Expiration = exp
 			return l, nil
 		} else {
-			log.Infof("Found lease (%+v) for current IP (%v) but not compatible with current config, deleting", l, extIaddr)
+			log.Infof("Found lease (%+v) for current node (%v) but not compatible with current config, deleting", l, extIaddr)
 			if err := m.registry.deleteSubnet(ctx, l.Subnet, l.IPv6Subnet); err != nil {
 				return nil, err
 			}
@@ -185,7 +233,7 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *subnet.Confi
 		// use previous subnet
 		if l := findLeaseBySubnet(leases, m.previousSubnet); l == nil {
 			// Check if the previous subnet is a part of the network and of the right subnet length
-			if isSubnetConfigCompat(config, m.previousSubnet) && isIPv6SubnetConfigCompat(config, m.previousIPv6Subnet) {
+			if allocation.SubnetCompatible(config, m.previousSubnet) && allocation.IPv6SubnetCompatible(config, m.previousIPv6Subnet) {
 				log.Infof("Found previously leased subnet (%v), reusing", m.previousSubnet)
 				sn = m.previousSubnet
 				sn6 = m.previousIPv6Subnet
@@ -197,7 +245,7 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *subnet.Confi
 
 	if sn.Empty() {
 		// no existing match, grab a new one
-		sn, sn6, err = m.allocateSubnet(config, leases)
+		sn, sn6, err = allocation.Allocate(config, leases, m.nodeIdentity)
 		if err != nil {
 			return nil, err
 		}
@@ -222,57 +270,6 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *subnet.Confi
 	}
 }
 
-func (m *LocalManager) allocateSubnet(config *subnet.Config, leases []lease.Lease) (ip.IP4Net, ip.IP6Net, error) {
-	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
-	if config.EnableIPv6 {
-		log.Infof("Picking ipv6 subnet in range %s ... %s", config.IPv6SubnetMin, config.IPv6SubnetMax)
-	}
-
-	var availableIPs []ip.IP4
-	var availableIPv6s []*ip.IP6
-
-	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
-	var sn6 ip.IP6Net
-	if config.EnableIPv6 {
-		sn6 = ip.IP6Net{IP: config.IPv6SubnetMin, PrefixLen: config.IPv6SubnetLen}
-	}
-
-OuterLoop:
-	for ; sn.IP <= config.SubnetMax && len(availableIPs) < 100; sn = sn.Next() {
-		for _, l := range leases {
-			if sn.Overlaps(l.Subnet) {
-				continue OuterLoop
-			}
-		}
-		availableIPs = append(availableIPs, sn.IP)
-	}
-
-	if !sn6.Empty() {
-	OuterLoopv6:
-		for ; sn6.IP.Cmp(config.IPv6SubnetMax) <= 0 && len(availableIPv6s) < 100; sn6 = sn6.Next() {
-			for _, l := range leases {
-				if sn6.Overlaps(l.IPv6Subnet) {
-					continue OuterLoopv6
-				}
-			}
-			availableIPv6s = append(availableIPv6s, sn6.IP)
-		}
-	}
-
-	if len(availableIPs) == 0 || (!sn6.Empty() && len(availableIPv6s) == 0) {
-		return ip.IP4Net{}, ip.IP6Net{}, errors.New("out of subnets")
-	} else {
-		i := randInt(0, len(availableIPs))
-		ipnet := ip.IP4Net{IP: availableIPs[i], PrefixLen: config.SubnetLen}
-
-		if sn6.Empty() {
-			return ipnet, ip.IP6Net{}, nil
-		}
-		i = randInt(0, len(availableIPv6s))
-		return ipnet, ip.IP6Net{IP: availableIPv6s[i], PrefixLen: config.IPv6SubnetLen}, nil
-	}
-}
-
 func (m *LocalManager) RenewLease(ctx context.Context, lease *lease.Lease) error {
 	exp, err := m.registry.updateSubnet(ctx, lease.Subnet, lease.IPv6Subnet, &lease.Attrs, subnetTTL, 0)
 	if err != nil {
@@ -280,6 +277,7 @@ func (m *LocalManager) RenewLease(ctx context.Context, lease *lease.Lease) error
 	}
 
 	lease.Expiration = exp
+	metrics.LeaseRenewed(exp)
 	return nil
 }
 
@@ -394,6 +392,9 @@ func (m *LocalManager) CompleteLease(ctx context.Context, myLease *lease.Lease,
 			}
 			switch e.Type {
 			case lease.EventAdded:
+				// The backend may update the attributes of the lease,
+				// they're kept when it's renewed
+				myLease.Attrs = e.Lease.Attrs
 				myLease.Expiration = e.Lease.Expiration
 				dur = time.Until(myLease.Expiration) - renewMargin
 				log.Infof("Waiting for %s to renew lease", dur)
@@ -410,25 +411,6 @@ func isIndexTooSmall(err error) bool {
 	return err == rpctypes.ErrGRPCCompacted
 }
 
-func isSubnetConfigCompat(config *subnet.Config, sn ip.IP4Net) bool {
-	if sn.IP < config.SubnetMin || sn.IP > config.SubnetMax {
-		return false
-	}
-
-	return sn.PrefixLen == config.SubnetLen
-}
-
-func isIPv6SubnetConfigCompat(config *subnet.Config, sn6 ip.IP6Net) bool {
-	if !config.EnableIPv6 {
-		return sn6.Empty()
-	}
-	if sn6.Empty() || sn6.IP.Cmp(config.IPv6SubnetMin) < 0 || sn6.IP.Cmp(config.IPv6SubnetMax) > 0 {
-		return false
-	}
-
-	return sn6.PrefixLen == config.IPv6SubnetLen
-}
-
 func (m *LocalManager) Name() string {
 	previousSubnet := m.previousSubnet.String()
 	if m.previousSubnet.Empty() {
@@ -31,6 +31,9 @@ type annotations struct {
 	BackendNodePublicIPv6      string
 	BackendPublicIPOverwrite   string
 	BackendPublicIPv6Overwrite string
+	MigrationBackendType       string
+	MigrationBackendData       string
+	MigrationBackendV6Data     string
 }
 
 func newAnnotations(prefix string) (annotations, error) {
@@ -70,6 +73,9 @@ func newAnnotations(prefix string) (annotations, error) {
 		BackendPublicIPv6:          prefix + "public-ipv6",
 		BackendNodePublicIPv6:      prefix + "node-public-ipv6",
 		BackendPublicIPv6Overwrite: prefix + "public-ipv6-overwrite",
+		MigrationBackendType:       prefix + "migration-backend-type",
+		MigrationBackendData:       prefix + "migration-backend-data",
+		MigrationBackendV6Data:     prefix + "migration-backend-v6-data",
 	}
 
 	return a, nil
@@ -28,6 +28,7 @@ import (
 
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
 	"github.com/flannel-io/flannel/pkg/subnet"
 	"golang.org/x/sync/semaphore"
 	v1 "k8s.io/api/core/v1"
@@ -70,6 +71,8 @@ type kubeSubnetManager struct {
 	nodeStore                 cache.Store
 	nodeController            cache.Controller
 	subnetConf                *subnet.Config
+	subnetConfLock            sync.Mutex
+	netConfPath               string
 	events                    chan lease.Event
 	asyncSendSemaphore        *semaphore.Weighted
 	clusterCIDRController     cache.Controller
@@ -130,6 +133,7 @@ func NewSubnetManager(ctx context.Context, apiUrl, kubeconfig, prefix, netConfPa
 		return nil, fmt.Errorf("error creating network manager: %s", err)
 	}
 	sm.setNodeNetworkUnavailable = setNodeNetworkUnavailable
+	sm.netConfPath = netConfPath
 
 	if sm.disableNodeInformer {
 		log.Infof("Node controller skips sync")
@@ -328,6 +332,12 @@ func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(ctx context.Context, oldObj
 		changed = false
 	}
 
+	for _, a := range ksm.migrationAnnotationNames() {
+		if o.Annotations[a] != n.Annotations[a] {
+			changed = true
+		}
+	}
+
 	if !changed {
 		return // No change to lease
 	}
@@ -341,13 +351,43 @@ func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(ctx context.Context, oldObj
 }
 
 func (ksm *kubeSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	ksm.subnetConfLock.Lock()
+	defer ksm.subnetConfLock.Unlock()
 	return ksm.subnetConf, nil
 }
 
+// LoadNetworkConfig reads the net conf file again, it doesn't change the
+// config returned by GetNetworkConfig.
+func (ksm *kubeSubnetManager) LoadNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	netConf, err := os.ReadFile(ksm.netConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read net conf: %v", err)
+	}
+
+	sc, err := subnet.ParseConfig(string(netConf))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing subnet config: %s", err)
+	}
+	return sc, nil
+}
+
+// SetNetworkConfig replaces the config returned by GetNetworkConfig once
+// flanneld applied it.
+func (ksm *kubeSubnetManager) SetNetworkConfig(config *subnet.Config) {
+	ksm.subnetConfLock.Lock()
+	defer ksm.subnetConfLock.Unlock()
+	ksm.subnetConf = config
+}
+
 // AcquireLease adds the flannel specific node annotations (defined in the struct LeaseAttrs) and returns a lease
 // with important information for the backend, such as the subnet. This function is called once by the backend when
 // registering
 func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *lease.LeaseAttrs) (*lease.Lease, error) {
+	// The config is replaced by SetNetworkConfig when it's reloaded
+	ksm.subnetConfLock.Lock()
+	subnetConf := ksm.subnetConf
+	ksm.subnetConfLock.Unlock()
+
 	var cachedNode *v1.Node
 	waitErr := wait.PollUntilContextTimeout(ctx, 3*time.Second, 30*time.Second, true, func(context.Context) (done bool, err error) {
 		if ksm.disableNodeInformer {
@@ -417,7 +457,15 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *lease.Lea
 		return nil, fmt.Errorf("node %q pod cidrs should be IPv4/IPv6 only or dualstack", ksm.nodeName)
 	}
 
-	if (n.Annotations[ksm.annotations.BackendData] != string(bd) ||
+	migrationAnnotations := ksm.migrationAnnotations(attrs)
+	migrationChanged := false
+	for a, v := range migrationAnnotations {
+		if n.Annotations[a] != v {
+			migrationChanged = true
+		}
+	}
+
+	if migrationChanged || (n.Annotations[ksm.annotations.BackendData] != string(bd) ||
 		n.Annotations[ksm.annotations.BackendType] != attrs.BackendType ||
 		n.Annotations[ksm.annotations.BackendPublicIP] != attrs.PublicIP.String() ||
 		n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" ||
@@ -430,8 +478,11 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *lease.Lea
 				(n.Annotations[ksm.annotations.BackendPublicIPv6Overwrite] != "" && n.Annotations[ksm.annotations.BackendPublicIPv6Overwrite] != attrs.PublicIPv6.String()))) {
 		n.Annotations[ksm.annotations.BackendType] = attrs.BackendType
 
-		//TODO -i only vxlan and host-gw backends support dual stack now.
-		if (attrs.BackendType == "vxlan" && string(bd) != "null") || (attrs.BackendType == "wireguard" && string(bd) != "null") || attrs.BackendType != "vxlan" {
+		//TODO -i only vxlan, geneve and host-gw backends support dual stack now.
+		if (attrs.BackendType == "vxlan" && string(bd) != "null") ||
+			(attrs.BackendType == "geneve" && string(bd) != "null") ||
+			(attrs.BackendType == "wireguard" && string(bd) != "null") ||
+			(attrs.BackendType != "vxlan" && attrs.BackendType != "geneve") {
 			n.Annotations[ksm.annotations.BackendData] = string(bd)
 			if n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != "" {
 				if n.Annotations[ksm.annotations.BackendPublicIP] != n.Annotations[ksm.annotations.BackendPublicIPOverwrite] {
@@ -446,8 +497,15 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *lease.Lea
 		}
 
 		if (attrs.BackendType == "vxlan" && string(v6Bd) != "null") ||
+			(attrs.BackendType == "geneve" && string(v6Bd) != "null") ||
 			(attrs.BackendType == "wireguard" && string(v6Bd) != "null" && attrs.PublicIPv6 != nil) ||
 			(attrs.BackendType == "host-gw" && attrs.PublicIPv6 != nil) ||
+			(attrs.BackendType == "bgp" && attrs.PublicIPv6 != nil) ||
+			(attrs.BackendType == "ipsec" && attrs.PublicIPv6 != nil) ||
+			(attrs.BackendType == "ipip" && attrs.PublicIPv6 != nil) ||
+			(attrs.BackendType == "gre" && attrs.PublicIPv6 != nil) ||
+			(attrs.BackendType == "tencent-vpc" && attrs.PublicIPv6 != nil) ||
+			(attrs.BackendType == "auto" && attrs.PublicIPv6 != nil) ||
 			(attrs.BackendType == "extension" && attrs.PublicIPv6 != nil) {
 			n.Annotations[ksm.annotations.BackendV6Data] = string(v6Bd)
 			if n.Annotations[ksm.annotations.BackendPublicIPv6Overwrite] != "" {
@@ -461,6 +519,13 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *lease.Lea
 				n.Annotations[ksm.annotations.BackendPublicIPv6] = attrs.PublicIPv6.String()
 			}
 		}
+		for a, v := range migrationAnnotations {
+			if v == "" {
+				delete(n.Annotations, a)
+			} else {
+				n.Annotations[a] = v
+			}
+		}
 		n.Annotations[ksm.annotations.SubnetKubeManaged] = "true"
 
 		oldData, err := json.Marshal(cachedNode)
@@ -496,27 +561,79 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *lease.Lea
 		Expiration: time.Now().Add(24 * time.Hour),
 	}
 	if cidr != nil && ksm.enableIPv4 {
-		if ksm.subnetConf.Network.Empty() || !containsCIDR(ksm.subnetConf.Network.ToIPNet(), cidr) {
-			return nil, fmt.Errorf("subnet %q specified in the flannel net config doesn't contain %q PodCIDR of the %q node", ksm.subnetConf.Network, cidr, ksm.nodeName)
-		}
-
 		lease.Subnet = ip.FromIPNet(cidr)
+		if subnetConf.Network.Empty() || !subnetConf.ContainsSubnet(lease.Subnet) {
+			return nil, fmt.Errorf("subnets %v specified in the flannel net config don't contain %q PodCIDR of the %q node", subnetConf.Networks(), cidr, ksm.nodeName)
+		}
+		if subnet.IsSubnetExcluded(subnetConf, lease.Subnet) {
+			log.Warningf("PodCIDR %s of the %q node overlaps the ExcludedSubnets %v of the flannel net config", lease.Subnet, ksm.nodeName, subnetConf.ExcludedSubnets)
+		}
 	}
 	if ipv6Cidr != nil && ksm.enableIPv6 {
-		if ksm.subnetConf.IPv6Network.Empty() || !containsCIDR(ksm.subnetConf.IPv6Network.ToIPNet(), ipv6Cidr) {
-			return nil, fmt.Errorf("subnet %q specified in the flannel net config doesn't contain %q IPv6 PodCIDR of the %q node", ksm.subnetConf.IPv6Network, ipv6Cidr, ksm.nodeName)
-		}
-
 		lease.IPv6Subnet = ip.FromIP6Net(ipv6Cidr)
+		if subnetConf.IPv6Network.Empty() || !subnetConf.ContainsIPv6Subnet(lease.IPv6Subnet) {
+			return nil, fmt.Errorf("subnets %v specified in the flannel net config don't contain %q IPv6 PodCIDR of the %q node", subnetConf.IPv6Networks(), ipv6Cidr, ksm.nodeName)
+		}
+		if subnet.IsIPv6SubnetExcluded(subnetConf, lease.IPv6Subnet) {
+			log.Warningf("IPv6 PodCIDR %s of the %q node overlaps the IPv6ExcludedSubnets %v of the flannel net config", lease.IPv6Subnet, ksm.nodeName, subnetConf.IPv6ExcludedSubnets)
+		}
 	}
-	//TODO - only vxlan, host-gw and wireguard backends support dual stack now.
-	if attrs.BackendType != "vxlan" && attrs.BackendType != "host-gw" && attrs.BackendType != "wireguard" {
+	//TODO - only vxlan, geneve, host-gw, bgp, wireguard, ipsec, ipip, gre, tencent-vpc, auto and extension (v2 protocol) backends support dual stack now.
+	if attrs.BackendType != "vxlan" && attrs.BackendType != "geneve" && attrs.BackendType != "host-gw" &&
+		attrs.BackendType != "bgp" && attrs.BackendType != "wireguard" && attrs.BackendType != "ipsec" &&
+		attrs.BackendType != "ipip" && attrs.BackendType != "gre" && attrs.BackendType != "tencent-vpc" &&
+		attrs.BackendType != "auto" && (attrs.BackendType != "extension" || !isExtensionV2(subnetConf)) {
 		lease.EnableIPv4 = true
 		lease.EnableIPv6 = false
 	}
+	// The lease isn't renewed, it's refreshed each time it's acquired
+	metrics.LeaseRenewed(lease.Expiration)
 	return lease, nil
 }
 
+// isExtensionV2 tells if the extension backend of the config uses the v2
+// protocol, which passes the IPv6 subnets to the plugin. The commands of the
+// v1 protocol only get the IPv4 subnets.
+func isExtensionV2(config *subnet.Config) bool {
+	var cfg struct {
+		Protocol string
+	}
+	if config == nil || len(config.Backend) == 0 {
+		return false
+	}
+	if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+		return false
+	}
+	return cfg.Protocol == "v2"
+}
+
+func (ksm *kubeSubnetManager) migrationAnnotationNames() []string {
+	return []string{
+		ksm.annotations.MigrationBackendType,
+		ksm.annotations.MigrationBackendData,
+		ksm.annotations.MigrationBackendV6Data,
+	}
+}
+
+// migrationAnnotations returns the annotations advertising the backend the
+// node migrates to, an empty value meaning that the annotation is removed.
+func (ksm *kubeSubnetManager) migrationAnnotations(attrs *lease.LeaseAttrs) map[string]string {
+	annotations := make(map[string]string)
+	for _, a := range ksm.migrationAnnotationNames() {
+		annotations[a] = ""
+	}
+	if attrs.MigrationBackendType == "" {
+		return annotations
+	}
+
+	annotations[ksm.annotations.MigrationBackendType] = attrs.MigrationBackendType
+	annotations[ksm.annotations.MigrationBackendData] = string(attrs.MigrationBackendData)
+	if attrs.PublicIPv6 != nil {
+		annotations[ksm.annotations.MigrationBackendV6Data] = string(attrs.MigrationBackendV6Data)
+	}
+	return annotations
+}
+
 // WatchLeases waits for the kubeSubnetManager to provide an event in case something relevant changed in the node data
 func (ksm *kubeSubnetManager) WatchLeases(ctx context.Context, receiver chan []lease.LeaseWatchResult) error {
 	for {
@@ -546,6 +663,9 @@ func (ksm *kubeSubnetManager) nodeToLease(n v1.Node) (l lease.Lease, err error)
 			return l, err
 		}
 		l.Attrs.BackendData = json.RawMessage(n.Annotations[ksm.annotations.BackendData])
+		if data := n.Annotations[ksm.annotations.MigrationBackendData]; data != "" {
+			l.Attrs.MigrationBackendData = json.RawMessage(data)
+		}
 
 		var cidr *net.IPNet
 		switch {
@@ -585,6 +705,9 @@ func (ksm *kubeSubnetManager) nodeToLease(n v1.Node) (l lease.Lease, err error)
 			return l, err
 		}
 		l.Attrs.BackendV6Data = json.RawMessage(n.Annotations[ksm.annotations.BackendV6Data])
+		if data := n.Annotations[ksm.annotations.MigrationBackendV6Data]; data != "" {
+			l.Attrs.MigrationBackendV6Data = json.RawMessage(data)
+		}
 
 		var ipv6Cidr *net.IPNet
 		switch {
@@ -618,6 +741,7 @@ func (ksm *kubeSubnetManager) nodeToLease(n v1.Node) (l lease.Lease, err error)
 		l.EnableIPv6 = ksm.enableIPv6
 	}
 	l.Attrs.BackendType = n.Annotations[ksm.annotations.BackendType]
+	l.Attrs.MigrationBackendType = n.Annotations[ksm.annotations.MigrationBackendType]
 	return l, nil
 }
 
@@ -15,9 +15,21 @@
 package kube
 
 import (
+	"context"
+	"encoding/json"
 	"net"
+	"time"
 
 	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
+	"github.com/flannel-io/flannel/pkg/subnet"
+	dto "github.com/prometheus/client_model/go"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestContainsCIDR(t *testing.T) {
@@ -50,3 +62,61 @@ func TestContainsCIDR(t *testing.T) {
 		}
 	}
 }
+
+func TestIsExtensionV2(t *testing.T) {
+	testCases := []struct {
+		backend        string
+		expectedResult bool
+	}{
+		{`{"Type": "extension", "Protocol": "v2", "PluginCommand": "plugin"}`, true},
+		{`{"Type": "extension", "Protocol": "v1", "PreStartupCommand": "cmd"}`, false},
+		{`{"Type": "extension", "PreStartupCommand": "cmd"}`, false},
+		{``, false},
+	}
+
+	for i, tc := range testCases {
+		config := &subnet.Config{Backend: json.RawMessage(tc.backend)}
+		if actualResult := isExtensionV2(config); actualResult != tc.expectedResult {
+			t.Errorf("#%d: Expected %t, but was %t.", i, tc.expectedResult, actualResult)
+		}
+	}
+}
+
+func TestAcquireLeaseMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{}},
+		Spec:       v1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+	}
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "Backend": {"Type": "alloc"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.BackendType = "alloc"
+	ksm, err := newKubeSubnetManager(ctx, fake.NewSimpleClientset(node), sc, node.Name, "flannel.alpha.coreos.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Unix()
+	l, err := ksm.AcquireLease(ctx, &lease.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "alloc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &dto.Metric{}
+	if err := metrics.LeaseRenewalTimestamp.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.GetGauge().GetValue(); got < float64(before) {
+		t.Errorf("expected the lease renewal to be recorded after %d, got %v", before, got)
+	}
+	if err := metrics.LeaseExpirationTimestamp.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.GetGauge().GetValue(); got != float64(l.Expiration.Unix()) {
+		t.Errorf("expected the lease expiration %d, got %v", l.Expiration.Unix(), got)
+	}
+}
@@ -22,10 +22,12 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
 	log "k8s.io/klog/v2"
 )
 
@@ -78,12 +80,21 @@ func WriteSubnetFile(path string, config *Config, ipMasq bool, sn ip.IP4Net, ipv
 	if config.EnableIPv4 {
 		// Write out the first usable IP by incrementing sn.IP by one
 		sn.IncrementIP()
-		b = fmt.Appendf(b, "FLANNEL_NETWORK=%s\nFLANNEL_SUBNET=%s\n", config.Network, sn)
+		// The network pools are written as a comma separated list
+		var networks []string
+		for _, n := range config.Networks() {
+			networks = append(networks, n.String())
+		}
+		b = fmt.Appendf(b, "FLANNEL_NETWORK=%s\nFLANNEL_SUBNET=%s\n", strings.Join(networks, ","), sn)
 	}
 	if config.EnableIPv6 {
 		// Write out the first usable IP by incrementing ip6Sn.IP by one
 		ipv6sn.IncrementIP()
-		b = fmt.Appendf(b, "FLANNEL_IPV6_NETWORK=%s\nFLANNEL_IPV6_SUBNET=%s\n", config.IPv6Network, ipv6sn)
+		var networks []string
+		for _, n := range config.IPv6Networks() {
+			networks = append(networks, n.String())
+		}
+		b = fmt.Appendf(b, "FLANNEL_IPV6_NETWORK=%s\nFLANNEL_IPV6_SUBNET=%s\n", strings.Join(networks, ","), ipv6sn)
 	}
 
 	b = fmt.Appendf(b, "FLANNEL_MTU=%d\nFLANNEL_IPMASQ=%t\n", mtu, ipMasq)
@@ -105,11 +116,27 @@ type Manager interface {
 	Name() string
 }
 
+// ConfigReloader is implemented by the subnet managers able to reload the
+// network config while flanneld is running.
+type ConfigReloader interface {
+	// LoadNetworkConfig reads the current network config from its source.
+	LoadNetworkConfig(ctx context.Context) (*Config, error)
+	// SetNetworkConfig sets the config returned by GetNetworkConfig.
+	SetNetworkConfig(config *Config)
+}
+
+// leaseSubset is implemented by the subnet managers watching a subset of the
+// leases of another manager, which records the lease metrics.
+type leaseSubset interface {
+	WatchesLeaseSubset() bool
+}
+
 // WatchLeases performs a long term watch of the given network's subnet leases
 // and communicates addition/deletion events on receiver channel. It takes care
 // of handling "fall-behind" logic where the history window has advanced too far
 // and it needs to diff the latest snapshot with its saved state and generate events
 func WatchLeases(ctx context.Context, sm Manager, ownLease *lease.Lease, receiver chan []lease.Event) {
+	_, subset := sm.(leaseSubset)
 
 	// LeaseWatcher is initiated with the Lease of the local node
 	lw := &lease.LeaseWatcher{
@@ -136,6 +163,12 @@ func WatchLeases(ctx context.Context, sm Manager, ownLease *lease.Lease, receive
 
 			for i := range batch {
 				log.Infof("Batch elem [%d] is { %#v }", i, batch[i])
+				if !subset {
+					metrics.LeaseEvents.WithLabelValues(batch[i].Type.String()).Inc()
+				}
+			}
+			if !subset {
+				metrics.Leases.Set(float64(len(lw.Leases)))
 			}
 			if len(batch) > 0 {
 				receiver <- batch
@@ -15,8 +15,11 @@
 package subnet
 
 import (
-	"github.com/flannel-io/flannel/pkg/ip"
+	"fmt"
 	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/flannel-io/flannel/pkg/lease"
 )
 
 func TestSubnetNodev4(t *testing.T) {
@@ -101,3 +104,78 @@ func TestSubnetNodeInvalid(t *testing.T) {
 	}
 
 }
+
+func makeLeases(count int) []lease.Lease {
+	leases := make([]lease.Lease, count)
+	for i := range leases {
+		leases[i] = lease.Lease{
+			EnableIPv4: true,
+			Subnet:     ip.IP4Net{IP: ip.MustParseIP4("10.0.0.0") + ip.IP4((i+1)<<8), PrefixLen: 24},
+			Attrs:      lease.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1") + ip.IP4(i)},
+		}
+	}
+	return leases
+}
+
+func TestLeaseWatcher(t *testing.T) {
+	own := lease.Lease{EnableIPv4: true, Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.0.0.0"), PrefixLen: 24}}
+	lw := &lease.LeaseWatcher{OwnLease: &own}
+	leases := makeLeases(3)
+
+	batch := lw.Reset(append([]lease.Lease{own}, leases[:2]...))
+	if len(batch) != 2 || len(lw.Leases) != 2 {
+		t.Fatalf("unexpected batch %v", batch)
+	}
+
+	// A lease of an existing subnet replaces the previous one
+	updated := leases[0]
+	updated.Attrs.PublicIP = ip.MustParseIP4("192.168.1.1")
+	batch = lw.Update([]lease.Event{{Type: lease.EventAdded, Lease: updated}, {Type: lease.EventAdded, Lease: own}})
+	if len(batch) != 1 || len(lw.Leases) != 2 || lw.Leases[updated.Subnet.String()].Attrs.PublicIP != updated.Attrs.PublicIP {
+		t.Fatalf("unexpected batch %v", batch)
+	}
+
+	batch = lw.Update([]lease.Event{{Type: lease.EventRemoved, Lease: leases[1]}})
+	if len(batch) != 1 || batch[0].Type != lease.EventRemoved || len(lw.Leases) != 1 {
+		t.Fatalf("unexpected batch %v", batch)
+	}
+
+	// The snapshot adds leases[1] and leases[2], and removes leases[0]
+	batch = lw.Reset(leases[1:])
+	if len(batch) != 3 || len(lw.Leases) != 2 {
+		t.Fatalf("unexpected batch %v", batch)
+	}
+	for _, e := range batch {
+		if (e.Type == lease.EventRemoved) != e.Lease.Subnet.Equal(leases[0].Subnet) {
+			t.Errorf("unexpected event %v", e)
+		}
+	}
+}
+
+func BenchmarkLeaseWatcher(b *testing.B) {
+	own := lease.Lease{EnableIPv4: true, Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.0.0.0"), PrefixLen: 24}}
+	for _, size := range []int{100, 1000, 5000} {
+		leases := makeLeases(size)
+		added := make([]lease.Event, size)
+		removed := make([]lease.Event, size)
+		for i, l := range leases {
+			added[i] = lease.Event{Type: lease.EventAdded, Lease: l}
+			removed[i] = lease.Event{Type: lease.EventRemoved, Lease: l}
+		}
+
+		b.Run(fmt.Sprintf("Update/%d leases", size), func(b *testing.B) {
+			lw := &lease.LeaseWatcher{OwnLease: &own}
+			for i := 0; i < b.N; i++ {
+				lw.Update(added)
+				lw.Update(removed)
+			}
+		})
+		b.Run(fmt.Sprintf("Reset/%d leases", size), func(b *testing.B) {
+			lw := &lease.LeaseWatcher{OwnLease: &own}
+			for i := 0; i < b.N; i++ {
+				lw.Reset(leases)
+				lw.Reset(nil)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/lease"
+	"github.com/flannel-io/flannel/pkg/metrics"
 	"github.com/flannel-io/flannel/pkg/trafficmngr"
 	log "k8s.io/klog/v2"
 )
@@ -63,14 +64,7 @@ func (iptm *IPTablesManager) CleanUp(ctx context.Context) error {
 		// if we can't find iptables, give up and return
 		return fmt.Errorf("failed to setup IPTables. iptables binary was not found: %v", err)
 	}
-	err = ipt.ClearAndDeleteChain("nat", "FLANNEL-POSTRTG")
-	if err != nil {
-		log.V(2).Infof("could not clean-up FLANNEL-POSTRTG (IPv4): %v", err)
-	}
-	err = ipt.ClearAndDeleteChain("nat", "FLANNEL-FWD")
-	if err != nil {
-		log.V(2).Infof("could not clean-up FLANNEL-FWD (IPv4): %v", err)
-	}
+	cleanUpChains(ipt, "IPv4")
 
 	//IPv6
 	ipt6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
@@ -78,156 +72,190 @@ func (iptm *IPTablesManager) CleanUp(ctx context.Context) error {
 		// if we can't find iptables, give up and return
 		return fmt.Errorf("failed to setup IPTables. ip6tables binary was not found: %v", err)
 	}
-	err = ipt6.ClearAndDeleteChain("nat", "FLANNEL-POSTRTG")
-	if err != nil {
-		log.V(2).Infof("could not clean-up FLANNEL-POSTRTG (IPv6): %v", err)
+	cleanUpChains(ipt6, "IPv6")
+	return nil
+}
+
+// cleanUpChains removes the flannel chains and the rules jumping to them
+func cleanUpChains(ipt *iptables.IPTables, family string) {
+	if err := ipt.DeleteIfExists("nat", "POSTROUTING", "-m", "comment", "--comment", "flanneld masq", "-j", "FLANNEL-POSTRTG"); err != nil {
+		log.V(2).Infof("could not delete the FLANNEL-POSTRTG jump rule (%s): %v", family, err)
 	}
-	err = ipt6.ClearAndDeleteChain("nat", "FLANNEL-FWD")
-	if err != nil {
-		log.V(2).Infof("could not clean-up FLANNEL-FWD (IPv6): %v", err)
+	if err := ipt.ClearAndDeleteChain("nat", "FLANNEL-POSTRTG"); err != nil {
+		log.V(2).Infof("could not clean-up FLANNEL-POSTRTG (%s): %v", family, err)
+	}
+	if err := ipt.DeleteIfExists("filter", "FORWARD", "-m", "comment", "--comment", "flanneld forward", "-j", "FLANNEL-FWD"); err != nil {
+		log.V(2).Infof("could not delete the FLANNEL-FWD jump rule (%s): %v", family, err)
+	}
+	if err := ipt.ClearAndDeleteChain("filter", "FLANNEL-FWD"); err != nil {
+		log.V(2).Infof("could not clean-up FLANNEL-FWD (%s): %v", family, err)
 	}
-	return nil
 }
 
-func (iptm *IPTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flannelIPv4Net, prevSubnet, prevNetwork ip.IP4Net,
-	flannelIPv6Net, prevIPv6Subnet, prevIPv6Network ip.IP6Net,
+func (iptm *IPTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flannelIPv4Nets []ip.IP4Net, prevSubnet ip.IP4Net, prevNetworks []ip.IP4Net,
+	flannelIPv6Nets []ip.IP6Net, prevIPv6Subnet ip.IP6Net, prevIPv6Networks []ip.IP6Net,
 	currentlease *lease.Lease,
 	resyncPeriod int,
 	ipMasqRandomFullyDisable bool) error {
 
-	if !flannelIPv4Net.Empty() {
+	if len(flannelIPv4Nets) > 0 {
 		// recycle iptables rules only when network configured or subnet leased is not equal to current one.
-		if !flannelIPv4Net.Equal(prevNetwork) || !prevSubnet.Equal(currentlease.Subnet) {
+		if !ip4NetsEqual(flannelIPv4Nets, prevNetworks) || !prevSubnet.Equal(currentlease.Subnet) {
 			log.Infof("Current network or subnet (%v, %v) is not equal to previous one (%v, %v), trying to recycle old iptables rules",
-				flannelIPv4Net, currentlease.Subnet, prevNetwork, prevSubnet)
+				flannelIPv4Nets, currentlease.Subnet, prevNetworks, prevSubnet)
 			newLease := &lease.Lease{
 				Subnet: prevSubnet,
 			}
-			if err := iptm.deleteIP4Tables(iptm.masqRules(prevNetwork, newLease, ipMasqRandomFullyDisable)); err != nil {
+			if err := iptm.deleteIP4Tables(iptm.masqRules(prevNetworks, newLease, ipMasqRandomFullyDisable)); err != nil {
 				return err
 			}
 		}
 
 		log.Infof("Setting up masking rules")
 		iptm.CreateIP4Chain("nat", "FLANNEL-POSTRTG")
-		iptm.setupAndEnsureIP4Tables(ctx, iptm.masqRules(flannelIPv4Net, currentlease, ipMasqRandomFullyDisable), resyncPeriod)
+		iptm.setupAndEnsureIP4Tables(ctx, iptm.masqRules(flannelIPv4Nets, currentlease, ipMasqRandomFullyDisable), resyncPeriod)
 	}
-	if !flannelIPv6Net.Empty() {
+	if len(flannelIPv6Nets) > 0 {
 		// recycle iptables rules only when network configured or subnet leased is not equal to current one.
-		if !flannelIPv6Net.Equal(prevIPv6Network) || !prevIPv6Subnet.Equal(currentlease.IPv6Subnet) {
+		if !ip6NetsEqual(flannelIPv6Nets, prevIPv6Networks) || !prevIPv6Subnet.Equal(currentlease.IPv6Subnet) {
 			log.Infof("Current network or subnet (%v, %v) is not equal to previous one (%v, %v), trying to recycle old iptables rules",
-				flannelIPv6Net, currentlease.IPv6Subnet, prevIPv6Network, prevIPv6Subnet)
+				flannelIPv6Nets, currentlease.IPv6Subnet, prevIPv6Networks, prevIPv6Subnet)
 			newLease := &lease.Lease{
 				IPv6Subnet: prevIPv6Subnet,
 			}
-			if err := iptm.deleteIP6Tables(iptm.masqIP6Rules(prevIPv6Network, newLease, ipMasqRandomFullyDisable)); err != nil {
+			if err := iptm.deleteIP6Tables(iptm.masqIP6Rules(prevIPv6Networks, newLease, ipMasqRandomFullyDisable)); err != nil {
 				return err
 			}
 		}
 
 		log.Infof("Setting up masking rules for IPv6")
 		iptm.CreateIP6Chain("nat", "FLANNEL-POSTRTG")
-		iptm.setupAndEnsureIP6Tables(ctx, iptm.masqIP6Rules(flannelIPv6Net, currentlease, ipMasqRandomFullyDisable), resyncPeriod)
+		iptm.setupAndEnsureIP6Tables(ctx, iptm.masqIP6Rules(flannelIPv6Nets, currentlease, ipMasqRandomFullyDisable), resyncPeriod)
 	}
 	return nil
 }
 
-func (iptm *IPTablesManager) masqRules(ccidr ip.IP4Net, lease *lease.Lease, ipMasqRandomFullyDisable bool) []trafficmngr.IPTablesRule {
-	cluster_cidr := ccidr.String()
+func ip4NetsEqual(n1, n2 []ip.IP4Net) bool {
+	if len(n1) != len(n2) {
+		return false
+	}
+	for i := range n1 {
+		if !n1[i].Equal(n2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func ip6NetsEqual(n1, n2 []ip.IP6Net) bool {
+	if len(n1) != len(n2) {
+		return false
+	}
+	for i := range n1 {
+		if !n1[i].Equal(n2[i]) {
+			return false
+		}
+	}
+	return true
+}
 
+func (iptm *IPTablesManager) masqRules(ccidrs []ip.IP4Net, lease *lease.Lease, ipMasqRandomFullyDisable bool) []trafficmngr.IPTablesRule {
+	cluster_cidrs := make([]string, 0, len(ccidrs))
+	for _, ccidr := range ccidrs {
+		cluster_cidrs = append(cluster_cidrs, ccidr.String())
+	}
 	pod_cidr := lease.Subnet.String()
 	ipt, err := iptables.New()
 	supports_random_fully := false
 	if err == nil {
 		supports_random_fully = ipt.HasRandomFully()
 	}
-	rules := make([]trafficmngr.IPTablesRule, 2)
-	// This rule ensure that the flannel iptables rules are executed before other rules on the node
-	rules[0] = trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "POSTROUTING", Rulespec: []string{"-m", "comment", "--comment", "flanneld masq", "-j", "FLANNEL-POSTRTG"}}
-	// This rule will not masquerade traffic marked by the kube-proxy to avoid double NAT bug on some kernel version
-	rules[1] = trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-m", "mark", "--mark", trafficmngr.KubeProxyMark, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}}
-	// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0), for any of the cluster_cidrs
-	rules = append(rules,
-		trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", pod_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}},
-		trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", cluster_cidr, "-d", pod_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}},
-	)
-	// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
-	rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"!", "-s", cluster_cidr, "-d", pod_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}})
-	// NAT if it's not multicast traffic
-	if supports_random_fully && !ipMasqRandomFullyDisable {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", cluster_cidr, "!", "-d", "224.0.0.0/4", "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE", "--random-fully"}})
-	} else {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", cluster_cidr, "!", "-d", "224.0.0.0/4", "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE"}})
-	}
-	// Masquerade anything headed towards flannel from the host
-	if supports_random_fully && !ipMasqRandomFullyDisable {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"!", "-s", cluster_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE", "--random-fully"}})
-	} else {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"!", "-s", cluster_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE"}})
-	}
-	return rules
+	return masqRulesFor(cluster_cidrs, pod_cidr, "224.0.0.0/4", supports_random_fully && !ipMasqRandomFullyDisable)
 }
 
-func (iptm *IPTablesManager) masqIP6Rules(ccidr ip.IP6Net, lease *lease.Lease, ipMasqRandomFullyDisable bool) []trafficmngr.IPTablesRule {
-	cluster_cidr := ccidr.String()
+func (iptm *IPTablesManager) masqIP6Rules(ccidrs []ip.IP6Net, lease *lease.Lease, ipMasqRandomFullyDisable bool) []trafficmngr.IPTablesRule {
+	cluster_cidrs := make([]string, 0, len(ccidrs))
+	for _, ccidr := range ccidrs {
+		cluster_cidrs = append(cluster_cidrs, ccidr.String())
+	}
 	pod_cidr := lease.IPv6Subnet.String()
 	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
 	supports_random_fully := false
 	if err == nil {
 		supports_random_fully = ipt.HasRandomFully()
 	}
-	rules := make([]trafficmngr.IPTablesRule, 2)
+	return masqRulesFor(cluster_cidrs, pod_cidr, "ff00::/8", supports_random_fully && !ipMasqRandomFullyDisable)
+}
 
+// masqRulesFor returns the masquerade rules of the pod_cidr of the node in the
+// flannel network made of the cluster_cidrs pools.
+func masqRulesFor(cluster_cidrs []string, pod_cidr, multicast_cidr string, randomFully bool) []trafficmngr.IPTablesRule {
+	masquerade := []string{"-j", "MASQUERADE"}
+	if randomFully {
+		masquerade = append(masquerade, "--random-fully")
+	}
+
+	rules := make([]trafficmngr.IPTablesRule, 2)
 	// This rule ensure that the flannel iptables rules are executed before other rules on the node
 	rules[0] = trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "POSTROUTING", Rulespec: []string{"-m", "comment", "--comment", "flanneld masq", "-j", "FLANNEL-POSTRTG"}}
 	// This rule will not masquerade traffic marked by the kube-proxy to avoid double NAT bug on some kernel version
 	rules[1] = trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-m", "mark", "--mark", trafficmngr.KubeProxyMark, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}}
-
 	// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0), for any of the cluster_cidrs
-	rules = append(rules,
-		trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", pod_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}},
-		trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", cluster_cidr, "-d", pod_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}},
-	)
+	for _, cluster_cidr := range cluster_cidrs {
+		rules = append(rules,
+			trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", pod_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}},
+			trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", cluster_cidr, "-d", pod_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}},
+		)
+	}
 	// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
-	rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"!", "-s", cluster_cidr, "-d", pod_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}})
+	for _, cluster_cidr := range cluster_cidrs {
+		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"!", "-s", cluster_cidr, "-d", pod_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "RETURN"}})
+	}
 	// NAT if it's not multicast traffic
-	if supports_random_fully && !ipMasqRandomFullyDisable {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", cluster_cidr, "!", "-d", "ff00::/8", "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE", "--random-fully"}})
-	} else {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"-s", cluster_cidr, "!", "-d", "ff00::/8", "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE"}})
+	for _, cluster_cidr := range cluster_cidrs {
+		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: append([]string{"-s", cluster_cidr, "!", "-d", multicast_cidr, "-m", "comment", "--comment", "flanneld masq"}, masquerade...)})
 	}
-
 	// Masquerade anything headed towards flannel from the host
-	if supports_random_fully && !ipMasqRandomFullyDisable {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"!", "-s", cluster_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE", "--random-fully"}})
-	} else {
-		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: []string{"!", "-s", cluster_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE"}})
+	for _, cluster_cidr := range cluster_cidrs {
+		rules = append(rules, trafficmngr.IPTablesRule{Table: "nat", Action: "-A", Chain: "FLANNEL-POSTRTG", Rulespec: append([]string{"!", "-s", cluster_cidr, "-d", cluster_cidr, "-m", "comment", "--comment", "flanneld masq"}, masquerade...)})
 	}
-
 	return rules
 }
 
-func (iptm *IPTablesManager) SetupAndEnsureForwardRules(ctx context.Context, flannelIPv4Network ip.IP4Net, flannelIPv6Network ip.IP6Net, resyncPeriod int) {
-	if !flannelIPv4Network.Empty() {
+func (iptm *IPTablesManager) SetupAndEnsureForwardRules(ctx context.Context, flannelIPv4Networks []ip.IP4Net, flannelIPv6Networks []ip.IP6Net, resyncPeriod int) {
+	if len(flannelIPv4Networks) > 0 {
 		log.Infof("Changing default FORWARD chain policy to ACCEPT")
+		networks := make([]string, 0, len(flannelIPv4Networks))
+		for _, n := range flannelIPv4Networks {
+			networks = append(networks, n.String())
+		}
 		iptm.CreateIP4Chain("filter", "FLANNEL-FWD")
-		iptm.setupAndEnsureIP4Tables(ctx, iptm.forwardRules(flannelIPv4Network.String()), resyncPeriod)
+		iptm.setupAndEnsureIP4Tables(ctx, iptm.forwardRules(networks), resyncPeriod)
 	}
-	if !flannelIPv6Network.Empty() {
+	if len(flannelIPv6Networks) > 0 {
 		log.Infof("IPv6: Changing default FORWARD chain policy to ACCEPT")
+		networks := make([]string, 0, len(flannelIPv6Networks))
+		for _, n := range flannelIPv6Networks {
+			networks = append(networks, n.String())
+		}
 		iptm.CreateIP6Chain("filter", "FLANNEL-FWD")
-		iptm.setupAndEnsureIP6Tables(ctx, iptm.forwardRules(flannelIPv6Network.String()), resyncPeriod)
+		iptm.setupAndEnsureIP6Tables(ctx, iptm.forwardRules(networks), resyncPeriod)
 	}
 }
 
-func (iptm *IPTablesManager) forwardRules(flannelNetwork string) []trafficmngr.IPTablesRule {
-	return []trafficmngr.IPTablesRule{
+func (iptm *IPTablesManager) forwardRules(flannelNetworks []string) []trafficmngr.IPTablesRule {
+	rules := []trafficmngr.IPTablesRule{
 		// This rule ensure that the flannel iptables rules are executed before other rules on the node
 		{Table: "filter", Action: "-A", Chain: "FORWARD", Rulespec: []string{"-m", "comment", "--comment", "flanneld forward", "-j", "FLANNEL-FWD"}},
-		// These rules allow traffic to be forwarded if it is to or from the flannel network range.
-		{Table: "filter", Action: "-A", Chain: "FLANNEL-FWD", Rulespec: []string{"-s", flannelNetwork, "-m", "comment", "--comment", "flanneld forward", "-j", "ACCEPT"}},
-		{Table: "filter", Action: "-A", Chain: "FLANNEL-FWD", Rulespec: []string{"-d", flannelNetwork, "-m", "comment", "--comment", "flanneld forward", "-j", "ACCEPT"}},
 	}
+	// These rules allow traffic to be forwarded if it is to or from the flannel network ranges.
+	for _, flannelNetwork := range flannelNetworks {
+		rules = append(rules,
+			trafficmngr.IPTablesRule{Table: "filter", Action: "-A", Chain: "FLANNEL-FWD", Rulespec: []string{"-s", flannelNetwork, "-m", "comment", "--comment", "flanneld forward", "-j", "ACCEPT"}},
+			trafficmngr.IPTablesRule{Table: "filter", Action: "-A", Chain: "FLANNEL-FWD", Rulespec: []string{"-d", flannelNetwork, "-m", "comment", "--comment", "flanneld forward", "-j", "ACCEPT"}},
+		)
+	}
+	return rules
 }
 
 func (iptm *IPTablesManager) CreateIP4Chain(table, chain string) {
@@ -389,8 +417,10 @@ func (iptm *IPTablesManager) setupAndEnsureIP4Tables(ctx context.Context, rules
 				return
 			case <-time.After(time.Duration(resyncPeriod) * time.Second):
 				// Ensure that all the iptables rules exist every 5 seconds
+				metrics.TrafficResyncs.WithLabelValues("iptables", "ipv4").Inc()
 				if err := ensureIPTables(ipt, iptRestore, rules); err != nil {
 					log.Errorf("Failed to ensure iptables rules: %v", err)
+					metrics.TrafficResyncFailures.WithLabelValues("iptables", "ipv4").Inc()
 				}
 			}
 		}
@@ -426,8 +456,10 @@ func (iptm *IPTablesManager) setupAndEnsureIP6Tables(ctx context.Context, rules
 				return
 			case <-time.After(time.Duration(resyncPeriod) * time.Second):
 				// Ensure that all the iptables rules exist every 5 seconds
+				metrics.TrafficResyncs.WithLabelValues("iptables", "ipv6").Inc()
 				if err := ensureIPTables(ipt, iptRestore, rules); err != nil {
 					log.Errorf("Failed to ensure iptables rules: %v", err)
+					metrics.TrafficResyncFailures.WithLabelValues("iptables", "ipv6").Inc()
 				}
 			}
 		}
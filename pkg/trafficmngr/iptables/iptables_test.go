@@ -122,10 +122,10 @@ func TestDeleteRules(t *testing.T) {
 	iptr := &MockIPTablesRestore{t: t}
 	iptm := IPTablesManager{}
 	baseRules := iptm.masqRules(
-		ip.IP4Net{
+		[]ip.IP4Net{{
 			IP:        ip.MustParseIP4("10.0.1.0"),
 			PrefixLen: 16,
-		}, testingLease(), false)
+		}}, testingLease(), false)
 	expectedRules := expectedTearDownIPTablesRestoreRules(baseRules)
 
 	err := ipTablesBootstrap(ipt, iptr, baseRules)
@@ -151,6 +151,35 @@ func TestDeleteRules(t *testing.T) {
 
 }
 
+func TestMasqRulesNetworkPools(t *testing.T) {
+	iptm := IPTablesManager{}
+	rules := iptm.masqRules(
+		[]ip.IP4Net{
+			{IP: ip.MustParseIP4("10.0.0.0"), PrefixLen: 16},
+			{IP: ip.MustParseIP4("10.1.0.0"), PrefixLen: 16},
+		}, testingLease(), true)
+	if len(rules) != 12 {
+		t.Fatalf("Should be 12 masqRules, there are actually %d: %#v", len(rules), rules)
+	}
+
+	for _, cidr := range []string{"10.0.0.0/16", "10.1.0.0/16"} {
+		found := false
+		for _, rule := range rules {
+			if reflect.DeepEqual(rule.Rulespec, []string{"-s", cidr, "!", "-d", "224.0.0.0/4", "-m", "comment", "--comment", "flanneld masq", "-j", "MASQUERADE"}) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("No masquerade rule for the %s pool: %#v", cidr, rules)
+		}
+	}
+
+	fwdRules := iptm.forwardRules([]string{"10.0.0.0/16", "10.1.0.0/16"})
+	if len(fwdRules) != 5 {
+		t.Errorf("Should be 5 forwardRules, there are actually %d: %#v", len(fwdRules), fwdRules)
+	}
+}
+
 func TestDeleteMoreRules(t *testing.T) {
 	ipt := &MockIPTables{}
 	iptr := &MockIPTablesRestore{}
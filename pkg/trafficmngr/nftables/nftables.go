@@ -19,6 +19,7 @@ package nftables
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	log "k8s.io/klog/v2"
 
@@ -75,8 +76,8 @@ func initTable(ctx context.Context, ipFamily knftables.Family, name string) (knf
 // It is needed when using nftables? accept seems to be the default
 // warning: never add a default 'drop' policy on the forwardChain as it breaks connectivity to the node
 func (nftm *NFTablesManager) SetupAndEnsureForwardRules(ctx context.Context,
-	flannelIPv4Network ip.IP4Net, flannelIPv6Network ip.IP6Net, resyncPeriod int) {
-	if !flannelIPv4Network.Empty() {
+	flannelIPv4Networks []ip.IP4Net, flannelIPv6Networks []ip.IP6Net, resyncPeriod int) {
+	if len(flannelIPv4Networks) > 0 {
 		log.Infof("Changing default FORWARD chain policy to ACCEPT")
 		tx := nftm.nftv4.NewTransaction()
 
@@ -94,14 +95,14 @@ func (nftm *NFTablesManager) SetupAndEnsureForwardRules(ctx context.Context,
 		tx.Add(&knftables.Rule{
 			Chain: forwardChain,
 			Rule: knftables.Concat(
-				"ip saddr", flannelIPv4Network.String(),
+				"ip saddr", ip4Set(flannelIPv4Networks),
 				"accept",
 			),
 		})
 		tx.Add(&knftables.Rule{
 			Chain: forwardChain,
 			Rule: knftables.Concat(
-				"ip daddr", flannelIPv4Network.String(),
+				"ip daddr", ip4Set(flannelIPv4Networks),
 				"accept",
 			),
 		})
@@ -110,7 +111,7 @@ func (nftm *NFTablesManager) SetupAndEnsureForwardRules(ctx context.Context,
 			log.Errorf("nftables: couldn't setup forward rules: %v", err)
 		}
 	}
-	if !flannelIPv6Network.Empty() {
+	if len(flannelIPv6Networks) > 0 {
 		log.Infof("Changing default FORWARD chain policy to ACCEPT (ipv6)")
 		tx := nftm.nftv6.NewTransaction()
 
@@ -128,14 +129,14 @@ func (nftm *NFTablesManager) SetupAndEnsureForwardRules(ctx context.Context,
 		tx.Add(&knftables.Rule{
 			Chain: forwardChain,
 			Rule: knftables.Concat(
-				"ip6 saddr", flannelIPv6Network.String(),
+				"ip6 saddr", ip6Set(flannelIPv6Networks),
 				"accept",
 			),
 		})
 		tx.Add(&knftables.Rule{
 			Chain: forwardChain,
 			Rule: knftables.Concat(
-				"ip6 daddr", flannelIPv6Network.String(),
+				"ip6 daddr", ip6Set(flannelIPv6Networks),
 				"accept",
 			),
 		})
@@ -146,12 +147,12 @@ func (nftm *NFTablesManager) SetupAndEnsureForwardRules(ctx context.Context,
 	}
 }
 
-func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flannelIPv4Net, prevSubnet, prevNetwork ip.IP4Net,
-	flannelIPv6Net, prevIPv6Subnet, prevIPv6Network ip.IP6Net,
+func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flannelIPv4Nets []ip.IP4Net, prevSubnet ip.IP4Net, prevNetworks []ip.IP4Net,
+	flannelIPv6Nets []ip.IP6Net, prevIPv6Subnet ip.IP6Net, prevIPv6Networks []ip.IP6Net,
 	currentlease *lease.Lease,
 	resyncPeriod int,
 	ipMasqRandomFullyDisable bool) error {
-	if !flannelIPv4Net.Empty() {
+	if len(flannelIPv4Nets) > 0 {
 		log.Infof("nftables: setting up masking rules (ipv4)")
 		tx := nftm.nftv4.NewTransaction()
 
@@ -167,7 +168,7 @@ func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flanne
 		tx.Flush(&knftables.Chain{
 			Name: postrtgChain,
 		})
-		err := nftm.addMasqRules(ctx, tx, flannelIPv4Net.String(), currentlease.Subnet.String(), knftables.IPv4Family, ipMasqRandomFullyDisable)
+		err := nftm.addMasqRules(ctx, tx, ip4Set(flannelIPv4Nets), currentlease.Subnet.String(), knftables.IPv4Family, ipMasqRandomFullyDisable)
 		if err != nil {
 			return fmt.Errorf("nftables: couldn't setup masq rules: %v", err)
 		}
@@ -176,7 +177,7 @@ func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flanne
 			return fmt.Errorf("nftables: couldn't setup masq rules: %v", err)
 		}
 	}
-	if !flannelIPv6Net.Empty() {
+	if len(flannelIPv6Nets) > 0 {
 		log.Infof("nftables: setting up masking rules (ipv6)")
 		tx := nftm.nftv6.NewTransaction()
 
@@ -192,7 +193,7 @@ func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flanne
 		tx.Flush(&knftables.Chain{
 			Name: postrtgChain,
 		})
-		err := nftm.addMasqRules(ctx, tx, flannelIPv6Net.String(), currentlease.IPv6Subnet.String(), knftables.IPv6Family, ipMasqRandomFullyDisable)
+		err := nftm.addMasqRules(ctx, tx, ip6Set(flannelIPv6Nets), currentlease.IPv6Subnet.String(), knftables.IPv6Family, ipMasqRandomFullyDisable)
 		if err != nil {
 			return fmt.Errorf("nftables: couldn't setup masq rules: %v", err)
 		}
@@ -204,7 +205,33 @@ func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flanne
 	return nil
 }
 
-// add required masking rules to transaction tx
+// ip4Set returns the networks as a single CIDR or as an anonymous set
+// matching all of them
+func ip4Set(networks []ip.IP4Net) string {
+	cidrs := make([]string, 0, len(networks))
+	for _, n := range networks {
+		cidrs = append(cidrs, n.String())
+	}
+	return cidrSet(cidrs)
+}
+
+func ip6Set(networks []ip.IP6Net) string {
+	cidrs := make([]string, 0, len(networks))
+	for _, n := range networks {
+		cidrs = append(cidrs, n.String())
+	}
+	return cidrSet(cidrs)
+}
+
+func cidrSet(cidrs []string) string {
+	if len(cidrs) == 1 {
+		return cidrs[0]
+	}
+	return "{ " + strings.Join(cidrs, ", ") + " }"
+}
+
+// add required masking rules to transaction tx.
+// clusterCidr is a CIDR or a set of CIDRs.
 func (nftm *NFTablesManager) addMasqRules(ctx context.Context,
 	tx *knftables.Transaction,
 	clusterCidr, podCidr string,
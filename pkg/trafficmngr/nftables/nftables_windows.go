@@ -37,11 +37,11 @@ func (nftm *NFTablesManager) CleanUp(ctx context.Context) error {
 }
 
 func (nftm *NFTablesManager) SetupAndEnsureForwardRules(ctx context.Context,
-	flannelIPv4Network ip.IP4Net, flannelIPv6Network ip.IP6Net, resyncPeriod int) {
+	flannelIPv4Networks []ip.IP4Net, flannelIPv6Networks []ip.IP6Net, resyncPeriod int) {
 }
 
-func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flannelIPv4Net, prevSubnet, prevNetwork ip.IP4Net,
-	flannelIPv6Net, prevIPv6Subnet, prevIPv6Network ip.IP6Net,
+func (nftm *NFTablesManager) SetupAndEnsureMasqRules(ctx context.Context, flannelIPv4Nets []ip.IP4Net, prevSubnet ip.IP4Net, prevNetworks []ip.IP4Net,
+	flannelIPv6Nets []ip.IP6Net, prevIPv6Subnet ip.IP6Net, prevIPv6Networks []ip.IP6Net,
 	currentlease *lease.Lease,
 	resyncPeriod int,
 	ipMasqRandomFullyDisable bool) error {
@@ -40,20 +40,20 @@ type TrafficManager interface {
 	Init(ctx context.Context) error
 	// Clean-up existing tables and rules
 	CleanUp(ctx context.Context) error
-	// Install kernel rules to forward the traffic to and from the flannel network range.
-	// This is done for IPv4 and/or IPv6 based on whether flannelIPv4Network and flannelIPv6Network are set.
+	// Install kernel rules to forward the traffic to and from the flannel network ranges.
+	// This is done for IPv4 and/or IPv6 based on whether flannelIPv4Networks and flannelIPv6Networks are set.
 	// SetupAndEnsureForwardRules installs the initial rules and arranges any
 	// backend-specific periodic resync every resyncPeriod seconds if needed.
-	SetupAndEnsureForwardRules(ctx context.Context, flannelIPv4Network ip.IP4Net, flannelIPv6Network ip.IP6Net, resyncPeriod int)
+	SetupAndEnsureForwardRules(ctx context.Context, flannelIPv4Networks []ip.IP4Net, flannelIPv6Networks []ip.IP6Net, resyncPeriod int)
 	// Install kernel rules to setup NATing of packets sent to the flannel interface
-	// This is done for IPv4 and/or IPv6 based on whether flannelIPv4Network and flannelIPv6Network are set.
+	// This is done for IPv4 and/or IPv6 based on whether flannelIPv4Nets and flannelIPv6Nets are set.
 	// prevSubnet,prevNetworks, prevIPv6Subnet, prevIPv6Networks are used
 	// to determine whether the existing rules need to be replaced.
 	// SetupAndEnsureMasqRules installs the initial rules and arranges any
 	// backend-specific periodic resync every resyncPeriod seconds if needed.
 	SetupAndEnsureMasqRules(ctx context.Context,
-		flannelIPv4Net, prevSubnet, prevNetwork ip.IP4Net,
-		flannelIPv6Net, prevIPv6Subnet, prevIPv6Network ip.IP6Net,
+		flannelIPv4Nets []ip.IP4Net, prevSubnet ip.IP4Net, prevNetworks []ip.IP4Net,
+		flannelIPv6Nets []ip.IP6Net, prevIPv6Subnet ip.IP6Net, prevIPv6Networks []ip.IP6Net,
 		currentlease *lease.Lease,
 		resyncPeriod int,
 		ipMasqRandomFullyDisable bool) error